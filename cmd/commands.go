@@ -27,6 +27,33 @@ var (
 			server.Start()
 		},
 	}
+
+	migrateRedisCmd = &cobra.Command{
+		Use:   "migrate-redis",
+		Short: "Rewrites values stored in redis into the current JSON format",
+		Run: func(cmd *cobra.Command, args []string) {
+			server.MigrateRedis()
+		},
+	}
+
+	migratePostgresCmd = &cobra.Command{
+		Use:   "migrate-postgres",
+		Short: "Moves order items stored in the legacy items column to the order_items table",
+		Run: func(cmd *cobra.Command, args []string) {
+			server.MigratePostgres()
+		},
+	}
+
+	checkLedgerCmd = &cobra.Command{
+		Use:   "check-ledger",
+		Short: "Recomputes the credit of every user from the credit ledger and reports differences",
+		Run: func(cmd *cobra.Command, args []string) {
+			if backend != "" {
+				viper.Set("backend", backend)
+			}
+			server.CheckLedger()
+		},
+	}
 )
 
 // Initialize commands
@@ -34,9 +61,15 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./redi.yaml)")
-	rootCmd.Flags().StringVarP(&service, "service", "s", "", "Service to start (user, stock, order, payment)")
-	rootCmd.Flags().StringVarP(&backend, "backend", "b", "", "Backend to use (postgres, redis)")
+	rootCmd.Flags().StringVarP(&service, "service", "s", "", "Service to start (user, stock, order, payment, all)")
+	rootCmd.Flags().StringVarP(&backend, "backend", "b", "", "Backend to use (postgres, redis, memory, sqlite)")
 	rootCmd.Flags().StringVarP(&port, "port", "p", "", "Port to listen in")
+
+	rootCmd.AddCommand(migrateRedisCmd)
+	rootCmd.AddCommand(migratePostgresCmd)
+
+	checkLedgerCmd.Flags().StringVarP(&backend, "backend", "b", "", "Backend to check (postgres, redis, sqlite)")
+	rootCmd.AddCommand(checkLedgerCmd)
 }
 
 func initConfig() {
@@ -72,6 +105,8 @@ func initConfig() {
 	viper.SetDefault("postgres.password", "postgres")
 	viper.SetDefault("postgres.database", "redi")
 
+	viper.SetDefault("sqlite.directory", ".")
+
 	viper.SetDefault("redis.url", "localhost")
 	viper.SetDefault("redis.port", "6379")
 	viper.SetDefault("redis.password", "redis")
@@ -79,12 +114,22 @@ func initConfig() {
 	viper.SetDefault("broker.url", "localhost")
 	viper.SetDefault("broker.port", "6379")
 	viper.SetDefault("broker.password", "redis")
+	viper.SetDefault("broker.transport", "pubsub")
+	viper.SetDefault("broker.reclaim_after", "30s")
+	viper.SetDefault("broker.max_len", 100000)
 
 	viper.SetDefault("url.user", "localhost")
 	viper.SetDefault("url.order", "localhost")
 	viper.SetDefault("url.stock", "localhost")
 	viper.SetDefault("url.payment", "localhost")
 
+	viper.SetDefault("checkout.mode", "saga")
+	viper.SetDefault("checkout.timeout", "10s")
+	viper.SetDefault("checkout.recover_after", "30s")
+	viper.SetDefault("checkout.dedup_ttl", "24h")
+	viper.SetDefault("checkout.reservation_ttl", "5m")
+	viper.SetDefault("checkout.sweep_interval", "10s")
+
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
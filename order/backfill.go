@@ -0,0 +1,62 @@
+package order
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Time between attempts to backfill the status of orders without one
+const backfillInterval = 10 * time.Second
+
+// Backfills the status of orders stored before orders had a status until every
+// order has one
+func (h *orderRouteHandler) backfillStatuses(interval time.Duration) {
+	ctx := context.Background()
+
+	for {
+		remaining, err := h.backfillStatus(ctx)
+		if err == nil && remaining == 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Sets the status of every order without one to the status of its payment, a
+// paid order is paid and any other order open. Returns the number of orders
+// whose payment could not be retrieved.
+func (h *orderRouteHandler) backfillStatus(ctx context.Context) (int, error) {
+	orderIDs, err := h.orderStore.UnknownStatus(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("unable to get orders without status")
+		return 0, err
+	}
+
+	remaining := 0
+	for _, orderID := range orderIDs {
+		logger := logrus.WithField("order_id", orderID)
+
+		status := StatusOpen
+		payment, err := getPayment(&h.urls, orderID)
+		if err == nil && payment.Paid {
+			status = StatusPaid
+		} else if err != nil && err != ErrNil {
+			logger.WithError(err).Warn("unable to get payment to backfill order status")
+			remaining++
+			continue
+		}
+
+		err = h.orderStore.BackfillStatus(ctx, orderID, status)
+		if err != nil {
+			logger.WithError(err).Error("unable to backfill order status")
+			remaining++
+		}
+	}
+
+	if len(orderIDs) > 0 {
+		logrus.WithField("orders", len(orderIDs)).WithField("remaining", remaining).Info("backfilled order statuses")
+	}
+	return remaining, nil
+}
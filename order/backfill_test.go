@@ -0,0 +1,52 @@
+package order
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestBackfillStatus(t *testing.T) {
+	// The payment service knows a paid and a cancelled payment, and fails for
+	// the order "unavailable"
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			switch strings.TrimPrefix(string(ctx.Path()), "/payment/status/") {
+			case "paid":
+				util.JSONResponse(ctx, fasthttp.StatusOK, &paymentRecord{Status: "paid", Paid: true})
+			case "cancelled":
+				util.JSONResponse(ctx, fasthttp.StatusOK, &paymentRecord{Status: "cancelled"})
+			case "unavailable":
+				util.InternalServerError(ctx)
+			default:
+				util.NotFound(ctx)
+			}
+		})
+	}()
+
+	store := newMemoryOrderStore()
+	for _, orderID := range []string{"paid", "cancelled", "unpaid", "unavailable"} {
+		store.orders[orderID] = &memoryOrder{Order: Order{ID: orderID}, items: map[string]*orderItem{}}
+	}
+	h := &orderRouteHandler{orderStore: store, urls: util.Services{Payment: "http://payment", Client: util.NewLocalClient(ln)}}
+
+	// Orders without status cannot be checked out until it is known
+	assert.Equal(t, ErrStatus, store.SetStatus(context.Background(), "paid", StatusCheckingOut))
+
+	remaining, err := h.backfillStatus(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, remaining)
+
+	assert.Equal(t, StatusPaid, store.orders["paid"].Status)
+	assert.Equal(t, StatusOpen, store.orders["cancelled"].Status)
+	assert.Equal(t, StatusOpen, store.orders["unpaid"].Status)
+	assert.Equal(t, StatusUnknown, store.orders["unavailable"].Status)
+}
@@ -0,0 +1,82 @@
+package order
+
+import (
+	"testing"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func cancel(h *orderRouteHandler) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("order_id", "order")
+	h.CancelOrder(ctx)
+	return ctx
+}
+
+func TestCancelPaidOrder(t *testing.T) {
+	h, store, broker := newTestHandler(map[string][]string{
+		util.MESSAGE_REFUND: {util.MESSAGE_ORDER_REFUNDED, util.MESSAGE_ORDER_SUCCESS},
+	})
+	store.status = StatusPaid
+
+	ctx := cancel(h)
+
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, SagaCancel, store.onlySaga().Kind)
+	assert.Equal(t, StepCancelled, store.onlySaga().Step)
+	assert.Equal(t, StatusCancelled, store.orderStatus())
+	assert.Equal(t, []published{{service: "payment", message: util.MESSAGE_REFUND}}, broker.messages())
+
+	// A cancelled order cannot be cancelled again
+	ctx = cancel(h)
+	assert.Equal(t, fasthttp.StatusConflict, ctx.Response.StatusCode())
+}
+
+func TestCancelOpenOrder(t *testing.T) {
+	h, store, broker := newTestHandler(map[string][]string{})
+
+	ctx := cancel(h)
+
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, StatusCancelled, store.orderStatus())
+	assert.Empty(t, store.sagas)
+	assert.Empty(t, broker.messages())
+}
+
+func TestCancelDuringCheckout(t *testing.T) {
+	h, store, _ := newTestHandler(map[string][]string{})
+	store.status = StatusCheckingOut
+
+	ctx := cancel(h)
+
+	assert.Equal(t, fasthttp.StatusConflict, ctx.Response.StatusCode())
+	assert.Equal(t, StatusCheckingOut, store.orderStatus())
+}
+
+func TestCancelRefundRefused(t *testing.T) {
+	h, store, _ := newTestHandler(map[string][]string{
+		util.MESSAGE_REFUND: {util.MESSAGE_ORDER_BADREQUEST},
+	})
+	store.status = StatusPaid
+
+	ctx := cancel(h)
+
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Equal(t, StepFailed, store.onlySaga().Step)
+	assert.Equal(t, StatusPaid, store.orderStatus())
+}
+
+func TestCancelTimeout(t *testing.T) {
+	h, store, _ := newTestHandler(map[string][]string{})
+	store.status = StatusPaid
+
+	ctx := cancel(h)
+
+	// The cancellation is finished by the recovery
+	assert.Equal(t, fasthttp.StatusAccepted, ctx.Response.StatusCode())
+	assert.Equal(t, StepRefundRequested, store.onlySaga().Step)
+	assert.Equal(t, StatusCancelling, store.orderStatus())
+	assert.Empty(t, h.resps)
+}
@@ -0,0 +1,277 @@
+package order
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// fakeStore only keeps sagas and the order status, every order is the same
+type fakeStore struct {
+	orderStore
+
+	lock     sync.Mutex
+	sagas    map[string]*Saga
+	status   string
+	prepared []string
+}
+
+func (s *fakeStore) SetStatus(_ context.Context, _ string, status string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !contains(allowedFrom(status), s.status) {
+		return ErrStatus
+	}
+	s.status = status
+	return nil
+}
+
+func (s *fakeStore) orderStatus() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.status
+}
+
+func (s *fakeStore) GetOrder(_ context.Context, orderID string) (*util.OrderPayload, error) {
+	return &util.OrderPayload{OrderID: orderID, UserID: "user", Items: util.OrderItems{"item": 1}, Cost: 1}, nil
+}
+
+func (s *fakeStore) CreateSaga(_ context.Context, saga *Saga) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := *saga
+	s.sagas[saga.TrackID] = &c
+	return nil
+}
+
+func (s *fakeStore) GetSaga(_ context.Context, trackID string) (*Saga, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	saga, ok := s.sagas[trackID]
+	if !ok {
+		return nil, ErrNil
+	}
+	c := *saga
+	return &c, nil
+}
+
+func (s *fakeStore) UpdateSagaStep(_ context.Context, trackID string, step string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if isFinished(s.sagas[trackID].Step) {
+		return ErrSagaFinished
+	}
+	s.sagas[trackID].Step = step
+	if isFinished(step) {
+		s.status = s.sagas[trackID].finishedStatus(step)
+	}
+	return nil
+}
+
+func (s *fakeStore) onlySaga() *Saga {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, saga := range s.sagas {
+		return saga
+	}
+	return nil
+}
+
+type published struct {
+	service string
+	message string
+}
+
+// fakeBroker records published messages and answers them with the configured
+// responses, a missing response simulates a lost message. Failed responses carry
+// the cause when it is set.
+type fakeBroker struct {
+	h         *orderRouteHandler
+	responses map[string][]string
+	cause     *errs.Error
+
+	lock sync.Mutex
+	sent []published
+}
+
+func (b *fakeBroker) Pub(_ context.Context, queue string, body string) error {
+	m, err := util.DecodeMessage(body)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	b.sent = append(b.sent, published{service: queue, message: m.Type})
+	b.lock.Unlock()
+
+	for _, resp := range b.responses[m.Type] {
+		next := m.Next(resp)
+		if b.cause != nil && resp != util.MESSAGE_ORDER_SUCCESS {
+			next = m.NextError(resp, b.cause)
+		}
+		body, err := util.EncodeMessage(next)
+		if err != nil {
+			return err
+		}
+		go b.h.handleMessage(context.Background(), body)
+	}
+
+	return nil
+}
+
+func (b *fakeBroker) Sub(context.Context, string, util.MessageHandler) error {
+	return nil
+}
+
+func (b *fakeBroker) Close(context.Context) error {
+	return nil
+}
+
+func (b *fakeBroker) messages() []published {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]published{}, b.sent...)
+}
+
+func newTestHandler(responses map[string][]string) (*orderRouteHandler, *fakeStore, *fakeBroker) {
+	store := &fakeStore{sagas: map[string]*Saga{}, status: StatusOpen}
+	broker := &fakeBroker{responses: responses}
+	h := &orderRouteHandler{
+		orderStore: store,
+		transport:  broker,
+		resps:      map[string]chan *util.Message{},
+		lock:       &sync.Mutex{},
+		channelID:  "channel",
+		timeout:    50 * time.Millisecond,
+	}
+	broker.h = h
+
+	return h, store, broker
+}
+
+func checkout(h *orderRouteHandler) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("order_id", "order")
+	h.CheckoutOrder(ctx)
+	return ctx
+}
+
+func TestCheckoutSuccess(t *testing.T) {
+	h, store, _ := newTestHandler(map[string][]string{
+		util.MESSAGE_PAY: {util.MESSAGE_ORDER_SUCCESS},
+	})
+
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, StepStockDone, store.onlySaga().Step)
+	assert.Equal(t, StatusPaid, store.orderStatus())
+	assert.Empty(t, h.resps)
+
+	// A paid order cannot be checked out again
+	ctx = checkout(h)
+	assert.Equal(t, fasthttp.StatusConflict, ctx.Response.StatusCode())
+}
+
+func TestCheckoutFailureCause(t *testing.T) {
+	h, store, _ := newTestHandler(map[string][]string{
+		util.MESSAGE_PAY: {util.MESSAGE_ORDER_BADREQUEST},
+	})
+	h.transport.(*fakeBroker).cause = errs.New(errs.InsufficientCredit, "insufficient credit").With("user_id", "user")
+
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Equal(t, StatusFailed, store.orderStatus())
+	err := errs.FromResponse(ctx.Response.StatusCode(), ctx.Response.Body())
+	assert.True(t, errs.Is(err, errs.InsufficientCredit))
+	assert.Equal(t, "user", err.(*errs.Error).Details["user_id"])
+}
+
+func TestCheckoutInProgress(t *testing.T) {
+	h, store, broker := newTestHandler(map[string][]string{})
+	store.status = StatusCheckingOut
+
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusConflict, ctx.Response.StatusCode())
+	assert.Empty(t, store.sagas)
+	assert.Empty(t, broker.messages())
+}
+
+func TestCheckoutTimeoutBeforePayment(t *testing.T) {
+	h, store, broker := newTestHandler(map[string][]string{})
+
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, ctx.Response.StatusCode())
+	assert.Equal(t, StepReverted, store.onlySaga().Step)
+	assert.Equal(t, StatusFailed, store.orderStatus())
+	assert.Empty(t, h.resps)
+	assert.Equal(t, []published{
+		{service: "payment", message: util.MESSAGE_PAY},
+		{service: "payment", message: util.MESSAGE_PAY_REVERT},
+		{service: "stock", message: util.MESSAGE_STOCK_REVERT},
+	}, broker.messages())
+}
+
+func TestCheckoutTimeoutAfterPayment(t *testing.T) {
+	h, store, broker := newTestHandler(map[string][]string{
+		util.MESSAGE_PAY: {util.MESSAGE_ORDER_PAID},
+	})
+
+	// Wait until the payment was recorded before the deadline passes
+	h.timeout = 200 * time.Millisecond
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, ctx.Response.StatusCode())
+	assert.Equal(t, StepReverted, store.onlySaga().Step)
+	assert.Equal(t, StatusFailed, store.orderStatus())
+	assert.Empty(t, h.resps)
+	assert.Equal(t, []published{
+		{service: "payment", message: util.MESSAGE_PAY},
+		{service: "payment", message: util.MESSAGE_PAY_REVERT},
+		{service: "stock", message: util.MESSAGE_STOCK_REVERT},
+	}, broker.messages())
+}
+
+func TestCheckoutTimeoutAfterResult(t *testing.T) {
+	h, store, broker := newTestHandler(map[string][]string{})
+	order := &util.OrderPayload{OrderID: "order", UserID: "user", Items: util.OrderItems{"item": 1}, Cost: 1}
+
+	// The result finished the saga between the deadline and its cancellation
+	for trackID, step := range map[string]string{"paid": StepStockDone, "failed": StepFailed} {
+		assert.NoError(t, store.CreateSaga(context.Background(), &Saga{TrackID: trackID, OrderID: "order", Kind: SagaCheckout, Step: step}))
+	}
+	assert.Equal(t, util.MESSAGE_ORDER_SUCCESS, h.cancelCheckout(context.Background(), "paid", order))
+	assert.Equal(t, util.MESSAGE_ORDER_BADREQUEST, h.cancelCheckout(context.Background(), "failed", order))
+
+	assert.Equal(t, StepStockDone, store.sagas["paid"].Step)
+	assert.Equal(t, StepFailed, store.sagas["failed"].Step)
+	assert.Empty(t, broker.messages())
+}
+
+func TestCheckoutLateResponseIgnored(t *testing.T) {
+	h, store, _ := newTestHandler(map[string][]string{})
+
+	ctx := checkout(h)
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, ctx.Response.StatusCode())
+
+	saga := store.onlySaga()
+	h.handleMessage(context.Background(), "channel#"+saga.TrackID+"#"+util.MESSAGE_ORDER_SUCCESS+"#")
+
+	assert.Equal(t, StepReverted, store.onlySaga().Step)
+
+	body, err := util.EncodeMessage(util.NewMessage(util.MESSAGE_ORDER_SUCCESS, "channel", saga.TrackID, nil))
+	assert.NoError(t, err)
+	h.handleMessage(context.Background(), body)
+
+	assert.Equal(t, StepReverted, store.onlySaga().Step)
+	assert.Empty(t, h.resps)
+}
@@ -1,29 +1,69 @@
 package order
 
 import (
-	"fmt"
+	"encoding/json"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/martijnjanssen/redi-shop/util"
+	errwrap "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-func itemStringToJSONString(items string) string {
-	if items == "[]" {
-		return "[]"
+// Returns the IDs of the items in a stable order
+func itemIDs(items map[string]*orderItem) []string {
+	ids := make([]string, 0, len(items))
+	for k := range items {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func itemQuantities(items map[string]*orderItem) util.OrderItems {
+	quantities := util.OrderItems{}
+	for k, v := range items {
+		quantities[k] = v.Quantity
+	}
+
+	return quantities
+}
+
+// Adds one of the item to the order, an item that is already in the order keeps
+// the price it was first added for. Returns the price of the added item.
+func addItem(items map[string]*orderItem, itemID string, price int) int {
+	item, ok := items[itemID]
+	if !ok {
+		item = &orderItem{Price: price}
+		items[itemID] = item
+	}
+	item.Quantity++
+
+	return item.Price
+}
+
+// Removes one of the item from the order and returns its price, which is 0 when
+// the item was not in the order.
+func removeItem(items map[string]*orderItem, itemID string) int {
+	item, ok := items[itemID]
+	if !ok {
+		return 0
 	}
 
-	m := itemStringToMap(items)
-	res := ""
-	for k := range m {
-		res = fmt.Sprintf("%s\"%s\",", res, k)
+	item.Quantity--
+	if item.Quantity <= 0 {
+		delete(items, itemID)
 	}
 
-	return fmt.Sprintf("[%s]", res[:len(res)-1])
+	return item.Price
 }
 
-func itemStringToMap(items string) map[string]int {
-	m := map[string]int{}
+// Parses items in the legacy "[id->price->quantity,...]" format, items without a
+// quantity were added once.
+func itemStringToMap(items string) map[string]*orderItem {
+	m := map[string]*orderItem{}
 
 	if items == "[]" {
 		return m
@@ -32,26 +72,68 @@ func itemStringToMap(items string) map[string]int {
 	itemSplit := strings.Split(items[1:len(items)-1], ",")
 	for i := range itemSplit {
 		item := strings.Split(itemSplit[i], "->")
-		val, err := strconv.Atoi(item[1])
+		price, err := strconv.Atoi(item[1])
 		if err != nil {
 			logrus.WithError(err).WithField("item", itemSplit[i]).WithField("items", items).Error("invalid representation of item")
 			continue
 		}
-		m[item[0]] = val
+
+		quantity := 1
+		if len(item) > 2 {
+			quantity, err = strconv.Atoi(item[2])
+			if err != nil {
+				logrus.WithError(err).WithField("item", itemSplit[i]).WithField("items", items).Error("invalid representation of item")
+				continue
+			}
+		}
+		m[item[0]] = &orderItem{Price: price, Quantity: quantity}
 	}
 
 	return m
 }
 
-func mapToItemString(items map[string]int) string {
-	if len(items) == 0 {
-		return "[]"
+// MigrateRedisValue converts an order stored as a single value, either in JSON or
+// the legacy hand-written format, to the hashes of the order. ok is false when
+// the value is not an order.
+func MigrateRedisValue(orderID string, value string) (util.RedisHashes, bool, error) {
+	order := &redisOrder{}
+	if strings.HasPrefix(value, "{\"user_id\": \"") && strings.Contains(value, "\"items\": [") {
+		userID := strings.Split(strings.Split(value, "\"user_id\": \"")[1], "\"")[0]
+		items := strings.Split(strings.Split(value, "\"items\": ")[1], ", \"cost\": ")[0]
+		costPart := strings.Split(value, "\"cost\": ")
+		cost, err := strconv.Atoi(strings.TrimSuffix(costPart[len(costPart)-1], "}"))
+		if err != nil {
+			return nil, false, errwrap.Wrap(err, "cannot parse order cost")
+		}
+
+		order = &redisOrder{UserID: userID, Items: itemStringToMap(items), Cost: cost}
+	} else {
+		fields := map[string]json.RawMessage{}
+		if json.Unmarshal([]byte(value), &fields) != nil {
+			return nil, false, nil
+		}
+		if _, ok := fields["user_id"]; !ok {
+			return nil, false, nil
+		}
+		if _, ok := fields["items"]; !ok {
+			return nil, false, nil
+		}
+
+		err := json.Unmarshal([]byte(value), order)
+		if err != nil {
+			return nil, false, errwrap.Wrap(err, "malformed order")
+		}
 	}
 
-	s := ""
-	for k, v := range items {
-		s = fmt.Sprintf("%s%s->%d,", s, k, v)
+	hashes := util.RedisHashes{
+		orderKey(orderID):      {"user_id": order.UserID, "cost": order.Cost},
+		orderItemsKey(orderID): {},
+		orderPriceKey(orderID): {},
+	}
+	for itemID, item := range order.Items {
+		hashes[orderItemsKey(orderID)][itemID] = item.Quantity
+		hashes[orderPriceKey(orderID)][itemID] = item.Price
 	}
 
-	return fmt.Sprintf("[%s]", s[:len(s)-1])
+	return hashes, true, nil
 }
@@ -0,0 +1,63 @@
+package order
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestItemQuantities(t *testing.T) {
+	items := map[string]*orderItem{}
+
+	assert.Equal(t, 5, addItem(items, "a", 5))
+	assert.Equal(t, 5, addItem(items, "a", 7))
+	assert.Equal(t, 3, addItem(items, "b", 3))
+	assert.Equal(t, util.OrderItems{"a": 2, "b": 1}, itemQuantities(items))
+
+	assert.Equal(t, 3, removeItem(items, "b"))
+	assert.Equal(t, 0, removeItem(items, "b"))
+	assert.Equal(t, 5, removeItem(items, "a"))
+	assert.Equal(t, util.OrderItems{"a": 1}, itemQuantities(items))
+}
+
+func TestItemString(t *testing.T) {
+	assert.Equal(t, map[string]*orderItem{"a": {Price: 5, Quantity: 2}}, itemStringToMap("[a->5->2]"))
+
+	// Items without a quantity were added once
+	assert.Equal(t, map[string]*orderItem{"a": {Price: 5, Quantity: 1}}, itemStringToMap("[a->5]"))
+	assert.Empty(t, itemStringToMap("[]"))
+}
+
+func TestOrderItemLegacyPrice(t *testing.T) {
+	order := &redisOrder{}
+	err := json.Unmarshal([]byte(`{"user_id":"u","items":{"a":5,"b":{"price":3,"quantity":2}},"cost":11}`), order)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*orderItem{"a": {Price: 5, Quantity: 1}, "b": {Price: 3, Quantity: 2}}, order.Items)
+}
+
+func TestMigrateRedisValue(t *testing.T) {
+	hashes, ok, err := MigrateRedisValue("o", `{"user_id": "u", "items": [a->5,b->3->2], "cost": 11}`)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, util.RedisHashes{
+		"order:o":        {"user_id": "u", "cost": 11},
+		"order:o:items":  {"a": 1, "b": 2},
+		"order:o:prices": {"a": 5, "b": 3},
+	}, hashes)
+
+	hashes, ok, err = MigrateRedisValue("o", `{"user_id":"u","items":{"a":{"price":5,"quantity":2}},"cost":10}`)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, util.RedisHashes{
+		"order:o":        {"user_id": "u", "cost": 10},
+		"order:o:items":  {"a": 2},
+		"order:o:prices": {"a": 5},
+	}, hashes)
+
+	_, ok, err = MigrateRedisValue("s", `{"price":5,"stock":1}`)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
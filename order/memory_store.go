@@ -0,0 +1,254 @@
+package order
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util"
+)
+
+// Order kept by the memory store with its items
+type memoryOrder struct {
+	Order
+	items map[string]*orderItem
+}
+
+// memoryOrderStore keeps the orders and sagas in memory, a single lock makes
+// every change atomic
+type memoryOrderStore struct {
+	lock   sync.Mutex
+	orders map[string]*memoryOrder
+	sagas  map[string]*Saga
+}
+
+func newMemoryOrderStore() *memoryOrderStore {
+	return &memoryOrderStore{
+		orders: map[string]*memoryOrder{},
+		sagas:  map[string]*Saga{},
+	}
+}
+
+func (s *memoryOrderStore) Create(_ context.Context, userID string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	orderID := uuid.Must(uuid.NewV4()).String()
+	s.orders[orderID] = &memoryOrder{
+		Order: Order{ID: orderID, UserID: util.Clone(userID), Status: StatusOpen},
+		items: map[string]*orderItem{},
+	}
+
+	return orderID, nil
+}
+
+func (s *memoryOrderStore) Remove(_ context.Context, orderID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Orders cannot be removed while a saga of the order runs
+	order, ok := s.orders[orderID]
+	if !ok {
+		return ErrNil
+	} else if contains(runningStatuses, order.Status) {
+		return ErrStatus
+	}
+	delete(s.orders, orderID)
+
+	return nil
+}
+
+func (s *memoryOrderStore) Find(_ context.Context, orderID string) (*findResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return nil, ErrNil
+	}
+
+	return &findResponse{
+		OrderID:    order.ID,
+		Status:     order.Status,
+		Paid:       order.Status == StatusPaid,
+		Items:      itemIDs(order.items),
+		Quantities: itemQuantities(order.items),
+		UserID:     order.UserID,
+		TotalCost:  order.Cost,
+	}, nil
+}
+
+func (s *memoryOrderStore) AddItem(_ context.Context, orderID string, itemID string, price int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	order, err := s.modifiable(orderID)
+	if err != nil {
+		return err
+	}
+	order.Cost += addItem(order.items, util.Clone(itemID), price)
+
+	return nil
+}
+
+func (s *memoryOrderStore) RemoveItem(_ context.Context, orderID string, itemID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	order, err := s.modifiable(orderID)
+	if err != nil {
+		return err
+	}
+	order.Cost -= removeItem(order.items, itemID)
+
+	return nil
+}
+
+// Returns the order, or ErrNil when it does not exist and ErrStatus when its
+// items cannot be changed. The lock must be held.
+func (s *memoryOrderStore) modifiable(orderID string) (*memoryOrder, error) {
+	order, ok := s.orders[orderID]
+	if !ok {
+		return nil, ErrNil
+	} else if !contains(modifiableStatuses, order.Status) {
+		return nil, ErrStatus
+	}
+
+	return order, nil
+}
+
+func (s *memoryOrderStore) GetOrder(_ context.Context, orderID string) (*util.OrderPayload, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return nil, ErrNil
+	}
+
+	return &util.OrderPayload{
+		OrderID: orderID,
+		UserID:  order.UserID,
+		Items:   itemQuantities(order.items),
+		Cost:    order.Cost,
+	}, nil
+}
+
+func (s *memoryOrderStore) SetStatus(_ context.Context, orderID string, status string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return ErrNil
+	} else if !contains(allowedFrom(status), order.Status) {
+		return ErrStatus
+	}
+	order.Status = status
+
+	return nil
+}
+
+func (s *memoryOrderStore) CreateSaga(_ context.Context, saga *Saga) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := *saga
+	c.OrderID = util.Clone(saga.OrderID)
+	c.UpdatedAt = time.Now()
+	s.sagas[c.TrackID] = &c
+
+	return nil
+}
+
+func (s *memoryOrderStore) GetSaga(_ context.Context, trackID string) (*Saga, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	saga, ok := s.sagas[trackID]
+	if !ok {
+		return nil, ErrNil
+	}
+
+	c := *saga
+	return &c, nil
+}
+
+func (s *memoryOrderStore) UpdateSagaStep(_ context.Context, trackID string, step string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	saga, ok := s.sagas[trackID]
+	if !ok {
+		return ErrNil
+	} else if isFinished(saga.Step) {
+		return ErrSagaFinished
+	}
+	saga.Step = step
+	saga.UpdatedAt = time.Now()
+
+	if !isFinished(step) {
+		return nil
+	}
+
+	// The saga of the order ended
+	order, ok := s.orders[saga.OrderID]
+	if ok && order.Status == saga.runningStatus() {
+		order.Status = saga.finishedStatus(step)
+	}
+
+	return nil
+}
+
+func (s *memoryOrderStore) ClaimSagas(_ context.Context, channelID string, before time.Time) ([]*Saga, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	sagas := []*Saga{}
+	for _, saga := range s.sagas {
+		if isFinished(saga.Step) || !saga.UpdatedAt.Before(before) {
+			continue
+		}
+
+		saga.ChannelID = channelID
+		saga.UpdatedAt = now
+		c := *saga
+		sagas = append(sagas, &c)
+	}
+
+	return sagas, nil
+}
+
+// The memory store has no prepared transactions
+func (s *memoryOrderStore) PreparedTransactions(_ context.Context, _ time.Time) ([]string, error) {
+	return []string{}, nil
+}
+
+// Orders in memory always have a status, unless a test stored them without
+func (s *memoryOrderStore) UnknownStatus(_ context.Context) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids := []string{}
+	for orderID, order := range s.orders {
+		if order.Status == StatusUnknown {
+			ids = append(ids, orderID)
+		}
+	}
+
+	return ids, nil
+}
+
+func (s *memoryOrderStore) BackfillStatus(_ context.Context, orderID string, status string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	order, ok := s.orders[orderID]
+	if ok && order.Status == StatusUnknown {
+		order.Status = status
+	}
+
+	return nil
+}
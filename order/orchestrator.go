@@ -0,0 +1,148 @@
+package order
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Steps of an orchestrated checkout besides the steps in checkoutSteps, the saga
+// is in the compensating step until every service undid its part
+const (
+	StepCompensating = "compensating"
+	StepCompleted    = "completed"
+)
+
+// sagaStep is a step of an orchestrated saga, the action is sent to the service
+// and the step succeeds when the service replies with success. The compensation
+// is sent when the step or a later step failed, it undoes every action of the
+// saga at the service.
+type sagaStep struct {
+	name         string
+	service      string
+	action       string
+	compensation string
+}
+
+// Steps of an orchestrated checkout, in the order they are issued. The credit and
+// stock are held before anything is paid, so a failing step only has to release.
+var checkoutSteps = []sagaStep{
+	{name: "reserve_credit", service: "payment", action: util.MESSAGE_PAY, compensation: util.MESSAGE_PAY_REVERT},
+	{name: "reserve_stock", service: "stock", action: util.MESSAGE_STOCK, compensation: util.MESSAGE_STOCK_REVERT},
+	{name: "commit_credit", service: "payment", action: util.MESSAGE_PAY_COMMIT, compensation: util.MESSAGE_PAY_REVERT},
+	{name: "commit_stock", service: "stock", action: util.MESSAGE_STOCK_COMMIT, compensation: util.MESSAGE_STOCK_REVERT},
+}
+
+// Checks out the order with a saga orchestrated by this service, which issues
+// every step and compensation itself
+func (h *orderRouteHandler) checkoutOrchestrated(ctx *fasthttp.RequestCtx, order *util.OrderPayload, payload string) {
+	trackID := uuid.Must(uuid.NewV4()).String()
+
+	// Persist the saga before anything happens, so it can be recovered
+	err := h.orderStore.CreateSaga(ctx, &Saga{
+		TrackID:   trackID,
+		OrderID:   order.OrderID,
+		Kind:      SagaOrchestrated,
+		ChannelID: h.channelID,
+		Step:      checkoutSteps[0].name,
+		Order:     payload,
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to start checkout")
+		h.failCheckout(ctx, order.OrderID)
+		return
+	}
+
+	message, cause := h.runSteps(ctx, trackID, order, 0)
+	sagaResponse(ctx, message, cause)
+}
+
+// Issues the steps of the saga starting at the step with the index, and returns
+// the message to respond with and the error the failed step replied with. Every
+// service handles a repeated step only once, so the step that was running when
+// the saga was interrupted is issued again.
+func (h *orderRouteHandler) runSteps(ctx context.Context, trackID string, order *util.OrderPayload, from int) (string, *errs.Error) {
+	for i := from; i < len(checkoutSteps); i++ {
+		step := checkoutSteps[i]
+		if i > from {
+			h.updateSagaStep(ctx, trackID, step.name)
+		}
+
+		message := util.MESSAGE_ORDER_TIMEOUT
+		var cause *errs.Error
+		if reply := h.awaitStep(ctx, trackID, step.name, step.service, step.action, order); reply != nil {
+			message, cause = reply.Type, reply.Error
+		}
+		if message == util.MESSAGE_ORDER_SUCCESS || message == util.MESSAGE_ORDER_PAID {
+			continue
+		}
+
+		logrus.WithField("track_id", trackID).WithField("step", step.name).WithField("message", message).Info("saga step failed, compensating")
+		h.updateSagaStep(ctx, trackID, StepCompensating)
+		h.compensate(ctx, trackID, order, i)
+
+		return message, cause
+	}
+
+	h.updateSagaStep(ctx, trackID, StepCompleted)
+	return util.MESSAGE_ORDER_SUCCESS, nil
+}
+
+// Compensates the step with the index and the steps before it, latest first. A
+// step that timed out may still happen, so it is compensated as well. Returns
+// false when the compensation has to be retried by the recovery.
+func (h *orderRouteHandler) compensate(ctx context.Context, trackID string, order *util.OrderPayload, last int) bool {
+	sent := map[string]bool{}
+	for i := last; i >= 0; i-- {
+		step := checkoutSteps[i]
+		if step.compensation == "" || sent[step.compensation] {
+			continue
+		}
+		sent[step.compensation] = true
+
+		reply := h.awaitStep(ctx, trackID, "compensate_"+step.name, step.service, step.compensation, order)
+		if reply == nil || reply.Type != util.MESSAGE_ORDER_SUCCESS {
+			logrus.WithField("track_id", trackID).WithField("step", step.name).Warn("compensation failed, retrying later")
+			return false
+		}
+	}
+
+	h.updateSagaStep(ctx, trackID, StepReverted)
+	return true
+}
+
+// Sends the action of a step to the service and waits for its reply, returns nil
+// when the reply did not arrive before the deadline
+func (h *orderRouteHandler) awaitStep(ctx context.Context, trackID string, step string, service string, action string, order *util.OrderPayload) *util.Message {
+	m := util.NewMessage(action, h.channelID, trackID, order)
+	m.Step = step
+
+	return h.awaitSaga(ctx, stepKey(trackID, step), service, m)
+}
+
+// Replies to the steps of orchestrated sagas are awaited per step, so a late
+// reply is not taken for the reply to the next step
+func stepKey(trackID string, step string) string {
+	return trackID + "/" + step
+}
+
+// Resumes an orchestrated checkout at the step it was interrupted in
+func (h *orderRouteHandler) recoverOrchestrated(ctx context.Context, saga *Saga, order *util.OrderPayload) {
+	if saga.Step == StepCompensating {
+		h.compensate(ctx, saga.TrackID, order, len(checkoutSteps)-1)
+		return
+	}
+
+	for i, step := range checkoutSteps {
+		if step.name == saga.Step {
+			h.runSteps(ctx, saga.TrackID, order, i)
+			return
+		}
+	}
+
+	logrus.WithField("track_id", saga.TrackID).WithField("step", saga.Step).Error("unable to recover saga in unknown step")
+}
@@ -0,0 +1,80 @@
+package order
+
+import (
+	"context"
+	"testing"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func newOrchestratedHandler(responses map[string][]string) (*orderRouteHandler, *fakeStore, *fakeBroker) {
+	h, store, broker := newTestHandler(responses)
+	h.mode = util.ORCHESTRATED
+
+	return h, store, broker
+}
+
+func TestOrchestratedCheckout(t *testing.T) {
+	h, store, broker := newOrchestratedHandler(map[string][]string{
+		util.MESSAGE_PAY:          {util.MESSAGE_ORDER_PAID},
+		util.MESSAGE_STOCK:        {util.MESSAGE_ORDER_SUCCESS},
+		util.MESSAGE_PAY_COMMIT:   {util.MESSAGE_ORDER_SUCCESS},
+		util.MESSAGE_STOCK_COMMIT: {util.MESSAGE_ORDER_SUCCESS},
+	})
+
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, StepCompleted, store.onlySaga().Step)
+	assert.Equal(t, StatusPaid, store.orderStatus())
+	assert.Empty(t, h.resps)
+	assert.Equal(t, []published{
+		{service: "payment", message: util.MESSAGE_PAY},
+		{service: "stock", message: util.MESSAGE_STOCK},
+		{service: "payment", message: util.MESSAGE_PAY_COMMIT},
+		{service: "stock", message: util.MESSAGE_STOCK_COMMIT},
+	}, broker.messages())
+}
+
+func TestOrchestratedCheckoutCompensates(t *testing.T) {
+	h, store, broker := newOrchestratedHandler(map[string][]string{
+		util.MESSAGE_PAY:          {util.MESSAGE_ORDER_PAID},
+		util.MESSAGE_STOCK:        {util.MESSAGE_ORDER_BADREQUEST},
+		util.MESSAGE_STOCK_REVERT: {util.MESSAGE_ORDER_SUCCESS},
+		util.MESSAGE_PAY_REVERT:   {util.MESSAGE_ORDER_SUCCESS},
+	})
+
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Equal(t, StepReverted, store.onlySaga().Step)
+	assert.Equal(t, StatusFailed, store.orderStatus())
+	assert.Equal(t, []published{
+		{service: "payment", message: util.MESSAGE_PAY},
+		{service: "stock", message: util.MESSAGE_STOCK},
+		{service: "stock", message: util.MESSAGE_STOCK_REVERT},
+		{service: "payment", message: util.MESSAGE_PAY_REVERT},
+	}, broker.messages())
+}
+
+func TestOrchestratedCheckoutRecoversCompensation(t *testing.T) {
+	h, store, broker := newOrchestratedHandler(map[string][]string{
+		util.MESSAGE_PAY: {util.MESSAGE_ORDER_PAID},
+	})
+
+	// The stock service does not reply, and neither does it to the compensation
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, ctx.Response.StatusCode())
+	assert.Equal(t, StepCompensating, store.onlySaga().Step)
+	assert.Equal(t, StatusCheckingOut, store.orderStatus())
+
+	broker.responses[util.MESSAGE_STOCK_REVERT] = []string{util.MESSAGE_ORDER_SUCCESS}
+	broker.responses[util.MESSAGE_PAY_REVERT] = []string{util.MESSAGE_ORDER_SUCCESS}
+	h.recoverSaga(context.Background(), store.onlySaga())
+
+	assert.Equal(t, StepReverted, store.onlySaga().Step)
+	assert.Equal(t, StatusFailed, store.orderStatus())
+}
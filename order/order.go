@@ -1,8 +1,114 @@
 package order
 
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Status of an order, see transitions for the allowed changes
+const (
+	StatusOpen        = "open"
+	StatusCheckingOut = "checking_out"
+	StatusPaid        = "paid"
+	StatusFailed      = "failed"
+	StatusCancelling  = "cancelling"
+	StatusCancelled   = "cancelled"
+
+	// Orders stored before orders had a status have none until it is backfilled
+	// from their payment, until then their status cannot change
+	StatusUnknown = ""
+)
+
+// Statuses an order can move to from a status
+var transitions = map[string][]string{
+	StatusOpen:        {StatusCheckingOut, StatusCancelled},
+	StatusCheckingOut: {StatusPaid, StatusFailed},
+	StatusFailed:      {StatusCheckingOut, StatusCancelled},
+	StatusPaid:        {StatusCancelling},
+	StatusCancelling:  {StatusCancelled, StatusPaid},
+	StatusCancelled:   {},
+}
+
+// Statuses in which the items of an order can be changed
+var modifiableStatuses = []string{StatusOpen, StatusFailed}
+
+// Statuses in which a saga of the order runs, the order cannot be removed until
+// the saga finished
+var runningStatuses = []string{StatusCheckingOut, StatusCancelling}
+
+// Returns the statuses an order can move to the status from
+func allowedFrom(status string) []string {
+	from := []string{}
+	for s, to := range transitions {
+		for _, t := range to {
+			if t == status {
+				from = append(from, s)
+			}
+		}
+	}
+	sort.Strings(from)
+
+	return from
+}
+
+func contains(statuses []string, status string) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
 type Order struct {
-	ID     string `sql:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	ID     string `sql:"type:uuid;primary_key"`
 	UserID string
-	Items  string
 	Cost   int
+	Status string
+}
+
+// Line of an order, the unit price is the price the item was first added for
+type OrderItem struct {
+	OrderID   string `gorm:"type:uuid;primary_key"`
+	ItemID    string `gorm:"primary_key"`
+	Quantity  int
+	UnitPrice int
+}
+
+type createResponse struct {
+	OrderID string `json:"order_id"`
+}
+
+// Item in an order with the price it was added for
+type orderItem struct {
+	Price    int `json:"price"`
+	Quantity int `json:"quantity"`
+}
+
+// UnmarshalJSON also accepts the bare price stored before orders had quantities
+func (i *orderItem) UnmarshalJSON(b []byte) error {
+	var price int
+	if json.Unmarshal(b, &price) == nil {
+		*i = orderItem{Price: price, Quantity: 1}
+		return nil
+	}
+
+	type item orderItem
+	return json.Unmarshal(b, (*item)(i))
+}
+
+type findResponse struct {
+	OrderID    string         `json:"order_id"`
+	Status     string         `json:"status"`
+	Paid       bool           `json:"paid"`
+	Items      []string       `json:"items"`
+	Quantities map[string]int `json:"quantities"`
+	UserID     string         `json:"user_id"`
+	TotalCost  int            `json:"total_cost"`
+	Payment    *paymentRecord `json:"payment,omitempty"`
+}
+
+// Response of the stock service when finding an item
+type itemResponse struct {
+	Price int `json:"price"`
 }
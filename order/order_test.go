@@ -0,0 +1,55 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAllowedFrom(t *testing.T) {
+	assert.Equal(t, []string{StatusFailed, StatusOpen}, allowedFrom(StatusCheckingOut))
+	assert.Equal(t, []string{StatusCancelling, StatusCheckingOut}, allowedFrom(StatusPaid))
+	assert.Equal(t, []string{StatusCancelling, StatusFailed, StatusOpen}, allowedFrom(StatusCancelled))
+	assert.Empty(t, allowedFrom(StatusOpen))
+}
+
+func TestOrderErrorResponse(t *testing.T) {
+	for err, status := range map[error]int{
+		ErrNil:                   fasthttp.StatusNotFound,
+		ErrStatus:                fasthttp.StatusConflict,
+		errors.New("connection"): fasthttp.StatusInternalServerError,
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		orderErrorResponse(ctx, err)
+		assert.Equal(t, status, ctx.Response.StatusCode(), err.Error())
+	}
+}
+
+func TestRemoveOrder(t *testing.T) {
+	store := newMemoryOrderStore()
+	h := &orderRouteHandler{orderStore: store}
+	remove := func(orderID string) int {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("order_id", orderID)
+		h.RemoveOrder(ctx)
+		return ctx.Response.StatusCode()
+	}
+
+	orderID, err := store.Create(context.Background(), "user")
+	require.NoError(t, err)
+	checkingOut, err := store.Create(context.Background(), "user")
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(context.Background(), checkingOut, StatusCheckingOut))
+	cancelling, err := store.Create(context.Background(), "user")
+	require.NoError(t, err)
+	store.orders[cancelling].Status = StatusCancelling
+
+	assert.Equal(t, fasthttp.StatusOK, remove(orderID))
+	assert.Equal(t, fasthttp.StatusNotFound, remove(orderID))
+	assert.Equal(t, fasthttp.StatusConflict, remove(checkingOut))
+	assert.Equal(t, fasthttp.StatusConflict, remove(cancelling))
+}
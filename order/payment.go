@@ -0,0 +1,66 @@
+package order
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	errwrap "github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Payment of an order as returned by the payment service
+type paymentRecord struct {
+	Amount    int             `json:"amount"`
+	Refunded  int             `json:"refunded"`
+	Reserved  int             `json:"reserved"`
+	Status    string          `json:"status"`
+	Paid      bool            `json:"paid"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Refunds   []*refundRecord `json:"refunds"`
+}
+
+type refundRecord struct {
+	RefundID  string    `json:"refund_id"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Returns the payment of the order from the payment service, or ErrNil when the
+// order has no payment
+func getPayment(urls *util.Services, orderID string) (*paymentRecord, error) {
+	status, resp, err := urls.HTTPClient().Get([]byte{}, fmt.Sprintf("%s/payment/status/%s", urls.Payment, orderID))
+	if err != nil {
+		logrus.WithError(err).Error("unable to get payment")
+		return nil, errs.Unavailable("payment")
+	} else if status == fasthttp.StatusNotFound {
+		return nil, ErrNil
+	}
+	err = errs.FromResponse(status, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	payment := &paymentRecord{}
+	err = json.Unmarshal(resp, payment)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "malformed payment")
+	}
+
+	return payment, nil
+}
+
+// Returns the payment of the order to include when finding it, an order is still
+// found when its payment cannot be retrieved
+func findPayment(urls *util.Services, orderID string) *paymentRecord {
+	payment, err := getPayment(urls, orderID)
+	if err != nil && err != ErrNil {
+		logrus.WithError(err).WithField("order_id", orderID).Warn("unable to get payment of order")
+	}
+
+	return payment
+}
@@ -1,212 +1,545 @@
 package order
 
 import (
-	"errors"
-	"fmt"
-	"strconv"
-	"strings"
+	"context"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/martijnjanssen/redi-shop/util"
 	errwrap "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 )
 
 type postgresOrderStore struct {
-	db   *gorm.DB
-	urls *util.Services
+	db *gorm.DB
 }
 
-func newPostgresOrderStore(db *gorm.DB, urls *util.Services) *postgresOrderStore {
-	err := db.AutoMigrate(&Order{}).Error
+func newPostgresOrderStore(db *gorm.DB) *postgresOrderStore {
+	// Orders with items in the legacy column would be checked out without items,
+	// they are migrated before any request is served
+	migrated, err := MigratePostgres(db)
 	if err != nil {
 		panic(err)
+	} else if migrated > 0 {
+		logrus.WithField("migrated", migrated).Info("migrated legacy order items")
 	}
+
 	return &postgresOrderStore{
-		db:   db,
-		urls: urls,
+		db: db,
+	}
+}
+
+func createTables(db *gorm.DB) error {
+	err := db.AutoMigrate(&Order{}, &OrderItem{}, &Saga{}).Error
+	if err != nil {
+		return err
+	}
+
+	// Remove the items together with their order, sqlite cannot add a foreign key
+	// to an existing table so Remove removes the items there
+	if util.IsSQLite(db) {
+		return nil
 	}
+	return db.Model(&OrderItem{}).AddForeignKey("order_id", "orders(id)", "CASCADE", "CASCADE").Error
+}
+
+// BeforeCreate generates the ID of the order
+func (o *Order) BeforeCreate(scope *gorm.Scope) error {
+	return util.GenerateID(scope)
 }
 
-func (s *postgresOrderStore) Create(ctx *fasthttp.RequestCtx, userID string) {
+func (s *postgresOrderStore) Create(_ context.Context, userID string) (string, error) {
 	order := &Order{
 		UserID: userID,
-		Items:  "[]",
+		Status: StatusOpen,
 	}
 	err := s.db.Model(&Order{}).
 		Create(order).
 		Error
 	if err != nil {
-		logrus.WithError(err).Error("unable to create new order")
-		util.InternalServerError(ctx)
-		return
+		return "", errwrap.Wrap(err, "unable to create new order")
 	}
 
-	util.JSONResponse(ctx, fasthttp.StatusCreated, fmt.Sprintf("{\"order_id\": \"%s\"}", order.ID))
+	return order.ID, nil
 }
 
-func (s *postgresOrderStore) Remove(ctx *fasthttp.RequestCtx, orderID string) {
-	err := s.db.Model(&Order{}).
-		Delete(&Order{ID: orderID}).
-		Error
-	if err != nil {
-		logrus.WithError(err).Error("unable to remove order")
-		util.InternalServerError(ctx)
-		return
+func (s *postgresOrderStore) Remove(_ context.Context, orderID string) error {
+	// Orders cannot be removed while a saga of the order runs
+	del := s.db.Model(&Order{}).
+		Where("status IS NULL OR status NOT IN (?)", runningStatuses).
+		Delete(&Order{ID: orderID})
+	if del.Error != nil {
+		return errwrap.Wrap(del.Error, "unable to remove order")
+	}
+
+	if del.RowsAffected > 0 && util.IsSQLite(s.db) {
+		err := s.db.Where("order_id = ?", orderID).
+			Delete(&OrderItem{}).
+			Error
+		if err != nil {
+			return errwrap.Wrap(err, "unable to remove order items")
+		}
+	} else if del.RowsAffected == 0 {
+		err := s.db.Model(&Order{}).
+			Where("id = ?", orderID).
+			First(&Order{}).
+			Error
+		if err == nil {
+			return ErrStatus
+		} else if err == gorm.ErrRecordNotFound {
+			return ErrNil
+		}
+		return errwrap.Wrap(err, "unable to find order to remove")
 	}
 
-	util.Ok(ctx)
+	return nil
 }
 
-func (s *postgresOrderStore) Find(ctx *fasthttp.RequestCtx, orderID string) {
+func (s *postgresOrderStore) Find(_ context.Context, orderID string) (*findResponse, error) {
 	order := &Order{}
 	err := s.db.Model(&Order{}).
 		Where("id = ?", orderID).
 		First(order).
 		Error
 	if err == gorm.ErrRecordNotFound {
-		util.NotFound(ctx)
-		return
+		return nil, ErrNil
 	} else if err != nil {
-		logrus.WithError(err).Error("unable to find order")
-		util.InternalServerError(ctx)
-		return
+		return nil, errwrap.Wrap(err, "unable to find order")
 	}
 
-	c := fasthttp.Client{}
-	status, statusResp, err := c.Post([]byte{}, fmt.Sprintf("%s/payment/status/%s/", s.urls.Payment, orderID), nil)
+	items, err := getItems(s.db, orderID)
 	if err != nil {
-		logrus.WithError(err).Error("unable to get payment status")
-		util.InternalServerError(ctx)
-		return
-	} else if status != fasthttp.StatusOK {
-		logrus.WithField("status", status).Error("error while getting payment status")
-		ctx.SetStatusCode(status)
-		return
+		return nil, err
 	}
 
-	response := fmt.Sprintf("{\"order_id\": \"%s\", \"paid\": %t, \"items\": %s, \"user_id\": \"%s\", \"total_cost\": %d}", order.ID, strings.Contains(string(statusResp), "true"), itemStringToJSONString(order.Items), order.UserID, order.Cost)
-	util.JSONResponse(ctx, fasthttp.StatusOK, response)
+	return &findResponse{
+		OrderID:    order.ID,
+		Status:     order.Status,
+		Paid:       order.Status == StatusPaid,
+		Items:      itemIDs(items),
+		Quantities: itemQuantities(items),
+		UserID:     order.UserID,
+		TotalCost:  order.Cost,
+	}, nil
 }
 
-func (s *postgresOrderStore) AddItem(ctx *fasthttp.RequestCtx, orderID string, itemID string) {
+func (s *postgresOrderStore) AddItem(_ context.Context, orderID string, itemID string, price int) error {
+	var result error
+
 	err := s.db.Transaction(func(tx *gorm.DB) error {
-		// Get the order from the database
-		order := &Order{}
-		err := tx.Model(&Order{}).
-			Where("id = ?", orderID).
-			First(order).
-			Error
-		if err == gorm.ErrRecordNotFound {
-			util.NotFound(ctx)
-			return errors.New("order not found")
-		} else if err != nil {
-			util.InternalServerError(ctx)
-			return errwrap.Wrap(err, "unable to get order")
+		result = lockModifiable(tx, orderID)
+		if result != nil {
+			return result
 		}
 
-		// Get the price of the item
-		c := fasthttp.Client{}
-		status, resp, err := c.Get([]byte{}, fmt.Sprintf("%s/stock/find/%s", s.urls.Stock, itemID))
-		if err != nil {
-			util.InternalServerError(ctx)
-			return errwrap.Wrap(err, "unable to get item price")
-		} else if status != fasthttp.StatusOK {
-			ctx.SetStatusCode(status)
-			return errors.New("error while getting item price")
-		}
-		pricePart := strings.Split(string(resp), "\"price\": ")[1]
-		price, err := strconv.Atoi(pricePart[:len(pricePart)-1])
+		// Add the item to the order, an item already in the order keeps its price
+		err := tx.Exec(`INSERT INTO order_items (order_id, item_id, quantity, unit_price) VALUES (?, ?, 1, ?)
+			ON CONFLICT (order_id, item_id) DO UPDATE SET quantity = order_items.quantity + 1`, orderID, itemID, price).
+			Error
 		if err != nil {
-			util.InternalServerError(ctx)
-			return errwrap.Wrap(err, "malformed response from stock service")
+			result = errwrap.Wrap(err, "unable to add order item")
+			return result
 		}
 
-		// Add the item to the order and update the price of the order
-		items := itemStringToMap(order.Items)
-		items[itemID] = price
-		itemsString := mapToItemString(items)
-		cost := order.Cost + price
+		item := &OrderItem{}
+		err = tx.Model(&OrderItem{}).
+			Where("order_id = ? AND item_id = ?", orderID, itemID).
+			First(item).
+			Error
+		if err != nil {
+			result = errwrap.Wrap(err, "unable to get order item")
+			return result
+		}
 
-		// Save the updated order in the database
+		// Update the price of the order
 		err = tx.Model(&Order{}).
 			Where("id = ?", orderID).
-			Update("items", itemsString).
-			Update("cost", cost).
+			Update("cost", gorm.Expr("cost + ?", item.UnitPrice)).
 			Error
-		if err == gorm.ErrRecordNotFound {
-			util.NotFound(ctx)
-			return errwrap.Wrap(err, "unable to find order")
-		} else if err != nil {
-			util.InternalServerError(ctx)
-			return errwrap.Wrap(err, "unable to update order")
+		if err != nil {
+			result = errwrap.Wrap(err, "unable to update order")
+			return result
 		}
 
 		return nil
 	})
-	if err != nil {
-		logrus.WithError(err).Error("unable to add item to order")
-		return
+	if err != nil && result == nil {
+		return errwrap.Wrap(err, "unable to add item to order")
 	}
-	util.Ok(ctx)
+
+	return result
 }
 
-func (s *postgresOrderStore) RemoveItem(ctx *fasthttp.RequestCtx, orderID string, itemID string) {
+func (s *postgresOrderStore) RemoveItem(_ context.Context, orderID string, itemID string) error {
+	var result error
+
 	err := s.db.Transaction(func(tx *gorm.DB) error {
-		order := &Order{}
-		err := tx.Model(&Order{}).
-			Where("id = ?", orderID).
-			First(order).
+		result = lockModifiable(tx, orderID)
+		if result != nil {
+			return result
+		}
+
+		item := &OrderItem{}
+		err := util.ForUpdate(tx).
+			Model(&OrderItem{}).
+			Where("order_id = ? AND item_id = ?", orderID, itemID).
+			First(item).
 			Error
 		if err == gorm.ErrRecordNotFound {
-			util.NotFound(ctx)
-			return errors.New("order not found")
+			// The item is not in the order, nothing to remove
+			return nil
 		} else if err != nil {
-			util.InternalServerError(ctx)
-			return errwrap.Wrap(err, "unable to get order from database")
+			result = errwrap.Wrap(err, "unable to get order item")
+			return result
 		}
 
-		// Remove the item from the order and update the price of the order
-		items := itemStringToMap(order.Items)
-		cost := order.Cost - items[itemID]
-		delete(items, itemID)
-		itemsString := mapToItemString(items)
+		// Remove one of the item from the order
+		if item.Quantity > 1 {
+			err = tx.Model(&OrderItem{}).
+				Where("order_id = ? AND item_id = ?", orderID, itemID).
+				Update("quantity", gorm.Expr("quantity - 1")).
+				Error
+		} else {
+			err = tx.Where("order_id = ? AND item_id = ?", orderID, itemID).
+				Delete(&OrderItem{}).
+				Error
+		}
+		if err != nil {
+			result = errwrap.Wrap(err, "unable to remove order item")
+			return result
+		}
 
+		// Update the price of the order
 		err = tx.Model(&Order{}).
 			Where("id = ?", orderID).
-			Update("items", itemsString).
-			Update("cost", cost).
+			Update("cost", gorm.Expr("cost - ?", item.UnitPrice)).
 			Error
-		if err == gorm.ErrRecordNotFound {
-			util.NotFound(ctx)
-			return errors.New("order not found")
-		} else if err != nil {
-			util.InternalServerError(ctx)
-			return errwrap.Wrap(err, "unable to update order")
+		if err != nil {
+			result = errwrap.Wrap(err, "unable to update order")
+			return result
 		}
 
 		return nil
 	})
-	if err != nil {
-		logrus.WithError(err).Error("unable to remove item from order")
-		return
+	if err != nil && result == nil {
+		return errwrap.Wrap(err, "unable to remove item from order")
 	}
 
-	util.Ok(ctx)
+	return result
 }
 
-func (s *postgresOrderStore) GetOrder(ctx *fasthttp.RequestCtx, orderID string) (string, error) {
+// Locks the order until the end of the transaction, returns ErrNil when it does
+// not exist and ErrStatus when its items cannot be changed
+func lockModifiable(tx *gorm.DB, orderID string) error {
+	order := &Order{}
+	err := util.ForUpdate(tx).
+		Model(&Order{}).
+		Where("id = ?", orderID).
+		First(order).
+		Error
+	if err == gorm.ErrRecordNotFound {
+		return ErrNil
+	} else if err != nil {
+		return errwrap.Wrap(err, "unable to get order")
+	} else if !contains(modifiableStatuses, order.Status) {
+		return ErrStatus
+	}
+
+	return nil
+}
+
+func (s *postgresOrderStore) GetOrder(_ context.Context, orderID string) (*util.OrderPayload, error) {
 	order := &Order{}
 	err := s.db.Model(&Order{}).
 		Where("id = ?", orderID).
 		First(order).
 		Error
 	if err == gorm.ErrRecordNotFound {
-		return "", ErrNil
+		return nil, ErrNil
+	} else if err != nil {
+		return nil, errwrap.Wrap(err, "unable to find order for checkout")
+	}
+
+	items, err := getItems(s.db, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &util.OrderPayload{
+		OrderID: orderID,
+		UserID:  order.UserID,
+		Items:   itemQuantities(items),
+		Cost:    order.Cost,
+	}, nil
+}
+
+func (s *postgresOrderStore) SetStatus(_ context.Context, orderID string, status string) error {
+	update := s.db.Model(&Order{}).
+		Where("id = ?", orderID).
+		Where("status IN (?)", allowedFrom(status)).
+		Update("status", status)
+	if update.Error != nil {
+		return errwrap.Wrap(update.Error, "unable to update order status")
+	} else if update.RowsAffected > 0 {
+		return nil
+	}
+
+	err := s.db.Model(&Order{}).
+		Where("id = ?", orderID).
+		First(&Order{}).
+		Error
+	if err == gorm.ErrRecordNotFound {
+		return ErrNil
+	} else if err != nil {
+		return errwrap.Wrap(err, "unable to get order")
+	}
+
+	return ErrStatus
+}
+
+func getItems(db *gorm.DB, orderID string) (map[string]*orderItem, error) {
+	rows := []*OrderItem{}
+	err := db.Model(&OrderItem{}).
+		Where("order_id = ?", orderID).
+		Find(&rows).
+		Error
+	if err != nil {
+		return nil, errwrap.Wrap(err, "unable to get order items")
+	}
+
+	items := map[string]*orderItem{}
+	for _, row := range rows {
+		items[row.ItemID] = &orderItem{Price: row.UnitPrice, Quantity: row.Quantity}
+	}
+
+	return items, nil
+}
+
+func (s *postgresOrderStore) CreateSaga(_ context.Context, saga *Saga) error {
+	err := s.db.Model(&Saga{}).
+		Create(saga).
+		Error
+	if err != nil {
+		return errwrap.Wrap(err, "unable to create saga")
+	}
+
+	return nil
+}
+
+func (s *postgresOrderStore) GetSaga(_ context.Context, trackID string) (*Saga, error) {
+	saga := &Saga{}
+	err := s.db.Model(&Saga{}).
+		Where("track_id = ?", trackID).
+		First(saga).
+		Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrNil
 	} else if err != nil {
-		return "", errwrap.Wrap(err, "unable to find order for checkout")
+		return nil, errwrap.Wrap(err, "unable to get saga")
+	}
+
+	return saga, nil
+}
+
+func (s *postgresOrderStore) UpdateSagaStep(_ context.Context, trackID string, step string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		saga := &Saga{}
+		err := tx.Model(&Saga{}).
+			Where("track_id = ?", trackID).
+			First(saga).
+			Error
+		if err == gorm.ErrRecordNotFound {
+			return ErrNil
+		} else if err != nil {
+			return errwrap.Wrap(err, "unable to get saga")
+		}
+
+		// A finished saga keeps its last step
+		update := tx.Model(&Saga{}).
+			Where("track_id = ? AND step NOT IN (?)", trackID, finishedSteps).
+			Update("step", step)
+		if update.Error != nil {
+			return errwrap.Wrap(update.Error, "unable to update saga step")
+		} else if update.RowsAffected == 0 {
+			return ErrSagaFinished
+		}
+
+		if !isFinished(step) {
+			return nil
+		}
+
+		// The saga of the order ended
+		err = tx.Model(&Order{}).
+			Where("id = ?", saga.OrderID).
+			Where("status = ?", saga.runningStatus()).
+			Update("status", saga.finishedStatus(step)).
+			Error
+		if err != nil {
+			return errwrap.Wrap(err, "unable to update order status")
+		}
+
+		return nil
+	})
+}
+
+func (s *postgresOrderStore) ClaimSagas(_ context.Context, channelID string, before time.Time) ([]*Saga, error) {
+	sagas := []*Saga{}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Skip sagas that are being claimed by another instance
+		err := util.ForUpdateSkipLocked(tx).
+			Model(&Saga{}).
+			Where("step NOT IN (?)", finishedSteps).
+			Where("updated_at < ?", before).
+			Find(&sagas).
+			Error
+		if err != nil {
+			return errwrap.Wrap(err, "unable to get unfinished sagas")
+		}
+
+		if len(sagas) == 0 {
+			return nil
+		}
+
+		trackIDs := make([]string, len(sagas))
+		for i := range sagas {
+			trackIDs[i] = sagas[i].TrackID
+		}
+
+		err = tx.Model(&Saga{}).
+			Where("track_id IN (?)", trackIDs).
+			Update("channel_id", channelID).
+			Error
+		if err != nil {
+			return errwrap.Wrap(err, "unable to claim sagas")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sagas, nil
+}
+
+func (s *postgresOrderStore) PreparedTransactions(_ context.Context, before time.Time) ([]string, error) {
+	if util.IsSQLite(s.db) {
+		return []string{}, nil
+	}
+
+	rows, err := s.db.Raw("SELECT gid FROM pg_prepared_xacts WHERE prepared < ?", before).Rows()
+	if err != nil {
+		return nil, errwrap.Wrap(err, "unable to get prepared transactions")
+	}
+	defer rows.Close()
+
+	gids := []string{}
+	for rows.Next() {
+		var gid string
+		err = rows.Scan(&gid)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "unable to read prepared transaction")
+		}
+		gids = append(gids, gid)
+	}
+
+	return gids, rows.Err()
+}
+
+func (s *postgresOrderStore) UnknownStatus(_ context.Context) ([]string, error) {
+	ids := []string{}
+	err := s.db.Model(&Order{}).
+		Where("status IS NULL OR status = ?", StatusUnknown).
+		Pluck("id", &ids).
+		Error
+	if err != nil {
+		return nil, errwrap.Wrap(err, "unable to get orders without status")
+	}
+
+	return ids, nil
+}
+
+func (s *postgresOrderStore) BackfillStatus(_ context.Context, orderID string, status string) error {
+	err := s.db.Model(&Order{}).
+		Where("id = ?", orderID).
+		Where("status IS NULL OR status = ?", StatusUnknown).
+		Update("status", status).
+		Error
+	if err != nil {
+		return errwrap.Wrap(err, "unable to backfill order status")
+	}
+
+	return nil
+}
+
+// MigratePostgres moves the items of orders stored in the legacy items column to
+// the order_items table, the column is dropped afterwards. Returns the number of
+// migrated orders. Runs when the order service starts, when the column is gone
+// there is nothing to migrate.
+func MigratePostgres(db *gorm.DB) (int, error) {
+	err := createTables(db)
+	if err != nil {
+		return 0, errwrap.Wrap(err, "unable to create tables")
+	}
+
+	if !db.Dialect().HasColumn("orders", "items") {
+		return 0, nil
+	}
+
+	migrated := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Block changes to orders while they are migrated
+		err := tx.Exec("LOCK TABLE orders IN EXCLUSIVE MODE").Error
+		if err != nil {
+			return errwrap.Wrap(err, "unable to lock orders")
+		}
+
+		// Another instance may have migrated the orders in the meantime
+		if !tx.Dialect().HasColumn("orders", "items") {
+			return nil
+		}
+
+		rows, err := tx.Raw("SELECT id, items FROM orders WHERE items IS NOT NULL AND items <> ''").Rows()
+		if err != nil {
+			return errwrap.Wrap(err, "unable to get legacy orders")
+		}
+		legacy := map[string]string{}
+		for rows.Next() {
+			var orderID, items string
+			err = rows.Scan(&orderID, &items)
+			if err != nil {
+				_ = rows.Close()
+				return errwrap.Wrap(err, "unable to read legacy order")
+			}
+			legacy[orderID] = items
+		}
+		err = rows.Close()
+		if err != nil {
+			return errwrap.Wrap(err, "unable to read legacy orders")
+		}
+
+		for orderID, items := range legacy {
+			for itemID, item := range itemStringToMap(items) {
+				err = tx.Set("gorm:insert_option", "ON CONFLICT DO NOTHING").
+					Create(&OrderItem{OrderID: orderID, ItemID: itemID, Quantity: item.Quantity, UnitPrice: item.Price}).
+					Error
+				if err != nil {
+					return errwrap.Wrapf(err, "unable to migrate items of order %s", orderID)
+				}
+			}
+			migrated++
+		}
+
+		err = tx.Exec("ALTER TABLE orders DROP COLUMN items").Error
+		if err != nil {
+			return errwrap.Wrap(err, "unable to drop legacy items column")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	return fmt.Sprintf("{\"order_id\": \"%s\", \"user_id\": \"%s\", \"items\": %s, \"cost\": %d}", orderID, order.UserID, itemStringToJSONString(order.Items), order.Cost), nil
+	return migrated, nil
 }
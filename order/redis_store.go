@@ -1,216 +1,491 @@
 package order
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gofrs/uuid"
 	"github.com/martijnjanssen/redi-shop/util"
 	errwrap "github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 )
 
+// Set containing the track IDs of all unfinished sagas
+const openSagasKey = "sagas"
+
+// Moves an unfinished saga to a new channel when it was last updated before ARGV[2]
+var claimSaga = redis.NewScript(`
+		local updated = redis.call("HGET", KEYS[1], "updated_at")
+		if updated and tonumber(updated) < tonumber(ARGV[2]) then
+			redis.call("HSET", KEYS[1], "channel_id", ARGV[1], "updated_at", ARGV[3])
+			return 1
+		end
+		return false
+	`)
+
+// Sets the step of saga KEYS[1] with track ID ARGV[3] to ARGV[1], updated at
+// ARGV[2], unless its step is one of the arguments after ARGV[5]. When the saga
+// finishes with status ARGV[4] it is removed from the unfinished sagas KEYS[2],
+// and order KEYS[3] gets the status when it still has running status ARGV[5].
+var updateSagaStep = redis.NewScript(`
+		local step = redis.call("HGET", KEYS[1], "step")
+		if not step then
+			return 1
+		end
+		for i = 6, #ARGV do
+			if step == ARGV[i] then
+				return 2
+			end
+		end
+		redis.call("HSET", KEYS[1], "step", ARGV[1], "updated_at", ARGV[2])
+		if ARGV[4] == "" then
+			return 0
+		end
+		redis.call("SREM", KEYS[2], ARGV[3])
+		if redis.call("HGET", KEYS[3], "status") == ARGV[5] then
+			redis.call("HSET", KEYS[3], "status", ARGV[4])
+		end
+		return 0
+	`)
+
+// Creates order KEYS[1] for user ARGV[1] with status ARGV[2], unless it exists
+var createOrder = redis.NewScript(`
+		if redis.call("EXISTS", KEYS[1]) == 1 then
+			return 0
+		end
+		redis.call("HSET", KEYS[1], "user_id", ARGV[1], "status", ARGV[2])
+		return 1
+	`)
+
+// Results of the order scripts
+const (
+	scriptOk        = 0
+	scriptNotFound  = 1
+	scriptBadStatus = 2
+)
+
+// Adds one of item ARGV[1] to the order, an item that is already in the order
+// keeps the price it was first added for, otherwise it is added for ARGV[2]. The
+// order is only changed when its status (ARGV[3] when missing) is one of the
+// other arguments.
+var addOrderItem = redis.NewScript(`
+		if redis.call("EXISTS", KEYS[1]) == 0 then
+			return 1
+		end
+		local status = redis.call("HGET", KEYS[1], "status") or ARGV[3]
+		local modifiable = false
+		for i = 4, #ARGV do
+			modifiable = modifiable or status == ARGV[i]
+		end
+		if not modifiable then
+			return 2
+		end
+		redis.call("HSETNX", KEYS[3], ARGV[1], ARGV[2])
+		redis.call("HINCRBY", KEYS[2], ARGV[1], 1)
+		redis.call("HINCRBY", KEYS[1], "cost", redis.call("HGET", KEYS[3], ARGV[1]))
+		return 0
+	`)
+
+// Removes one of item ARGV[1] from the order. The order is only changed when its
+// status (ARGV[2] when missing) is one of the other arguments.
+var removeOrderItem = redis.NewScript(`
+		if redis.call("EXISTS", KEYS[1]) == 0 then
+			return 1
+		end
+		local status = redis.call("HGET", KEYS[1], "status") or ARGV[2]
+		local modifiable = false
+		for i = 3, #ARGV do
+			modifiable = modifiable or status == ARGV[i]
+		end
+		if not modifiable then
+			return 2
+		end
+		local quantity = redis.call("HGET", KEYS[2], ARGV[1])
+		if not quantity then
+			return 0
+		end
+		redis.call("HINCRBY", KEYS[1], "cost", -redis.call("HGET", KEYS[3], ARGV[1]))
+		if tonumber(quantity) > 1 then
+			redis.call("HINCRBY", KEYS[2], ARGV[1], -1)
+		else
+			redis.call("HDEL", KEYS[2], ARGV[1])
+			redis.call("HDEL", KEYS[3], ARGV[1])
+		end
+		return 0
+	`)
+
+// Removes the order unless its status is one of the arguments
+var removeOrder = redis.NewScript(`
+		if redis.call("EXISTS", KEYS[1]) == 0 then
+			return 1
+		end
+		local status = redis.call("HGET", KEYS[1], "status")
+		for i = 1, #ARGV do
+			if status == ARGV[i] then
+				return 2
+			end
+		end
+		redis.call("DEL", unpack(KEYS))
+		return 0
+	`)
+
+// Sets the status of the order to ARGV[1] when its current status (ARGV[2] when
+// missing) is one of the other arguments
+var setOrderStatus = redis.NewScript(`
+		if redis.call("EXISTS", KEYS[1]) == 0 then
+			return 1
+		end
+		local status = redis.call("HGET", KEYS[1], "status") or ARGV[2]
+		for i = 3, #ARGV do
+			if status == ARGV[i] then
+				redis.call("HSET", KEYS[1], "status", ARGV[1])
+				return 0
+			end
+		end
+		return 2
+	`)
+
+// Order as it is read from its hashes
+type redisOrder struct {
+	UserID string                `json:"user_id"`
+	Status string                `json:"-"`
+	Items  map[string]*orderItem `json:"items"`
+	Cost   int                   `json:"cost"`
+}
+
 type redisOrderStore struct {
 	store *redis.Client
-	urls  *util.Services
 }
 
-func newRedisOrderStore(c *redis.Client, urls *util.Services) *redisOrderStore {
+func newRedisOrderStore(c *redis.Client) *redisOrderStore {
 	return &redisOrderStore{
 		store: c,
-		urls:  urls,
 	}
 }
 
-func (s *redisOrderStore) Create(ctx *fasthttp.RequestCtx, userID string) {
-	json := fmt.Sprintf("{\"user_id\": \"%s\", \"items\": [], \"cost\": 0}", userID)
+// Hash with the user, cost and status of the order
+func orderKey(orderID string) string {
+	return fmt.Sprintf("order:%s", orderID)
+}
+
+// Hash with the quantity of every item in the order
+func orderItemsKey(orderID string) string {
+	return fmt.Sprintf("order:%s:items", orderID)
+}
+
+// Hash with the price every item in the order was first added for
+func orderPriceKey(orderID string) string {
+	return fmt.Sprintf("order:%s:prices", orderID)
+}
 
+// Keys of the hashes of an order, as used by the order scripts
+func orderKeys(orderID string) []string {
+	return []string{orderKey(orderID), orderItemsKey(orderID), orderPriceKey(orderID)}
+}
+
+func (s *redisOrderStore) Create(ctx context.Context, userID string) (string, error) {
 	var orderID string
 	created := false
 	for !created {
+		// The order is created with its status, so it is never seen without one
 		orderID = uuid.Must(uuid.NewV4()).String()
-		set := s.store.SetNX(ctx, orderID, json, 0)
-		if set.Err() != nil {
-			logrus.WithError(set.Err()).Error("unable to create new order")
-			util.InternalServerError(ctx)
-			return
+		n, err := createOrder.Run(ctx, s.store, []string{orderKey(orderID)}, userID, StatusOpen).Int()
+		if err != nil {
+			return "", errwrap.Wrap(err, "unable to create new order")
 		}
 
-		created = set.Val()
+		created = n == 1
 	}
 
-	util.JSONResponse(ctx, fasthttp.StatusCreated, fmt.Sprintf("{\"order_id\": \"%s\"}", orderID))
+	return orderID, nil
+}
+
+func (s *redisOrderStore) Remove(ctx context.Context, orderID string) error {
+	// Orders cannot be removed while a saga of the order runs
+	res := removeOrder.Run(ctx, s.store, orderKeys(orderID), statusArgs(runningStatuses)...)
+	return scriptResult(res, "unable to remove order")
 }
 
-func (s *redisOrderStore) Remove(ctx *fasthttp.RequestCtx, orderID string) {
-	del := s.store.Del(ctx, orderID)
-	if del.Err() != nil {
-		logrus.WithError(del.Err()).Error("unable to remove order")
-		util.InternalServerError(ctx)
-		return
+func (s *redisOrderStore) Find(ctx context.Context, orderID string) (*findResponse, error) {
+	order, err := s.get(ctx, orderID)
+	if err != nil {
+		return nil, err
 	}
 
-	util.Ok(ctx)
+	return &findResponse{
+		OrderID:    orderID,
+		Status:     order.Status,
+		Paid:       order.Status == StatusPaid,
+		Items:      itemIDs(order.Items),
+		Quantities: itemQuantities(order.Items),
+		UserID:     order.UserID,
+		TotalCost:  order.Cost,
+	}, nil
+}
+
+func (s *redisOrderStore) AddItem(ctx context.Context, orderID string, itemID string, price int) error {
+	// Add the item to the order and update the price of the order
+	args := append([]interface{}{itemID, price, StatusUnknown}, statusArgs(modifiableStatuses)...)
+	res := addOrderItem.Run(ctx, s.store, orderKeys(orderID), args...)
+	return scriptResult(res, "unable to add item to order")
 }
 
-func (s *redisOrderStore) Find(ctx *fasthttp.RequestCtx, orderID string) {
-	get := s.store.Get(ctx, orderID)
-	if get.Err() == redis.Nil {
-		util.NotFound(ctx)
-		return
-	} else if get.Err() != nil {
-		logrus.WithError(get.Err()).Error("unable to find order")
-		util.InternalServerError(ctx)
-		return
+func (s *redisOrderStore) RemoveItem(ctx context.Context, orderID string, itemID string) error {
+	args := append([]interface{}{itemID, StatusUnknown}, statusArgs(modifiableStatuses)...)
+	res := removeOrderItem.Run(ctx, s.store, orderKeys(orderID), args...)
+	return scriptResult(res, "unable to remove item from order")
+}
+
+// Returns the error for the result of an order script
+func scriptResult(res *redis.Cmd, errMsg string) error {
+	result, err := res.Int()
+	if err != nil {
+		return errwrap.Wrap(err, errMsg)
+	}
+
+	switch result {
+	case scriptNotFound:
+		return ErrNil
+	case scriptBadStatus:
+		return ErrStatus
+	default:
+		return nil
 	}
+}
 
-	c := fasthttp.Client{}
-	status, statusResp, err := c.Post([]byte{}, fmt.Sprintf("%s/payment/status/%s/", s.urls.Payment, orderID), nil)
+func (s *redisOrderStore) SetStatus(ctx context.Context, orderID string, status string) error {
+	args := append([]interface{}{status, StatusUnknown}, statusArgs(allowedFrom(status))...)
+	result, err := setOrderStatus.Run(ctx, s.store, []string{orderKey(orderID)}, args...).Int()
 	if err != nil {
-		logrus.WithError(err).Error("unable to get payment status")
-		util.InternalServerError(ctx)
-		return
-	} else if status != fasthttp.StatusOK {
-		logrus.WithField("status", status).Error("error while getting payment status")
-		ctx.SetStatusCode(status)
-		return
-	}
-
-	// Extract [...] part of the order, remove "->#" (cost mapping) from string and assemble string again
-	itemsSplit := strings.Split(get.Val(), "items\": ")
-	arraySplit := strings.Split(itemsSplit[1], ", ")
-	arraySplit[0] = itemStringToJSONString(arraySplit[0])
-	itemsSplit[1] = strings.Join(arraySplit, ", ")
-	json := strings.Join(itemsSplit, "items\": ")
-
-	util.JSONResponse(ctx, fasthttp.StatusOK, fmt.Sprintf("%s, \"paid\": %t}", json[:len(json)-1], strings.Contains(string(statusResp), "true")))
-}
-
-func (s *redisOrderStore) AddItem(ctx *fasthttp.RequestCtx, orderID string, itemID string) {
-	getOrder := s.store.Get(ctx, orderID)
-	if getOrder.Err() == redis.Nil {
-		util.NotFound(ctx)
-		return
-	} else if getOrder.Err() != nil {
-		logrus.WithError(getOrder.Err()).Error("unable to get order to add item")
-		util.InternalServerError(ctx)
-		return
-	}
-
-	// Get price of the item
-	c := fasthttp.Client{}
-	status, resp, err := c.Get([]byte{}, fmt.Sprintf("%s/stock/find/%s", s.urls.Stock, itemID))
+		return errwrap.Wrap(err, "unable to update order status")
+	}
+
+	switch result {
+	case scriptNotFound:
+		return ErrNil
+	case scriptBadStatus:
+		return ErrStatus
+	default:
+		return nil
+	}
+}
+
+func statusArgs(statuses []string) []interface{} {
+	args := make([]interface{}, len(statuses))
+	for i := range statuses {
+		args[i] = statuses[i]
+	}
+	return args
+}
+
+func (s *redisOrderStore) GetOrder(ctx context.Context, orderID string) (*util.OrderPayload, error) {
+	order, err := s.get(ctx, orderID)
 	if err != nil {
-		logrus.WithError(err).Error("unable to get item price")
-		util.InternalServerError(ctx)
-		return
-	} else if status != fasthttp.StatusOK {
-		logrus.WithField("status", status).Error("error while getting item price")
-		ctx.SetStatusCode(status)
-		return
+		return nil, err
 	}
 
-	pricePart := strings.Split(strings.Split(string(resp), "\"price\": ")[1], ",")[0]
-	price, err := strconv.Atoi(pricePart)
+	return &util.OrderPayload{
+		OrderID: orderID,
+		UserID:  order.UserID,
+		Items:   itemQuantities(order.Items),
+		Cost:    order.Cost,
+	}, nil
+}
+
+func (s *redisOrderStore) get(ctx context.Context, orderID string) (*redisOrder, error) {
+	var fields, quantities, prices *redis.StringStringMapCmd
+	_, err := s.store.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		fields = pipe.HGetAll(ctx, orderKey(orderID))
+		quantities = pipe.HGetAll(ctx, orderItemsKey(orderID))
+		prices = pipe.HGetAll(ctx, orderPriceKey(orderID))
+		return nil
+	})
 	if err != nil {
-		logrus.WithError(err).WithField("stock", string(resp)).Error("malformed response from stock service")
-		util.InternalServerError(ctx)
-		return
+		return nil, errwrap.Wrap(err, "unable to get order")
+	} else if len(fields.Val()) == 0 {
+		return nil, ErrNil
+	}
+
+	order := &redisOrder{
+		UserID: fields.Val()["user_id"],
+		Status: fields.Val()["status"],
+		Items:  map[string]*orderItem{},
+	}
+	if cost, ok := fields.Val()["cost"]; ok {
+		order.Cost, err = strconv.Atoi(cost)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "malformed order cost")
+		}
 	}
 
-	// Get the items of the order
-	json := getOrder.Val()
-	jsonSplit := strings.Split(json, "\"items\": ")
+	for itemID, q := range quantities.Val() {
+		quantity, err := strconv.Atoi(q)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "malformed order item quantity")
+		}
+		price, err := strconv.Atoi(prices.Val()[itemID])
+		if err != nil {
+			return nil, errwrap.Wrap(err, "malformed order item price")
+		}
+		order.Items[itemID] = &orderItem{Price: price, Quantity: quantity}
+	}
+
+	return order, nil
+}
 
-	// Add the item to the order
-	items := itemStringToMap(strings.Split(jsonSplit[1], ",")[0])
-	items[itemID] = price
-	itemsString := mapToItemString(items)
+func sagaKey(trackID string) string {
+	return fmt.Sprintf("saga:%s", trackID)
+}
 
-	//update the price of the order
-	costPart := strings.Split(jsonSplit[1], "\"cost\": ")[1]
-	cost, err := strconv.Atoi(costPart[0 : len(costPart)-1])
+func (s *redisOrderStore) CreateSaga(ctx context.Context, saga *Saga) error {
+	_, err := s.store.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sagaKey(saga.TrackID),
+			"order_id", saga.OrderID,
+			"kind", saga.Kind,
+			"channel_id", saga.ChannelID,
+			"step", saga.Step,
+			"order", saga.Order,
+			"updated_at", millis(time.Now()),
+		)
+		pipe.SAdd(ctx, openSagasKey, saga.TrackID)
+		return nil
+	})
 	if err != nil {
-		logrus.WithField("cost", costPart).WithError(err).Error("cannot parse order cost")
-		util.InternalServerError(ctx)
-		return
+		return errwrap.Wrap(err, "unable to create saga")
 	}
 
-	// Update item list and total cost
-	jsonSplit[1] = fmt.Sprintf("%s, \"cost\": %d}", itemsString, cost+price)
-	updatedJson := strings.Join(jsonSplit, "\"items\": ")
+	return nil
+}
+
+func (s *redisOrderStore) GetSaga(ctx context.Context, trackID string) (*Saga, error) {
+	get := s.store.HGetAll(ctx, sagaKey(trackID))
+	if get.Err() != nil {
+		return nil, errwrap.Wrap(get.Err(), "unable to get saga")
+	} else if len(get.Val()) == 0 {
+		return nil, ErrNil
+	}
 
-	set := s.store.Set(ctx, orderID, updatedJson, 0)
-	if set.Err() != nil {
-		logrus.WithError(set.Err()).Error("unable to update order item")
-		util.InternalServerError(ctx)
-		return
+	m := get.Val()
+	updated, err := strconv.ParseInt(m["updated_at"], 10, 64)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "malformed saga update time")
 	}
 
-	util.Ok(ctx)
+	return &Saga{
+		TrackID:   trackID,
+		OrderID:   m["order_id"],
+		Kind:      m["kind"],
+		ChannelID: m["channel_id"],
+		Step:      m["step"],
+		Order:     m["order"],
+		UpdatedAt: time.Unix(0, updated*int64(time.Millisecond)),
+	}, nil
 }
 
-func (s *redisOrderStore) RemoveItem(ctx *fasthttp.RequestCtx, orderID string, itemID string) {
-	getOrder := s.store.Get(ctx, orderID)
-	if getOrder.Err() == redis.Nil {
-		util.NotFound(ctx)
-		return
-	} else if getOrder.Err() != nil {
-		logrus.WithError(getOrder.Err()).Error("unable to get order to add item")
-		util.InternalServerError(ctx)
-		return
+func (s *redisOrderStore) UpdateSagaStep(ctx context.Context, trackID string, step string) error {
+	saga, err := s.GetSaga(ctx, trackID)
+	if err != nil {
+		return err
 	}
 
-	// Get the items of the order
-	json := getOrder.Val()
-	jsonSplit := strings.Split(json, "\"items\": ")
+	// The saga of the order ends with the finished status
+	status := ""
+	if isFinished(step) {
+		status = saga.finishedStatus(step)
+	}
 
-	// Get price of the order
-	costPart := strings.Split(jsonSplit[1], "\"cost\": ")[1]
-	cost, err := strconv.Atoi(costPart[0 : len(costPart)-1])
+	keys := []string{sagaKey(trackID), openSagasKey, orderKey(saga.OrderID)}
+	args := append([]interface{}{step, millis(time.Now()), trackID, status, saga.runningStatus()}, statusArgs(finishedSteps)...)
+	result, err := updateSagaStep.Run(ctx, s.store, keys, args...).Int()
 	if err != nil {
-		logrus.WithField("cost", costPart).WithError(err).Error("cannot parse order cost")
-		util.InternalServerError(ctx)
-		return
+		return errwrap.Wrap(err, "unable to update saga step")
 	}
 
-	// Get the price of the item to remove and remove the item
-	items := itemStringToMap(strings.Split(jsonSplit[1], ",")[0])
-	price := items[itemID]
-	delete(items, itemID)
-	itemsString := mapToItemString(items)
+	switch result {
+	case scriptNotFound:
+		return ErrNil
+	case scriptBadStatus:
+		return ErrSagaFinished
+	default:
+		return nil
+	}
+}
 
-	// Update item list and total cost
-	jsonSplit[1] = fmt.Sprintf("%s, \"cost\": %d}", itemsString, cost-price)
-	updatedJson := strings.Join(jsonSplit, "\"items\": ")
+func (s *redisOrderStore) ClaimSagas(ctx context.Context, channelID string, before time.Time) ([]*Saga, error) {
+	members := s.store.SMembers(ctx, openSagasKey)
+	if members.Err() != nil {
+		return nil, errwrap.Wrap(members.Err(), "unable to get unfinished sagas")
+	}
+
+	sagas := []*Saga{}
+	for _, trackID := range members.Val() {
+		res := claimSaga.Run(ctx, s.store, []string{sagaKey(trackID)}, channelID, millis(before), millis(time.Now()))
+		if res.Err() == redis.Nil {
+			// Saga is still active or claimed by another instance
+			continue
+		} else if res.Err() != nil {
+			return nil, errwrap.Wrap(res.Err(), "unable to claim saga")
+		}
 
-	set := s.store.Set(ctx, orderID, updatedJson, 0)
-	if set.Err() != nil {
-		logrus.WithError(set.Err()).Error("unable to update order item")
-		util.InternalServerError(ctx)
-		return
+		saga, err := s.GetSaga(ctx, trackID)
+		if err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, saga)
 	}
 
-	util.Ok(ctx)
+	return sagas, nil
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Redis has no prepared transactions
+func (s *redisOrderStore) PreparedTransactions(_ context.Context, _ time.Time) ([]string, error) {
+	return []string{}, nil
 }
 
-func (s *redisOrderStore) GetOrder(ctx *fasthttp.RequestCtx, orderID string) (string, error) {
-	get := s.store.Get(ctx, orderID)
-	if get.Err() == redis.Nil {
-		return "", ErrNil
-	} else if get.Err() != nil {
-		return "", errwrap.Wrap(get.Err(), "unable to get order to add item")
+// Scans the order hashes for orders without a status
+func (s *redisOrderStore) UnknownStatus(ctx context.Context) ([]string, error) {
+	ids := []string{}
+	var cursor uint64
+	for {
+		keys, next, err := s.store.Scan(ctx, cursor, orderKey("*"), 1000).Result()
+		if err != nil {
+			return nil, errwrap.Wrap(err, "unable to scan orders")
+		}
+
+		for _, key := range keys {
+			// Skip the items and prices of the orders
+			orderID := strings.TrimPrefix(key, orderKey(""))
+			if strings.Contains(orderID, ":") {
+				continue
+			}
+
+			exists, err := s.store.HExists(ctx, key, "status").Result()
+			if err != nil {
+				return nil, errwrap.Wrap(err, "unable to get order status")
+			} else if !exists {
+				ids = append(ids, orderID)
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return ids, nil
+		}
 	}
+}
 
-	// Extract [...] part of the order, remove "->#" (cost mapping) from string and assemble string again
-	itemsSplit := strings.Split(get.Val(), "items\": ")
-	arraySplit := strings.Split(itemsSplit[1], ", ")
-	arraySplit[0] = itemStringToJSONString(arraySplit[0])
-	itemsSplit[1] = strings.Join(arraySplit, ", ")
-	json := strings.Join(itemsSplit, "items\": ")
+func (s *redisOrderStore) BackfillStatus(ctx context.Context, orderID string, status string) error {
+	err := s.store.HSetNX(ctx, orderKey(orderID), "status", status).Err()
+	if err != nil {
+		return errwrap.Wrap(err, "unable to backfill order status")
+	}
 
-	return fmt.Sprintf("{\"order_id\": \"%s\", %s", orderID, json[1:]), nil
+	return nil
 }
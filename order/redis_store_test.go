@@ -0,0 +1,172 @@
+package order
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The redis tests run against a live redis, set REDI_TEST_REDIS to a redis
+// address to run them
+func testRedisStore(t *testing.T) (*redisOrderStore, *redis.Client) {
+	addr := os.Getenv("REDI_TEST_REDIS")
+	if addr == "" {
+		t.Skip("REDI_TEST_REDIS is not set")
+	}
+
+	c := redis.NewClient(&redis.Options{Addr: addr})
+	require.NoError(t, c.Ping(context.Background()).Err())
+	return newRedisOrderStore(c), c
+}
+
+func TestRedisCreateOrder(t *testing.T) {
+	ctx := context.Background()
+	s, c := testRedisStore(t)
+	defer c.Close()
+
+	orderID, err := s.Create(ctx, "user")
+	require.NoError(t, err)
+	defer c.Del(ctx, orderKeys(orderID)...)
+
+	fields, err := c.HGetAll(ctx, orderKey(orderID)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"user_id": "user", "status": StatusOpen}, fields)
+}
+
+func TestRedisRemoveItemDecrements(t *testing.T) {
+	ctx := context.Background()
+	s, c := testRedisStore(t)
+	defer c.Close()
+
+	orderID, err := s.Create(ctx, "user")
+	require.NoError(t, err)
+	defer c.Del(ctx, orderKeys(orderID)...)
+
+	require.NoError(t, s.AddItem(ctx, orderID, "item", 3))
+	// The item keeps the price it was first added for
+	require.NoError(t, s.AddItem(ctx, orderID, "item", 5))
+
+	require.NoError(t, s.RemoveItem(ctx, orderID, "item"))
+	order, err := s.Find(ctx, orderID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"item": 1}, order.Quantities)
+	assert.Equal(t, 3, order.TotalCost)
+
+	// The last one removes the item from the order
+	require.NoError(t, s.RemoveItem(ctx, orderID, "item"))
+	order, err = s.Find(ctx, orderID)
+	require.NoError(t, err)
+	assert.Empty(t, order.Quantities)
+	assert.Equal(t, 0, order.TotalCost)
+	exists, err := c.HExists(ctx, orderPriceKey(orderID), "item").Result()
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Removing an item that is not in the order changes nothing
+	require.NoError(t, s.RemoveItem(ctx, orderID, "item"))
+	order, err = s.Find(ctx, orderID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, order.TotalCost)
+}
+
+func TestRedisOrderWrongStatus(t *testing.T) {
+	ctx := context.Background()
+	s, c := testRedisStore(t)
+	defer c.Close()
+
+	orderID, err := s.Create(ctx, "user")
+	require.NoError(t, err)
+	defer c.Del(ctx, orderKeys(orderID)...)
+	require.NoError(t, s.AddItem(ctx, orderID, "item", 3))
+
+	require.NoError(t, s.SetStatus(ctx, orderID, StatusCheckingOut))
+
+	// The order is claimed by the checkout, it cannot be claimed again or changed
+	assert.Equal(t, ErrStatus, s.SetStatus(ctx, orderID, StatusCheckingOut))
+	assert.Equal(t, ErrStatus, s.AddItem(ctx, orderID, "item", 3))
+	assert.Equal(t, ErrStatus, s.RemoveItem(ctx, orderID, "item"))
+
+	order, err := s.Find(ctx, orderID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCheckingOut, order.Status)
+	assert.Equal(t, map[string]int{"item": 1}, order.Quantities)
+	assert.Equal(t, 3, order.TotalCost)
+
+	unknown := uuid.Must(uuid.NewV4()).String()
+	assert.Equal(t, ErrNil, s.SetStatus(ctx, unknown, StatusCheckingOut))
+	assert.Equal(t, ErrNil, s.AddItem(ctx, unknown, "item", 3))
+}
+
+func TestRedisRemoveOrder(t *testing.T) {
+	ctx := context.Background()
+	s, c := testRedisStore(t)
+	defer c.Close()
+
+	orderID, err := s.Create(ctx, "user")
+	require.NoError(t, err)
+	defer c.Del(ctx, orderKeys(orderID)...)
+	require.NoError(t, s.AddItem(ctx, orderID, "item", 3))
+
+	require.NoError(t, s.SetStatus(ctx, orderID, StatusCheckingOut))
+	assert.Equal(t, ErrStatus, s.Remove(ctx, orderID))
+	require.NoError(t, s.SetStatus(ctx, orderID, StatusPaid))
+	require.NoError(t, s.SetStatus(ctx, orderID, StatusCancelling))
+	assert.Equal(t, ErrStatus, s.Remove(ctx, orderID))
+	require.NoError(t, s.SetStatus(ctx, orderID, StatusPaid))
+
+	require.NoError(t, s.Remove(ctx, orderID))
+	exists, err := c.Exists(ctx, orderKeys(orderID)...).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), exists)
+	assert.Equal(t, ErrNil, s.Remove(ctx, orderID))
+}
+
+func TestRedisClaimSagas(t *testing.T) {
+	ctx := context.Background()
+	s, c := testRedisStore(t)
+	defer c.Close()
+
+	orderID, err := s.Create(ctx, "user")
+	require.NoError(t, err)
+	require.NoError(t, s.SetStatus(ctx, orderID, StatusCheckingOut))
+	trackID := uuid.Must(uuid.NewV4()).String()
+	require.NoError(t, s.CreateSaga(ctx, &Saga{TrackID: trackID, OrderID: orderID, Kind: SagaCheckout, ChannelID: "crashed", Step: StepPaid}))
+	defer c.Del(ctx, append(orderKeys(orderID), sagaKey(trackID))...)
+	defer c.SRem(ctx, openSagasKey, trackID)
+
+	claimed := func(before time.Time) bool {
+		sagas, err := s.ClaimSagas(ctx, "channel", before)
+		require.NoError(t, err)
+		for _, saga := range sagas {
+			if saga.TrackID == trackID {
+				assert.Equal(t, "channel", saga.ChannelID)
+				return true
+			}
+		}
+		return false
+	}
+
+	// Sagas that progressed recently are still running
+	assert.False(t, claimed(time.Now().Add(-time.Minute)))
+	assert.True(t, claimed(time.Now().Add(time.Second)))
+
+	// Finished sagas are never claimed
+	require.NoError(t, s.UpdateSagaStep(ctx, trackID, StepStockDone))
+	assert.False(t, claimed(time.Now().Add(time.Minute)))
+
+	// A late step does not replace the finished one
+	assert.Equal(t, ErrSagaFinished, s.UpdateSagaStep(ctx, trackID, StepReverted))
+	saga, err := s.GetSaga(ctx, trackID)
+	require.NoError(t, err)
+	assert.Equal(t, StepStockDone, saga.Step)
+
+	order, err := s.Find(ctx, orderID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPaid, order.Status)
+}
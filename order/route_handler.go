@@ -2,63 +2,97 @@ package order
 
 import (
 	"context"
-	"errors"
-	"fmt"
-	"strings"
 	"sync"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/gofrs/uuid"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 )
 
 type orderStore interface {
-	Create(*fasthttp.RequestCtx, string)
-	Remove(*fasthttp.RequestCtx, string)
-	Find(*fasthttp.RequestCtx, string)
-	AddItem(*fasthttp.RequestCtx, string, string)
-	RemoveItem(*fasthttp.RequestCtx, string, string)
-
-	GetOrder(*fasthttp.RequestCtx, string) (string, error)
+	// Create returns the ID of the new order of the user
+	Create(context.Context, string) (string, error)
+	// Remove returns ErrStatus when the order is being checked out
+	Remove(context.Context, string) error
+	Find(context.Context, string) (*findResponse, error)
+	// AddItem adds one of the item for the price, an item already in the order
+	// keeps the price it was first added for. AddItem and RemoveItem return
+	// ErrStatus when the items of the order cannot be changed.
+	AddItem(context.Context, string, string, int) error
+	RemoveItem(context.Context, string, string) error
+
+	// Stores return ErrNil when the order does not exist
+	GetOrder(context.Context, string) (*util.OrderPayload, error)
+	// SetStatus moves the order to the status, returns ErrStatus when the
+	// transition is not allowed from the current status
+	SetStatus(context.Context, string, string) error
+
+	CreateSaga(context.Context, *Saga) error
+	GetSaga(context.Context, string) (*Saga, error)
+	UpdateSagaStep(context.Context, string, string) error
+	ClaimSagas(context.Context, string, time.Time) ([]*Saga, error)
+	// PreparedTransactions returns the global identifiers of the transactions
+	// prepared before the time, only postgres has prepared transactions
+	PreparedTransactions(context.Context, time.Time) ([]string, error)
+
+	// UnknownStatus returns the IDs of the orders without a status, BackfillStatus
+	// sets the status of such an order
+	UnknownStatus(context.Context) ([]string, error)
+	BackfillStatus(context.Context, string, string) error
 }
 
-var ErrNil = errors.New("value does not exist")
+var ErrNil = errs.New(errs.NotFound, "order not found")
+var ErrStatus = errs.New(errs.InvalidState, "operation not allowed in order status")
 
 type orderRouteHandler struct {
 	orderStore orderStore
-	broker     *redis.Client
+	transport  util.Transport
 	urls       util.Services
+	mode       util.CheckoutMode
+	// twoPhase sends an action of a two-phase commit checkout to a service
+	twoPhase func(service string, action string, txID string, payload string) error
 
-	wgs   map[string]*sync.WaitGroup
-	resps map[string]string
+	resps map[string]chan *util.Message
 	lock  *sync.Mutex
 
-	channelID string
+	channelID    string
+	timeout      time.Duration
+	recoverAfter time.Duration
 }
 
 func NewRouteHandler(conn *util.Connection) *orderRouteHandler {
 	var store orderStore
 
 	switch conn.Backend {
-	case util.POSTGRES:
-		store = newPostgresOrderStore(conn.Postgres, &conn.URL)
+	case util.POSTGRES, util.SQLITE:
+		store = newPostgresOrderStore(conn.Postgres)
 	case util.REDIS:
-		store = newRedisOrderStore(conn.Redis, &conn.URL)
+		store = newRedisOrderStore(conn.Redis)
+	case util.MEMORY:
+		store = newMemoryOrderStore()
 	}
 
 	h := &orderRouteHandler{
-		orderStore: store,
-		broker:     conn.Broker,
-		urls:       conn.URL,
-		wgs:        map[string]*sync.WaitGroup{},
-		resps:      map[string]string{},
-		lock:       &sync.Mutex{},
-		channelID:  uuid.Must(uuid.NewV4()).String(),
+		orderStore:   store,
+		transport:    conn.Transport,
+		urls:         conn.URL,
+		mode:         conn.Checkout.Mode,
+		resps:        map[string]chan *util.Message{},
+		lock:         &sync.Mutex{},
+		channelID:    uuid.Must(uuid.NewV4()).String(),
+		timeout:      conn.Checkout.Timeout,
+		recoverAfter: conn.Checkout.RecoverAfter,
+	}
+
+	h.twoPhase = func(service string, action string, txID string, payload string) error {
+		return postTwoPhase(&h.urls, h.timeout, service, action, txID, payload)
 	}
 
 	go h.handleEvents()
+	go h.backfillStatuses(backfillInterval)
 
 	return h
 }
@@ -66,103 +100,286 @@ func NewRouteHandler(conn *util.Connection) *orderRouteHandler {
 func (h *orderRouteHandler) handleEvents() {
 	ctx := context.Background()
 
-	pubsub := h.broker.PSubscribe(ctx, fmt.Sprintf("%s.%s", util.CHANNEL_ORDER, h.channelID))
-
-	// Wait for confirmation that subscription is created before publishing anything.
-	_, err := pubsub.Receive(ctx)
+	err := h.transport.Sub(ctx, util.OrderChannel(h.channelID), h.handleMessage)
 	if err != nil {
 		logrus.WithError(err).Panic("error listening to channel")
 	}
 
-	// Go channel which receives messages.
-	var rm *redis.Message
-	ch := pubsub.Channel()
-	for rm = range ch {
-		s := strings.Split(rm.Payload, "#")
-
-		h.lock.Lock()
-		h.resps[s[1]] = s[2]
-		wg, ok := h.wgs[s[1]]
-		h.lock.Unlock()
+	// Only start recovering sagas once responses for them can be received
+	h.recoverSagas()
+}
 
-		if !ok {
-			logrus.Error("could not get waitgroup")
-			continue
+// Replies are only delivered to the running request, so they are never
+// delivered again
+func (h *orderRouteHandler) handleMessage(ctx context.Context, body string) error {
+	m, err := util.DecodeMessage(body)
+	if err != nil {
+		logrus.WithError(err).Error("unable to decode order message")
+		return nil
+	}
+	trackID, message := m.TrackID, m.Type
+
+	key := trackID
+	if m.Orchestrated() {
+		// Reply to a step of an orchestrated saga, which records its own steps
+		key = stepKey(trackID, m.Step)
+	} else {
+		h.logSagaStep(ctx, trackID, message)
+
+		// Progress update, the saga is still running
+		if message == util.MESSAGE_ORDER_PAID || message == util.MESSAGE_ORDER_REFUNDED {
+			return nil
 		}
-		wg.Done()
 	}
 
-	logrus.Fatal("SHOULD NEVER REACH THIS")
+	h.lock.Lock()
+	resp, ok := h.resps[key]
+	h.lock.Unlock()
+
+	// Recovered and timed out sagas have no request waiting for the result
+	if !ok {
+		return nil
+	}
+
+	select {
+	case resp <- m:
+	default:
+		logrus.WithField("track_id", trackID).Error("duplicate response for saga")
+	}
+
+	return nil
 }
 
 // Creates order for given user, and returns an order ID
 func (h *orderRouteHandler) CreateOrder(ctx *fasthttp.RequestCtx) {
 	userID := ctx.UserValue("user_id").(string)
-	h.orderStore.Create(ctx, userID)
+	orderID, err := h.orderStore.Create(ctx, userID)
+	if err != nil {
+		orderErrorResponse(ctx, err)
+		return
+	}
+
+	util.JSONResponse(ctx, fasthttp.StatusCreated, &createResponse{OrderID: orderID})
 }
 
 // Deletes an order by ID
 func (h *orderRouteHandler) RemoveOrder(ctx *fasthttp.RequestCtx) {
 	orderID := ctx.UserValue("order_id").(string)
-	h.orderStore.Remove(ctx, orderID)
+	err := h.orderStore.Remove(ctx, orderID)
+	if err != nil {
+		orderErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
 }
 
 // Retrieves information of an order
 func (h *orderRouteHandler) FindOrder(ctx *fasthttp.RequestCtx) {
 	orderID := ctx.UserValue("order_id").(string)
-	h.orderStore.Find(ctx, orderID)
+	order, err := h.orderStore.Find(ctx, orderID)
+	if err != nil {
+		orderErrorResponse(ctx, err)
+		return
+	}
+	order.Payment = findPayment(&h.urls, orderID)
+
+	util.JSONResponse(ctx, fasthttp.StatusOK, order)
 }
 
 // Adds a g given item in the order given
 func (h *orderRouteHandler) AddOrderItem(ctx *fasthttp.RequestCtx) {
 	orderID := ctx.UserValue("order_id").(string)
 	itemID := ctx.UserValue("item_id").(string)
-	h.orderStore.AddItem(ctx, orderID, itemID)
+
+	price, err := getItemPrice(&h.urls, itemID)
+	if err != nil {
+		orderErrorResponse(ctx, err)
+		return
+	}
+
+	err = h.orderStore.AddItem(ctx, orderID, itemID, price)
+	if err != nil {
+		orderErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
 }
 
 // Removes the given item from the give order
 func (h *orderRouteHandler) RemoveOrderItem(ctx *fasthttp.RequestCtx) {
 	orderID := ctx.UserValue("order_id").(string)
 	itemID := ctx.UserValue("item_id").(string)
-	h.orderStore.RemoveItem(ctx, orderID, itemID)
+	err := h.orderStore.RemoveItem(ctx, orderID, itemID)
+	if err != nil {
+		orderErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
+}
+
+// Sets the response for an error of the order store or another service
+func orderErrorResponse(ctx *fasthttp.RequestCtx, err error) {
+	if errs.Is(err, errs.Internal) {
+		logrus.WithError(err).Error("unable to handle order request")
+	}
+
+	util.ErrorResponse(ctx, err)
 }
 
 // Make the payment, subtract the stock and return a status
 func (h *orderRouteHandler) CheckoutOrder(ctx *fasthttp.RequestCtx) {
 	orderID := ctx.UserValue("order_id").(string)
 
-	// h.orderStore.Checkout(ctx, orderID)
+	// Prevent changes to the order and concurrent checkouts
+	err := h.orderStore.SetStatus(ctx, orderID, StatusCheckingOut)
+	if err != nil {
+		orderErrorResponse(ctx, err)
+		return
+	}
+
 	order, err := h.orderStore.GetOrder(ctx, orderID)
-	if err == ErrNil {
-		util.NotFound(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("unable to get order")
+		h.failCheckout(ctx, orderID)
 		return
-	} else if err != nil {
+	}
+
+	payload, err := util.EncodeOrderPayload(order)
+	if err != nil {
+		logrus.WithError(err).Error("unable to encode order")
+		h.failCheckout(ctx, orderID)
+		return
+	}
+
+	switch h.mode {
+	case util.TWO_PHASE:
+		h.checkoutTwoPhase(ctx, order, payload)
+		return
+	case util.ORCHESTRATED:
+		h.checkoutOrchestrated(ctx, order, payload)
+		return
+	}
+
+	trackID := uuid.Must(uuid.NewV4()).String()
+
+	// Persist the saga before anything happens, so it can be recovered
+	err = h.orderStore.CreateSaga(ctx, &Saga{
+		TrackID:   trackID,
+		OrderID:   orderID,
+		Kind:      SagaCheckout,
+		ChannelID: h.channelID,
+		Step:      StepPayRequested,
+		Order:     payload,
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to start checkout")
+		h.failCheckout(ctx, orderID)
+		return
+	}
+
+	// Send message to issue order payment
+	reply := h.awaitSaga(ctx, trackID, "payment", util.NewMessage(util.MESSAGE_PAY, h.channelID, trackID, order))
+	if reply == nil {
+		sagaResponse(ctx, h.cancelCheckout(ctx, trackID, order), nil)
+		return
+	}
+
+	sagaResponse(ctx, reply.Type, reply.Error)
+}
+
+// Cancels an order, a paid order is refunded and its stock is added again
+func (h *orderRouteHandler) CancelOrder(ctx *fasthttp.RequestCtx) {
+	orderID := ctx.UserValue("order_id").(string)
+
+	err := h.orderStore.SetStatus(ctx, orderID, StatusCancelling)
+	if err == ErrStatus {
+		// Nothing was paid, so there is nothing to compensate
+		err = h.orderStore.SetStatus(ctx, orderID, StatusCancelled)
+		if err == nil {
+			util.Ok(ctx)
+			return
+		}
+	}
+	if err != nil {
+		orderErrorResponse(ctx, err)
+		return
+	}
+
+	order, err := h.orderStore.GetOrder(ctx, orderID)
+	if err != nil {
 		logrus.WithError(err).Error("unable to get order")
-		util.InternalServerError(ctx)
+		h.failCancel(ctx, orderID)
+		return
+	}
+
+	payload, err := util.EncodeOrderPayload(order)
+	if err != nil {
+		logrus.WithError(err).Error("unable to encode order")
+		h.failCancel(ctx, orderID)
 		return
 	}
 
 	trackID := uuid.Must(uuid.NewV4()).String()
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+
+	// Persist the saga before anything happens, so it can be recovered
+	err = h.orderStore.CreateSaga(ctx, &Saga{
+		TrackID:   trackID,
+		OrderID:   orderID,
+		Kind:      SagaCancel,
+		ChannelID: h.channelID,
+		Step:      StepRefundRequested,
+		Order:     payload,
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to start cancellation")
+		h.failCancel(ctx, orderID)
+		return
+	}
+
+	// Send message to refund the order payment
+	reply := h.awaitSaga(ctx, trackID, "payment", util.NewMessage(util.MESSAGE_REFUND, h.channelID, trackID, order))
+	if reply == nil {
+		// A refund is not undone, the saga is finished by the recovery
+		util.Accepted(ctx)
+		return
+	}
+
+	sagaResponse(ctx, reply.Type, reply.Error)
+}
+
+// Sends the first message of a saga and waits for its result, which arrives
+// under the key. Returns nil when the result did not arrive before the deadline.
+func (h *orderRouteHandler) awaitSaga(ctx context.Context, key string, service string, m *util.Message) *util.Message {
+	resp := make(chan *util.Message, 1)
 	h.lock.Lock()
-	h.wgs[trackID] = wg
+	h.resps[key] = resp
 	h.lock.Unlock()
 
-	// Send message to issue order payment
-	util.Pub(h.urls.Payment, "payment", h.channelID, trackID, util.MESSAGE_PAY, order)
+	util.Pub(h.transport, ctx, service, m)
 
-	wg.Wait()
+	timer := time.NewTimer(h.timeout)
+	var reply *util.Message
+	select {
+	case reply = <-resp:
+		timer.Stop()
+	case <-timer.C:
+	}
 
 	h.lock.Lock()
-	message, ok := h.resps[trackID]
-	delete(h.resps, trackID)
-	delete(h.wgs, trackID)
+	delete(h.resps, key)
 	h.lock.Unlock()
 
-	if !ok {
-		logrus.Error("could not get response from map")
-		util.InternalServerError(ctx)
+	return reply
+}
+
+// Sets the response for the result of a saga, a failed saga responds with the
+// error that caused it when a service sent one
+func sagaResponse(ctx *fasthttp.RequestCtx, message string, cause *errs.Error) {
+	if cause != nil && message != util.MESSAGE_ORDER_SUCCESS {
+		util.ErrorResponse(ctx, cause)
 		return
 	}
 
@@ -173,7 +390,29 @@ func (h *orderRouteHandler) CheckoutOrder(ctx *fasthttp.RequestCtx) {
 		util.BadRequest(ctx)
 	case util.MESSAGE_ORDER_INTERNAL:
 		util.InternalServerError(ctx)
+	case util.MESSAGE_ORDER_TIMEOUT:
+		util.GatewayTimeout(ctx)
 	default:
 		logrus.WithField("message", message).Error("unknown message")
 	}
 }
+
+// Ends a checkout that failed before the saga was started
+func (h *orderRouteHandler) failCheckout(ctx *fasthttp.RequestCtx, orderID string) {
+	err := h.orderStore.SetStatus(ctx, orderID, StatusFailed)
+	if err != nil {
+		logrus.WithError(err).WithField("order_id", orderID).Error("unable to fail checkout")
+	}
+
+	util.InternalServerError(ctx)
+}
+
+// Ends a cancellation that failed before the saga was started
+func (h *orderRouteHandler) failCancel(ctx *fasthttp.RequestCtx, orderID string) {
+	err := h.orderStore.SetStatus(ctx, orderID, StatusPaid)
+	if err != nil {
+		logrus.WithError(err).WithField("order_id", orderID).Error("unable to fail cancellation")
+	}
+
+	util.InternalServerError(ctx)
+}
@@ -0,0 +1,284 @@
+package order
+
+import (
+	"context"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of sagas, a checkout pays the order and subtracts the stock, a cancel
+// refunds the payment and adds the stock again.
+const (
+	SagaCheckout = "checkout"
+	SagaCancel   = "cancel"
+	// A checkout with a two-phase commit instead of a saga
+	SagaTwoPhase = "2pc"
+	// A checkout with a saga of which the steps are issued by the order service
+	SagaOrchestrated = "orchestrated"
+)
+
+// Steps of the sagas, every step is persisted in the order store so that an
+// interrupted saga can be resumed or compensated after a crash.
+const (
+	StepPayRequested   = "pay_requested"
+	StepPaid           = "paid"
+	StepStockRequested = "stock_requested"
+	StepStockDone      = "stock_done"
+	StepReverted       = "reverted"
+	StepFailed         = "failed"
+
+	StepRefundRequested  = "refund_requested"
+	StepRefunded         = "refunded"
+	StepRestockRequested = "restock_requested"
+	StepCancelled        = "cancelled"
+)
+
+// Steps after which the saga does not need any further action
+var finishedSteps = []string{StepStockDone, StepReverted, StepFailed, StepCancelled, StepCommitted, StepAborted, StepCompleted}
+
+// ErrSagaFinished is returned for a step recorded for a saga that already
+// finished, e.g. by a late reply or a recovery that raced the reply
+var ErrSagaFinished = errs.New(errs.InvalidState, "saga already finished")
+
+type Saga struct {
+	TrackID   string `sql:"type:uuid;primary_key"`
+	OrderID   string `sql:"type:uuid"`
+	Kind      string
+	ChannelID string
+	Step      string
+	Order     string
+	UpdatedAt time.Time
+}
+
+// Sagas stored before cancellation existed have no kind
+func (s *Saga) isCancel() bool {
+	return s.Kind == SagaCancel
+}
+
+// Returns the status of the order while the saga runs
+func (s *Saga) runningStatus() string {
+	if s.isCancel() {
+		return StatusCancelling
+	}
+	return StatusCheckingOut
+}
+
+// Returns the status of the order after the saga finished in the step
+func (s *Saga) finishedStatus(step string) string {
+	switch {
+	case s.isCancel() && step == StepCancelled:
+		return StatusCancelled
+	case s.isCancel():
+		// The refund was refused, the order stays paid
+		return StatusPaid
+	case step == StepStockDone, step == StepCommitted, step == StepCompleted:
+		return StatusPaid
+	default:
+		return StatusFailed
+	}
+}
+
+func isFinished(step string) bool {
+	for _, s := range finishedSteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Periodically claims sagas that have not progressed for a while, this includes
+// sagas from instances that crashed, and resumes or compensates them.
+func (h *orderRouteHandler) recoverSagas() {
+	ctx := context.Background()
+
+	ticker := time.NewTicker(h.recoverAfter)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		sagas, err := h.orderStore.ClaimSagas(ctx, h.channelID, time.Now().Add(-h.recoverAfter))
+		if err != nil {
+			logrus.WithError(err).Error("unable to claim unfinished sagas")
+			continue
+		}
+
+		for _, saga := range sagas {
+			h.recoverSaga(ctx, saga)
+		}
+
+		if h.mode == util.TWO_PHASE {
+			h.recoverPrepared(ctx)
+		}
+	}
+}
+
+func (h *orderRouteHandler) recoverSaga(ctx context.Context, saga *Saga) {
+	logger := logrus.WithField("track_id", saga.TrackID).WithField("step", saga.Step)
+	logger.Info("recovering unfinished saga")
+
+	if saga.Kind == SagaTwoPhase {
+		h.recoverTwoPhase(ctx, saga)
+		return
+	}
+
+	order, err := util.DecodeOrderPayload(saga.Order)
+	if err != nil {
+		logger.WithError(err).Error("unable to decode order of saga")
+		return
+	}
+
+	if saga.Kind == SagaOrchestrated {
+		h.recoverOrchestrated(ctx, saga, order)
+		return
+	}
+
+	switch saga.Step {
+	case StepPayRequested:
+		paid, err := h.paymentStatus(saga.OrderID)
+		if err != nil {
+			logger.WithError(err).Error("unable to get payment status of saga")
+			return
+		}
+
+		// The payment never happened, release credit that may still be held
+		if !paid {
+			util.Pub(h.transport, ctx, "payment", util.NewMessage(util.MESSAGE_PAY_REVERT, h.channelID, saga.TrackID, order))
+			h.updateSagaStep(ctx, saga.TrackID, StepFailed)
+			return
+		}
+		fallthrough
+	case StepPaid, StepStockRequested:
+		// The response of the stock service was lost, request it again. The result
+		// will arrive on the channel of this instance.
+		h.updateSagaStep(ctx, saga.TrackID, StepStockRequested)
+		util.Pub(h.transport, ctx, "stock", util.NewMessage(util.MESSAGE_STOCK, h.channelID, saga.TrackID, order))
+	case StepRefundRequested:
+		// Refunds are deduplicated, so the refund can safely be requested again
+		util.Pub(h.transport, ctx, "payment", util.NewMessage(util.MESSAGE_REFUND, h.channelID, saga.TrackID, order))
+	case StepRefunded, StepRestockRequested:
+		h.updateSagaStep(ctx, saga.TrackID, StepRestockRequested)
+		util.Pub(h.transport, ctx, "stock", util.NewMessage(util.MESSAGE_RESTOCK, h.channelID, saga.TrackID, order))
+	default:
+		logger.Error("unable to recover saga in unknown step")
+	}
+}
+
+// Compensates a checkout that did not finish before the deadline and returns the
+// message to respond with. Payment and stock only revert what was done in this
+// saga, so both are always asked to revert. The saga is marked reverted first, so
+// a result that finished the saga in the meantime is never reverted.
+func (h *orderRouteHandler) cancelCheckout(ctx context.Context, trackID string, order *util.OrderPayload) string {
+	logger := logrus.WithField("track_id", trackID)
+
+	err := h.orderStore.UpdateSagaStep(ctx, trackID, StepReverted)
+	if err == ErrSagaFinished {
+		saga, err := h.orderStore.GetSaga(ctx, trackID)
+		if err != nil {
+			logger.WithError(err).Error("unable to get finished saga")
+			return util.MESSAGE_ORDER_INTERNAL
+		}
+
+		// The result arrived just after the deadline
+		if saga.Step == StepStockDone {
+			return util.MESSAGE_ORDER_SUCCESS
+		}
+		return util.MESSAGE_ORDER_BADREQUEST
+	} else if err != nil {
+		logger.WithError(err).Error("unable to cancel saga")
+		return util.MESSAGE_ORDER_INTERNAL
+	}
+
+	logger.Info("checkout timed out, reverting")
+	util.Pub(h.transport, ctx, "payment", util.NewMessage(util.MESSAGE_PAY_REVERT, h.channelID, trackID, order))
+	util.Pub(h.transport, ctx, "stock", util.NewMessage(util.MESSAGE_STOCK_REVERT, h.channelID, trackID, order))
+
+	return util.MESSAGE_ORDER_TIMEOUT
+}
+
+// Records the step following from a message on the order channel
+func (h *orderRouteHandler) logSagaStep(ctx context.Context, trackID string, message string) {
+	saga, err := h.orderStore.GetSaga(ctx, trackID)
+	if err != nil {
+		logrus.WithError(err).WithField("track_id", trackID).Error("unable to get saga")
+		return
+	}
+
+	// Late messages of a saga that was already finished, e.g. after a timeout
+	if isFinished(saga.Step) {
+		logrus.WithField("track_id", trackID).WithField("message", message).Info("ignoring message for finished saga")
+		return
+	}
+
+	if saga.isCancel() {
+		step := cancelStep(saga, message)
+		if step != "" {
+			h.updateSagaStep(ctx, trackID, step)
+		}
+		return
+	}
+
+	var step string
+	switch message {
+	case util.MESSAGE_ORDER_PAID:
+		step = StepPaid
+	case util.MESSAGE_ORDER_SUCCESS:
+		step = StepStockDone
+	default:
+		// When the credit was already reserved the failure comes from the stock or
+		// payment service, which revert the reservation and stock before reporting back.
+		step = StepFailed
+		if saga.Step != StepPayRequested {
+			step = StepReverted
+		}
+	}
+
+	h.updateSagaStep(ctx, trackID, step)
+}
+
+// Returns the step of a cancel saga following from a message, or an empty string
+// when the saga has to be retried
+func cancelStep(saga *Saga, message string) string {
+	logger := logrus.WithField("track_id", saga.TrackID).WithField("message", message)
+
+	switch message {
+	case util.MESSAGE_ORDER_REFUNDED:
+		return StepRefunded
+	case util.MESSAGE_ORDER_SUCCESS:
+		return StepCancelled
+	case util.MESSAGE_ORDER_BADREQUEST:
+		if saga.Step == StepRefundRequested {
+			logger.Warn("refund of order was refused")
+			return StepFailed
+		}
+		// The refund cannot be undone, the order is cancelled without its stock
+		logger.Error("UNABLE TO ADD STOCK OF CANCELLED ORDER")
+		return StepCancelled
+	default:
+		// Compensations have to complete, the recovery requests them again
+		logger.Warn("cancellation step failed, retrying later")
+		return ""
+	}
+}
+
+func (h *orderRouteHandler) updateSagaStep(ctx context.Context, trackID string, step string) {
+	err := h.orderStore.UpdateSagaStep(ctx, trackID, step)
+	if err == ErrSagaFinished {
+		logrus.WithField("track_id", trackID).WithField("step", step).Info("saga already finished, not recording step")
+	} else if err != nil {
+		logrus.WithError(err).WithField("track_id", trackID).WithField("step", step).Error("unable to update saga step")
+	}
+}
+
+func (h *orderRouteHandler) paymentStatus(orderID string) (bool, error) {
+	payment, err := getPayment(&h.urls, orderID)
+	if err == ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return payment.Paid, nil
+}
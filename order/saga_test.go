@@ -0,0 +1,137 @@
+package order
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// Returns a handler on the memory store with an order of which the checkout saga
+// was interrupted in the step. The payment service reports the order as paid
+// when paid is set.
+func newInterruptedSaga(t *testing.T, step string, paid bool, responses map[string][]string) (*orderRouteHandler, *memoryOrderStore, *fakeBroker, string, string) {
+	ln := fasthttputil.NewInmemoryListener()
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			util.JSONResponse(ctx, fasthttp.StatusOK, &paymentRecord{Paid: paid})
+		})
+	}()
+
+	ctx := context.Background()
+	store := newMemoryOrderStore()
+	broker := &fakeBroker{responses: responses}
+	h := &orderRouteHandler{
+		orderStore: store,
+		transport:  broker,
+		resps:      map[string]chan *util.Message{},
+		lock:       &sync.Mutex{},
+		channelID:  "channel",
+		urls:       util.Services{Payment: "http://payment", Client: util.NewLocalClient(ln)},
+	}
+	broker.h = h
+
+	orderID, err := store.Create(ctx, "user")
+	require.NoError(t, err)
+	require.NoError(t, store.AddItem(ctx, orderID, "item", 1))
+	order, err := store.GetOrder(ctx, orderID)
+	require.NoError(t, err)
+	encoded, err := util.EncodeOrderPayload(order)
+	require.NoError(t, err)
+
+	trackID := uuid.Must(uuid.NewV4()).String()
+	require.NoError(t, store.SetStatus(ctx, orderID, StatusCheckingOut))
+	require.NoError(t, store.CreateSaga(ctx, &Saga{TrackID: trackID, OrderID: orderID, Kind: SagaCheckout, ChannelID: "crashed", Step: step, Order: encoded}))
+
+	return h, store, broker, orderID, trackID
+}
+
+// Claims the sagas like the recovery loop does after the instance crashed
+func recoverAll(t *testing.T, h *orderRouteHandler) {
+	sagas, err := h.orderStore.ClaimSagas(context.Background(), h.channelID, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, sagas, 1)
+	assert.Equal(t, h.channelID, sagas[0].ChannelID)
+
+	for _, saga := range sagas {
+		h.recoverSaga(context.Background(), saga)
+	}
+}
+
+func TestRecoverPaidSagaFinishes(t *testing.T) {
+	h, store, broker, orderID, trackID := newInterruptedSaga(t, StepPaid, true, map[string][]string{
+		util.MESSAGE_STOCK: {util.MESSAGE_ORDER_SUCCESS},
+	})
+
+	recoverAll(t, h)
+
+	assert.Eventually(t, func() bool {
+		saga, err := store.GetSaga(context.Background(), trackID)
+		return err == nil && saga.Step == StepStockDone
+	}, time.Second, 10*time.Millisecond)
+	order, err := store.Find(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPaid, order.Status)
+	assert.Equal(t, []published{{service: "stock", message: util.MESSAGE_STOCK}}, broker.messages())
+}
+
+func TestRecoverUnpaidSagaCompensates(t *testing.T) {
+	h, store, broker, orderID, trackID := newInterruptedSaga(t, StepPayRequested, false, map[string][]string{})
+
+	recoverAll(t, h)
+
+	saga, err := store.GetSaga(context.Background(), trackID)
+	require.NoError(t, err)
+	assert.Equal(t, StepFailed, saga.Step)
+	order, err := store.Find(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusFailed, order.Status)
+	assert.Equal(t, []published{{service: "payment", message: util.MESSAGE_PAY_REVERT}}, broker.messages())
+
+	// Finished sagas are not claimed again
+	sagas, err := store.ClaimSagas(context.Background(), h.channelID, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, sagas)
+}
+
+func TestRecoverRacingReplyKeepsFinishedStep(t *testing.T) {
+	h, store, broker, orderID, trackID := newInterruptedSaga(t, StepPaid, true, map[string][]string{})
+
+	sagas, err := store.ClaimSagas(context.Background(), h.channelID, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, sagas, 1)
+
+	// The reply of the stock service arrives before the recovery records its step
+	require.NoError(t, h.handleMessage(context.Background(), encodeReply(t, trackID, orderID, util.MESSAGE_ORDER_SUCCESS)))
+	h.recoverSaga(context.Background(), sagas[0])
+	assert.Equal(t, []published{{service: "stock", message: util.MESSAGE_STOCK}}, broker.messages())
+
+	assert.Equal(t, ErrSagaFinished, store.UpdateSagaStep(context.Background(), trackID, StepReverted))
+	saga, err := store.GetSaga(context.Background(), trackID)
+	require.NoError(t, err)
+	assert.Equal(t, StepStockDone, saga.Step)
+
+	// A late failure does not change the finished saga either
+	require.NoError(t, h.handleMessage(context.Background(), encodeReply(t, trackID, orderID, util.MESSAGE_ORDER_BADREQUEST)))
+	saga, err = store.GetSaga(context.Background(), trackID)
+	require.NoError(t, err)
+	assert.Equal(t, StepStockDone, saga.Step)
+	order, err := store.Find(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPaid, order.Status)
+}
+
+// Encodes the reply of a service to the order channel
+func encodeReply(t *testing.T, trackID string, orderID string, message string) string {
+	m := util.NewMessage(util.MESSAGE_STOCK, "channel", trackID, &util.OrderPayload{OrderID: orderID})
+	body, err := util.EncodeMessage(m.Next(message))
+	require.NoError(t, err)
+	return body
+}
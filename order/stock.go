@@ -0,0 +1,33 @@
+package order
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	errwrap "github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Returns the price of the item from the stock service, or the error the stock
+// service responded with
+func getItemPrice(urls *util.Services, itemID string) (int, error) {
+	status, resp, err := urls.HTTPClient().Get([]byte{}, fmt.Sprintf("%s/stock/find/%s", urls.Stock, itemID))
+	if err != nil {
+		logrus.WithError(err).Error("unable to get item price")
+		return 0, errs.Unavailable("stock")
+	}
+	err = errs.FromResponse(status, resp)
+	if err != nil {
+		return 0, err
+	}
+
+	item := &itemResponse{}
+	err = json.Unmarshal(resp, item)
+	if err != nil {
+		return 0, errwrap.Wrap(err, "malformed response from stock service")
+	}
+
+	return item.Price, nil
+}
@@ -0,0 +1,188 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Steps of a two-phase commit checkout, the coordinator decided to commit once
+// the saga is in the committing step
+const (
+	StepPreparing  = "preparing"
+	StepCommitting = "committing"
+	StepCommitted  = "committed"
+	StepAborted    = "aborted"
+)
+
+// Services taking part in a two-phase commit checkout, in the order they are
+// asked to prepare
+var participants = []string{"user", "payment", "stock"}
+
+// Checks out the order with a two-phase commit, the user, payment and stock
+// services all prepare their part of the checkout before any of them commits.
+func (h *orderRouteHandler) checkoutTwoPhase(ctx *fasthttp.RequestCtx, order *util.OrderPayload, payload string) {
+	txID := uuid.Must(uuid.NewV4()).String()
+	logger := logrus.WithField("track_id", txID)
+
+	// Persist the transaction before anything is prepared, so it can be recovered
+	err := h.orderStore.CreateSaga(ctx, &Saga{
+		TrackID:   txID,
+		OrderID:   order.OrderID,
+		Kind:      SagaTwoPhase,
+		ChannelID: h.channelID,
+		Step:      StepPreparing,
+		Order:     payload,
+	})
+	if err != nil {
+		logger.WithError(err).Error("unable to start checkout")
+		h.failCheckout(ctx, order.OrderID)
+		return
+	}
+
+	for _, service := range participants {
+		err = h.twoPhase(service, "prepare", txID, payload)
+		if err != nil {
+			logger.WithError(err).WithField("service", service).Info("checkout was not prepared, aborting")
+			h.abortTwoPhase(ctx, txID, payload)
+			util.ErrorResponse(ctx, err)
+			return
+		}
+	}
+
+	// The decision to commit, from here on the checkout is only committed
+	err = h.orderStore.UpdateSagaStep(ctx, txID, StepCommitting)
+	if err != nil {
+		logger.WithError(err).Error("unable to record commit decision")
+		h.abortTwoPhase(ctx, txID, payload)
+		util.InternalServerError(ctx)
+		return
+	}
+
+	if !h.commitTwoPhase(ctx, txID, payload) {
+		// The order is paid, the recovery finishes the commit
+		util.Accepted(ctx)
+		return
+	}
+
+	util.Ok(ctx)
+}
+
+// Commits every participant and finishes the checkout, returns false when one of
+// them has to be committed again later
+func (h *orderRouteHandler) commitTwoPhase(ctx context.Context, txID string, payload string) bool {
+	return h.finishTwoPhase(ctx, txID, payload, "commit", StepCommitted)
+}
+
+// Aborts every participant and fails the checkout, returns false when one of
+// them has to be aborted again later
+func (h *orderRouteHandler) abortTwoPhase(ctx context.Context, txID string, payload string) bool {
+	return h.finishTwoPhase(ctx, txID, payload, "abort", StepAborted)
+}
+
+func (h *orderRouteHandler) finishTwoPhase(ctx context.Context, txID string, payload string, action string, step string) bool {
+	done := true
+	for _, service := range participants {
+		err := h.twoPhase(service, action, txID, payload)
+		if err != nil {
+			logrus.WithError(err).WithField("track_id", txID).WithField("service", service).Errorf("unable to %s transaction", action)
+			done = false
+		}
+	}
+	if !done {
+		return false
+	}
+
+	h.updateSagaStep(ctx, txID, step)
+	return true
+}
+
+// Recovers a two-phase commit checkout, a checkout that was not decided yet is
+// aborted
+func (h *orderRouteHandler) recoverTwoPhase(ctx context.Context, saga *Saga) {
+	switch saga.Step {
+	case StepPreparing:
+		h.abortTwoPhase(ctx, saga.TrackID, saga.Order)
+	case StepCommitting:
+		h.commitTwoPhase(ctx, saga.TrackID, saga.Order)
+	default:
+		logrus.WithField("track_id", saga.TrackID).WithField("step", saga.Step).Error("unable to recover transaction in unknown step")
+	}
+}
+
+// Finishes the transactions prepared by the participants that are not part of a
+// running checkout, e.g. a prepare that arrived after its checkout was aborted.
+// Transactions of a decided checkout are committed, the others are aborted.
+func (h *orderRouteHandler) recoverPrepared(ctx context.Context) {
+	gids, err := h.orderStore.PreparedTransactions(ctx, time.Now().Add(-h.recoverAfter))
+	if err != nil {
+		logrus.WithError(err).Error("unable to get prepared transactions")
+		return
+	}
+
+	for _, gid := range gids {
+		service, txID, ok := util.ParseTransactionGID(gid)
+		if !ok || !contains(participants, service) {
+			continue
+		}
+
+		action := "abort"
+		saga, err := h.orderStore.GetSaga(ctx, txID)
+		if err != nil && err != ErrNil {
+			logrus.WithError(err).WithField("track_id", txID).Error("unable to get saga of prepared transaction")
+			continue
+		} else if err == nil {
+			switch saga.Step {
+			case StepPreparing:
+				// The checkout is still running or is recovered with its saga
+				continue
+			case StepCommitting, StepCommitted:
+				action = "commit"
+			}
+		}
+
+		logrus.WithField("track_id", txID).WithField("service", service).Infof("finishing prepared transaction with %s", action)
+		err = h.twoPhase(service, action, txID, "")
+		if err != nil {
+			logrus.WithError(err).WithField("track_id", txID).WithField("service", service).Errorf("unable to %s prepared transaction", action)
+		}
+	}
+}
+
+// Sends the action of the two-phase commit to the service, the order is sent
+// along for the service to prepare. A service that does not answer in time votes
+// to abort.
+func postTwoPhase(urls *util.Services, timeout time.Duration, service string, action string, txID string, payload string) error {
+	var url string
+	switch service {
+	case "user":
+		url = fmt.Sprintf("%s/users/2pc/%s/%s", urls.User, action, txID)
+	case "payment":
+		url = fmt.Sprintf("%s/payment/2pc/%s/%s", urls.Payment, action, txID)
+	case "stock":
+		url = fmt.Sprintf("%s/stock/2pc/%s/%s", urls.Stock, action, txID)
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(url)
+	req.SetBodyString(payload)
+
+	err := urls.HTTPClient().DoTimeout(req, resp, timeout)
+	if err != nil {
+		logrus.WithError(err).WithField("service", service).Errorf("unable to send %s", action)
+		return errs.Unavailable(service)
+	}
+
+	return errs.FromResponse(resp.StatusCode(), resp.Body())
+}
@@ -0,0 +1,116 @@
+package order
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// fakeParticipants records the two-phase commit actions sent to the services and
+// fails the configured ones
+type fakeParticipants struct {
+	lock   sync.Mutex
+	sent   []string
+	errors map[string]error
+}
+
+func (p *fakeParticipants) send(service string, action string, _ string, _ string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sent = append(p.sent, service+" "+action)
+	return p.errors[service+" "+action]
+}
+
+func (s *fakeStore) PreparedTransactions(_ context.Context, _ time.Time) ([]string, error) {
+	return s.prepared, nil
+}
+
+func newTwoPhaseHandler(errors map[string]error) (*orderRouteHandler, *fakeStore, *fakeParticipants) {
+	h, store, _ := newTestHandler(map[string][]string{})
+	participants := &fakeParticipants{errors: errors}
+	h.mode = util.TWO_PHASE
+	h.twoPhase = participants.send
+
+	return h, store, participants
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	h, store, participants := newTwoPhaseHandler(map[string]error{})
+
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, StepCommitted, store.onlySaga().Step)
+	assert.Equal(t, StatusPaid, store.orderStatus())
+	assert.Equal(t, []string{
+		"user prepare", "payment prepare", "stock prepare",
+		"user commit", "payment commit", "stock commit",
+	}, participants.sent)
+}
+
+func TestTwoPhaseAbort(t *testing.T) {
+	h, store, participants := newTwoPhaseHandler(map[string]error{
+		"stock prepare": util.BAD_REQUEST,
+	})
+
+	ctx := checkout(h)
+
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Equal(t, StepAborted, store.onlySaga().Step)
+	assert.Equal(t, StatusFailed, store.orderStatus())
+	assert.Equal(t, []string{
+		"user prepare", "payment prepare", "stock prepare",
+		"user abort", "payment abort", "stock abort",
+	}, participants.sent)
+}
+
+func TestTwoPhaseRecoverCommit(t *testing.T) {
+	h, store, participants := newTwoPhaseHandler(map[string]error{
+		"payment commit": util.INTERNAL_ERR,
+	})
+
+	ctx := checkout(h)
+
+	// The decision was made, so the checkout is only finished later
+	assert.Equal(t, fasthttp.StatusAccepted, ctx.Response.StatusCode())
+	assert.Equal(t, StepCommitting, store.onlySaga().Step)
+	assert.Equal(t, StatusCheckingOut, store.orderStatus())
+
+	participants.errors = map[string]error{}
+	h.recoverSaga(context.Background(), store.onlySaga())
+
+	assert.Equal(t, StepCommitted, store.onlySaga().Step)
+	assert.Equal(t, StatusPaid, store.orderStatus())
+	assert.Equal(t, []string{"user commit", "payment commit", "stock commit"}, participants.sent[6:])
+}
+
+func TestTwoPhaseRecoverPrepared(t *testing.T) {
+	h, store, participants := newTwoPhaseHandler(map[string]error{})
+	sagas := map[string]string{
+		"3f1c4c52-4b27-4d7e-9a0e-5d6f7b1a2c01": StepAborted,
+		"3f1c4c52-4b27-4d7e-9a0e-5d6f7b1a2c02": StepCommitting,
+		"3f1c4c52-4b27-4d7e-9a0e-5d6f7b1a2c03": StepPreparing,
+	}
+	for txID, step := range sagas {
+		store.sagas[txID] = &Saga{TrackID: txID, Kind: SagaTwoPhase, Step: step}
+	}
+	store.prepared = []string{
+		"stock-3f1c4c52-4b27-4d7e-9a0e-5d6f7b1a2c01",
+		"user-3f1c4c52-4b27-4d7e-9a0e-5d6f7b1a2c02",
+		"payment-3f1c4c52-4b27-4d7e-9a0e-5d6f7b1a2c03",
+		// The checkout of the transaction is unknown
+		"payment-3f1c4c52-4b27-4d7e-9a0e-5d6f7b1a2c04",
+		// Not prepared by a participant
+		"backup",
+	}
+
+	h.recoverPrepared(context.Background())
+
+	// A running checkout is left to the recovery of its saga
+	assert.Equal(t, []string{"stock abort", "user commit", "payment abort"}, participants.sent)
+}
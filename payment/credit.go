@@ -0,0 +1,65 @@
+package payment
+
+import (
+	"fmt"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/sirupsen/logrus"
+)
+
+// Holds the amount of the credit of the user for the order at the user service,
+// the reservation ID is the track ID of the checkout saga
+func reserveCredit(urls *util.Services, userID string, orderID string, reservationID string, amount int) error {
+	return postCredit(urls, fmt.Sprintf("%s/users/credit/reserve/%s/%s/%d?reason=payment&reference=%s", urls.User, userID, reservationID, amount, orderID), "unable to reserve credit")
+}
+
+// Subtracts the credit held by the reservation from the user
+func commitCredit(urls *util.Services, reservationID string) error {
+	return postCredit(urls, fmt.Sprintf("%s/users/credit/commit/%s", urls.User, reservationID), "unable to commit credit reservation")
+}
+
+// Releases the credit held by the reservation, a reservation that does not exist
+// holds nothing
+func releaseCredit(urls *util.Services, reservationID string) error {
+	err := postCredit(urls, fmt.Sprintf("%s/users/credit/release/%s", urls.User, reservationID), "unable to release credit reservation")
+	if errs.Is(err, errs.NotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// Adds the refunded amount of the order to the credit of the user, the ID of the
+// refund is the ID of its ledger entry so the user is credited once per refund
+func refundCredit(urls *util.Services, userID string, orderID string, refundID string, amount int) error {
+	return postCredit(urls, fmt.Sprintf("%s/users/credit/add/%s/%d?reason=refund&reference=%s&entry_id=%s", urls.User, userID, amount, orderID, refundID), "unable to refund credit to user")
+}
+
+// Credits the recorded refunds of the order to the user, credited is called for
+// every refund the user was credited for. A refund that could not be credited
+// stays pending, it is credited again by the next refund of the order.
+func creditRefunds(urls *util.Services, userID string, orderID string, refunds []*Refund, credited func(*Refund)) error {
+	for _, refund := range refunds {
+		err := refundCredit(urls, userID, orderID, refund.ID, refund.Amount)
+		if err != nil {
+			logrus.WithError(err).WithField("refund_id", refund.ID).Error("error while refunding credit to user")
+			return err
+		}
+		credited(refund)
+	}
+
+	return nil
+}
+
+// Sends a request to the user service, returns the error the user service
+// responded with
+func postCredit(urls *util.Services, url string, errMsg string) error {
+	status, body, err := urls.HTTPClient().Post([]byte{}, url, nil)
+	if err != nil {
+		logrus.WithError(err).Error(errMsg)
+		return errs.Unavailable("user")
+	}
+
+	return errs.FromResponse(status, body)
+}
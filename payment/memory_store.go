@@ -0,0 +1,240 @@
+package payment
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/sirupsen/logrus"
+)
+
+// memoryPaymentStore keeps the payments in memory. The payment of an order is
+// locked while the user service is called, as the postgres store locks its row.
+type memoryPaymentStore struct {
+	urls *util.Services
+
+	lock     sync.Mutex
+	orders   map[string]*sync.Mutex
+	payments map[string]*Payment
+	refunds  map[string][]*Refund
+}
+
+func newMemoryPaymentStore(urls *util.Services) *memoryPaymentStore {
+	return &memoryPaymentStore{
+		urls:     urls,
+		orders:   map[string]*sync.Mutex{},
+		payments: map[string]*Payment{},
+		refunds:  map[string][]*Refund{},
+	}
+}
+
+// Locks the payment of the order until the returned function is called
+func (s *memoryPaymentStore) lockOrder(orderID string) func() {
+	s.lock.Lock()
+	l, ok := s.orders[orderID]
+	if !ok {
+		l = &sync.Mutex{}
+		s.orders[util.Clone(orderID)] = l
+	}
+	s.lock.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Returns a copy of the payment, or nil when the order has no payment
+func (s *memoryPaymentStore) get(orderID string) *Payment {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	payment, ok := s.payments[orderID]
+	if !ok {
+		return nil
+	}
+	c := *payment
+	return &c
+}
+
+func (s *memoryPaymentStore) put(payment *Payment) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	payment.UpdatedAt = time.Now()
+	s.payments[payment.OrderID] = payment
+}
+
+func (s *memoryPaymentStore) Reserve(_ context.Context, userID string, orderID string, reservationID string, amount int) error {
+	defer s.lockOrder(orderID)()
+
+	payment := s.get(orderID)
+	if payment != nil && payment.Status == StatusPaid {
+		logrus.Info("order was already paid")
+		return errAlreadyPaid.With("order_id", orderID)
+	} else if payment != nil && payment.holds(reservationID) {
+		return nil
+	}
+
+	err := reserveCredit(s.urls, userID, orderID, reservationID, amount)
+	if err != nil {
+		return err
+	}
+
+	// The amount that was paid before is only changed once the reservation is committed
+	if payment == nil {
+		payment = &Payment{OrderID: util.Clone(orderID), CreatedAt: time.Now()}
+	}
+	payment.UserID = util.Clone(userID)
+	payment.Reserved = amount
+	payment.ReservationID = util.Clone(reservationID)
+	payment.Status = StatusReserved
+	s.put(payment)
+
+	return nil
+}
+
+func (s *memoryPaymentStore) Commit(_ context.Context, orderID string, reservationID string) error {
+	defer s.lockOrder(orderID)()
+
+	payment := s.get(orderID)
+	if payment == nil {
+		return errPaymentNotFound.With("order_id", orderID)
+	} else if payment.Status == StatusPaid && payment.ReservationID == reservationID {
+		return nil
+	} else if !payment.holds(reservationID) {
+		logrus.WithField("order_id", orderID).Info("payment does not hold the reservation")
+		return errNotHeld.With("order_id", orderID)
+	}
+
+	err := commitCredit(s.urls, reservationID)
+	if err != nil {
+		return err
+	}
+
+	payment.Amount += payment.Reserved
+	payment.Reserved = 0
+	payment.Status = StatusPaid
+	s.put(payment)
+
+	return nil
+}
+
+func (s *memoryPaymentStore) Release(_ context.Context, orderID string, reservationID string) error {
+	defer s.lockOrder(orderID)()
+
+	// Nothing is held for the reservation
+	payment := s.get(orderID)
+	if payment == nil || !payment.holds(reservationID) {
+		return nil
+	}
+
+	err := releaseCredit(s.urls, reservationID)
+	if err != nil {
+		return err
+	}
+
+	payment.Reserved = 0
+	payment.Status = StatusCancelled
+	s.put(payment)
+
+	return nil
+}
+
+func (s *memoryPaymentStore) Refund(_ context.Context, userID string, orderID string, amount int) error {
+	defer s.lockOrder(orderID)()
+
+	payment := s.get(orderID)
+	if payment == nil {
+		return errPaymentNotFound.With("order_id", orderID)
+	}
+
+	userID, err := payment.refundUser(userID)
+	if err != nil {
+		return err
+	}
+
+	// Refunds the user was not credited for yet are credited first, refunding
+	// everything again credits what was not credited yet
+	refunds := s.pendingRefunds(orderID)
+	if payment.Status == StatusPaid {
+		refund, err := s.recordRefund(payment, amount)
+		if err != nil {
+			return err
+		}
+		refunds = append(refunds, refund)
+	} else if amount != 0 || len(refunds) == 0 {
+		return errNotRefundable.With("order_id", orderID).With("status", payment.Status)
+	}
+
+	return creditRefunds(s.urls, userID, orderID, refunds, func(refund *Refund) {
+		s.lock.Lock()
+		refund.Pending = false
+		s.lock.Unlock()
+	})
+}
+
+// Records the refund of the amount of the payment, or of the remaining amount
+// when it is 0. The refund is pending until the user was credited.
+func (s *memoryPaymentStore) recordRefund(payment *Payment, amount int) (*Refund, error) {
+	refundable := payment.Amount - payment.Refunded
+	if amount == 0 {
+		amount = refundable
+	}
+	if amount <= 0 || amount > refundable {
+		return nil, errRefundExceeds.With("order_id", payment.OrderID).With("refundable", refundable)
+	}
+
+	// The payment is cancelled once everything was refunded
+	payment.Refunded += amount
+	if amount == refundable {
+		payment.Status = StatusCancelled
+	}
+	s.put(payment)
+
+	refund := &Refund{
+		ID:        uuid.Must(uuid.NewV4()).String(),
+		OrderID:   payment.OrderID,
+		Amount:    amount,
+		Pending:   true,
+		CreatedAt: time.Now(),
+	}
+	s.lock.Lock()
+	s.refunds[payment.OrderID] = append(s.refunds[payment.OrderID], refund)
+	s.lock.Unlock()
+
+	return refund, nil
+}
+
+// Returns the refunds of the order the user was not credited for yet
+func (s *memoryPaymentStore) pendingRefunds(orderID string) []*Refund {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	refunds := []*Refund{}
+	for _, refund := range s.refunds[orderID] {
+		if refund.Pending {
+			refunds = append(refunds, refund)
+		}
+	}
+	return refunds
+}
+
+func (s *memoryPaymentStore) Find(_ context.Context, orderID string) (*Payment, []*Refund, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	payment, ok := s.payments[orderID]
+	if !ok {
+		return nil, nil, errPaymentNotFound.With("order_id", orderID)
+	}
+	c := *payment
+
+	refunds := make([]*Refund, len(s.refunds[orderID]))
+	for i, refund := range s.refunds[orderID] {
+		r := *refund
+		refunds[i] = &r
+	}
+
+	return &c, refunds, nil
+}
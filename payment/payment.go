@@ -1,7 +1,140 @@
 package payment
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	errwrap "github.com/pkg/errors"
+)
+
+// Status of a payment, a payment is reserved while the credit of the user is
+// held during checkout and cancelled once everything was refunded or the
+// reservation was released
+const (
+	StatusReserved  = "reserved"
+	StatusPaid      = "paid"
+	StatusCancelled = "cancelled"
+)
+
+// Errors of the payment service, returned with the ID of the order
+var (
+	errPaymentNotFound = errs.New(errs.NotFound, "payment not found")
+	errAlreadyPaid     = errs.New(errs.AlreadyPaid, "order was already paid")
+	errNotHeld         = errs.New(errs.InvalidState, "payment does not hold the reservation")
+	errNotRefundable   = errs.New(errs.InvalidState, "payment cannot be refunded")
+	errRefundExceeds   = errs.New(errs.BadRequest, "refund exceeds the refundable amount")
+	errRefundUser      = errs.New(errs.Conflict, "user did not pay for the order")
+	errNotReverted     = errs.New(errs.Internal, "payment was not reverted")
+)
+
+// Payment of an order, the amount is the total that was paid for the order and
+// reserved is the credit held for the checkout in progress. Refunds go to the
+// user that paid.
 type Payment struct {
-	OrderID string `sql:"type:uuid;primary_key"`
-	Amount  int
-	Status  string
+	OrderID       string    `sql:"type:uuid;primary_key" json:"order_id"`
+	UserID        string    `json:"user_id,omitempty"`
+	Amount        int       `json:"amount"`
+	Refunded      int       `gorm:"not null;default:0" json:"refunded"`
+	Reserved      int       `gorm:"not null;default:0" json:"reserved"`
+	ReservationID string    `json:"-"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `gorm:"not null;default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt     time.Time `gorm:"not null;default:CURRENT_TIMESTAMP" json:"updated_at"`
+}
+
+// Returns whether the credit of the reservation is still held for the payment
+func (p *Payment) holds(reservationID string) bool {
+	return p.Status == StatusReserved && p.ReservationID == reservationID
+}
+
+// Returns the user to refund the payment to, the given user has to be the user
+// that paid. Payments stored before the user was recorded are refunded to the
+// given user.
+func (p *Payment) refundUser(userID string) (string, error) {
+	if p.UserID == "" {
+		return userID, nil
+	} else if p.UserID != userID {
+		return "", errRefundUser.With("order_id", p.OrderID).With("user_id", userID)
+	}
+
+	return p.UserID, nil
+}
+
+// Entry in the ledger of refunds of a payment, a refund is recorded before the
+// user is credited and pending until the user was credited
+type Refund struct {
+	ID        string    `sql:"type:uuid;primary_key" json:"refund_id"`
+	OrderID   string    `sql:"type:uuid;index" json:"-"`
+	Amount    int       `json:"amount"`
+	Pending   bool      `gorm:"not null;default:false" json:"pending"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Full record of the payment of an order
+type statusResponse struct {
+	*Payment
+	Paid    bool      `json:"paid"`
+	Refunds []*Refund `json:"refunds"`
+}
+
+func newStatusResponse(payment *Payment, refunds []*Refund) *statusResponse {
+	return &statusResponse{
+		Payment: payment,
+		Paid:    payment.Status == StatusPaid,
+		Refunds: refunds,
+	}
+}
+
+type refundsResponse struct {
+	OrderID    string    `json:"order_id"`
+	Amount     int       `json:"amount"`
+	Refunded   int       `json:"refunded"`
+	Refundable int       `json:"refundable"`
+	Refunds    []*Refund `json:"refunds"`
+}
+
+func newRefundsResponse(payment *Payment, refunds []*Refund) *refundsResponse {
+	resp := &refundsResponse{
+		OrderID:  payment.OrderID,
+		Amount:   payment.Amount,
+		Refunded: payment.Refunded,
+		Refunds:  refunds,
+	}
+	// Payments cancelled before refunds were tracked have nothing refunded
+	if payment.Status == StatusPaid {
+		resp.Refundable = payment.Amount - payment.Refunded
+	}
+
+	return resp
+}
+
+// MigrateRedisValue converts a payment stored as a single JSON value to its
+// hash, ok is false when the value is not a payment.
+func MigrateRedisValue(orderID string, value string) (util.RedisHashes, bool, error) {
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal([]byte(value), &fields) != nil {
+		return nil, false, nil
+	}
+	if _, ok := fields["amount"]; !ok {
+		return nil, false, nil
+	}
+	if _, ok := fields["status"]; !ok {
+		return nil, false, nil
+	}
+
+	payment := &Payment{}
+	err := json.Unmarshal([]byte(value), payment)
+	if err != nil {
+		return nil, false, errwrap.Wrap(err, "malformed payment")
+	}
+	if payment.Status != StatusPaid {
+		payment.Status = StatusCancelled
+		payment.Refunded = payment.Amount
+	}
+
+	return util.RedisHashes{
+		paymentKey(orderID): {"amount": payment.Amount, "refunded": payment.Refunded, "status": payment.Status},
+	}, true, nil
 }
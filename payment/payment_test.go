@@ -0,0 +1,53 @@
+package payment
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefundsResponse(t *testing.T) {
+	resp := newRefundsResponse(&Payment{OrderID: "o", Amount: 10, Refunded: 4, Status: StatusPaid}, []*Refund{{Amount: 4}})
+	assert.Equal(t, 6, resp.Refundable)
+
+	resp = newRefundsResponse(&Payment{OrderID: "o", Amount: 10, Status: StatusCancelled}, []*Refund{})
+	assert.Equal(t, 0, resp.Refundable)
+}
+
+func TestStatusResponse(t *testing.T) {
+	b, err := json.Marshal(newStatusResponse(&Payment{OrderID: "o", Amount: 10, ReservationID: "r", Status: StatusPaid}, []*Refund{}))
+	assert.NoError(t, err)
+
+	fields := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(b, &fields))
+	assert.Equal(t, true, fields["paid"])
+	assert.Equal(t, "o", fields["order_id"])
+	assert.Equal(t, float64(10), fields["amount"])
+	assert.Contains(t, fields, "created_at")
+	assert.Contains(t, fields, "refunds")
+	assert.NotContains(t, fields, "reservation_id")
+}
+
+func TestPaymentHolds(t *testing.T) {
+	payment := &Payment{Reserved: 5, ReservationID: "r", Status: StatusReserved}
+	assert.True(t, payment.holds("r"))
+	assert.False(t, payment.holds("other"))
+
+	payment.Status = StatusPaid
+	assert.False(t, payment.holds("r"))
+}
+
+func TestMigrateRedisValue(t *testing.T) {
+	hashes, ok, err := MigrateRedisValue("o", `{"amount": 10, "status": "canceled"}`)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, util.RedisHashes{
+		"payment:o": {"amount": 10, "refunded": 10, "status": StatusCancelled},
+	}, hashes)
+
+	_, ok, err = MigrateRedisValue("s", `{"price": 5, "stock": 1}`)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -3,13 +3,12 @@ package payment
 import (
 	"context"
 	"errors"
-	"fmt"
 
 	"github.com/jinzhu/gorm"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	errwrap "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 )
 
 type postgresPaymentStore struct {
@@ -19,7 +18,7 @@ type postgresPaymentStore struct {
 
 func newPostgresPaymentStore(db *gorm.DB, urls *util.Services) *postgresPaymentStore {
 	// AutoMigrate structs to create or update database tables
-	err := db.AutoMigrate(&Payment{}).Error
+	err := db.AutoMigrate(&Payment{}, &Refund{}).Error
 	if err != nil {
 		panic(err)
 	}
@@ -30,49 +29,52 @@ func newPostgresPaymentStore(db *gorm.DB, urls *util.Services) *postgresPaymentS
 	}
 }
 
-func (s *postgresPaymentStore) Pay(_ context.Context, userID string, orderID string, amount int) error {
+// BeforeCreate generates the ID of the refund
+func (r *Refund) BeforeCreate(scope *gorm.Scope) error {
+	return util.GenerateID(scope)
+}
+
+func (s *postgresPaymentStore) Reserve(_ context.Context, userID string, orderID string, reservationID string, amount int) error {
 	var result error
 
 	err := s.db.Transaction(func(tx *gorm.DB) error {
 		exists := true
-		payment := &Payment{}
-		err := tx.Model(&Payment{}).
-			Where("order_id = ?", orderID).
-			First(payment).
-			Error
+		payment, err := lockPayment(tx, orderID)
 		if err == gorm.ErrRecordNotFound {
 			// Do nothing, record has to be created
 			exists = false
 		} else if err != nil {
 			result = util.INTERNAL_ERR
-			return errwrap.Wrap(err, "unable to retrieve payment status")
+			return err
 		}
 
 		// If record is found, check that it is not already paid
-		if exists && payment.Status == "paid" {
-			result = util.BAD_REQUEST
+		if exists && payment.Status == StatusPaid {
+			result = errAlreadyPaid.With("order_id", orderID)
 			return errors.New("order was already paid")
+		} else if exists && payment.holds(reservationID) {
+			return nil
 		}
 
-		c := fasthttp.Client{}
-		status, _, err := c.Post([]byte{}, fmt.Sprintf("%s/users/credit/subtract/%s/%d", s.urls.User, userID, amount), nil)
-		if err != nil {
-			result = util.INTERNAL_ERR
-			return errwrap.Wrap(err, "unable to subtract credit")
-		} else if status != fasthttp.StatusOK {
-			result = util.HTTPErrorToSAGAError(status)
-			return errors.New("error while subtracting credit")
+		result = reserveCredit(s.urls, userID, orderID, reservationID, amount)
+		if result != nil {
+			return errors.New("error while reserving credit")
 		}
 
-		payment = &Payment{OrderID: orderID, Amount: amount, Status: "paid"}
-		q := s.db.Model(&Payment{})
-		// If it exists, update, otherwise, create
+		// If it exists, update, otherwise, create. The amount that was paid before
+		// is only changed once the reservation is committed.
+		q := tx.Model(&Payment{})
 		if exists {
 			q = q.
-				Where("order_id = ?", payment.OrderID).
-				Update("status", payment.Status)
+				Where("order_id = ?", orderID).
+				Updates(map[string]interface{}{
+					"user_id":        userID,
+					"reserved":       amount,
+					"reservation_id": reservationID,
+					"status":         StatusReserved,
+				})
 		} else {
-			q = q.Create(payment)
+			q = q.Create(&Payment{OrderID: orderID, UserID: userID, Reserved: amount, ReservationID: reservationID, Status: StatusReserved})
 		}
 		err = q.Error
 		if err != nil {
@@ -83,85 +85,279 @@ func (s *postgresPaymentStore) Pay(_ context.Context, userID string, orderID str
 		return nil
 	})
 	if err != nil {
-		logrus.WithError(err).Error("unable to pay")
+		logrus.WithError(err).Error("unable to reserve payment")
+	}
+
+	return result
+}
+
+func (s *postgresPaymentStore) Commit(_ context.Context, orderID string, reservationID string) error {
+	var result error
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		payment, err := lockPayment(tx, orderID)
+		if err == gorm.ErrRecordNotFound {
+			result = errPaymentNotFound.With("order_id", orderID)
+			return errwrap.Wrap(err, "payment to commit not found")
+		} else if err != nil {
+			result = util.INTERNAL_ERR
+			return err
+		}
+
+		if payment.Status == StatusPaid && payment.ReservationID == reservationID {
+			return nil
+		} else if !payment.holds(reservationID) {
+			result = errNotHeld.With("order_id", orderID)
+			return errors.New("payment does not hold the reservation")
+		}
+
+		result = commitCredit(s.urls, reservationID)
+		if result != nil {
+			return errors.New("error while committing credit reservation")
+		}
+
+		err = tx.Model(&Payment{}).
+			Where("order_id = ?", orderID).
+			Updates(map[string]interface{}{
+				"amount":   gorm.Expr("amount + ?", payment.Reserved),
+				"reserved": 0,
+				"status":   StatusPaid,
+			}).
+			Error
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return errwrap.Wrap(err, "unable to update payment status")
+		}
+
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit payment")
 	}
 
 	return result
 }
 
-func (s *postgresPaymentStore) Cancel(_ context.Context, userID string, orderID string) error {
+func (s *postgresPaymentStore) Release(_ context.Context, orderID string, reservationID string) error {
 	var result error
 
 	err := s.db.Transaction(func(tx *gorm.DB) error {
-		// Retrieve the payment which needs to be cancelled
+		payment, err := lockPayment(tx, orderID)
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		} else if err != nil {
+			result = util.INTERNAL_ERR
+			return err
+		}
+
+		// Nothing is held for the reservation
+		if !payment.holds(reservationID) {
+			return nil
+		}
+
+		result = releaseCredit(s.urls, reservationID)
+		if result != nil {
+			return errors.New("error while releasing credit reservation")
+		}
+
+		err = tx.Model(&Payment{}).
+			Where("order_id = ?", orderID).
+			Updates(map[string]interface{}{
+				"reserved": 0,
+				"status":   StatusCancelled,
+			}).
+			Error
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return errwrap.Wrap(err, "unable to update payment status")
+		}
+
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to release payment")
+	}
+
+	return result
+}
+
+// Marks the order as paid in the prepared transaction of a two-phase commit
+// checkout, the credit is subtracted by the user service in its own transaction
+func prepareCheckout(tx *gorm.DB, order *util.OrderPayload) error {
+	payment, err := lockPayment(tx, order.OrderID)
+	if err == gorm.ErrRecordNotFound {
+		err = tx.Create(&Payment{OrderID: order.OrderID, UserID: order.UserID, Amount: order.Cost, Status: StatusPaid}).Error
+		if err != nil {
+			logrus.WithError(err).Error("unable to create payment")
+			return util.INTERNAL_ERR
+		}
+		return nil
+	} else if err != nil {
+		logrus.WithError(err).Error("unable to prepare checkout")
+		return util.INTERNAL_ERR
+	}
+
+	// A paid order or a checkout saga in progress cannot be paid again
+	if payment.Status == StatusPaid {
+		return errAlreadyPaid.With("order_id", order.OrderID)
+	} else if payment.Status != StatusCancelled {
+		return errs.New(errs.InvalidState, "payment is being checked out").With("order_id", order.OrderID)
+	}
+
+	err = tx.Model(&Payment{}).
+		Where("order_id = ?", order.OrderID).
+		Updates(map[string]interface{}{
+			"user_id": order.UserID,
+			"amount":  gorm.Expr("amount + ?", order.Cost),
+			"status":  StatusPaid,
+		}).
+		Error
+	if err != nil {
+		logrus.WithError(err).Error("unable to update payment status")
+		return util.INTERNAL_ERR
+	}
+
+	return nil
+}
+
+// Returns the payment and locks it until the end of the transaction
+func lockPayment(tx *gorm.DB, orderID string) (*Payment, error) {
+	payment := &Payment{}
+	err := util.ForUpdate(tx).
+		Model(&Payment{}).
+		Where("order_id = ?", orderID).
+		First(payment).
+		Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errwrap.Wrap(err, "unable to retrieve payment")
+	}
+
+	return payment, err
+}
+
+func (s *postgresPaymentStore) Refund(_ context.Context, userID string, orderID string, amount int) error {
+	var result error
+	refunds := []*Refund{}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Retrieve the payment which needs to be refunded
 		payment := &Payment{}
-		err := tx.Model(&Payment{}).
+		err := util.ForUpdate(tx).
+			Model(&Payment{}).
 			Where("order_id = ?", orderID).
 			First(payment).
 			Error
 		if err == gorm.ErrRecordNotFound {
-			result = util.BAD_REQUEST
-			return errwrap.Wrap(err, "payment to cancel not found")
+			result = errPaymentNotFound.With("order_id", orderID)
+			return errwrap.Wrap(err, "payment to refund not found")
 		} else if err != nil {
 			result = util.INTERNAL_ERR
-			return errwrap.Wrap(err, "unable to retrieve payment to cancel")
+			return errwrap.Wrap(err, "unable to retrieve payment to refund")
+		}
+
+		userID, result = payment.refundUser(userID)
+		if result != nil {
+			return errors.New("user did not pay for the order")
+		}
+
+		// Refunds the user was not credited for yet are credited first
+		err = tx.Model(&Refund{}).
+			Where("order_id = ? AND pending = ?", orderID, true).
+			Order("created_at").
+			Find(&refunds).
+			Error
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return errwrap.Wrap(err, "unable to retrieve pending refunds")
 		}
 
-		if payment.Status == "cancelled" {
-			result = util.BAD_REQUEST
-			return errors.New("payment already canceled")
+		if payment.Status != StatusPaid {
+			// Refunding everything again credits what was not credited yet
+			if amount == 0 && len(refunds) > 0 {
+				return nil
+			}
+			result = errNotRefundable.With("order_id", orderID).With("status", payment.Status)
+			return errors.New("payment already cancelled")
 		}
 
-		// Refund the credit to the user
-		c := fasthttp.Client{}
-		status, _, err := c.Post([]byte{}, fmt.Sprintf("%s/users/credit/add/%s/%d", s.urls.User, userID, payment.Amount), nil)
+		refundable := payment.Amount - payment.Refunded
+		if amount == 0 {
+			amount = refundable
+		}
+		if amount <= 0 || amount > refundable {
+			result = errRefundExceeds.With("order_id", orderID).With("refundable", refundable)
+			return errors.New("refund exceeds the refundable amount")
+		}
+
+		// Record the refund, the user is credited after the transaction
+		refund := &Refund{OrderID: orderID, Amount: amount, Pending: true}
+		err = tx.Create(refund).Error
 		if err != nil {
 			result = util.INTERNAL_ERR
-			return errwrap.Wrap(err, "unable to refund user credit")
-		} else if status != fasthttp.StatusOK {
-			result = util.HTTPErrorToSAGAError(status)
-			return errors.New("error refunding user credit")
+			return errwrap.Wrap(err, "unable to record refund")
 		}
+		refunds = append(refunds, refund)
 
-		// Update the status of the payment to "cancelled"
+		// The payment is cancelled once everything was refunded
+		paymentStatus := StatusPaid
+		if amount == refundable {
+			paymentStatus = StatusCancelled
+		}
 		err = tx.Model(&Payment{}).
 			Where("order_id = ?", orderID).
-			Update("status", "cancelled").
+			Updates(map[string]interface{}{
+				"refunded": gorm.Expr("refunded + ?", amount),
+				"status":   paymentStatus,
+			}).
 			Error
-		if err == gorm.ErrRecordNotFound {
-			result = util.BAD_REQUEST
-			return errwrap.Wrap(err, "unable to update payment status")
-		} else if err != nil {
+		if err != nil {
 			result = util.INTERNAL_ERR
-			return errwrap.Wrap(err, "unable to update payment status")
+			return errwrap.Wrap(err, "unable to update payment")
 		}
 
 		return nil
 	})
 	if err != nil {
-		logrus.WithError(err).Error("unable to cancel payment")
+		logrus.WithError(err).Error("unable to refund payment")
+	}
+	if result != nil {
+		return result
 	}
 
-	return result
+	return creditRefunds(s.urls, userID, orderID, refunds, func(refund *Refund) {
+		err := s.db.Model(&Refund{}).
+			Where("id = ?", refund.ID).
+			Update("pending", false).
+			Error
+		if err != nil {
+			logrus.WithError(err).WithField("refund_id", refund.ID).Error("unable to mark refund as credited")
+		}
+	})
 }
 
-func (s *postgresPaymentStore) PaymentStatus(ctx *fasthttp.RequestCtx, orderID string) {
+func (s *postgresPaymentStore) Find(_ context.Context, orderID string) (*Payment, []*Refund, error) {
 	payment := &Payment{}
 	err := s.db.Model(&Payment{}).
 		Where("order_id = ?", orderID).
+		First(payment).
 		Error
 	if err == gorm.ErrRecordNotFound {
-		util.NotFound(ctx)
-		return
+		return nil, nil, errPaymentNotFound.With("order_id", orderID)
 	} else if err != nil {
-		util.InternalServerError(ctx)
-		return
+		logrus.WithError(err).Error("unable to retrieve payment")
+		return nil, nil, util.INTERNAL_ERR
 	}
-	paid := "false"
 
-	if payment.Status == "paid" {
-		paid = "true"
+	refunds := []*Refund{}
+	err = s.db.Model(&Refund{}).
+		Where("order_id = ?", orderID).
+		Order("created_at").
+		Find(&refunds).
+		Error
+	if err != nil {
+		logrus.WithError(err).Error("unable to retrieve refunds")
+		return nil, nil, util.INTERNAL_ERR
 	}
 
-	util.JSONResponse(ctx, fasthttp.StatusOK, fmt.Sprintf("{\"paid\": %s}", paid))
+	return payment, refunds, nil
 }
@@ -2,15 +2,44 @@ package payment
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 )
 
+// Refunds ARGV[1] of the payment, or the remaining amount when it is 0, and adds
+// the refund to the ledger and to the pending refunds in KEYS[3]. Returns the
+// refunded amount, or false when the payment is not paid or the amount exceeds
+// the refundable amount.
+var refundPayment = redis.NewScript(`
+		if redis.call("HGET", KEYS[1], "status") ~= ARGV[4] then
+			return false
+		end
+		local refundable = tonumber(redis.call("HGET", KEYS[1], "amount")) - tonumber(redis.call("HGET", KEYS[1], "refunded") or 0)
+		local amount = tonumber(ARGV[1])
+		if amount == 0 then
+			amount = refundable
+		end
+		if amount <= 0 or amount > refundable then
+			return false
+		end
+		redis.call("HINCRBY", KEYS[1], "refunded", amount)
+		redis.call("HSET", KEYS[1], "updated_at", ARGV[3])
+		redis.call("RPUSH", KEYS[2], cjson.encode({refund_id = ARGV[2], amount = amount, created_at = ARGV[3]}))
+		redis.call("HSET", KEYS[3], ARGV[2], amount)
+		if amount == refundable then
+			redis.call("HSET", KEYS[1], "status", ARGV[5])
+		end
+		return amount
+	`)
+
 type redisPaymentStore struct {
 	store *redis.Client
 	urls  *util.Services
@@ -24,102 +53,259 @@ func newRedisPaymentStore(c *redis.Client, urls *util.Services) *redisPaymentSto
 	}
 }
 
-func (s *redisPaymentStore) Pay(ctx context.Context, userID string, orderID string, amount int) error {
-	exists := true
-	get := s.store.Get(ctx, orderID)
-	if get.Err() == redis.Nil {
-		exists = false
-	} else if get.Err() != nil {
-		logrus.WithError(get.Err()).Error("unable to retrieve payment")
-		return util.INTERNAL_ERR
+func (s *redisPaymentStore) Reserve(ctx context.Context, userID string, orderID string, reservationID string, amount int) error {
+	payment, err := s.get(ctx, orderID)
+	if err != nil && !errs.Is(err, errs.NotFound) {
+		return err
 	}
 
-	if exists && strings.Contains(get.Val(), "paid") {
+	if payment != nil && payment.Status == StatusPaid {
 		logrus.Info("order was already paid")
-		return util.BAD_REQUEST
+		return errAlreadyPaid.With("order_id", orderID)
+	} else if payment != nil && payment.holds(reservationID) {
+		return nil
 	}
 
-	//Call the user service to subtract the order amount from the users' credit
-	c := fasthttp.Client{}
-	status, _, err := c.Post([]byte{}, fmt.Sprintf("%s/users/credit/subtract/%s/%d", s.urls.User, userID, amount), nil)
+	err = reserveCredit(s.urls, userID, orderID, reservationID, amount)
 	if err != nil {
-		logrus.WithError(err).Error("unable to subtract credit")
-		return util.INTERNAL_ERR
-	} else if status != fasthttp.StatusOK {
-		return util.HTTPErrorToSAGAError(status)
+		return err
 	}
 
-	set := s.store.Set(ctx, orderID, fmt.Sprintf("{\"amount\": %d, \"status\": \"paid\"}", amount), 0)
-	if set.Err() != nil {
-		logrus.WithError(set.Err()).Error("unable to persist payment")
+	// The amount that was paid before is only changed once the reservation is committed
+	now := timestamp()
+	_, err = s.store.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, paymentKey(orderID), "created_at", now)
+		pipe.HSet(ctx, paymentKey(orderID), "user_id", userID, "reserved", amount, "reservation_id", reservationID, "status", StatusReserved, "updated_at", now)
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to persist payment reservation")
 		return util.INTERNAL_ERR
 	}
 
 	return nil
 }
 
-func (s *redisPaymentStore) Cancel(ctx context.Context, userID string, orderID string) error {
-	// Retrieve the payment which needs to be canceled
-	get := s.store.Get(ctx, orderID)
-	if get.Err() == redis.Nil {
-		return util.BAD_REQUEST
-	} else if get.Err() != nil {
-		logrus.WithError(get.Err()).Error("unable to retrieve payment to cancel")
+func (s *redisPaymentStore) Commit(ctx context.Context, orderID string, reservationID string) error {
+	payment, err := s.get(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	if payment.Status == StatusPaid && payment.ReservationID == reservationID {
+		return nil
+	} else if !payment.holds(reservationID) {
+		logrus.WithField("order_id", orderID).Info("payment does not hold the reservation")
+		return errNotHeld.With("order_id", orderID)
+	}
+
+	err = commitCredit(s.urls, reservationID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.store.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, paymentKey(orderID), "amount", int64(payment.Reserved))
+		pipe.HSet(ctx, paymentKey(orderID), "reserved", 0, "status", StatusPaid, "updated_at", timestamp())
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("order_id", orderID).Error("UNABLE TO PERSIST COMMITTED PAYMENT")
 		return util.INTERNAL_ERR
 	}
 
-	// get the amount and status in this format --> {"amount": int, "status": "string"}
-	json := get.Val()
+	return nil
+}
 
-	// code for retrieving only the status of the payment from the json (used to check if the payment has already been canceled)
-	// Retrieve the string between "\"status\": \"" and "\"}"
-	payment_status := strings.Split(strings.Split(json, "\"status\": \"")[1], "\"}")[0]
+func (s *redisPaymentStore) Release(ctx context.Context, orderID string, reservationID string) error {
+	payment, err := s.get(ctx, orderID)
+	if errs.Is(err, errs.NotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-	// code for retrieving only the amount of the payment from the json (used to refund credit to the user)
-	// Retrieve the string between "\"amount\": " and ","
-	amount := strings.Split(strings.Split(json, "\"amount\": ")[1], ",")[0]
+	// Nothing is held for the reservation
+	if !payment.holds(reservationID) {
+		return nil
+	}
 
-	if payment_status == "canceled" {
-		logrus.Info("payment is already canceled")
-		return util.BAD_REQUEST
+	err = releaseCredit(s.urls, reservationID)
+	if err != nil {
+		return err
 	}
 
-	// Refund the credit to the user
-	c := fasthttp.Client{}
-	status, _, err := c.Post([]byte{}, fmt.Sprintf("%s/users/credit/add/%s/%s", s.urls.User, userID, amount), nil)
+	err = s.store.HSet(ctx, paymentKey(orderID), "reserved", 0, "status", StatusCancelled, "updated_at", timestamp()).Err()
 	if err != nil {
-		logrus.WithError(err).Error("unable to refund credit to user")
+		logrus.WithError(err).Error("unable to persist released payment")
 		return util.INTERNAL_ERR
-	} else if status != fasthttp.StatusOK {
-		logrus.WithField("status", status).Error("error while refunding credit to user")
-		return util.HTTPErrorToSAGAError(status)
 	}
 
-	// Update the status of the payment to canceled
-	set := s.store.Set(ctx, orderID, fmt.Sprintf("{\"amount\": %s, \"status\": \"canceled\"}", amount), 0)
-	if set.Err() != nil {
-		logrus.WithError(set.Err()).Error("unable to update payment status")
+	return nil
+}
+
+func (s *redisPaymentStore) Refund(ctx context.Context, userID string, orderID string, amount int) error {
+	payment, err := s.get(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	// The user of a payment does not change
+	userID, err = payment.refundUser(userID)
+	if err != nil {
+		return err
+	}
+
+	// Record the refund first, so concurrent refunds cannot exceed the payment,
+	// the user is credited after
+	keys := []string{paymentKey(orderID), refundsKey(orderID), pendingRefundsKey(orderID)}
+	res := refundPayment.Run(ctx, s.store, keys, amount, uuid.Must(uuid.NewV4()).String(), timestamp(), StatusPaid, StatusCancelled)
+	refused := res.Err() == redis.Nil
+	if refused && amount != 0 {
+		logrus.WithField("order_id", orderID).Info("payment cannot be refunded")
+		return errNotRefundable.With("order_id", orderID)
+	} else if !refused && res.Err() != nil {
+		logrus.WithError(res.Err()).Error("unable to refund payment")
 		return util.INTERNAL_ERR
 	}
 
-	return nil
+	// Refunds the user was not credited for yet are credited with the new one,
+	// refunding everything again credits what was not credited yet
+	refunds, err := s.pendingRefunds(ctx, orderID)
+	if err != nil {
+		return err
+	} else if refused && len(refunds) == 0 {
+		logrus.WithField("order_id", orderID).Info("payment cannot be refunded")
+		return errNotRefundable.With("order_id", orderID)
+	}
+
+	return creditRefunds(s.urls, userID, orderID, refunds, func(refund *Refund) {
+		err := s.store.HDel(ctx, pendingRefundsKey(orderID), refund.ID).Err()
+		if err != nil {
+			logrus.WithError(err).WithField("refund_id", refund.ID).Error("unable to mark refund as credited")
+		}
+	})
+}
+
+// Returns the refunds of the order the user was not credited for yet
+func (s *redisPaymentStore) pendingRefunds(ctx context.Context, orderID string) ([]*Refund, error) {
+	pending, err := s.store.HGetAll(ctx, pendingRefundsKey(orderID)).Result()
+	if err != nil {
+		logrus.WithError(err).Error("unable to retrieve pending refunds")
+		return nil, util.INTERNAL_ERR
+	}
+
+	refunds := make([]*Refund, 0, len(pending))
+	for refundID, value := range pending {
+		amount, err := strconv.Atoi(value)
+		if err != nil {
+			logrus.WithError(err).WithField("refund_id", refundID).Error("malformed pending refund")
+			return nil, util.INTERNAL_ERR
+		}
+		refunds = append(refunds, &Refund{ID: refundID, OrderID: orderID, Amount: amount, Pending: true})
+	}
+
+	return refunds, nil
+}
+
+func (s *redisPaymentStore) Find(ctx context.Context, orderID string) (*Payment, []*Refund, error) {
+	payment, err := s.get(ctx, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := s.store.LRange(ctx, refundsKey(orderID), 0, -1).Result()
+	if err != nil {
+		logrus.WithError(err).Error("unable to retrieve refunds")
+		return nil, nil, util.INTERNAL_ERR
+	}
+
+	pending, err := s.store.HGetAll(ctx, pendingRefundsKey(orderID)).Result()
+	if err != nil {
+		logrus.WithError(err).Error("unable to retrieve pending refunds")
+		return nil, nil, util.INTERNAL_ERR
+	}
+
+	refunds := make([]*Refund, len(entries))
+	for i := range entries {
+		refunds[i] = &Refund{}
+		err = json.Unmarshal([]byte(entries[i]), refunds[i])
+		if err != nil {
+			logrus.WithError(err).WithField("refund", entries[i]).Error("malformed refund")
+			return nil, nil, util.INTERNAL_ERR
+		}
+		_, refunds[i].Pending = pending[refunds[i].ID]
+	}
+
+	return payment, refunds, nil
+}
+
+// Hash with the amount, reservation, status and timestamps of the payment of an
+// order
+func paymentKey(orderID string) string {
+	return fmt.Sprintf("payment:%s", orderID)
+}
+
+// List with the ledger of refunds of the payment of an order
+func refundsKey(orderID string) string {
+	return fmt.Sprintf("payment:%s:refunds", orderID)
+}
+
+// Hash with the amounts of the refunds of an order the user was not credited for
+func pendingRefundsKey(orderID string) string {
+	return fmt.Sprintf("payment:%s:pending", orderID)
 }
 
-func (s *redisPaymentStore) PaymentStatus(ctx *fasthttp.RequestCtx, orderID string) {
-	get := s.store.Get(ctx, orderID)
-	if get.Err() == redis.Nil {
-		util.NotFound(ctx)
-		return
-	} else if get.Err() != nil {
+// Returns a not found error when the payment does not exist
+func (s *redisPaymentStore) get(ctx context.Context, orderID string) (*Payment, error) {
+	get := s.store.HGetAll(ctx, paymentKey(orderID))
+	if get.Err() != nil {
 		logrus.WithError(get.Err()).Error("unable to retrieve payment")
-		util.InternalServerError(ctx)
-		return
+		return nil, util.INTERNAL_ERR
+	} else if len(get.Val()) == 0 {
+		return nil, errPaymentNotFound.With("order_id", orderID)
+	}
+
+	payment := &Payment{
+		OrderID:       orderID,
+		UserID:        get.Val()["user_id"],
+		ReservationID: get.Val()["reservation_id"],
+		Status:        get.Val()["status"],
+	}
+	// Payments stored before timestamps were recorded have none
+	times := map[string]*time.Time{"created_at": &payment.CreatedAt, "updated_at": &payment.UpdatedAt}
+	for field, value := range times {
+		v, ok := get.Val()[field]
+		if !ok {
+			continue
+		}
+
+		var err error
+		*value, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			logrus.WithError(err).WithField(field, v).Error("malformed payment")
+			return nil, util.INTERNAL_ERR
+		}
 	}
 
-	paid := "false"
-	if strings.Contains(get.Val(), "paid") {
-		paid = "true"
+	fields := map[string]*int{"amount": &payment.Amount, "refunded": &payment.Refunded, "reserved": &payment.Reserved}
+	for field, value := range fields {
+		v, ok := get.Val()[field]
+		if !ok {
+			continue
+		}
+
+		var err error
+		*value, err = strconv.Atoi(v)
+		if err != nil {
+			logrus.WithError(err).WithField(field, v).Error("malformed payment")
+			return nil, util.INTERNAL_ERR
+		}
 	}
 
-	util.JSONResponse(ctx, fasthttp.StatusOK, fmt.Sprintf("{\"paid\": %s}", paid))
+	return payment, nil
+}
+
+// Returns the current time in the format of the timestamps of payments and refunds
+func timestamp() string {
+	return time.Now().Format(time.RFC3339Nano)
 }
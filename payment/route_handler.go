@@ -3,91 +3,417 @@ package payment
 import (
 	"context"
 	"strconv"
-	"strings"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 )
 
 type paymentStore interface {
-	Pay(context.Context, string, string, int) error
-	Cancel(context.Context, string, string) error
-	PaymentStatus(*fasthttp.RequestCtx, string)
+	// Reserve holds the credit of the user for the order under the reservation,
+	// Commit pays the order with the held credit and Release lets it go
+	Reserve(context.Context, string, string, string, int) error
+	Commit(context.Context, string, string) error
+	Release(context.Context, string, string) error
+	// Refund refunds part of the payment to the user, an amount of 0 refunds
+	// everything that was not refunded yet
+	Refund(context.Context, string, string, int) error
+	// Find returns the payment of the order with its refunds, oldest first, or
+	// a not found error when the order has no payment
+	Find(context.Context, string) (*Payment, []*Refund, error)
 }
 
 type paymentRouteHandler struct {
 	paymentStore paymentStore
-	broker       *redis.Client
+	twoPhase     *util.TwoPhaseParticipant
+	dedup        util.DedupStore
+	transport    util.Transport
 	urls         util.Services
 }
 
 func NewRouteHandler(conn *util.Connection) *paymentRouteHandler {
 	var store paymentStore
+	var dedup util.DedupStore
 
 	switch conn.Backend {
-	case util.POSTGRES:
+	case util.POSTGRES, util.SQLITE:
 		store = newPostgresPaymentStore(conn.Postgres, &conn.URL)
+		dedup = util.NewPostgresDedupStore(conn.Postgres, conn.Checkout.DedupTTL)
 	case util.REDIS:
 		store = newRedisPaymentStore(conn.Redis, &conn.URL)
+		dedup = util.NewRedisDedupStore(conn.Redis, conn.Checkout.DedupTTL)
+	case util.MEMORY:
+		store = newMemoryPaymentStore(&conn.URL)
+		dedup = util.NewMemoryDedupStore()
 	}
 
 	h := &paymentRouteHandler{
 		paymentStore: store,
-		broker:       conn.Broker,
+		twoPhase:     util.NewTwoPhaseParticipant("payment", conn, prepareCheckout),
+		dedup:        dedup,
+		transport:    conn.Transport,
 		urls:         conn.URL,
 	}
 
+	err := h.transport.Sub(context.Background(), "payment", h.handleMessage)
+	if err != nil {
+		logrus.WithError(err).Panic("error subscribing to payment messages")
+	}
+
 	return h
 }
 
+// Receives messages sent over HTTP
 func (h *paymentRouteHandler) HandleMessage(ctx *fasthttp.RequestCtx) {
-	message := string(ctx.Request.Body())
+	err := h.handleMessage(ctx, string(ctx.Request.Body()))
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
+}
 
-	s := strings.Split(message, "#")
-	switch s[2] {
+// Returns an error when the message has to be delivered again, malformed
+// messages are dropped
+func (h *paymentRouteHandler) handleMessage(ctx context.Context, body string) error {
+	m, err := util.DecodeMessage(body)
+	if err != nil {
+		logrus.WithError(err).Error("unable to decode payment message")
+		return nil
+	} else if m.Order == nil {
+		logrus.WithField("track_id", m.TrackID).Error("payment message without order")
+		return nil
+	}
+
+	switch m.Type {
 	case util.MESSAGE_PAY:
-		h.PayOrder(ctx, s[0], s[1], s[3])
+		return h.PayOrder(ctx, m)
 	case util.MESSAGE_PAY_REVERT:
-		h.CancelOrder(ctx, s[3])
+		return h.CancelOrder(ctx, m)
+	case util.MESSAGE_PAY_COMMIT:
+		return h.CommitOrder(ctx, m)
+	case util.MESSAGE_REFUND:
+		return h.RefundOrder(ctx, m)
 	}
 
-	util.Ok(ctx)
+	return nil
 }
 
-func (h *paymentRouteHandler) PayOrder(ctx context.Context, orderChannelID string, tracker string, order string) {
-	userID := strings.Split(strings.Split(order, "\"user_id\": \"")[1], "\"")[0]
-	orderID := strings.Split(strings.Split(order, "\"order_id\": \"")[1], "\"")[0]
-	amount, _ := strconv.Atoi(strings.Split(strings.Split(order, "\"cost\": ")[1], "}")[0])
+// Reserves the credit for the order once per saga, a repeated message is
+// answered with the outcome of the first one. The order is paid once the stock
+// was reserved. Returns an error when the outcome was not recorded.
+func (h *paymentRouteHandler) PayOrder(ctx context.Context, m *util.Message) error {
+	logger := logrus.WithField("track_id", m.TrackID)
+	key := util.DedupKey("payment", m.TrackID, util.MESSAGE_PAY)
 
-	err := h.paymentStore.Pay(ctx, userID, orderID, amount)
+	outcome, err := h.dedup.Outcome(ctx, key)
 	if err != nil {
-		if err == util.INTERNAL_ERR {
-			util.PubToOrder(h.broker, ctx, orderChannelID, tracker, util.MESSAGE_ORDER_INTERNAL)
+		logger.WithError(err).Error("unable to check for duplicate payment")
+		util.PubToOrder(h.transport, ctx, m.Next(util.MESSAGE_ORDER_INTERNAL))
+		return err
+	}
+
+	var cause, retry error
+	if outcome != "" {
+		logger.Info("replaying outcome of duplicate payment message")
+	} else {
+		outcome, cause = h.reserve(ctx, m)
+
+		// Internal errors are not recorded, so a redelivered message is retried
+		if outcome == util.MESSAGE_ORDER_INTERNAL {
+			retry = cause
 		} else {
-			util.PubToOrder(h.broker, ctx, orderChannelID, tracker, util.MESSAGE_ORDER_BADREQUEST)
+			recorded, err := h.dedup.Record(ctx, key, outcome)
+			if err != nil {
+				logger.WithError(err).Error("unable to record payment outcome")
+				retry = err
+			} else {
+				// The saga was reverted while reserving, release the credit
+				if outcome == util.MESSAGE_ORDER_PAID && recorded != util.MESSAGE_ORDER_PAID {
+					h.release(ctx, m)
+				}
+				if recorded != outcome {
+					cause = nil
+				}
+				outcome = recorded
+			}
 		}
+	}
 
-		return
+	util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+	if outcome == util.MESSAGE_ORDER_PAID && !m.Orchestrated() {
+		util.Pub(h.transport, ctx, "stock", m.Next(util.MESSAGE_STOCK))
+	}
+
+	return retry
+}
+
+// Reverts the payment of a saga, when the credit was not reserved or committed
+// yet that is blocked. Held credit is released, a committed payment refunded.
+// Returns an error when the payment has to be reverted again.
+func (h *paymentRouteHandler) CancelOrder(ctx context.Context, m *util.Message) error {
+	reverted := h.revert(ctx, m)
+
+	// The order service waits for the compensation of an orchestrated saga
+	if m.Orchestrated() {
+		outcome := util.MESSAGE_ORDER_SUCCESS
+		if !reverted {
+			outcome = util.MESSAGE_ORDER_INTERNAL
+		}
+		util.PubToOrder(h.transport, ctx, m.Next(outcome))
+	}
+
+	if !reverted {
+		return errNotReverted.With("order_id", m.Order.OrderID)
+	}
+	return nil
+}
+
+// Returns false when the payment has to be reverted again
+func (h *paymentRouteHandler) revert(ctx context.Context, m *util.Message) bool {
+	logger := logrus.WithField("track_id", m.TrackID)
+
+	// Make sure a payment message arriving after the revert is rejected
+	payOutcome, err := h.dedup.Record(ctx, util.DedupKey("payment", m.TrackID, util.MESSAGE_PAY), util.MESSAGE_ORDER_BADREQUEST)
+	if err != nil {
+		logger.WithError(err).Error("unable to block payment of reverted saga")
+		return false
+	} else if payOutcome != util.MESSAGE_ORDER_PAID {
+		// Nothing was reserved in this saga
+		return true
+	}
+
+	// Make sure a commit message arriving after the revert is rejected
+	commitOutcome, err := h.dedup.Record(ctx, util.DedupKey("payment", m.TrackID, util.MESSAGE_PAY_COMMIT), util.MESSAGE_ORDER_BADREQUEST)
+	if err != nil {
+		logger.WithError(err).Error("unable to block payment commit of reverted saga")
+		return false
+	} else if commitOutcome != util.MESSAGE_ORDER_SUCCESS {
+		// Nothing was paid in this saga, only release the held credit
+		h.release(ctx, m)
+		return true
+	}
+
+	key := util.DedupKey("payment", m.TrackID, util.MESSAGE_PAY_REVERT)
+	outcome, err := h.dedup.Outcome(ctx, key)
+	if err != nil {
+		logger.WithError(err).Error("unable to check for duplicate payment revert")
+		return false
+	} else if outcome != "" {
+		logger.Info("payment of saga was already reverted")
+		return true
+	}
+
+	if !h.cancel(ctx, m.Order) {
+		return false
+	}
+
+	_, err = h.dedup.Record(ctx, key, util.OUTCOME_DONE)
+	if err != nil {
+		logger.WithError(err).Error("unable to record payment revert")
+	}
+
+	return true
+}
+
+// Pays the order with the credit reserved in the saga once the stock was
+// reserved, a repeated message is answered with the outcome of the first one.
+// When the payment fails the credit and stock are released. Returns an error
+// when the outcome was not recorded.
+func (h *paymentRouteHandler) CommitOrder(ctx context.Context, m *util.Message) error {
+	logger := logrus.WithField("track_id", m.TrackID)
+	key := util.DedupKey("payment", m.TrackID, util.MESSAGE_PAY_COMMIT)
+
+	var cause, retry error
+	outcome, err := h.dedup.Outcome(ctx, key)
+	if err != nil {
+		logger.WithError(err).Error("unable to check for duplicate payment commit")
+		outcome = util.MESSAGE_ORDER_INTERNAL
+		retry = err
+	} else if outcome != "" {
+		logger.Info("replaying outcome of duplicate payment commit message")
+	} else {
+		outcome, cause = h.commit(ctx, m)
+
+		// Internal errors are not recorded, so a redelivered message is retried
+		if outcome == util.MESSAGE_ORDER_INTERNAL {
+			retry = cause
+		} else {
+			recorded, err := h.dedup.Record(ctx, key, outcome)
+			if err != nil {
+				logger.WithError(err).Error("unable to record payment commit outcome")
+				retry = err
+			} else {
+				// The saga was reverted while committing, undo the payment
+				if outcome == util.MESSAGE_ORDER_SUCCESS && recorded != util.MESSAGE_ORDER_SUCCESS {
+					h.cancel(ctx, m.Order)
+				}
+				if recorded != outcome {
+					cause = nil
+				}
+				outcome = recorded
+			}
+		}
+	}
+
+	// The order service issues the next step of an orchestrated saga
+	if m.Orchestrated() {
+		util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+		return retry
+	}
+
+	// The stock service commits the reserved stock and reports the outcome of the
+	// checkout
+	if outcome == util.MESSAGE_ORDER_SUCCESS {
+		util.Pub(h.transport, ctx, "stock", m.Next(util.MESSAGE_STOCK_COMMIT))
+		return retry
+	}
+
+	h.release(ctx, m)
+	util.Pub(h.transport, ctx, "stock", m.Next(util.MESSAGE_STOCK_REVERT))
+	util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+	return retry
+}
+
+// Refunds the payment of a cancelled order once per saga, a repeated message is
+// answered with the outcome of the first one. Returns an error when the outcome
+// was not recorded.
+func (h *paymentRouteHandler) RefundOrder(ctx context.Context, m *util.Message) error {
+	logger := logrus.WithField("track_id", m.TrackID)
+	key := util.DedupKey("payment", m.TrackID, util.MESSAGE_REFUND)
+
+	outcome, err := h.dedup.Outcome(ctx, key)
+	if err != nil {
+		logger.WithError(err).Error("unable to check for duplicate refund")
+		util.PubToOrder(h.transport, ctx, m.Next(util.MESSAGE_ORDER_INTERNAL))
+		return err
+	}
+
+	var cause error
+	if outcome != "" {
+		logger.Info("replaying outcome of duplicate refund message")
+	} else {
+		outcome = util.MESSAGE_ORDER_REFUNDED
+		cause = h.paymentStore.Refund(ctx, m.Order.UserID, m.Order.OrderID, 0)
+		if cause != nil {
+			outcome = util.ErrorOutcome(cause)
+		}
+		if outcome == util.MESSAGE_ORDER_INTERNAL {
+			// Internal errors are not recorded, so a redelivered message is retried
+			util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+			return cause
+		}
+
+		outcome, err = h.dedup.Record(ctx, key, outcome)
+		if err != nil {
+			logger.WithError(err).Error("unable to record refund outcome")
+			util.PubToOrder(h.transport, ctx, m.Next(util.MESSAGE_ORDER_INTERNAL))
+			return err
+		}
+	}
+
+	util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+	if outcome == util.MESSAGE_ORDER_REFUNDED {
+		util.Pub(h.transport, ctx, "stock", m.Next(util.MESSAGE_RESTOCK))
+	}
+
+	return nil
+}
+
+// Reserves the credit for the order, the track ID of the saga is the ID of the
+// reservation. Returns the outcome and the error that caused a failure.
+func (h *paymentRouteHandler) reserve(ctx context.Context, m *util.Message) (string, error) {
+	err := h.paymentStore.Reserve(ctx, m.Order.UserID, m.Order.OrderID, m.TrackID, m.Order.Cost)
+	if err != nil {
+		return util.ErrorOutcome(err), err
+	}
+
+	return util.MESSAGE_ORDER_PAID, nil
+}
+
+func (h *paymentRouteHandler) commit(ctx context.Context, m *util.Message) (string, error) {
+	err := h.paymentStore.Commit(ctx, m.Order.OrderID, m.TrackID)
+	if err != nil {
+		return util.ErrorOutcome(err), err
 	}
 
-	util.Pub(h.urls.Stock, "stock", orderChannelID, tracker, util.MESSAGE_STOCK, order)
+	return util.MESSAGE_ORDER_SUCCESS, nil
 }
 
-func (h *paymentRouteHandler) CancelOrder(ctx context.Context, order string) {
-	userID := strings.Split(strings.Split(order, "\"user_id\": \"")[1], "\"")[0]
-	orderID := strings.Split(strings.Split(order, "\"order_id\": \"")[1], "\"")[0]
+// Releases the credit held in the saga, an expired reservation holds nothing
+func (h *paymentRouteHandler) release(ctx context.Context, m *util.Message) {
+	err := h.paymentStore.Release(ctx, m.Order.OrderID, m.TrackID)
+	if err != nil {
+		logrus.WithError(err).WithField("track_id", m.TrackID).Error("unable to release credit reservation")
+	}
+}
 
-	err := h.paymentStore.Cancel(ctx, userID, orderID)
+func (h *paymentRouteHandler) cancel(ctx context.Context, order *util.OrderPayload) bool {
+	err := h.paymentStore.Refund(ctx, order.UserID, order.OrderID, 0)
 	if err != nil {
 		logrus.WithError(err).Info("unable to revert order payment")
+		return false
 	}
+
+	return true
 }
 
-// Return the status of a payment
+// Returns the payment of an order with its status and refunds
 func (h *paymentRouteHandler) GetPaymentStatus(ctx *fasthttp.RequestCtx) {
 	orderID := ctx.UserValue("order_id").(string)
 
-	h.paymentStore.PaymentStatus(ctx, orderID)
+	payment, refunds, err := h.paymentStore.Find(ctx, orderID)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.JSONResponse(ctx, fasthttp.StatusOK, newStatusResponse(payment, refunds))
+}
+
+// Refunds part of the payment of an order
+func (h *paymentRouteHandler) RefundPayment(ctx *fasthttp.RequestCtx) {
+	userID := ctx.UserValue("user_id").(string)
+	orderID := ctx.UserValue("order_id").(string)
+	amount, err := strconv.Atoi(ctx.UserValue("amount").(string))
+	if err != nil || amount <= 0 {
+		util.ErrorResponse(ctx, errs.New(errs.BadRequest, "amount should be a positive integer"))
+		return
+	}
+
+	err = h.paymentStore.Refund(ctx, userID, orderID, amount)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
+}
+
+// Returns the refunds of the payment of an order
+func (h *paymentRouteHandler) GetRefunds(ctx *fasthttp.RequestCtx) {
+	orderID := ctx.UserValue("order_id").(string)
+
+	payment, refunds, err := h.paymentStore.Find(ctx, orderID)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.JSONResponse(ctx, fasthttp.StatusOK, newRefundsResponse(payment, refunds))
+}
+
+// Prepares the payment of the order in the body for a two-phase commit checkout
+func (h *paymentRouteHandler) PrepareTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Prepare(ctx)
+}
+
+func (h *paymentRouteHandler) CommitTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Commit(ctx)
+}
+
+func (h *paymentRouteHandler) AbortTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Abort(ctx)
 }
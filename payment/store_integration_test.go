@@ -0,0 +1,268 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// These tests run against a live database, set REDI_TEST_POSTGRES to a postgres
+// connection string or REDI_TEST_REDIS to a redis address to run them.
+
+// Accepts every credit change, as a user service with enough credit would
+func fakeUserService() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// User service that fails the next refunds after crediting them, as when the
+// response is lost, and records the entry IDs of the refunds it was sent
+type refundingUserService struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	fail    int
+	entries []string
+}
+
+func newRefundingUserService() *refundingUserService {
+	users := &refundingUserService{}
+	users.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users.lock.Lock()
+		defer users.lock.Unlock()
+
+		if strings.HasPrefix(r.URL.Path, "/users/credit/add/") {
+			users.entries = append(users.entries, r.URL.Query().Get("entry_id"))
+			if users.fail > 0 {
+				users.fail--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return users
+}
+
+func (u *refundingUserService) failNext(n int) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.fail = n
+}
+
+func (u *refundingUserService) refundEntries() []string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return append([]string{}, u.entries...)
+}
+
+func TestPostgresPaymentStatus(t *testing.T) {
+	dsn := os.Getenv("REDI_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("REDI_TEST_POSTGRES is not set")
+	}
+
+	db, err := gorm.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\"").Error)
+
+	users := fakeUserService()
+	defer users.Close()
+
+	testPaymentStatus(t, newPostgresPaymentStore(db, &util.Services{User: users.URL}))
+}
+
+func TestRedisPaymentStatus(t *testing.T) {
+	addr := os.Getenv("REDI_TEST_REDIS")
+	if addr == "" {
+		t.Skip("REDI_TEST_REDIS is not set")
+	}
+
+	c := redis.NewClient(&redis.Options{Addr: addr})
+	defer c.Close()
+	require.NoError(t, c.Ping(context.Background()).Err())
+
+	users := fakeUserService()
+	defer users.Close()
+
+	testPaymentStatus(t, newRedisPaymentStore(c, &util.Services{User: users.URL}))
+}
+
+// The memory store needs no database and always runs
+func TestMemoryPaymentStatus(t *testing.T) {
+	users := fakeUserService()
+	defer users.Close()
+
+	testPaymentStatus(t, newMemoryPaymentStore(&util.Services{User: users.URL}))
+}
+
+// Sqlite needs no server, the postgres store runs on it in every test run
+func TestSQLiteRefundRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "payment.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	users := newRefundingUserService()
+	defer users.Close()
+
+	testRefundRetried(t, newPostgresPaymentStore(db, &util.Services{User: users.URL}), users)
+}
+
+func TestRedisRefundRetried(t *testing.T) {
+	addr := os.Getenv("REDI_TEST_REDIS")
+	if addr == "" {
+		t.Skip("REDI_TEST_REDIS is not set")
+	}
+
+	c := redis.NewClient(&redis.Options{Addr: addr})
+	defer c.Close()
+	require.NoError(t, c.Ping(context.Background()).Err())
+
+	users := newRefundingUserService()
+	defer users.Close()
+
+	testRefundRetried(t, newRedisPaymentStore(c, &util.Services{User: users.URL}), users)
+}
+
+func TestMemoryRefundRetried(t *testing.T) {
+	users := newRefundingUserService()
+	defer users.Close()
+
+	testRefundRetried(t, newMemoryPaymentStore(&util.Services{User: users.URL}), users)
+}
+
+// A refund the user service failed for stays recorded and is credited again with
+// the same entry ID when the refund is retried
+func testRefundRetried(t *testing.T, store paymentStore, users *refundingUserService) {
+	ctx := context.Background()
+	orderID := uuid.Must(uuid.NewV4()).String()
+	reservationID := uuid.Must(uuid.NewV4()).String()
+	require.NoError(t, store.Reserve(ctx, "user", orderID, reservationID, 10))
+	require.NoError(t, store.Commit(ctx, orderID, reservationID))
+
+	users.failNext(1)
+	err := store.Refund(ctx, "user", orderID, 0)
+	assert.True(t, errs.Is(err, errs.UpstreamUnavailable), err)
+
+	payment, refunds, err := store.Find(ctx, orderID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelled, payment.Status)
+	assert.Equal(t, 10, payment.Refunded)
+	require.Len(t, refunds, 1)
+	assert.True(t, refunds[0].Pending)
+
+	require.NoError(t, store.Refund(ctx, "user", orderID, 0))
+	assert.Equal(t, []string{refunds[0].ID, refunds[0].ID}, users.refundEntries())
+
+	payment, refunds, err = store.Find(ctx, orderID)
+	require.NoError(t, err)
+	assert.Equal(t, 10, payment.Refunded)
+	require.Len(t, refunds, 1)
+	assert.False(t, refunds[0].Pending)
+
+	// Everything was refunded and credited
+	err = store.Refund(ctx, "user", orderID, 0)
+	assert.True(t, errs.Is(err, errs.InvalidState), err)
+	assert.Len(t, users.refundEntries(), 2)
+}
+
+func testPaymentStatus(t *testing.T, store paymentStore) {
+	ctx := context.Background()
+	h := &paymentRouteHandler{paymentStore: store}
+	orderID := uuid.Must(uuid.NewV4()).String()
+	reservationID := uuid.Must(uuid.NewV4()).String()
+
+	// The handler is served, the stores use the request as context
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = fasthttp.Serve(ln, func(c *fasthttp.RequestCtx) {
+			c.SetUserValue("order_id", orderID)
+			h.GetPaymentStatus(c)
+		})
+	}()
+	client := util.NewLocalClient(ln)
+
+	status := func() (int, *statusResponse) {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.SetRequestURI("http://localhost/payment/status/" + orderID)
+		c := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(c)
+		require.NoError(t, client.Do(req, c))
+
+		resp := &statusResponse{}
+		if c.StatusCode() == fasthttp.StatusOK {
+			require.NoError(t, json.Unmarshal(c.Body(), resp))
+		}
+		return c.StatusCode(), resp
+	}
+
+	code, _ := status()
+	assert.Equal(t, fasthttp.StatusNotFound, code)
+
+	require.NoError(t, store.Reserve(ctx, "user", orderID, reservationID, 10))
+	code, resp := status()
+	assert.Equal(t, fasthttp.StatusOK, code)
+	assert.False(t, resp.Paid)
+	assert.Equal(t, StatusReserved, resp.Status)
+	assert.Equal(t, 10, resp.Reserved)
+	assert.False(t, resp.CreatedAt.IsZero())
+	assert.Equal(t, "user", resp.UserID)
+
+	require.NoError(t, store.Commit(ctx, orderID, reservationID))
+	code, resp = status()
+	assert.Equal(t, fasthttp.StatusOK, code)
+	assert.True(t, resp.Paid)
+	assert.Equal(t, orderID, resp.OrderID)
+	assert.Equal(t, 10, resp.Amount)
+	assert.Equal(t, 0, resp.Reserved)
+	assert.False(t, resp.UpdatedAt.Before(resp.CreatedAt))
+	assert.Empty(t, resp.Refunds)
+
+	// Only the user that paid can be refunded
+	err := store.Refund(ctx, "other", orderID, 4)
+	assert.True(t, errs.Is(err, errs.Conflict), err)
+
+	require.NoError(t, store.Refund(ctx, "user", orderID, 4))
+	code, resp = status()
+	assert.Equal(t, fasthttp.StatusOK, code)
+	assert.True(t, resp.Paid)
+	assert.Equal(t, 4, resp.Refunded)
+	if assert.Len(t, resp.Refunds, 1) {
+		assert.Equal(t, 4, resp.Refunds[0].Amount)
+	}
+
+	require.NoError(t, store.Refund(ctx, "user", orderID, 0))
+	code, resp = status()
+	assert.Equal(t, fasthttp.StatusOK, code)
+	assert.False(t, resp.Paid)
+	assert.Equal(t, StatusCancelled, resp.Status)
+	assert.Len(t, resp.Refunds, 2)
+}
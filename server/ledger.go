@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+
+	"github.com/martijnjanssen/redi-shop/user"
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// CheckLedger recomputes the credit of every user from the ledger and reports
+// the users whose credit differs, it exits with an error when there are any.
+func CheckLedger() {
+	var mismatches []*user.Mismatch
+	var err error
+
+	switch util.GetConnectionType(viper.GetString("backend")) {
+	case util.POSTGRES:
+		db := connectPostgres()
+		defer func() {
+			if err := db.Close(); err != nil {
+				logrus.WithError(err).Error("unable to close database connection")
+			}
+		}()
+
+		mismatches, err = user.CheckPostgresLedger(db)
+
+	case util.REDIS:
+		client := connectRedis()
+		defer func() {
+			if err := client.Close(); err != nil {
+				logrus.WithError(err).Error("unable to close redis connection")
+			}
+		}()
+
+		mismatches, err = user.CheckRedisLedger(context.Background(), client)
+
+	case util.SQLITE:
+		db := connectSQLite(viper.GetString("sqlite.directory"), "user")
+		defer func() {
+			if err := db.Close(); err != nil {
+				logrus.WithError(err).Error("unable to close database connection")
+			}
+		}()
+
+		mismatches, err = user.CheckPostgresLedger(db)
+
+	case util.MEMORY:
+		logrus.Fatal("the memory backend keeps no ledger between runs")
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to check ledger")
+	}
+
+	for _, m := range mismatches {
+		logrus.WithField("user_id", m.UserID).
+			WithField("credit", m.Credit).
+			WithField("ledger", m.Ledger).
+			Warn("credit does not match ledger")
+	}
+
+	if len(mismatches) > 0 {
+		logrus.WithField("mismatches", len(mismatches)).Fatal("Ledger check found mismatches")
+	}
+	logrus.Info("Ledger check finished, all credit matches the ledger")
+}
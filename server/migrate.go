@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/martijnjanssen/redi-shop/order"
+	"github.com/martijnjanssen/redi-shop/payment"
+	"github.com/martijnjanssen/redi-shop/stock"
+	"github.com/martijnjanssen/redi-shop/user"
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Moves the value in KEYS[1] to the hashes in the other keys, but only when it
+// was not changed since it was read. ARGV[1] is the value that was read, it is
+// followed by the number of fields of every hash and the field value pairs.
+var moveToHashes = redis.NewScript(`
+		if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+			return false
+		end
+		local arg = 2
+		for k = 2, #KEYS do
+			local n = tonumber(ARGV[arg])
+			for i = 1, n do
+				redis.call("HSET", KEYS[k], ARGV[arg + 2 * i - 1], ARGV[arg + 2 * i])
+			end
+			arg = arg + 2 * n + 1
+		end
+		return redis.call("DEL", KEYS[1])
+	`)
+
+// MigrateRedis moves orders, stock items and payments stored as a single value,
+// in JSON or the legacy hand-written format, to their hashes. The credit of
+// users without a ledger is recorded as their opening balance.
+func MigrateRedis() {
+	ctx := context.Background()
+	client := connectRedis()
+	defer func() {
+		if err := client.Close(); err != nil {
+			logrus.WithError(err).Error("unable to close redis connection")
+		}
+	}()
+
+	migrated := 0
+	var cursor uint64
+	for {
+		scan := client.Scan(ctx, cursor, "*", 1000)
+		keys, next, err := scan.Result()
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to scan keys")
+		}
+
+		for _, key := range keys {
+			if migrateKey(ctx, client, key) {
+				migrated++
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	opened, err := user.OpenRedisLedgers(ctx, client)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to record opening balances")
+	}
+
+	logrus.WithField("migrated", migrated).WithField("opened", opened).Info("Migration finished")
+}
+
+// MigratePostgres moves the items of orders from the legacy items column to the
+// order_items table.
+func MigratePostgres() {
+	db := connectPostgres()
+	defer func() {
+		if err := db.Close(); err != nil {
+			logrus.WithError(err).Error("unable to close database connection")
+		}
+	}()
+
+	migrated, err := order.MigratePostgres(db)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to migrate orders")
+	}
+
+	logrus.WithField("migrated", migrated).Info("Migration finished")
+}
+
+func migrateKey(ctx context.Context, client *redis.Client, key string) bool {
+	logger := logrus.WithField("key", key)
+
+	// Prefixed keys were always stored in their current format
+	if strings.Contains(key, ":") {
+		return false
+	}
+
+	get := client.Get(ctx, key)
+	if get.Err() != nil {
+		// Not a string value, e.g. a set
+		return false
+	}
+	value := get.Val()
+
+	migrators := []func(string, string) (util.RedisHashes, bool, error){
+		order.MigrateRedisValue,
+		stock.MigrateRedisValue,
+		payment.MigrateRedisValue,
+	}
+	for _, migrate := range migrators {
+		hashes, ok, err := migrate(key, value)
+		if err != nil {
+			logger.WithError(err).Error("unable to migrate value")
+			return false
+		} else if !ok {
+			continue
+		}
+
+		keys := []string{key}
+		args := []interface{}{value}
+		for hash, fields := range hashes {
+			keys = append(keys, hash)
+			args = append(args, len(fields))
+			for field, v := range fields {
+				args = append(args, field, v)
+			}
+		}
+
+		err = moveToHashes.Run(ctx, client, keys, args...).Err()
+		if err == redis.Nil {
+			logger.Warn("value changed during migration, skipping")
+			return false
+		} else if err != nil {
+			logger.WithError(err).Error("unable to store migrated value")
+			return false
+		}
+
+		return true
+	}
+
+	return false
+}
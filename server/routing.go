@@ -11,72 +11,131 @@ import (
 	"github.com/martijnjanssen/redi-shop/stock"
 	"github.com/martijnjanssen/redi-shop/user"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
 )
 
-// returns the router with all user routes
-func getUserRouter(conn *util.Connection) fasthttp.RequestHandler {
+// adds all user routes to the router
+func addUserRoutes(r *router.Router, conn *util.Connection) {
 	h := user.NewRouteHandler(conn)
 
-	r := router.New()
-	r.PanicHandler = panicHandler
-
 	r.POST("/users/create/", h.CreateUser)
 	r.DELETE("/users/remove/{user_id}", h.RemoveUser)
 	r.GET("/users/find/{user_id}", h.FindUser)
 
 	r.POST("/users/credit/subtract/{user_id}/{amount}", h.SubtractUserCredit)
 	r.POST("/users/credit/add/{user_id}/{amount}", h.AddUserCredit)
-
-	return r.Handler
+	r.GET("/users/ledger/{user_id}", h.GetLedger)
+
+	r.POST("/users/credit/reserve/{user_id}/{reservation_id}/{amount}", h.ReserveCredit)
+	r.POST("/users/credit/commit/{reservation_id}", h.CommitCredit)
+	r.POST("/users/credit/release/{reservation_id}", h.ReleaseCredit)
+
+	// Only postgres supports the prepared transactions of a two-phase commit
+	if conn.Backend == util.POSTGRES {
+		r.POST("/users/2pc/prepare/{tx_id}", h.PrepareTransaction)
+		r.POST("/users/2pc/commit/{tx_id}", h.CommitTransaction)
+		r.POST("/users/2pc/abort/{tx_id}", h.AbortTransaction)
+	}
 }
 
-func getOrderRouter(conn *util.Connection) fasthttp.RequestHandler {
+func addOrderRoutes(r *router.Router, conn *util.Connection) {
 	h := order.NewRouteHandler(conn)
 
-	r := router.New()
-	r.PanicHandler = panicHandler
-
 	r.POST("/orders/create/{user_id}", h.CreateOrder)
 	r.DELETE("/orders/remove/{order_id}", h.RemoveOrder)
 	r.GET("/orders/find/{order_id}", h.FindOrder)
 	r.POST("/orders/additem/{order_id}/{item_id}", h.AddOrderItem)
 	r.DELETE("/orders/removeitem/{order_id}/{item_id}", h.RemoveOrderItem)
 	r.POST("/orders/checkout/{order_id}", h.CheckoutOrder)
-
-	return r.Handler
+	r.POST("/orders/cancel/{order_id}", h.CancelOrder)
 }
 
-func getStockRouter(conn *util.Connection) fasthttp.RequestHandler {
+func addStockRoutes(r *router.Router, conn *util.Connection) {
 	h := stock.NewRouteHandler(conn)
 
-	r := router.New()
-	r.PanicHandler = panicHandler
-
 	r.GET("/stock/find/{item_id}", h.FindStockItem)
 	r.POST("/stock/subtract/{item_id}/{number}", h.SubtractStockNumber)
 	r.POST("/stock/add/{item_id}/{number}", h.AddStockNumber)
 	r.POST("/stock/item/create/{price}", h.CreateStockItem)
 	r.POST("/stock/message", h.HandleMessage)
 
-	return r.Handler
+	// Only postgres supports the prepared transactions of a two-phase commit
+	if conn.Backend == util.POSTGRES {
+		r.POST("/stock/2pc/prepare/{tx_id}", h.PrepareTransaction)
+		r.POST("/stock/2pc/commit/{tx_id}", h.CommitTransaction)
+		r.POST("/stock/2pc/abort/{tx_id}", h.AbortTransaction)
+	}
 }
 
-func getPaymentRouter(conn *util.Connection) fasthttp.RequestHandler {
+func addPaymentRoutes(r *router.Router, conn *util.Connection) {
 	h := payment.NewRouteHandler(conn)
 
+	r.GET("/payment/status/{order_id}", h.GetPaymentStatus)
+	r.POST("/payment/refund/{user_id}/{order_id}/{amount}", h.RefundPayment)
+	r.GET("/payment/refunds/{order_id}", h.GetRefunds)
+	r.POST("/payment/message", h.HandleMessage)
+
+	// Only postgres supports the prepared transactions of a two-phase commit
+	if conn.Backend == util.POSTGRES {
+		r.POST("/payment/2pc/prepare/{tx_id}", h.PrepareTransaction)
+		r.POST("/payment/2pc/commit/{tx_id}", h.CommitTransaction)
+		r.POST("/payment/2pc/abort/{tx_id}", h.AbortTransaction)
+	}
+}
+
+// Returns the router with the routes of the services
+func getRouter(conn *util.Connection, services ...string) fasthttp.RequestHandler {
 	r := router.New()
 	r.PanicHandler = panicHandler
 
-	r.GET("/payment/status/{order_id}", h.GetPaymentStatus)
-	r.POST("/payment/message", h.HandleMessage)
+	for _, service := range services {
+		serviceRoutes[service](r, serviceConnection(conn, service))
+	}
 
 	return r.Handler
 }
 
+// Returns the connection of the service. With the sqlite backend every service
+// has its own database, as a service calls others while its transaction holds the
+// write lock of the database.
+func serviceConnection(conn *util.Connection, service string) *util.Connection {
+	if conn.Backend != util.SQLITE {
+		return conn
+	}
+
+	c := *conn
+	c.Postgres = conn.SQLite[service]
+	return &c
+}
+
+// Returns the router with the routes of every service. The services send their
+// requests and messages to each other within the process.
+func getAllRouter(conn *util.Connection) fasthttp.RequestHandler {
+	ln := fasthttputil.NewInmemoryListener()
+	conn.URL = util.Services{
+		User:    localURL,
+		Order:   localURL,
+		Stock:   localURL,
+		Payment: localURL,
+		Client:  util.NewLocalClient(ln),
+	}
+
+	handler := getRouter(conn, serviceNames...)
+	go func() {
+		err := fasthttp.Serve(ln, handler)
+		if err != nil {
+			logrus.WithError(err).Fatal("error while serving local requests")
+		}
+	}()
+
+	return handler
+}
+
 func panicHandler(ctx *fasthttp.RequestCtx, p interface{}) {
 	fmt.Println("Recovered in panicHandler", p, string(debug.Stack()))
 
 	ctx.Response.Reset()
-	ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	util.InternalServerError(ctx)
 }
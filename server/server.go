@@ -3,22 +3,120 @@ package server
 import (
 	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
+	"github.com/fasthttp/router"
 	"github.com/go-redis/redis/v8"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/martijnjanssen/redi-shop/util"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/valyala/fasthttp"
 )
 
-var services = map[string]func(*util.Connection) fasthttp.RequestHandler{
-	"user":    getUserRouter,
-	"stock":   getStockRouter,
-	"payment": getPaymentRouter,
-	"order":   getOrderRouter,
+// Service that starts every service in one process
+const allServices = "all"
+
+// Address of the services when they are served in the same process
+const localURL = "http://localhost"
+
+var serviceRoutes = map[string]func(*router.Router, *util.Connection){
+	"user":    addUserRoutes,
+	"stock":   addStockRoutes,
+	"payment": addPaymentRoutes,
+	"order":   addOrderRoutes,
+}
+
+var serviceNames = []string{"user", "stock", "payment", "order"}
+
+func connectRedis() *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("%s:%d", viper.GetString("redis.url"), viper.GetInt("redis.port")),
+		// TODO: enable password access for redis
+		// https://github.com/go-redis/redis/pull/1325
+		// Password: viper.GetString("redis.password"),
+		DB: 0, // use default DB
+	})
+	err := client.Ping(context.Background()).Err()
+	if err != nil {
+		logrus.WithError(err).Error("invalid redis connection")
+	}
+
+	return client
+}
+
+func connectPostgres() *gorm.DB {
+	db, err := gorm.Open("postgres",
+		fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=disable",
+			viper.GetString("postgres.url"),
+			viper.GetInt("postgres.port"),
+			viper.GetString("postgres.database"),
+			viper.GetString("postgres.username"),
+			viper.GetString("postgres.password"),
+		))
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to connect to database")
+	}
+
+	err = db.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\"").Error
+	if err != nil {
+		logrus.WithError(err).Error("unable to create extension")
+	}
+
+	return db
+}
+
+// Opens the sqlite database of the service in the directory. Transactions take
+// the write lock when they begin, writers wait for each other instead of failing.
+func connectSQLite(directory string, service string) *gorm.DB {
+	path := filepath.Join(directory, fmt.Sprintf("redi-%s.db", service))
+	db, err := gorm.Open("sqlite3", fmt.Sprintf("file:%s?_txlock=immediate&_busy_timeout=10000&_journal_mode=WAL", path))
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Fatal("unable to open database")
+	}
+
+	return db
+}
+
+// Opens the sqlite databases of the services in the directory
+func connectSQLiteServices(directory string, services []string) map[string]*gorm.DB {
+	dbs := map[string]*gorm.DB{}
+	for _, service := range services {
+		dbs[service] = connectSQLite(directory, service)
+	}
+
+	return dbs
+}
+
+func closeSQLiteServices(dbs map[string]*gorm.DB) {
+	for service, db := range dbs {
+		if err := db.Close(); err != nil {
+			logrus.WithError(err).WithField("service", service).Error("unable to close database connection")
+		}
+	}
+}
+
+func connectBroker() *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("%s:%d", viper.GetString("broker.url"), viper.GetInt("broker.port")),
+		// TODO: enable password access for redis
+		// https://github.com/go-redis/redis/pull/1325
+		// Password: viper.GetString("broker.password"),
+		DB:       0, // use default DB
+		PoolSize: 1000,
+	})
+	err := client.Ping(context.Background()).Err()
+	if err != nil {
+		logrus.WithError(err).Error("invalid message broker connection")
+	}
+
+	return client
 }
 
 // Start initializes the database connection and starts listening to incoming requests
@@ -29,69 +127,67 @@ func Start() {
 	conn := &util.Connection{Backend: util.GetConnectionType(viper.GetString("backend"))}
 	switch conn.Backend {
 	case util.POSTGRES:
-		// Open database connection
-		db, err := gorm.Open("postgres",
-			fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=disable",
-				viper.GetString("postgres.url"),
-				viper.GetInt("postgres.port"),
-				viper.GetString("postgres.database"),
-				viper.GetString("postgres.username"),
-				viper.GetString("postgres.password"),
-			))
-		if err != nil {
-			logrus.WithError(err).Fatal("unable to connect to database")
-		}
+		db := connectPostgres()
 		defer func() {
 			if err := db.Close(); err != nil {
 				logrus.WithError(err).Error("unable to close database connection")
 			}
 		}()
 
-		err = db.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\"").Error
-		if err != nil {
-			logrus.WithError(err).Error("unable to create extension")
-		}
-
 		conn.Postgres = db
 
 	case util.REDIS:
-		client := redis.NewClient(&redis.Options{
-			Addr: fmt.Sprintf("%s:%d", viper.GetString("redis.url"), viper.GetInt("redis.port")),
-			// TODO: enable password access for redis
-			// https://github.com/go-redis/redis/pull/1325
-			// Password: viper.GetString("redis.password"),
-			DB: 0, // use default DB
-		})
-		err := client.Ping(context.Background()).Err()
-		if err != nil {
-			logrus.WithError(err).Error("invalid redis connection")
+		conn.Redis = connectRedis()
+
+	case util.SQLITE:
+		services := []string{service}
+		if service == allServices {
+			services = serviceNames
 		}
-		conn.Redis = client
+		conn.SQLite = connectSQLiteServices(viper.GetString("sqlite.directory"), services)
+		defer closeSQLiteServices(conn.SQLite)
 	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%d", viper.GetString("broker.url"), viper.GetInt("broker.port")),
-		// TODO: enable password access for redis
-		// https://github.com/go-redis/redis/pull/1325
-		// Password: viper.GetString("broker.password"),
-		DB:       0, // use default DB
-		PoolSize: 1000,
-	})
-	err := client.Ping(context.Background()).Err()
-	if err != nil {
-		logrus.WithError(err).Error("invalid message broker connection")
+	// Every service started in the same process uses the in-process broker
+	transport := util.GetTransportType(viper.GetString("broker.transport"))
+	if service == allServices {
+		transport = util.MEMORY_BROKER
+	}
+
+	switch transport {
+	case util.PUBSUB:
+		conn.Broker = connectBroker()
+		conn.Transport = util.NewPubSubTransport(conn.Broker, &conn.URL)
+	case util.STREAMS:
+		conn.Broker = connectBroker()
+		conn.Transport = util.NewStreamsTransport(conn.Broker, viper.GetDuration("broker.reclaim_after"), viper.GetInt64("broker.max_len"))
+	case util.MEMORY_BROKER:
+		conn.Transport = util.NewMemoryTransport()
 	}
-	conn.Broker = client
 
 	conn.URL.User = viper.GetString("url.user")
 	conn.URL.Order = viper.GetString("url.order")
 	conn.URL.Stock = viper.GetString("url.stock")
 	conn.URL.Payment = viper.GetString("url.payment")
 
-	// Get the handlerFunc for the service we want to use
-	handlerFn, ok := services[service]
-	if !ok {
-		logrus.WithField("service", service).Fatal("service does not exist, valid services are: user, stock, order, payment")
+	conn.Checkout.Mode = util.GetCheckoutMode(viper.GetString("checkout.mode"))
+	if conn.Checkout.Mode == util.TWO_PHASE && conn.Backend != util.POSTGRES {
+		logrus.Fatal("two-phase commit checkout requires the postgres backend")
+	}
+	conn.Checkout.Timeout = viper.GetDuration("checkout.timeout")
+	conn.Checkout.RecoverAfter = viper.GetDuration("checkout.recover_after")
+	conn.Checkout.DedupTTL = viper.GetDuration("checkout.dedup_ttl")
+	conn.Checkout.ReservationTTL = viper.GetDuration("checkout.reservation_ttl")
+	conn.Checkout.SweepInterval = viper.GetDuration("checkout.sweep_interval")
+
+	// Get the handler for the service we want to use
+	var handler fasthttp.RequestHandler
+	if service == allServices {
+		handler = getAllRouter(conn)
+	} else if _, ok := serviceRoutes[service]; ok {
+		handler = getRouter(conn, service)
+	} else {
+		logrus.WithField("service", service).Fatal("service does not exist, valid services are: user, stock, order, payment, all")
 	}
 
 	// Start listening to incoming requests
@@ -100,10 +196,31 @@ func Start() {
 		Concurrency:   256 * 1024,
 		MaxConnsPerIP: 3 * 1024,
 		IdleTimeout:   10 * time.Second,
-		Handler:       handlerFn(conn),
+		Handler:       handler,
 	}
-	err = server.ListenAndServe(fmt.Sprintf(":%d", viper.GetInt("port")))
+	go shutdownOnSignal(&server)
+
+	err := server.ListenAndServe(fmt.Sprintf(":%d", viper.GetInt("port")))
 	if err != nil {
 		logrus.WithError(err).Fatal("error while listening")
 	}
+
+	// Remove the queues of this instance, nobody will read them anymore
+	err = conn.Transport.Close(context.Background())
+	if err != nil {
+		logrus.WithError(err).Error("unable to close message transport")
+	}
+}
+
+// Stops the server once the process is interrupted or terminated
+func shutdownOnSignal(server *fasthttp.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	logrus.Info("shutting down")
+	err := server.Shutdown()
+	if err != nil {
+		logrus.WithError(err).Error("unable to shut down server")
+	}
 }
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func memoryConnection(mode util.CheckoutMode) *util.Connection {
+	return connection(util.MEMORY, mode)
+}
+
+func connection(backend util.ConnectionType, mode util.CheckoutMode) *util.Connection {
+	return &util.Connection{
+		Backend:   backend,
+		Transport: util.NewMemoryTransport(),
+		Checkout: util.Checkout{
+			Mode:           mode,
+			Timeout:        5 * time.Second,
+			RecoverAfter:   time.Minute,
+			DedupTTL:       time.Hour,
+			ReservationTTL: time.Minute,
+			SweepInterval:  time.Minute,
+		},
+	}
+}
+
+// Starts every service with the connection on its own local port, and returns
+// their addresses
+func startShop(t *testing.T, conn *util.Connection) *util.Services {
+	listeners := map[string]net.Listener{}
+	for _, name := range serviceNames {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[name] = ln
+	}
+	url := func(name string) string {
+		return fmt.Sprintf("http://%s", listeners[name].Addr())
+	}
+	conn.URL = util.Services{User: url("user"), Order: url("order"), Stock: url("stock"), Payment: url("payment")}
+
+	for _, name := range serviceNames {
+		go func(ln net.Listener, handler fasthttp.RequestHandler) {
+			_ = fasthttp.Serve(ln, handler)
+		}(listeners[name], getRouter(conn, name))
+	}
+
+	return &conn.URL
+}
+
+// Starts all services on a single local port, as the all service does
+func startAllInOne(t *testing.T, mode util.CheckoutMode) *util.Services {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	handler := getAllRouter(memoryConnection(mode))
+	go func() {
+		_ = fasthttp.Serve(ln, handler)
+	}()
+
+	url := fmt.Sprintf("http://%s", ln.Addr())
+	return &util.Services{User: url, Order: url, Stock: url, Payment: url}
+}
+
+// Sends the request and decodes the JSON response into v when it is given
+func call(t *testing.T, method string, url string, v interface{}) int {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(url)
+	req.Header.SetMethod(method)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	require.NoError(t, fasthttp.Do(req, resp))
+
+	if v != nil {
+		require.NoError(t, json.Unmarshal(resp.Body(), v), string(resp.Body()))
+	}
+	return resp.StatusCode()
+}
+
+func TestMemoryShopCheckout(t *testing.T) {
+	for name, mode := range map[string]util.CheckoutMode{"saga": util.SAGA, "orchestrated": util.ORCHESTRATED} {
+		t.Run(name, func(t *testing.T) {
+			testCheckout(t, startShop(t, memoryConnection(mode)))
+		})
+	}
+}
+
+func TestSQLiteShopCheckout(t *testing.T) {
+	for name, mode := range map[string]util.CheckoutMode{"saga": util.SAGA, "orchestrated": util.ORCHESTRATED} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "redi")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			conn := connection(util.SQLITE, mode)
+			conn.SQLite = connectSQLiteServices(dir, serviceNames)
+			defer closeSQLiteServices(conn.SQLite)
+			testCheckout(t, startShop(t, conn))
+		})
+	}
+}
+
+func TestAllInOneCheckout(t *testing.T) {
+	for name, mode := range map[string]util.CheckoutMode{"saga": util.SAGA, "orchestrated": util.ORCHESTRATED} {
+		t.Run(name, func(t *testing.T) {
+			testCheckout(t, startAllInOne(t, mode))
+		})
+	}
+}
+
+func testCheckout(t *testing.T, urls *util.Services) {
+	user := struct {
+		UserID string `json:"user_id"`
+		Credit int    `json:"credit"`
+	}{}
+	require.Equal(t, fasthttp.StatusCreated, call(t, "POST", urls.User+"/users/create/", &user))
+	require.Equal(t, fasthttp.StatusOK, call(t, "POST", fmt.Sprintf("%s/users/credit/add/%s/10", urls.User, user.UserID), nil))
+
+	item := struct {
+		ItemID string `json:"item_id"`
+		Stock  int    `json:"stock"`
+	}{}
+	require.Equal(t, fasthttp.StatusCreated, call(t, "POST", urls.Stock+"/stock/item/create/3", &item))
+	require.Equal(t, fasthttp.StatusOK, call(t, "POST", fmt.Sprintf("%s/stock/add/%s/5", urls.Stock, item.ItemID), nil))
+
+	// Orders two of the item, which costs 6
+	newOrder := func() string {
+		order := struct {
+			OrderID string `json:"order_id"`
+		}{}
+		require.Equal(t, fasthttp.StatusCreated, call(t, "POST", fmt.Sprintf("%s/orders/create/%s", urls.Order, user.UserID), &order))
+		for i := 0; i < 2; i++ {
+			require.Equal(t, fasthttp.StatusOK, call(t, "POST", fmt.Sprintf("%s/orders/additem/%s/%s", urls.Order, order.OrderID, item.ItemID), nil))
+		}
+		return order.OrderID
+	}
+
+	orderID := newOrder()
+	assert.Equal(t, fasthttp.StatusOK, call(t, "POST", fmt.Sprintf("%s/orders/checkout/%s", urls.Order, orderID), nil))
+
+	order := struct {
+		Paid      bool `json:"paid"`
+		TotalCost int  `json:"total_cost"`
+	}{}
+	assert.Equal(t, fasthttp.StatusOK, call(t, "GET", fmt.Sprintf("%s/orders/find/%s", urls.Order, orderID), &order))
+	assert.True(t, order.Paid)
+	assert.Equal(t, 6, order.TotalCost)
+
+	// The second order costs more than the remaining credit
+	resp := &errs.Response{}
+	assert.Equal(t, fasthttp.StatusBadRequest, call(t, "POST", fmt.Sprintf("%s/orders/checkout/%s", urls.Order, newOrder()), resp))
+	if assert.NotNil(t, resp.Error) {
+		assert.Equal(t, errs.InsufficientCredit, resp.Error.Kind, resp.Error.Message)
+	}
+
+	assert.Equal(t, fasthttp.StatusOK, call(t, "GET", fmt.Sprintf("%s/users/find/%s", urls.User, user.UserID), &user))
+	assert.Equal(t, 4, user.Credit)
+	assert.Equal(t, fasthttp.StatusOK, call(t, "GET", fmt.Sprintf("%s/stock/find/%s", urls.Stock, item.ItemID), &item))
+	assert.Equal(t, 3, item.Stock)
+}
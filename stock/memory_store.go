@@ -0,0 +1,189 @@
+package stock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util"
+)
+
+// Reservation kept by the memory store with the stock it holds
+type memoryReservation struct {
+	StockReservation
+	items util.OrderItems
+}
+
+// memoryStockStore keeps the items and reservations in memory, a single lock
+// makes every change atomic
+type memoryStockStore struct {
+	lock         sync.Mutex
+	items        map[string]*Stock
+	reservations map[string]*memoryReservation
+}
+
+func newMemoryStockStore() *memoryStockStore {
+	return &memoryStockStore{
+		items:        map[string]*Stock{},
+		reservations: map[string]*memoryReservation{},
+	}
+}
+
+func (s *memoryStockStore) Create(_ context.Context, price int) (*Stock, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stock := &Stock{ID: uuid.Must(uuid.NewV4()).String(), Price: price}
+	s.items[stock.ID] = stock
+
+	c := *stock
+	return &c, nil
+}
+
+func (s *memoryStockStore) Find(_ context.Context, itemID string) (*Stock, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stock, ok := s.items[itemID]
+	if !ok {
+		return nil, errItemNotFound.With("item_id", itemID)
+	}
+
+	c := *stock
+	return &c, nil
+}
+
+func (s *memoryStockStore) add(ctx context.Context, itemID string, number int) error {
+	return s.addItems(ctx, util.OrderItems{itemID: number})
+}
+
+func (s *memoryStockStore) subtract(ctx context.Context, itemID string, number int) error {
+	return s.subtractItems(ctx, util.OrderItems{itemID: number})
+}
+
+func (s *memoryStockStore) subtractItems(_ context.Context, items util.OrderItems) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.subtractNumbers(items)
+}
+
+func (s *memoryStockStore) addItems(_ context.Context, items util.OrderItems) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.addNumbers(items)
+}
+
+// Subtracts the quantity of every item, or nothing when one of the items is out
+// of stock. The lock must be held.
+func (s *memoryStockStore) subtractNumbers(items util.OrderItems) error {
+	for itemID, number := range items {
+		stock, ok := s.items[itemID]
+		if !ok || stock.Number < number {
+			return errInsufficientStock.With("item_id", itemID).With("quantity", number)
+		}
+	}
+
+	for itemID, number := range items {
+		s.items[itemID].Number -= number
+	}
+
+	return nil
+}
+
+// Adds the quantity of every item, or nothing when one of the items does not
+// exist. The lock must be held.
+func (s *memoryStockStore) addNumbers(items util.OrderItems) error {
+	for itemID := range items {
+		if _, ok := s.items[itemID]; !ok {
+			return errItemNotFound.With("item_id", itemID)
+		}
+	}
+
+	for itemID, number := range items {
+		s.items[itemID].Number += number
+	}
+
+	return nil
+}
+
+func (s *memoryStockStore) reserve(_ context.Context, reservationID string, items util.OrderItems, expiresAt time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if existing, ok := s.reservations[reservationID]; ok {
+		if existing.Status == ReservationReleased {
+			return errReservationReleased.With("reservation_id", reservationID)
+		}
+		return nil
+	}
+
+	err := s.subtractNumbers(items)
+	if err != nil {
+		return err
+	}
+
+	reserved := util.OrderItems{}
+	for itemID, quantity := range items {
+		reserved[itemID] = quantity
+	}
+	s.reservations[reservationID] = &memoryReservation{
+		StockReservation: StockReservation{ID: reservationID, Status: ReservationHeld, ExpiresAt: expiresAt},
+		items:            reserved,
+	}
+
+	return nil
+}
+
+func (s *memoryStockStore) commit(_ context.Context, reservationID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reservation, ok := s.reservations[reservationID]
+	if !ok {
+		return errReservationNotFound.With("reservation_id", reservationID)
+	}
+
+	if reservation.Status == ReservationReleased {
+		return errReservationReleased.With("reservation_id", reservationID)
+	}
+	reservation.Status = ReservationCommitted
+
+	return nil
+}
+
+func (s *memoryStockStore) release(_ context.Context, reservationID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reservation, ok := s.reservations[reservationID]
+	if !ok || reservation.Status == ReservationReleased {
+		return nil
+	} else if reservation.Status == ReservationCommitted {
+		return errReservationCommitted.With("reservation_id", reservationID)
+	}
+
+	err := s.addNumbers(reservation.items)
+	if err != nil {
+		return err
+	}
+	reservation.Status = ReservationReleased
+
+	return nil
+}
+
+func (s *memoryStockStore) expired(_ context.Context, now time.Time) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids := []string{}
+	for id, reservation := range s.reservations {
+		if reservation.Status == ReservationHeld && reservation.ExpiresAt.Before(now) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
@@ -2,13 +2,12 @@ package stock
 
 import (
 	"context"
-	"fmt"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/martijnjanssen/redi-shop/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 )
 
 type postgresStockStore struct {
@@ -18,7 +17,7 @@ type postgresStockStore struct {
 
 func newPostgresStockStore(db *gorm.DB, urls *util.Services) *postgresStockStore {
 	// AutoMigrate structs to create or update database tables
-	err := db.AutoMigrate(&Stock{}).Error
+	err := db.AutoMigrate(&Stock{}, &StockReservation{}, &StockReservationItem{}).Error
 	if err != nil {
 		panic(err)
 	}
@@ -29,7 +28,12 @@ func newPostgresStockStore(db *gorm.DB, urls *util.Services) *postgresStockStore
 	}
 }
 
-func (s *postgresStockStore) Create(ctx *fasthttp.RequestCtx, price int) {
+// BeforeCreate generates the ID of the item
+func (s *Stock) BeforeCreate(scope *gorm.Scope) error {
+	return util.GenerateID(scope)
+}
+
+func (s *postgresStockStore) Create(_ context.Context, price int) (*Stock, error) {
 	stock := &Stock{
 		Price: price,
 	}
@@ -38,105 +42,294 @@ func (s *postgresStockStore) Create(ctx *fasthttp.RequestCtx, price int) {
 		Error
 	if err != nil {
 		logrus.WithError(err).Error("unable to create new stock item")
-		util.InternalServerError(ctx)
-		return
+		return nil, util.INTERNAL_ERR
 	}
 
-	response := fmt.Sprintf("{\"item_id\": \"%s\"}", stock.ID)
-	util.JSONResponse(ctx, fasthttp.StatusCreated, response)
+	return stock, nil
 }
 
-func (s *postgresStockStore) Find(ctx *fasthttp.RequestCtx, itemID string) {
+func (s *postgresStockStore) Find(_ context.Context, itemID string) (*Stock, error) {
 	stock := &Stock{}
 	err := s.db.Model(&Stock{}).
 		Where("id = ?", itemID).
 		First(stock).
 		Error
 	if err == gorm.ErrRecordNotFound {
-		util.NotFound(ctx)
-		return
+		return nil, errItemNotFound.With("item_id", itemID)
 	} else if err != nil {
 		logrus.WithError(err).Error("unable to find stock item")
-		util.InternalServerError(ctx)
-		return
+		return nil, util.INTERNAL_ERR
 	}
 
-	response := fmt.Sprintf("{\"stock\": %d, \"price\": %d}", stock.Number, stock.Price)
-	util.JSONResponse(ctx, fasthttp.StatusOK, response)
+	return stock, nil
+}
+
+func (s *postgresStockStore) subtract(ctx context.Context, itemID string, number int) error {
+	return s.subtractItems(ctx, util.OrderItems{itemID: number})
 }
 
-func (s *postgresStockStore) SubtractStock(ctx *fasthttp.RequestCtx, itemID string, number int) {
-	err := s.subtract(ctx, itemID, number)
-	if err == util.INTERNAL_ERR {
-		util.InternalServerError(ctx)
-	} else if err == util.BAD_REQUEST {
-		util.BadRequest(ctx)
+func (s *postgresStockStore) subtractItems(_ context.Context, items util.OrderItems) error {
+	var result error
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return subtractNumbers(tx, items, &result)
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to subtract stock")
+		return result
 	}
 
-	util.Ok(ctx)
+	return nil
 }
 
-func (s *postgresStockStore) AddStock(ctx *fasthttp.RequestCtx, itemID string, number int) {
-	err := s.add(ctx, itemID, number)
-	if err == util.INTERNAL_ERR {
-		util.InternalServerError(ctx)
-	} else if err == util.BAD_REQUEST {
-		util.BadRequest(ctx)
+func (s *postgresStockStore) addItems(_ context.Context, items util.OrderItems) error {
+	var result error
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return addNumbers(tx, items, &result)
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to add stock")
+		return result
 	}
 
-	util.Ok(ctx)
+	return nil
 }
 
-func (s *postgresStockStore) subtract(_ context.Context, itemID string, number int) error {
+func (s *postgresStockStore) reserve(_ context.Context, reservationID string, items util.OrderItems, expiresAt time.Time) error {
 	var result error
 
 	err := s.db.Transaction(func(tx *gorm.DB) error {
-		err := tx.Model(&Stock{}).
-			Where("id = ?", itemID).
-			Update("number", gorm.Expr("number - ?", number)).
+		existing := &StockReservation{}
+		err := tx.Model(&StockReservation{}).
+			Where("id = ?", reservationID).
+			First(existing).
 			Error
+		if err == nil {
+			if existing.Status == ReservationReleased {
+				result = errReservationReleased.With("reservation_id", reservationID)
+				return errors.New("reservation was released")
+			}
+			return nil
+		} else if err != gorm.ErrRecordNotFound {
+			result = util.INTERNAL_ERR
+			return errors.Wrap(err, "unable to get reservation")
+		}
+
+		err = subtractNumbers(tx, items, &result)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Create(&StockReservation{ID: reservationID, Status: ReservationHeld, ExpiresAt: expiresAt}).Error
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return errors.Wrap(err, "unable to create reservation")
+		}
+
+		for _, itemID := range items.IDs() {
+			err = tx.Create(&StockReservationItem{ReservationID: reservationID, ItemID: itemID, Quantity: items[itemID]}).Error
+			if err != nil {
+				result = util.INTERNAL_ERR
+				return errors.Wrap(err, "unable to create reservation item")
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to reserve stock")
+		return result
+	}
+
+	return nil
+}
+
+func (s *postgresStockStore) commit(_ context.Context, reservationID string) error {
+	var result error
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		reservation, err := lockReservation(tx, reservationID)
 		if err == gorm.ErrRecordNotFound {
-			result = util.BAD_REQUEST
-			return errors.Wrap(err, "stock not found")
+			result = errReservationNotFound.With("reservation_id", reservationID)
+			return errors.Wrap(err, "reservation not found")
 		} else if err != nil {
 			result = util.INTERNAL_ERR
-			return errors.Wrap(err, "unable to subtract stock")
+			return err
 		}
 
-		// Check whether the stock is still above 0
-		err = tx.Model(&Stock{}).
-			Where("id = ?", itemID).
-			Where("number-? > 0", number).
-			First(&Stock{}).
-			Error
+		if reservation.Status == ReservationCommitted {
+			return nil
+		} else if reservation.Status != ReservationHeld {
+			result = errReservationReleased.With("reservation_id", reservationID)
+			return errors.New("reservation was released")
+		}
+
+		return setReservationStatus(tx, reservationID, ReservationCommitted, &result)
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit stock reservation")
+		return result
+	}
+
+	return nil
+}
+
+func (s *postgresStockStore) release(_ context.Context, reservationID string) error {
+	var result error
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		reservation, err := lockReservation(tx, reservationID)
 		if err == gorm.ErrRecordNotFound {
-			result = util.BAD_REQUEST
-			return errors.Wrap(err, "stock cannot go below 0")
+			return nil
 		} else if err != nil {
 			result = util.INTERNAL_ERR
-			return errors.Wrap(err, "unable to get stock")
+			return err
 		}
 
-		return nil
+		if reservation.Status == ReservationReleased {
+			return nil
+		} else if reservation.Status == ReservationCommitted {
+			result = errReservationCommitted.With("reservation_id", reservationID)
+			return errors.New("reservation was committed")
+		}
+
+		reserved := []*StockReservationItem{}
+		err = tx.Model(&StockReservationItem{}).
+			Where("reservation_id = ?", reservationID).
+			Find(&reserved).
+			Error
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return errors.Wrap(err, "unable to get reservation items")
+		}
+
+		items := util.OrderItems{}
+		for _, item := range reserved {
+			items[item.ItemID] = item.Quantity
+		}
+		err = addNumbers(tx, items, &result)
+		if err != nil {
+			return err
+		}
+
+		return setReservationStatus(tx, reservationID, ReservationReleased, &result)
 	})
 	if err != nil {
-		logrus.WithError(err).Error("unable to subtract stock")
+		logrus.WithError(err).Error("unable to release stock reservation")
 		return result
 	}
 
 	return nil
 }
 
+func (s *postgresStockStore) expired(_ context.Context, now time.Time) ([]string, error) {
+	ids := []string{}
+	err := s.db.Model(&StockReservation{}).
+		Where("status = ? AND expires_at < ?", ReservationHeld, now).
+		Pluck("id", &ids).
+		Error
+	if err != nil {
+		logrus.WithError(err).Error("unable to get expired stock reservations")
+		return nil, util.INTERNAL_ERR
+	}
+
+	return ids, nil
+}
+
+// Subtracts the stock of the order in the prepared transaction of a two-phase
+// commit checkout
+func prepareCheckout(tx *gorm.DB, order *util.OrderPayload) error {
+	var result error
+	err := subtractNumbers(tx, order.Items, &result)
+	if err != nil {
+		logrus.WithError(err).WithField("order_id", order.OrderID).Warn("unable to prepare checkout")
+		return result
+	}
+
+	return nil
+}
+
+// Subtracts the quantity of every item, or nothing when one of the items is out
+// of stock. The items are updated in the order of their IDs, so concurrent
+// checkouts lock them in the same order. The error to return to the caller is
+// set in result.
+func subtractNumbers(tx *gorm.DB, items util.OrderItems, result *error) error {
+	for _, itemID := range items.IDs() {
+		number := items[itemID]
+		// Only subtract when enough stock is left
+		update := tx.Model(&Stock{}).
+			Where("id = ?", itemID).
+			Where("number >= ?", number).
+			Update("number", gorm.Expr("number - ?", number))
+		if update.Error != nil {
+			*result = util.INTERNAL_ERR
+			return errors.Wrap(update.Error, "unable to subtract stock")
+		} else if update.RowsAffected == 0 {
+			*result = errInsufficientStock.With("item_id", itemID).With("quantity", number)
+			return errors.Errorf("item %s not found or not enough stock", itemID)
+		}
+	}
+
+	return nil
+}
+
+// Adds the quantity of every item, in the order of their IDs like subtractNumbers
+func addNumbers(tx *gorm.DB, items util.OrderItems, result *error) error {
+	for _, itemID := range items.IDs() {
+		number := items[itemID]
+		update := tx.Model(&Stock{}).
+			Where("id = ?", itemID).
+			Update("number", gorm.Expr("number + ?", number))
+		if update.Error != nil {
+			*result = util.INTERNAL_ERR
+			return errors.Wrap(update.Error, "unable to add stock")
+		} else if update.RowsAffected == 0 {
+			*result = errItemNotFound.With("item_id", itemID)
+			return errors.Errorf("item %s not found", itemID)
+		}
+	}
+
+	return nil
+}
+
+// Returns the reservation and locks it until the end of the transaction
+func lockReservation(tx *gorm.DB, reservationID string) (*StockReservation, error) {
+	reservation := &StockReservation{}
+	err := util.ForUpdate(tx).
+		Model(&StockReservation{}).
+		Where("id = ?", reservationID).
+		First(reservation).
+		Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errors.Wrap(err, "unable to get reservation")
+	}
+
+	return reservation, err
+}
+
+func setReservationStatus(tx *gorm.DB, reservationID string, status string, result *error) error {
+	err := tx.Model(&StockReservation{}).
+		Where("id = ?", reservationID).
+		Update("status", status).
+		Error
+	if err != nil {
+		*result = util.INTERNAL_ERR
+		return errors.Wrap(err, "unable to update reservation")
+	}
+
+	return nil
+}
+
 func (s *postgresStockStore) add(_ context.Context, itemID string, number int) error {
-	err := s.db.Model(&Stock{}).
+	update := s.db.Model(&Stock{}).
 		Where("id = ?", itemID).
-		Update("number", gorm.Expr("number + ?", number)).
-		Error
-	if err == gorm.ErrRecordNotFound {
-		return util.BAD_REQUEST
-	} else if err != nil {
-		logrus.WithError(err).Error("unable to add stock")
+		Update("number", gorm.Expr("number + ?", number))
+	if update.Error != nil {
+		logrus.WithError(update.Error).Error("unable to add stock")
 		return util.INTERNAL_ERR
+	} else if update.RowsAffected == 0 {
+		return errItemNotFound.With("item_id", itemID)
 	}
 
 	return nil
@@ -4,139 +4,310 @@ import (
 	"context"
 	"fmt"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gofrs/uuid"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 )
 
+// Subtracts ARGV[i] from the stock of the item in KEYS[i] for every item, but
+// only when all items exist and have enough stock left. Returns -i for the first
+// item that does not.
+var subtractStock = redis.NewScript(`
+		for i = 1, #KEYS do
+			if redis.call("EXISTS", KEYS[i]) == 0 or tonumber(redis.call("HGET", KEYS[i], "stock") or 0) < tonumber(ARGV[i]) then
+				return -i
+			end
+		end
+		for i = 1, #KEYS do
+			redis.call("HINCRBY", KEYS[i], "stock", -ARGV[i])
+		end
+		return #KEYS
+	`)
+
+// Adds ARGV[i] to the stock of the item in KEYS[i] for every item, but only when
+// all items exist. Returns -i for the first item that does not.
+var addStock = redis.NewScript(`
+		for i = 1, #KEYS do
+			if redis.call("EXISTS", KEYS[i]) == 0 then
+				return -i
+			end
+		end
+		for i = 1, #KEYS do
+			redis.call("HINCRBY", KEYS[i], "stock", ARGV[i])
+		end
+		return #KEYS
+	`)
+
+// Sorted set of the held stock reservations by expiry
+const heldReservationsKey = "stock-reservations"
+
+// Creates reservation KEYS[1] with ID ARGV[1] until ARGV[2], holding the stock of
+// the items in the keys after KEYS[3]. The ID and quantity of every item are the
+// argument pairs after ARGV[2]. Nothing is held when one of the items does not
+// have enough stock left, then -i is returned for the first such item. Reserving
+// an existing reservation again only fails when it was released.
+var reserveStock = redis.NewScript(`
+		local status = redis.call("HGET", KEYS[1], "status")
+		if status == "released" then
+			return false
+		elseif status then
+			return 0
+		end
+		local n = #KEYS - 3
+		for i = 1, n do
+			local key = KEYS[3 + i]
+			if redis.call("EXISTS", key) == 0 or tonumber(redis.call("HGET", key, "stock") or 0) < tonumber(ARGV[2 + 2 * i]) then
+				return -i
+			end
+		end
+		for i = 1, n do
+			redis.call("HINCRBY", KEYS[3 + i], "stock", -ARGV[2 + 2 * i])
+			redis.call("HSET", KEYS[2], ARGV[1 + 2 * i], ARGV[2 + 2 * i])
+		end
+		redis.call("HSET", KEYS[1], "status", "held", "expires_at", ARGV[2])
+		redis.call("ZADD", KEYS[3], ARGV[2], ARGV[1])
+		return 0
+	`)
+
+// Commits held reservation KEYS[1] with ID ARGV[1], its hashes KEYS[1] and
+// KEYS[2] expire after ARGV[2] milliseconds
+var commitStock = redis.NewScript(`
+		local status = redis.call("HGET", KEYS[1], "status")
+		if status == "committed" then
+			return 0
+		elseif status ~= "held" then
+			return false
+		end
+		redis.call("HSET", KEYS[1], "status", "committed")
+		redis.call("ZREM", KEYS[3], ARGV[1])
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		redis.call("PEXPIRE", KEYS[2], ARGV[2])
+		return 0
+	`)
+
+// Releases reservation KEYS[1] with ID ARGV[1] unless it was committed, adding
+// ARGV[i - 1] to the stock of the item in KEYS[i] again for the keys after
+// KEYS[3]. Its hashes KEYS[1] and KEYS[2] expire after ARGV[2] milliseconds.
+var releaseStock = redis.NewScript(`
+		local status = redis.call("HGET", KEYS[1], "status")
+		if status == "committed" then
+			return false
+		elseif status ~= "held" then
+			return 0
+		end
+		for i = 4, #KEYS do
+			if redis.call("EXISTS", KEYS[i]) == 1 then
+				redis.call("HINCRBY", KEYS[i], "stock", ARGV[i - 1])
+			end
+		end
+		redis.call("HSET", KEYS[1], "status", "released")
+		redis.call("ZREM", KEYS[3], ARGV[1])
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		redis.call("PEXPIRE", KEYS[2], ARGV[2])
+		return 0
+	`)
+
 type redisStockStore struct {
 	store *redis.Client
+	// Time a committed or released reservation is kept, so a late reserve of a
+	// released reservation is still refused. Held reservations are kept until
+	// they are committed or released.
+	reservationTTL time.Duration
 }
 
-func newRedisStockStore(c *redis.Client) *redisStockStore {
-	// AutoMigrate structs to create or update database tables
+func newRedisStockStore(c *redis.Client, reservationTTL time.Duration) *redisStockStore {
 	return &redisStockStore{
-		store: c,
+		store:          c,
+		reservationTTL: reservationTTL,
 	}
 }
 
-func (s *redisStockStore) Create(ctx *fasthttp.RequestCtx, price int) {
-	json := fmt.Sprintf("{\"price\": %d, \"stock\": 0}", price)
+// Hash with the price and stock of the item
+func stockKey(itemID string) string {
+	return fmt.Sprintf("stock:%s", itemID)
+}
 
+// Hash with the status and expiry of a stock reservation
+func reservationKey(reservationID string) string {
+	return fmt.Sprintf("stock-reservation:%s", reservationID)
+}
+
+// Hash with the quantity of every item held by a stock reservation
+func reservationItemsKey(reservationID string) string {
+	return fmt.Sprintf("stock-reservation:%s:items", reservationID)
+}
+
+func (s *redisStockStore) Create(ctx context.Context, price int) (*Stock, error) {
 	var itemID string
 	created := false
 	for !created {
 		itemID = uuid.Must(uuid.NewV4()).String()
-		set := s.store.SetNX(ctx, itemID, json, 0)
+		set := s.store.HSetNX(ctx, stockKey(itemID), "price", price)
 		if set.Err() != nil {
-			logrus.WithError(set.Err()).Error("unable to create new order")
-			util.InternalServerError(ctx)
-			return
+			logrus.WithError(set.Err()).Error("unable to create new stock item")
+			return nil, util.INTERNAL_ERR
 		}
 
 		created = set.Val()
 	}
 
-	util.JSONResponse(ctx, fasthttp.StatusCreated, fmt.Sprintf("{\"item_id\": \"%s\"}", itemID))
+	return &Stock{ID: itemID, Price: price}, nil
 }
 
-func (s *redisStockStore) SubtractStock(ctx *fasthttp.RequestCtx, itemID string, amount int) {
-	err := s.subtract(ctx, itemID, amount)
-	if err == util.INTERNAL_ERR {
-		util.InternalServerError(ctx)
-	} else if err == util.BAD_REQUEST {
-		util.BadRequest(ctx)
-	}
-
-	util.Ok(ctx)
+func (s *redisStockStore) Find(ctx context.Context, ID string) (*Stock, error) {
+	return s.get(ctx, ID)
 }
 
-func (s *redisStockStore) AddStock(ctx *fasthttp.RequestCtx, itemID string, amount int) {
-	err := s.add(ctx, itemID, amount)
-	if err == util.INTERNAL_ERR {
-		util.InternalServerError(ctx)
-	} else if err == util.BAD_REQUEST {
-		util.BadRequest(ctx)
-	}
+func (s *redisStockStore) subtract(ctx context.Context, ID string, amount int) error {
+	return s.subtractItems(ctx, util.OrderItems{ID: amount})
+}
 
-	util.Ok(ctx)
+func (s *redisStockStore) add(ctx context.Context, ID string, amount int) error {
+	return s.addItems(ctx, util.OrderItems{ID: amount})
 }
 
-func (s *redisStockStore) Find(ctx *fasthttp.RequestCtx, ID string) {
-	get := s.store.Get(ctx, ID)
-	if get.Err() == redis.Nil {
-		util.NotFound(ctx)
-		return
-	} else if get.Err() != nil {
-		logrus.WithError(get.Err()).Error("unable to find stock item")
-		util.InternalServerError(ctx)
-		return
-	}
+func (s *redisStockStore) subtractItems(ctx context.Context, items util.OrderItems) error {
+	return s.run(ctx, subtractStock, items, errInsufficientStock)
+}
 
-	util.JSONResponse(ctx, fasthttp.StatusOK, get.Val())
+func (s *redisStockStore) addItems(ctx context.Context, items util.OrderItems) error {
+	return s.run(ctx, addStock, items, errItemNotFound)
 }
 
-func (s *redisStockStore) subtract(ctx context.Context, ID string, amount int) error {
-	get := s.store.Get(ctx, ID)
-	if get.Err() == redis.Nil {
-		return util.BAD_REQUEST
-	} else if get.Err() != nil {
-		logrus.WithError(get.Err()).Error("unable to find stock item")
-		return util.INTERNAL_ERR
+// Runs a stock script for the items, returns the refused error for the first item
+// the script refused to change the stock of
+func (s *redisStockStore) run(ctx context.Context, script *redis.Script, items util.OrderItems, refused *errs.Error) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	itemIDs := make([]string, 0, len(items))
+	keys := make([]string, 0, len(items))
+	amounts := make([]interface{}, 0, len(items))
+	for itemID, amount := range items {
+		itemIDs = append(itemIDs, itemID)
+		keys = append(keys, stockKey(itemID))
+		amounts = append(amounts, amount)
 	}
 
-	json := get.Val()
-	jsonSplit := strings.Split(json, ": ")
-	stock, err := strconv.Atoi(jsonSplit[2][0 : len(jsonSplit[2])-1])
+	n, err := script.Run(ctx, s.store, keys, amounts...).Int()
 	if err != nil {
-		logrus.WithError(err).Error("cannot parse stock amount")
+		logrus.WithError(err).Error("unable to update stock")
 		return util.INTERNAL_ERR
+	} else if n < 0 {
+		return refused.With("item_id", itemIDs[-n-1])
 	}
 
-	if stock-amount < 0 {
-		return util.BAD_REQUEST
+	return nil
+}
+
+func (s *redisStockStore) reserve(ctx context.Context, reservationID string, items util.OrderItems, expiresAt time.Time) error {
+	keys := []string{reservationKey(reservationID), reservationItemsKey(reservationID), heldReservationsKey}
+	args := []interface{}{reservationID, expiresAt.UnixNano() / int64(time.Millisecond)}
+	for itemID, quantity := range items {
+		keys = append(keys, stockKey(itemID))
+		args = append(args, itemID, quantity)
 	}
 
-	jsonSplit[2] = fmt.Sprintf("%d}", stock-amount)
-	updatedJson := strings.Join(jsonSplit, ": ")
+	n, err := s.runReservation(ctx, reserveStock, keys, args, errReservationReleased.With("reservation_id", reservationID), "unable to reserve stock")
+	if err == nil && n < 0 {
+		return errInsufficientStock.With("item_id", args[-2*n])
+	}
 
-	set := s.store.Set(ctx, ID, updatedJson, 0)
-	if set.Err() != nil {
-		logrus.WithError(set.Err()).Error("unable to update stock item")
+	return err
+}
+
+func (s *redisStockStore) commit(ctx context.Context, reservationID string) error {
+	keys := []string{reservationKey(reservationID), reservationItemsKey(reservationID), heldReservationsKey}
+	args := []interface{}{reservationID, s.expiry()}
+	_, err := s.runReservation(ctx, commitStock, keys, args, errReservationReleased.With("reservation_id", reservationID), "unable to commit stock reservation")
+	return err
+}
+
+func (s *redisStockStore) release(ctx context.Context, reservationID string) error {
+	// The items of a reservation never change, so they are passed to the script
+	items, err := s.store.HGetAll(ctx, reservationItemsKey(reservationID)).Result()
+	if err != nil {
+		logrus.WithError(err).Error("unable to get reservation items")
 		return util.INTERNAL_ERR
 	}
 
-	return nil
+	keys := []string{reservationKey(reservationID), reservationItemsKey(reservationID), heldReservationsKey}
+	args := []interface{}{reservationID, s.expiry()}
+	for itemID, quantity := range items {
+		keys = append(keys, stockKey(itemID))
+		args = append(args, quantity)
+	}
+
+	_, err = s.runReservation(ctx, releaseStock, keys, args, errReservationCommitted.With("reservation_id", reservationID), "unable to release stock reservation")
+	return err
 }
 
-func (s *redisStockStore) add(ctx context.Context, ID string, amount int) error {
-	get := s.store.Get(ctx, ID)
-	if get.Err() == redis.Nil {
-		return util.BAD_REQUEST
-	} else if get.Err() != nil {
-		logrus.WithError(get.Err()).Error("unable to find stock item")
-		return util.INTERNAL_ERR
+// Returns the milliseconds after which a finished reservation expires
+func (s *redisStockStore) expiry() int64 {
+	ms := s.reservationTTL.Milliseconds()
+	if ms < 1 {
+		// PEXPIRE refuses a zero ttl
+		return 1
 	}
+	return ms
+}
 
-	json := get.Val()
-	jsonSplit := strings.Split(json, ": ")
-	stockString := jsonSplit[2]
-	stock, err := strconv.Atoi(stockString[0 : len(stockString)-1])
+func (s *redisStockStore) expired(ctx context.Context, now time.Time) ([]string, error) {
+	ids, err := s.store.ZRangeByScore(ctx, heldReservationsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprintf("(%d", now.UnixNano()/int64(time.Millisecond)),
+	}).Result()
 	if err != nil {
-		logrus.WithError(err).Error("cannot parse stock amount")
-		return util.INTERNAL_ERR
+		logrus.WithError(err).Error("unable to get expired stock reservations")
+		return nil, util.INTERNAL_ERR
 	}
-	jsonSplit[2] = fmt.Sprintf("%d}", (stock + amount))
-	updatedJson := strings.Join(jsonSplit, ": ")
-	set := s.store.Set(ctx, ID, updatedJson, 0)
-	if set.Err() != nil {
-		logrus.WithError(set.Err()).Error("unable to update stock item")
-		return util.INTERNAL_ERR
+
+	return ids, nil
+}
+
+// Runs a reservation script and returns its result, or the refused error when the
+// script refused to change the reservation
+func (s *redisStockStore) runReservation(ctx context.Context, script *redis.Script, keys []string, args []interface{}, refused error, errMsg string) (int, error) {
+	n, err := script.Run(ctx, s.store, keys, args...).Int()
+	if err == redis.Nil {
+		return 0, refused
+	} else if err != nil {
+		logrus.WithError(err).Error(errMsg)
+		return 0, util.INTERNAL_ERR
 	}
 
-	return nil
+	return n, nil
+}
+
+func (s *redisStockStore) get(ctx context.Context, ID string) (*Stock, error) {
+	get := s.store.HGetAll(ctx, stockKey(ID))
+	if get.Err() != nil {
+		logrus.WithError(get.Err()).Error("unable to find stock item")
+		return nil, util.INTERNAL_ERR
+	} else if len(get.Val()) == 0 {
+		return nil, errItemNotFound.With("item_id", ID)
+	}
+
+	stock := &Stock{ID: ID}
+	fields := map[string]*int{"price": &stock.Price, "stock": &stock.Number}
+	for field, value := range fields {
+		v, ok := get.Val()[field]
+		if !ok {
+			continue
+		}
+
+		var err error
+		*value, err = strconv.Atoi(v)
+		if err != nil {
+			logrus.WithError(err).WithField(field, v).Error("malformed stock item")
+			return nil, util.INTERNAL_ERR
+		}
+	}
+
+	return stock, nil
 }
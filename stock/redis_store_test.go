@@ -0,0 +1,120 @@
+package stock
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The redis tests run against a live redis, set REDI_TEST_REDIS to a redis
+// address to run them
+func testRedisStore(t *testing.T) (*redisStockStore, *redis.Client) {
+	addr := os.Getenv("REDI_TEST_REDIS")
+	if addr == "" {
+		t.Skip("REDI_TEST_REDIS is not set")
+	}
+
+	c := redis.NewClient(&redis.Options{Addr: addr})
+	require.NoError(t, c.Ping(context.Background()).Err())
+	return newRedisStockStore(c, time.Minute), c
+}
+
+// Creates an item with the stock
+func createItem(t *testing.T, s *redisStockStore, number int) string {
+	ctx := context.Background()
+	item, err := s.Create(ctx, 1)
+	require.NoError(t, err)
+	require.NoError(t, s.add(ctx, item.ID, number))
+	return item.ID
+}
+
+func stockOf(t *testing.T, s *redisStockStore, itemID string) int {
+	item, err := s.Find(context.Background(), itemID)
+	require.NoError(t, err)
+	return item.Number
+}
+
+func TestRedisSubtractAllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	s, c := testRedisStore(t)
+	defer c.Close()
+
+	enough := createItem(t, s, 5)
+	short := createItem(t, s, 1)
+	defer c.Del(ctx, stockKey(enough), stockKey(short))
+
+	err := s.subtractItems(ctx, util.OrderItems{enough: 2, short: 2})
+	require.Error(t, err)
+	assert.True(t, errs.Is(err, errs.InsufficientStock))
+	assert.Equal(t, short, err.(*errs.Error).Details["item_id"])
+
+	// The item with enough stock was not changed either
+	assert.Equal(t, 5, stockOf(t, s, enough))
+	assert.Equal(t, 1, stockOf(t, s, short))
+
+	require.NoError(t, s.subtractItems(ctx, util.OrderItems{enough: 2, short: 1}))
+	assert.Equal(t, 3, stockOf(t, s, enough))
+	assert.Equal(t, 0, stockOf(t, s, short))
+}
+
+func TestRedisAddUnknownItem(t *testing.T) {
+	ctx := context.Background()
+	s, c := testRedisStore(t)
+	defer c.Close()
+
+	itemID := createItem(t, s, 1)
+	unknown := uuid.Must(uuid.NewV4()).String()
+	defer c.Del(ctx, stockKey(itemID))
+
+	err := s.addItems(ctx, util.OrderItems{itemID: 1, unknown: 1})
+	require.Error(t, err)
+	assert.True(t, errs.Is(err, errs.NotFound))
+	assert.Equal(t, unknown, err.(*errs.Error).Details["item_id"])
+	assert.Equal(t, 1, stockOf(t, s, itemID))
+}
+
+func TestRedisReservationExpires(t *testing.T) {
+	ctx := context.Background()
+	s, c := testRedisStore(t)
+	defer c.Close()
+
+	itemID := createItem(t, s, 5)
+	committed := uuid.Must(uuid.NewV4()).String()
+	released := uuid.Must(uuid.NewV4()).String()
+	defer c.Del(ctx, stockKey(itemID))
+
+	expiresAt := time.Now().Add(time.Minute)
+	require.NoError(t, s.reserve(ctx, committed, util.OrderItems{itemID: 1}, expiresAt))
+	require.NoError(t, s.reserve(ctx, released, util.OrderItems{itemID: 2}, expiresAt))
+	assert.Equal(t, 2, stockOf(t, s, itemID))
+
+	// Held reservations are kept until they are committed or released
+	ttl, err := c.PTTL(ctx, reservationKey(committed)).Result()
+	require.NoError(t, err)
+	assert.True(t, ttl < 0)
+
+	require.NoError(t, s.commit(ctx, committed))
+	require.NoError(t, s.release(ctx, released))
+	assert.Equal(t, 4, stockOf(t, s, itemID))
+
+	for _, id := range []string{committed, released} {
+		for _, key := range []string{reservationKey(id), reservationItemsKey(id)} {
+			ttl, err := c.PTTL(ctx, key).Result()
+			require.NoError(t, err)
+			assert.True(t, ttl > 0 && ttl <= time.Minute, key)
+		}
+	}
+
+	// A late reserve of the released reservation is refused
+	err = s.reserve(ctx, released, util.OrderItems{itemID: 2}, expiresAt)
+	assert.True(t, errs.Is(err, errs.InvalidState))
+	assert.Equal(t, 4, stockOf(t, s, itemID))
+}
@@ -2,100 +2,398 @@ package stock
 
 import (
 	"context"
-	"fmt"
 	"strconv"
-	"strings"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 )
 
 type stockStore interface {
-	Create(*fasthttp.RequestCtx, int)
-	Find(*fasthttp.RequestCtx, string)
-	AddStock(*fasthttp.RequestCtx, string, int)
-	SubtractStock(*fasthttp.RequestCtx, string, int)
+	Create(context.Context, int) (*Stock, error)
+	// Find returns a not found error when the item does not exist
+	Find(context.Context, string) (*Stock, error)
 
+	// add returns a not found error when the item does not exist, subtract an
+	// insufficient stock error when the item does not exist or has not enough stock
 	add(context.Context, string, int) error
 	subtract(context.Context, string, int) error
+	// Subtracts the quantity of every item, or nothing when one is out of stock
+	subtractItems(context.Context, util.OrderItems) error
+	addItems(context.Context, util.OrderItems) error
+
+	// reserve subtracts the quantity of every item for the reservation until it
+	// is committed, released or expires. Reserving again fails only when the
+	// reservation was released.
+	reserve(context.Context, string, util.OrderItems, time.Time) error
+	commit(context.Context, string) error
+	// release adds the stock held by a reservation that was not committed again
+	release(context.Context, string) error
+	// expired returns the IDs of the held reservations that expired at the time
+	expired(context.Context, time.Time) ([]string, error)
 }
 
 type stockRouteHandler struct {
-	stockStore stockStore
-	broker     *redis.Client
-	urls       *util.Services
+	stockStore     stockStore
+	twoPhase       *util.TwoPhaseParticipant
+	dedup          util.DedupStore
+	transport      util.Transport
+	urls           *util.Services
+	reservationTTL time.Duration
 }
 
 func NewRouteHandler(conn *util.Connection) *stockRouteHandler {
 	var store stockStore
+	var dedup util.DedupStore
 
 	switch conn.Backend {
-	case util.POSTGRES:
+	case util.POSTGRES, util.SQLITE:
 		store = newPostgresStockStore(conn.Postgres, &conn.URL)
+		dedup = util.NewPostgresDedupStore(conn.Postgres, conn.Checkout.DedupTTL)
 	case util.REDIS:
-		store = newRedisStockStore(conn.Redis)
+		store = newRedisStockStore(conn.Redis, conn.Checkout.ReservationTTL)
+		dedup = util.NewRedisDedupStore(conn.Redis, conn.Checkout.DedupTTL)
+	case util.MEMORY:
+		store = newMemoryStockStore()
+		dedup = util.NewMemoryDedupStore()
 	}
 
 	h := &stockRouteHandler{
-		stockStore: store,
-		broker:     conn.Broker,
-		urls:       &conn.URL,
+		stockStore:     store,
+		twoPhase:       util.NewTwoPhaseParticipant("stock", conn, prepareCheckout),
+		dedup:          dedup,
+		transport:      conn.Transport,
+		urls:           &conn.URL,
+		reservationTTL: conn.Checkout.ReservationTTL,
+	}
+
+	err := h.transport.Sub(context.Background(), "stock", h.handleMessage)
+	if err != nil {
+		logrus.WithError(err).Panic("error subscribing to stock messages")
 	}
 
+	go h.sweepReservations(conn.Checkout.SweepInterval)
+
 	return h
 }
 
+// Receives messages sent over HTTP
 func (h *stockRouteHandler) HandleMessage(ctx *fasthttp.RequestCtx) {
-	message := string(ctx.PostBody())
-
-	s := strings.Split(message, "#")
-	switch s[2] {
-	case util.MESSAGE_STOCK:
-		h.SubtractStockItems(ctx, s[0], s[1], s[3])
+	err := h.handleMessage(ctx, string(ctx.PostBody()))
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
 	}
 
 	util.Ok(ctx)
 }
 
-func (h *stockRouteHandler) SubtractStockItems(ctx context.Context, orderChannelID string, tracker string, order string) {
-	items := strings.Split(strings.Split(order, "\"items\": [")[1], "]")[0]
+// Returns an error when the message has to be delivered again, malformed
+// messages are dropped
+func (h *stockRouteHandler) handleMessage(ctx context.Context, body string) error {
+	m, err := util.DecodeMessage(body)
+	if err != nil {
+		logrus.WithError(err).Error("unable to decode stock message")
+		return nil
+	} else if m.Order == nil {
+		logrus.WithField("track_id", m.TrackID).Error("stock message without order")
+		return nil
+	}
 
-	if items == "" {
-		h.broker.Publish(ctx, fmt.Sprintf("%s.%s", util.CHANNEL_ORDER, orderChannelID), fmt.Sprintf("%s#%s#%s", tracker, util.MESSAGE_ORDER_SUCCESS, ""))
-		return
+	switch m.Type {
+	case util.MESSAGE_STOCK:
+		return h.ReserveStockItems(ctx, m)
+	case util.MESSAGE_STOCK_COMMIT:
+		return h.CommitStockItems(ctx, m)
+	case util.MESSAGE_STOCK_REVERT:
+		return h.AddStockItems(ctx, m)
+	case util.MESSAGE_RESTOCK:
+		return h.RestockItems(ctx, m)
 	}
 
-	var err error
-	done := []string{}
-	for _, item := range strings.Split(items[1:len(items)-1], "\",\"") {
-		err = h.stockStore.subtract(ctx, item, 1)
-		if err != nil {
-			break
+	return nil
+}
+
+// Reserves the stock of the order once per saga, a repeated message is answered
+// with the outcome of the first one. The track ID of the saga is the ID of the
+// reservation. Returns an error when the outcome was not recorded.
+func (h *stockRouteHandler) ReserveStockItems(ctx context.Context, m *util.Message) error {
+	logger := logrus.WithField("track_id", m.TrackID)
+	key := util.DedupKey("stock", m.TrackID, util.MESSAGE_STOCK)
+
+	var cause, retry error
+	outcome, err := h.dedup.Outcome(ctx, key)
+	if err != nil {
+		logger.WithError(err).Error("unable to check for duplicate stock subtraction")
+		outcome = util.MESSAGE_ORDER_INTERNAL
+		retry = err
+	} else if outcome != "" {
+		logger.Info("replaying outcome of duplicate stock message")
+	} else {
+		outcome, cause = h.reserveItems(ctx, m)
+
+		// Internal errors are not recorded, so a redelivered message is retried
+		if outcome == util.MESSAGE_ORDER_INTERNAL {
+			retry = cause
+		} else {
+			recorded, err := h.dedup.Record(ctx, key, outcome)
+			if err != nil {
+				logger.WithError(err).Error("unable to record stock outcome")
+				retry = err
+			} else {
+				// The saga was reverted while reserving, release the reservation
+				if outcome == util.MESSAGE_ORDER_SUCCESS && recorded != util.MESSAGE_ORDER_SUCCESS {
+					h.release(ctx, m.TrackID)
+				}
+				if recorded != outcome {
+					cause = nil
+				}
+				outcome = recorded
+			}
 		}
-		done = append(done, item)
 	}
 
+	// The order service issues the next step of an orchestrated saga
+	if m.Orchestrated() {
+		util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+		return retry
+	}
+
+	// The payment service pays the order with the reserved credit before the
+	// reservation is committed
+	if outcome == util.MESSAGE_ORDER_SUCCESS {
+		util.Pub(h.transport, ctx, "payment", m.Next(util.MESSAGE_PAY_COMMIT))
+		return retry
+	}
+
+	util.Pub(h.transport, ctx, "payment", m.Next(util.MESSAGE_PAY_REVERT))
+	util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+	return retry
+}
+
+// Commits the stock reserved in the saga once the order was paid, a repeated
+// message is answered with the outcome of the first one. When the commit fails
+// the reservation is released and the payment refunded. Returns an error when
+// the outcome was not recorded.
+func (h *stockRouteHandler) CommitStockItems(ctx context.Context, m *util.Message) error {
+	logger := logrus.WithField("track_id", m.TrackID)
+	key := util.DedupKey("stock", m.TrackID, util.MESSAGE_STOCK_COMMIT)
+
+	var cause, retry error
+	outcome, err := h.dedup.Outcome(ctx, key)
 	if err != nil {
-		for _, i := range done {
-			err = h.stockStore.add(ctx, i, 1)
+		logger.WithError(err).Error("unable to check for duplicate stock commit")
+		outcome = util.MESSAGE_ORDER_INTERNAL
+		retry = err
+	} else if outcome != "" {
+		logger.Info("replaying outcome of duplicate stock commit message")
+	} else {
+		outcome = util.MESSAGE_ORDER_SUCCESS
+		cause = h.stockStore.commit(ctx, m.TrackID)
+		if cause != nil {
+			outcome = util.ErrorOutcome(cause)
+		}
+
+		// Internal errors are not recorded, so a redelivered message is retried
+		if outcome == util.MESSAGE_ORDER_INTERNAL {
+			retry = cause
+		} else {
+			recorded, err := h.dedup.Record(ctx, key, outcome)
 			if err != nil {
-				logrus.WithField("item_id", i).WithError(err).Error("UNABLE TO REVERT STOCK SUBTRACTION")
+				logger.WithError(err).Error("unable to record stock commit outcome")
+				retry = err
+			} else {
+				// The saga was reverted while committing, add the committed stock again
+				if outcome == util.MESSAGE_ORDER_SUCCESS && recorded != util.MESSAGE_ORDER_SUCCESS {
+					h.addItems(ctx, m.Order.Items)
+				}
+				if recorded != outcome {
+					cause = nil
+				}
+				outcome = recorded
 			}
 		}
+	}
 
-		util.Pub(h.urls.Payment, "payment", orderChannelID, tracker, util.MESSAGE_PAY_REVERT, order)
-		if err == util.BAD_REQUEST {
-			util.PubToOrder(h.broker, ctx, orderChannelID, tracker, util.MESSAGE_ORDER_BADREQUEST)
-		} else {
-			util.PubToOrder(h.broker, ctx, orderChannelID, tracker, util.MESSAGE_ORDER_INTERNAL)
+	// The order service compensates a failed step of an orchestrated saga
+	if outcome != util.MESSAGE_ORDER_SUCCESS && !m.Orchestrated() {
+		h.release(ctx, m.TrackID)
+		util.Pub(h.transport, ctx, "payment", m.Next(util.MESSAGE_PAY_REVERT))
+	}
+	util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+
+	return retry
+}
+
+// Reverts the stock of a checkout that was cancelled, but only if the stock was
+// reserved in that saga. Held stock is released, committed stock added again.
+// Returns an error when the stock has to be reverted again.
+func (h *stockRouteHandler) AddStockItems(ctx context.Context, m *util.Message) error {
+	reverted := h.revert(ctx, m)
+
+	// The order service waits for the compensation of an orchestrated saga
+	if m.Orchestrated() {
+		outcome := util.MESSAGE_ORDER_SUCCESS
+		if !reverted {
+			outcome = util.MESSAGE_ORDER_INTERNAL
 		}
+		util.PubToOrder(h.transport, ctx, m.Next(outcome))
+	}
 
-		return
+	if !reverted {
+		return errNotReverted.With("order_id", m.Order.OrderID)
+	}
+	return nil
+}
+
+// Returns false when the stock has to be reverted again
+func (h *stockRouteHandler) revert(ctx context.Context, m *util.Message) bool {
+	logger := logrus.WithField("track_id", m.TrackID)
+
+	// Make sure a stock message arriving after the revert is rejected
+	stockOutcome, err := h.dedup.Record(ctx, util.DedupKey("stock", m.TrackID, util.MESSAGE_STOCK), util.MESSAGE_ORDER_BADREQUEST)
+	if err != nil {
+		logger.WithError(err).Error("unable to block stock reservation of reverted saga")
+		return false
+	} else if stockOutcome != util.MESSAGE_ORDER_SUCCESS {
+		// Nothing was reserved in this saga
+		return true
 	}
 
-	util.PubToOrder(h.broker, ctx, orderChannelID, tracker, util.MESSAGE_ORDER_SUCCESS)
+	// Make sure a commit message arriving after the revert is rejected
+	commitOutcome, err := h.dedup.Record(ctx, util.DedupKey("stock", m.TrackID, util.MESSAGE_STOCK_COMMIT), util.MESSAGE_ORDER_BADREQUEST)
+	if err != nil {
+		logger.WithError(err).Error("unable to block stock commit of reverted saga")
+		return false
+	} else if commitOutcome != util.MESSAGE_ORDER_SUCCESS {
+		h.release(ctx, m.TrackID)
+		return true
+	}
+
+	key := util.DedupKey("stock", m.TrackID, util.MESSAGE_STOCK_REVERT)
+	outcome, err := h.dedup.Outcome(ctx, key)
+	if err != nil {
+		logger.WithError(err).Error("unable to check for duplicate stock revert")
+		return false
+	} else if outcome != "" {
+		logger.Info("stock of saga was already reverted")
+		return true
+	}
+
+	h.addItems(ctx, m.Order.Items)
+
+	_, err = h.dedup.Record(ctx, key, util.OUTCOME_DONE)
+	if err != nil {
+		logger.WithError(err).Error("unable to record stock revert")
+	}
+
+	return true
+}
+
+// Adds the stock of every item of a cancelled order once per saga, a repeated
+// message is answered with the outcome of the first one. Returns an error when
+// the outcome was not recorded.
+func (h *stockRouteHandler) RestockItems(ctx context.Context, m *util.Message) error {
+	logger := logrus.WithField("track_id", m.TrackID)
+	key := util.DedupKey("stock", m.TrackID, util.MESSAGE_RESTOCK)
+
+	outcome, err := h.dedup.Outcome(ctx, key)
+	if err != nil {
+		logger.WithError(err).Error("unable to check for duplicate restock")
+		util.PubToOrder(h.transport, ctx, m.Next(util.MESSAGE_ORDER_INTERNAL))
+		return err
+	}
+
+	var cause error
+	if outcome != "" {
+		logger.Info("replaying outcome of duplicate restock message")
+	} else {
+		outcome = util.MESSAGE_ORDER_SUCCESS
+		cause = h.stockStore.addItems(ctx, m.Order.Items)
+		if cause != nil {
+			outcome = util.ErrorOutcome(cause)
+		}
+		if outcome == util.MESSAGE_ORDER_INTERNAL {
+			// Internal errors are not recorded, so a redelivered message is retried
+			util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+			return cause
+		}
+
+		outcome, err = h.dedup.Record(ctx, key, outcome)
+		if err != nil {
+			logger.WithError(err).Error("unable to record restock outcome")
+			util.PubToOrder(h.transport, ctx, m.Next(util.MESSAGE_ORDER_INTERNAL))
+			return err
+		}
+	}
+
+	util.PubToOrder(h.transport, ctx, m.NextError(outcome, cause))
+	return nil
+}
+
+// Reserves the ordered quantity of every item, or none when one of the items is
+// out of stock. Returns the outcome and the error that caused a failure.
+func (h *stockRouteHandler) reserveItems(ctx context.Context, m *util.Message) (string, error) {
+	err := h.stockStore.reserve(ctx, m.TrackID, m.Order.Items, time.Now().Add(h.reservationTTL))
+	if err != nil {
+		return util.ErrorOutcome(err), err
+	}
+
+	return util.MESSAGE_ORDER_SUCCESS, nil
+}
+
+func (h *stockRouteHandler) release(ctx context.Context, reservationID string) {
+	err := h.stockStore.release(ctx, reservationID)
+	if err != nil {
+		logrus.WithError(err).WithField("reservation_id", reservationID).Error("unable to release stock reservation")
+	}
+}
+
+// Periodically releases the held reservations that expired, so the stock held
+// by abandoned checkouts becomes available again
+func (h *stockRouteHandler) sweepReservations(interval time.Duration) {
+	ctx := context.Background()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.sweep(ctx, time.Now())
+	}
+}
+
+// Releases the reservations that expired at the time and returns how many were
+// released
+func (h *stockRouteHandler) sweep(ctx context.Context, now time.Time) int {
+	ids, err := h.stockStore.expired(ctx, now)
+	if err != nil {
+		logrus.WithError(err).Error("unable to find expired stock reservations")
+		return 0
+	}
+
+	released := 0
+	for _, id := range ids {
+		err = h.stockStore.release(ctx, id)
+		if err != nil {
+			logrus.WithError(err).WithField("reservation_id", id).Error("unable to release expired stock reservation")
+			continue
+		}
+		released++
+	}
+	if released > 0 {
+		logrus.WithField("released", released).Info("released expired stock reservations")
+	}
+
+	return released
+}
+
+func (h *stockRouteHandler) addItems(ctx context.Context, items util.OrderItems) {
+	err := h.stockStore.addItems(ctx, items)
+	if err != nil {
+		logrus.WithField("items", items).WithError(err).Error("UNABLE TO REVERT STOCK SUBTRACTION")
+	}
 }
 
 // Returns success/failure, depending on the price status.
@@ -103,19 +401,30 @@ func (h *stockRouteHandler) SubtractStockItems(ctx context.Context, orderChannel
 func (h *stockRouteHandler) CreateStockItem(ctx *fasthttp.RequestCtx) {
 	price, err := strconv.Atoi(ctx.UserValue("price").(string))
 	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString("price should be an integer")
+		util.ErrorResponse(ctx, errs.New(errs.BadRequest, "price should be an integer"))
 		return
 	}
 
-	h.stockStore.Create(ctx, price)
+	stock, err := h.stockStore.Create(ctx, price)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.JSONResponse(ctx, fasthttp.StatusCreated, &createResponse{ItemID: stock.ID})
 }
 
 // Returns a stock item with their details (stockNumber, price)
 func (h *stockRouteHandler) FindStockItem(ctx *fasthttp.RequestCtx) {
 	itemID := ctx.UserValue("item_id").(string)
 
-	h.stockStore.Find(ctx, itemID)
+	stock, err := h.stockStore.Find(ctx, itemID)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.JSONResponse(ctx, fasthttp.StatusOK, stock)
 }
 
 // Returns success/failure, depending on the stockNumber status.
@@ -124,12 +433,17 @@ func (h *stockRouteHandler) AddStockNumber(ctx *fasthttp.RequestCtx) {
 	itemID := ctx.UserValue("item_id").(string)
 	number, err := strconv.Atoi(ctx.UserValue("number").(string))
 	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString("number should be an integer")
+		util.ErrorResponse(ctx, errs.New(errs.BadRequest, "number should be an integer"))
+		return
+	}
+
+	err = h.stockStore.add(ctx, itemID, number)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
 		return
 	}
 
-	h.stockStore.AddStock(ctx, itemID, number)
+	util.Ok(ctx)
 }
 
 // Returns success/failure, depending on the stockNumber status.
@@ -138,10 +452,29 @@ func (h *stockRouteHandler) SubtractStockNumber(ctx *fasthttp.RequestCtx) {
 	itemID := ctx.UserValue("item_id").(string)
 	number, err := strconv.Atoi(ctx.UserValue("number").(string))
 	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString("number should be an integer")
+		util.ErrorResponse(ctx, errs.New(errs.BadRequest, "number should be an integer"))
+		return
+	}
+
+	err = h.stockStore.subtract(ctx, itemID, number)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
 		return
 	}
 
-	h.stockStore.SubtractStock(ctx, itemID, number)
+	util.Ok(ctx)
+}
+
+// Prepares subtracting the stock of the order in the body for a two-phase commit
+// checkout
+func (h *stockRouteHandler) PrepareTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Prepare(ctx)
+}
+
+func (h *stockRouteHandler) CommitTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Commit(ctx)
+}
+
+func (h *stockRouteHandler) AbortTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Abort(ctx)
 }
@@ -0,0 +1,195 @@
+package stock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// fakeStore records the reservations that were released and the stock that was
+// added again
+type fakeStore struct {
+	stockStore
+
+	expiredIDs []string
+	expiredErr error
+	failing    string
+	commitErr  error
+	released   []string
+	added      []util.OrderItems
+}
+
+func (s *fakeStore) expired(context.Context, time.Time) ([]string, error) {
+	return s.expiredIDs, s.expiredErr
+}
+
+func (s *fakeStore) release(_ context.Context, reservationID string) error {
+	if reservationID == s.failing {
+		return util.INTERNAL_ERR
+	}
+	s.released = append(s.released, reservationID)
+	return nil
+}
+
+func (s *fakeStore) addItems(_ context.Context, items util.OrderItems) error {
+	s.added = append(s.added, items)
+	return nil
+}
+
+func (s *fakeStore) commit(context.Context, string) error {
+	if s.commitErr != nil {
+		return s.commitErr
+	}
+	return util.BAD_REQUEST
+}
+
+func (s *fakeStore) subtract(context.Context, string, int) error {
+	return util.BAD_REQUEST
+}
+
+type fakeDedup map[string]string
+
+func (d fakeDedup) Outcome(_ context.Context, key string) (string, error) {
+	return d[key], nil
+}
+
+func (d fakeDedup) Record(_ context.Context, key string, outcome string) (string, error) {
+	if recorded, ok := d[key]; ok {
+		return recorded, nil
+	}
+	d[key] = outcome
+	return outcome, nil
+}
+
+// fakeTransport records the queues messages were published to and their types
+type fakeTransport struct {
+	sent []string
+}
+
+func (t *fakeTransport) Pub(_ context.Context, queue string, body string) error {
+	m, err := util.DecodeMessage(body)
+	if err != nil {
+		return err
+	}
+	t.sent = append(t.sent, queue+" "+m.Type)
+	return nil
+}
+
+func (t *fakeTransport) Sub(context.Context, string, util.MessageHandler) error {
+	return nil
+}
+
+func (t *fakeTransport) Close(context.Context) error {
+	return nil
+}
+
+func TestSweepReleasesExpired(t *testing.T) {
+	store := &fakeStore{expiredIDs: []string{"a", "b", "c"}, failing: "b"}
+	h := &stockRouteHandler{stockStore: store}
+
+	assert.Equal(t, 2, h.sweep(context.Background(), time.Now()))
+	assert.Equal(t, []string{"a", "c"}, store.released)
+
+	// Failing to find the expired reservations is logged
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	store = &fakeStore{expiredErr: util.INTERNAL_ERR}
+	h = &stockRouteHandler{stockStore: store}
+	assert.Equal(t, 0, h.sweep(context.Background(), time.Now()))
+	if assert.NotNil(t, hook.LastEntry()) {
+		assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+		assert.Equal(t, util.INTERNAL_ERR, hook.LastEntry().Data[logrus.ErrorKey])
+	}
+}
+
+func TestRevertReleasesReservation(t *testing.T) {
+	store := &fakeStore{}
+	dedup := fakeDedup{util.DedupKey("stock", "track", util.MESSAGE_STOCK): util.MESSAGE_ORDER_SUCCESS}
+	h := &stockRouteHandler{stockStore: store, dedup: dedup}
+
+	m := util.NewMessage(util.MESSAGE_STOCK_REVERT, "channel", "track", &util.OrderPayload{Items: util.OrderItems{"item": 2}})
+	h.AddStockItems(context.Background(), m)
+
+	assert.Equal(t, []string{"track"}, store.released)
+	assert.Empty(t, store.added)
+	assert.Equal(t, util.MESSAGE_ORDER_BADREQUEST, dedup[util.DedupKey("stock", "track", util.MESSAGE_STOCK_COMMIT)])
+}
+
+func TestRevertAddsCommittedStock(t *testing.T) {
+	store := &fakeStore{}
+	dedup := fakeDedup{
+		util.DedupKey("stock", "track", util.MESSAGE_STOCK):        util.MESSAGE_ORDER_SUCCESS,
+		util.DedupKey("stock", "track", util.MESSAGE_STOCK_COMMIT): util.MESSAGE_ORDER_SUCCESS,
+	}
+	h := &stockRouteHandler{stockStore: store, dedup: dedup}
+
+	m := util.NewMessage(util.MESSAGE_STOCK_REVERT, "channel", "track", &util.OrderPayload{Items: util.OrderItems{"item": 2}})
+	h.AddStockItems(context.Background(), m)
+	h.AddStockItems(context.Background(), m)
+
+	assert.Empty(t, store.released)
+	assert.Equal(t, []util.OrderItems{{"item": 2}}, store.added)
+}
+
+func TestRevertWithoutReservation(t *testing.T) {
+	store := &fakeStore{}
+	h := &stockRouteHandler{stockStore: store, dedup: fakeDedup{}}
+
+	m := util.NewMessage(util.MESSAGE_STOCK_REVERT, "channel", "track", &util.OrderPayload{Items: util.OrderItems{"item": 2}})
+	h.AddStockItems(context.Background(), m)
+
+	assert.Empty(t, store.released)
+	assert.Empty(t, store.added)
+}
+
+func TestOrchestratedCommitOnlyReplies(t *testing.T) {
+	store := &fakeStore{}
+	transport := &fakeTransport{}
+	h := &stockRouteHandler{stockStore: store, dedup: fakeDedup{}, transport: transport}
+
+	m := util.NewMessage(util.MESSAGE_STOCK_COMMIT, "channel", "track", &util.OrderPayload{Items: util.OrderItems{"item": 2}})
+	m.Step = "commit_stock"
+	h.CommitStockItems(context.Background(), m)
+
+	// The order service compensates the failed commit itself
+	assert.Empty(t, store.released)
+	assert.Equal(t, []string{util.OrderChannel("channel") + " " + util.MESSAGE_ORDER_BADREQUEST}, transport.sent)
+}
+
+func TestInternalOutcomeNotRecorded(t *testing.T) {
+	store := &fakeStore{commitErr: util.INTERNAL_ERR}
+	dedup := fakeDedup{}
+	transport := &fakeTransport{}
+	h := &stockRouteHandler{stockStore: store, dedup: dedup, transport: transport}
+
+	m := util.NewMessage(util.MESSAGE_STOCK_COMMIT, "channel", "track", &util.OrderPayload{Items: util.OrderItems{"item": 2}})
+	m.Step = "commit_stock"
+	assert.Error(t, h.CommitStockItems(context.Background(), m))
+	assert.Empty(t, dedup)
+
+	// The redelivered message is handled again
+	store.commitErr = nil
+	assert.NoError(t, h.CommitStockItems(context.Background(), m))
+	assert.Equal(t, util.MESSAGE_ORDER_BADREQUEST, dedup[util.DedupKey("stock", "track", util.MESSAGE_STOCK_COMMIT)])
+	assert.Equal(t, []string{
+		util.OrderChannel("channel") + " " + util.MESSAGE_ORDER_INTERNAL,
+		util.OrderChannel("channel") + " " + util.MESSAGE_ORDER_BADREQUEST,
+	}, transport.sent)
+}
+
+func TestSubtractStockNumberOutOfStock(t *testing.T) {
+	h := &stockRouteHandler{stockStore: &fakeStore{}}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("item_id", "item")
+	ctx.SetUserValue("number", "5")
+	h.SubtractStockNumber(ctx)
+
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
@@ -1,7 +1,78 @@
 package stock
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/pkg/errors"
+)
+
+// Errors of the stock service, returned with the ID of the item or reservation
+var (
+	errItemNotFound         = errs.New(errs.NotFound, "item not found")
+	errInsufficientStock    = errs.New(errs.InsufficientStock, "item does not exist or has not enough stock")
+	errReservationNotFound  = errs.New(errs.NotFound, "reservation not found")
+	errReservationReleased  = errs.New(errs.InvalidState, "reservation was released")
+	errReservationCommitted = errs.New(errs.InvalidState, "reservation was committed")
+	errNotReverted          = errs.New(errs.Internal, "stock was not reverted")
+)
+
 type Stock struct {
-	ID     string `sql:"type:uuid;primary_key;default:uuid_generate_v4()"`
-	Price  int
-	Number int
+	ID     string `sql:"type:uuid;primary_key" json:"-"`
+	Price  int    `json:"price"`
+	Number int    `json:"stock"`
+}
+
+// Status of a stock reservation, held stock is subtracted from the items but
+// added again when the reservation is released or expires
+const (
+	ReservationHeld      = "held"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+)
+
+// StockReservation holds the stock of the items of a checkout, the ID is the
+// track ID of the checkout saga
+type StockReservation struct {
+	ID        string `sql:"type:uuid;primary_key"`
+	Status    string
+	ExpiresAt time.Time `sql:"index"`
+}
+
+// StockReservationItem is the quantity of an item held by a reservation
+type StockReservationItem struct {
+	ReservationID string `gorm:"type:uuid;primary_key"`
+	ItemID        string `gorm:"primary_key"`
+	Quantity      int
+}
+
+type createResponse struct {
+	ItemID string `json:"item_id"`
+}
+
+// MigrateRedisValue converts a stock item stored as a single JSON value to its
+// hash, ok is false when the value is not a stock item.
+func MigrateRedisValue(itemID string, value string) (util.RedisHashes, bool, error) {
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal([]byte(value), &fields) != nil || len(fields) != 2 {
+		return nil, false, nil
+	}
+	if _, ok := fields["price"]; !ok {
+		return nil, false, nil
+	}
+	if _, ok := fields["stock"]; !ok {
+		return nil, false, nil
+	}
+
+	stock := &Stock{}
+	err := json.Unmarshal([]byte(value), stock)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "malformed stock item")
+	}
+
+	return util.RedisHashes{
+		stockKey(itemID): {"price": stock.Price, "stock": stock.Number},
+	}, true, nil
 }
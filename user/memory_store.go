@@ -0,0 +1,249 @@
+package user
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util"
+)
+
+// memoryUserStore keeps the users, their ledgers and reservations and the counter
+// accounts in memory, a single lock makes every change atomic
+type memoryUserStore struct {
+	lock         sync.Mutex
+	users        map[string]*User
+	ledgers      map[string][]*LedgerEntry
+	counters     map[string][]*CounterEntry
+	reservations map[string]*Reservation
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{
+		users:        map[string]*User{},
+		ledgers:      map[string][]*LedgerEntry{},
+		counters:     map[string][]*CounterEntry{},
+		reservations: map[string]*Reservation{},
+	}
+}
+
+func (s *memoryUserStore) Create(_ context.Context) (*User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	user := &User{ID: uuid.Must(uuid.NewV4()).String()}
+	s.users[user.ID] = user
+
+	c := *user
+	return &c, nil
+}
+
+func (s *memoryUserStore) Remove(_ context.Context, userID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return errUserNotFound.With("user_id", userID)
+	}
+
+	delete(s.users, userID)
+	delete(s.ledgers, userID)
+	return nil
+}
+
+func (s *memoryUserStore) Find(_ context.Context, userID string) (*User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return nil, errUserNotFound.With("user_id", userID)
+	}
+
+	c := *user
+	return &c, nil
+}
+
+func (s *memoryUserStore) SubtractCredit(_ context.Context, entry *LedgerEntry) error {
+	return s.changeCredit(entry)
+}
+
+func (s *memoryUserStore) AddCredit(_ context.Context, entry *LedgerEntry) error {
+	return s.changeCredit(entry)
+}
+
+// Changes the credit of the user by the amount of the entry and records it, the
+// credit cannot go below the credit held by reservations. An entry that was
+// already recorded is not applied again.
+func (s *memoryUserStore) changeCredit(entry *LedgerEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	user, ok := s.users[entry.UserID]
+	if !ok {
+		return errUserNotFound.With("user_id", entry.UserID)
+	}
+
+	if recorded := s.recorded(entry.ID); recorded != nil {
+		if !recorded.sameChange(entry) {
+			return errEntryExists.With("entry_id", entry.ID)
+		}
+		return nil
+	}
+
+	held := 0
+	if entry.Amount < 0 {
+		held = s.heldCredit(entry.UserID, entry.CreatedAt)
+	}
+	if user.Credit-held+entry.Amount < 0 {
+		return errInsufficientCredit.With("user_id", entry.UserID).With("available", user.Credit-held)
+	}
+
+	user.Credit += entry.Amount
+	s.record(entry)
+
+	return nil
+}
+
+// Returns the ledger entry with the ID, or nil when it was not recorded, the lock
+// must be held
+func (s *memoryUserStore) recorded(entryID string) *LedgerEntry {
+	if entryID == "" {
+		return nil
+	}
+	for _, ledger := range s.ledgers {
+		for _, entry := range ledger {
+			if entry.ID == entryID {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// Appends a copy of the entry to the ledger of its user and its counter entry to
+// the counter account, the user must exist
+func (s *memoryUserStore) record(entry *LedgerEntry) {
+	if entry.ID == "" {
+		entry.ID = uuid.Must(uuid.NewV4()).String()
+	}
+	c := *entry
+	c.UserID = s.users[entry.UserID].ID
+	c.Reason = util.Clone(entry.Reason)
+	c.Reference = util.Clone(entry.Reference)
+	s.ledgers[c.UserID] = append(s.ledgers[c.UserID], &c)
+
+	counter := c.counterEntry()
+	s.counters[counter.Account] = append(s.counters[counter.Account], counter)
+}
+
+// Returns the credit of the user held by reservations that did not expire, the
+// lock must be held
+func (s *memoryUserStore) heldCredit(userID string, now time.Time) int {
+	held := 0
+	for _, r := range s.reservations {
+		if r.UserID == userID && r.active(now) {
+			held += r.Amount
+		}
+	}
+
+	return held
+}
+
+func (s *memoryUserStore) Reserve(_ context.Context, reservation *Reservation) (*Reservation, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	user, ok := s.users[reservation.UserID]
+	if !ok {
+		return nil, false, errUserNotFound.With("user_id", reservation.UserID)
+	}
+
+	if existing, ok := s.reservations[reservation.ID]; ok {
+		if existing.UserID != reservation.UserID || existing.Amount != reservation.Amount || !existing.active(now) {
+			return nil, false, errReservationExists.With("reservation_id", reservation.ID)
+		}
+
+		c := *existing
+		return &c, false, nil
+	}
+
+	held := s.heldCredit(reservation.UserID, now)
+	if user.Credit-held < reservation.Amount {
+		return nil, false, errInsufficientCredit.With("user_id", reservation.UserID).With("available", user.Credit-held)
+	}
+
+	c := *reservation
+	c.ID = util.Clone(reservation.ID)
+	c.UserID = user.ID
+	c.Reason = util.Clone(reservation.Reason)
+	c.Reference = util.Clone(reservation.Reference)
+	s.reservations[c.ID] = &c
+
+	return reservation, true, nil
+}
+
+func (s *memoryUserStore) Commit(_ context.Context, reservationID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	reservation, ok := s.reservations[reservationID]
+	if !ok {
+		return errReservationNotFound.With("reservation_id", reservationID)
+	}
+
+	if reservation.Status == ReservationCommitted {
+		return nil
+	} else if !reservation.active(now) {
+		return errReservationInactive.With("reservation_id", reservationID)
+	}
+
+	user, ok := s.users[reservation.UserID]
+	if !ok {
+		return errUserNotFound.With("user_id", reservation.UserID)
+	}
+
+	user.Credit -= reservation.Amount
+	s.record(reservation.ledgerEntry(now))
+	reservation.Status = ReservationCommitted
+
+	return nil
+}
+
+func (s *memoryUserStore) Release(_ context.Context, reservationID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reservation, ok := s.reservations[reservationID]
+	if !ok {
+		return errReservationNotFound.With("reservation_id", reservationID)
+	}
+
+	if reservation.Status == ReservationCommitted {
+		return errReservationDone.With("reservation_id", reservationID)
+	}
+	reservation.Status = ReservationReleased
+
+	return nil
+}
+
+func (s *memoryUserStore) Ledger(_ context.Context, userID string, offset int, limit int) ([]*LedgerEntry, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, 0, errUserNotFound.With("user_id", userID)
+	}
+
+	ledger := s.ledgers[userID]
+	entries := []*LedgerEntry{}
+	for i := offset; i < len(ledger) && i < offset+limit; i++ {
+		c := *ledger[i]
+		entries = append(entries, &c)
+	}
+
+	return entries, len(ledger), nil
+}
@@ -0,0 +1,83 @@
+package user
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryReservationsCannotExceedCredit(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryUserStore()
+	user, err := store.Create(ctx)
+	require.NoError(t, err)
+	require.NoError(t, store.AddCredit(ctx, &LedgerEntry{UserID: user.ID, Amount: 10, Reason: ReasonDeposit, CreatedAt: time.Now()}))
+
+	// Only five of the reservations fit in the credit
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	reserved := []string{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := uuid.Must(uuid.NewV4()).String()
+			_, _, err := store.Reserve(ctx, &Reservation{ID: id, UserID: user.ID, Amount: 2, Status: ReservationHeld, ExpiresAt: time.Now().Add(time.Minute)})
+			if err == nil {
+				lock.Lock()
+				reserved = append(reserved, id)
+				lock.Unlock()
+			} else {
+				assert.True(t, errs.Is(err, errs.InsufficientCredit))
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, reserved, 5)
+
+	// Held credit cannot be spent
+	err = store.SubtractCredit(ctx, &LedgerEntry{UserID: user.ID, Amount: -1, CreatedAt: time.Now()})
+	assert.True(t, errs.Is(err, errs.InsufficientCredit))
+
+	require.NoError(t, store.Commit(ctx, reserved[0]))
+	require.NoError(t, store.Release(ctx, reserved[1]))
+	assert.True(t, errs.Is(store.Release(ctx, reserved[0]), errs.InvalidState))
+	assert.True(t, errs.Is(store.Commit(ctx, reserved[1]), errs.InvalidState))
+
+	found, err := store.Find(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 8, found.Credit)
+
+	entries, total, err := store.Ledger(ctx, user.ID, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, -2, entries[1].Amount)
+}
+
+func TestMemoryLedgerCounterEntries(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryUserStore()
+	user, err := store.Create(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, store.AddCredit(ctx, &LedgerEntry{UserID: user.ID, Amount: 10, Reason: ReasonDeposit, CreatedAt: time.Now()}))
+	require.NoError(t, store.SubtractCredit(ctx, &LedgerEntry{UserID: user.ID, Amount: -4, Reason: ReasonPayment, CreatedAt: time.Now()}))
+
+	// Every entry is balanced by an entry on its counter account
+	entries, _, err := store.Ledger(ctx, user.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, store.counters[AccountCash], 1)
+	require.Len(t, store.counters[AccountSales], 1)
+	assert.Equal(t, &CounterEntry{EntryID: entries[0].ID, Account: AccountCash, Amount: -10, CreatedAt: entries[0].CreatedAt}, store.counters[AccountCash][0])
+	assert.Equal(t, 4, store.counters[AccountSales][0].Amount)
+
+	// The ledger is removed with the user
+	require.NoError(t, store.Remove(ctx, user.ID))
+	assert.Empty(t, store.ledgers[user.ID])
+}
@@ -1,12 +1,13 @@
 package user
 
 import (
-	"fmt"
+	"context"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 
 	errwrap "github.com/pkg/errors"
 )
@@ -18,112 +19,495 @@ type postgresUserStore struct {
 
 func newPostgresUserStore(db *gorm.DB, urls *util.Services) *postgresUserStore {
 	// AutoMigrate structs to create or update database tables
-	err := db.AutoMigrate(&User{}).Error
+	err := db.AutoMigrate(&User{}, &LedgerEntry{}, &CounterEntry{}, &Reservation{}).Error
 	if err != nil {
 		panic(err)
 	}
 
+	opened, err := openLedgers(db)
+	if err != nil {
+		panic(err)
+	} else if opened > 0 {
+		logrus.WithField("users", opened).Info("recorded opening balances in the ledger")
+	}
+
 	return &postgresUserStore{
 		db:   db,
 		urls: urls,
 	}
 }
 
-func (s *postgresUserStore) Create(ctx *fasthttp.RequestCtx) {
+// BeforeCreate generates the ID of the user
+func (u *User) BeforeCreate(scope *gorm.Scope) error {
+	return util.GenerateID(scope)
+}
+
+// BeforeCreate generates the ID of the ledger entry
+func (l *LedgerEntry) BeforeCreate(scope *gorm.Scope) error {
+	return util.GenerateID(scope)
+}
+
+func (s *postgresUserStore) Create(_ context.Context) (*User, error) {
 	user := &User{}
 	err := s.db.Model(&User{}).
 		Create(user).
 		Error
 	if err != nil {
 		logrus.WithError(err).Error("unable to create new user")
-		util.InternalServerError(ctx)
-		return
+		return nil, util.INTERNAL_ERR
 	}
 
-	util.JSONResponse(ctx, fasthttp.StatusCreated, fmt.Sprintf("{\"user_id\": \"%s\"}", user.ID))
+	return user, nil
 }
 
-func (s *postgresUserStore) Remove(ctx *fasthttp.RequestCtx, userID string) {
-	err := s.db.Model(&User{}).
-		Delete(&User{ID: userID}).
-		Error
-	if err != nil {
-		logrus.WithError(err).Error("unable to remove user")
-		util.InternalServerError(ctx)
+func (s *postgresUserStore) Remove(_ context.Context, userID string) error {
+	del := s.db.Model(&User{}).
+		Where("id = ?", userID).
+		Delete(&User{})
+	if del.Error != nil {
+		logrus.WithError(del.Error).Error("unable to remove user")
+		return util.INTERNAL_ERR
+	} else if del.RowsAffected == 0 {
+		return errUserNotFound.With("user_id", userID)
 	}
 
-	util.Ok(ctx)
+	return nil
 }
 
-func (s *postgresUserStore) Find(ctx *fasthttp.RequestCtx, userID string) {
+func (s *postgresUserStore) Find(_ context.Context, userID string) (*User, error) {
 	user := &User{}
 	err := s.db.Model(&User{}).
 		Where("id = ?", userID).
 		First(user).
 		Error
 	if err == gorm.ErrRecordNotFound {
-		util.NotFound(ctx)
-		return
+		return nil, errUserNotFound.With("user_id", userID)
 	} else if err != nil {
 		logrus.WithError(err).Error("unable to find user")
-		util.InternalServerError(ctx)
-		return
+		return nil, util.INTERNAL_ERR
 	}
 
-	util.JSONResponse(ctx, fasthttp.StatusOK, fmt.Sprintf("{\"user_id\": \"%s\", \"credit\": %d}", user.ID, user.Credit))
+	return user, nil
+}
+
+func (s *postgresUserStore) SubtractCredit(_ context.Context, entry *LedgerEntry) error {
+	return s.changeCredit(entry, "unable to subtract credit")
+}
+
+func (s *postgresUserStore) AddCredit(_ context.Context, entry *LedgerEntry) error {
+	return s.changeCredit(entry, "unable to add credit")
 }
 
-func (s *postgresUserStore) SubtractCredit(ctx *fasthttp.RequestCtx, userID string, amount int) {
+// Changes the credit of the user and records the entry in the same transaction
+func (s *postgresUserStore) changeCredit(entry *LedgerEntry, errMsg string) error {
 	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return applyEntry(tx, entry)
+	})
+	if errwrap.Cause(err) == gorm.ErrRecordNotFound {
+		return errUserNotFound.With("user_id", entry.UserID)
+	} else if errs.Is(err, errs.InsufficientCredit) || errs.Is(err, errs.Conflict) {
+		return err
+	} else if err != nil {
+		logrus.WithError(err).Error(errMsg)
+		return util.INTERNAL_ERR
+	}
+
+	return nil
+}
+
+// Changes the credit of the user by the amount of the entry and records it, the
+// credit cannot go below the credit held by reservations. An entry that was
+// already recorded is not applied again.
+func applyEntry(tx *gorm.DB, entry *LedgerEntry) error {
+	user, err := lockUser(tx, entry.UserID)
+	if err != nil {
+		return err
+	}
+
+	recorded, err := entryRecorded(tx, entry)
+	if err != nil || recorded {
+		return err
+	}
+
+	held := 0
+	if entry.Amount < 0 {
+		held, err = heldCredit(tx, entry.UserID, entry.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	if user.Credit-held+entry.Amount < 0 {
+		return errInsufficientCredit.With("user_id", entry.UserID).With("available", user.Credit-held)
+	}
+
+	err = tx.Model(&User{}).
+		Where("id = ?", entry.UserID).
+		Update("credit", gorm.Expr("credit + ?", entry.Amount)).
+		Error
+	if err != nil {
+		return errwrap.Wrap(err, "unable to update credit")
+	}
+
+	return recordEntry(tx, entry)
+}
+
+// Returns whether the entry was already recorded, the entry recorded with its ID
+// has to be the same change
+func entryRecorded(tx *gorm.DB, entry *LedgerEntry) (bool, error) {
+	if entry.ID == "" {
+		return false, nil
+	}
+
+	recorded := &LedgerEntry{}
+	err := tx.Model(&LedgerEntry{}).
+		Where("id = ?", entry.ID).
+		First(recorded).
+		Error
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errwrap.Wrap(err, "unable to retrieve ledger entry")
+	}
+
+	if !recorded.sameChange(entry) {
+		return false, errEntryExists.With("entry_id", entry.ID)
+	}
+	return true, nil
+}
+
+// Records the ledger entry with its counter entry
+func recordEntry(tx *gorm.DB, entry *LedgerEntry) error {
+	err := tx.Create(entry).Error
+	if err != nil {
+		return errwrap.Wrap(err, "unable to record ledger entry")
+	}
+
+	err = tx.Create(entry.counterEntry()).Error
+	if err != nil {
+		return errwrap.Wrap(err, "unable to record counter entry")
+	}
+
+	return nil
+}
+
+// Records the credit of users that have credit but no ledger, as they existed
+// before the ledger, as their opening balance. Returns the number of users.
+func openLedgers(db *gorm.DB) (int, error) {
+	opened := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Block credit changes while the balances are recorded
+		if !util.IsSQLite(tx) {
+			err := tx.Exec("LOCK TABLE users IN EXCLUSIVE MODE").Error
+			if err != nil {
+				return errwrap.Wrap(err, "unable to lock users")
+			}
+		}
+
+		users := []*User{}
 		err := tx.Model(&User{}).
-			Where("id = ?", userID).
-			Update("credit", gorm.Expr("credit - ?", amount)).
+			Where("credit <> 0").
+			Where("NOT EXISTS (SELECT 1 FROM ledger_entries WHERE ledger_entries.user_id = users.id)").
+			Find(&users).
 			Error
+		if err != nil {
+			return errwrap.Wrap(err, "unable to get users without ledger")
+		}
+
+		now := time.Now()
+		for _, user := range users {
+			err = recordEntry(tx, openingBalance(user.ID, user.Credit, now))
+			if err != nil {
+				return errwrap.Wrapf(err, "unable to record opening balance of user %s", user.ID)
+			}
+		}
+		opened = len(users)
+
+		return nil
+	})
+
+	return opened, err
+}
+
+// Subtracts the cost of the order from the credit of the user in the prepared
+// transaction of a two-phase commit checkout
+func prepareCheckout(tx *gorm.DB, order *util.OrderPayload) error {
+	entry := &LedgerEntry{
+		UserID:    order.UserID,
+		Amount:    -order.Cost,
+		Reason:    ReasonPayment,
+		Reference: order.OrderID,
+		CreatedAt: time.Now(),
+	}
+
+	err := applyEntry(tx, entry)
+	if errwrap.Cause(err) == gorm.ErrRecordNotFound {
+		return errUserNotFound.With("user_id", order.UserID)
+	} else if errs.Is(err, errs.InsufficientCredit) {
+		return err
+	} else if err != nil {
+		logrus.WithError(err).WithField("order_id", order.OrderID).Error("unable to prepare checkout")
+		return util.INTERNAL_ERR
+	}
+
+	return nil
+}
+
+func (s *postgresUserStore) Reserve(_ context.Context, reservation *Reservation) (*Reservation, bool, error) {
+	var result error
+	created := true
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		user, err := lockUser(tx, reservation.UserID)
 		if err == gorm.ErrRecordNotFound {
-			util.NotFound(ctx)
+			result = errUserNotFound.With("user_id", reservation.UserID)
 			return errwrap.Wrap(err, "user not found")
 		} else if err != nil {
-			util.InternalServerError(ctx)
-			return errwrap.Wrap(err, "unable to update credit")
+			result = util.INTERNAL_ERR
+			return err
 		}
 
-		user := &User{}
-		err = tx.Model(&User{}).
-			Where("id = ?", userID).
-			Where("credit - ? > 0", amount).
-			First(user).
+		existing := &Reservation{}
+		err = tx.Model(&Reservation{}).
+			Where("id = ?", reservation.ID).
+			First(existing).
 			Error
+		if err == nil {
+			if existing.UserID != reservation.UserID || existing.Amount != reservation.Amount || !existing.active(now) {
+				result = errReservationExists.With("reservation_id", reservation.ID)
+				return errwrap.New("reservation already exists")
+			}
+
+			reservation = existing
+			created = false
+			return nil
+		} else if err != gorm.ErrRecordNotFound {
+			result = util.INTERNAL_ERR
+			return errwrap.Wrap(err, "unable to get reservation")
+		}
+
+		held, err := heldCredit(tx, reservation.UserID, now)
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return err
+		}
+		if user.Credit-held < reservation.Amount {
+			result = errInsufficientCredit.With("user_id", reservation.UserID).With("available", user.Credit-held)
+			return errwrap.New("not enough credit to reserve")
+		}
+
+		err = tx.Create(reservation).Error
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return errwrap.Wrap(err, "unable to create reservation")
+		}
+
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to reserve credit")
+		return nil, false, result
+	}
+
+	return reservation, created, nil
+}
+
+func (s *postgresUserStore) Commit(_ context.Context, reservationID string) error {
+	var result error
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		reservation, err := lockReservation(tx, reservationID)
 		if err == gorm.ErrRecordNotFound {
-			util.BadRequest(ctx)
-			return errwrap.Wrap(err, "credit cannot go below 0")
+			result = errReservationNotFound.With("reservation_id", reservationID)
+			return errwrap.Wrap(err, "reservation not found")
 		} else if err != nil {
-			util.InternalServerError(ctx)
-			return errwrap.Wrap(err, "unable to get user")
+			result = util.INTERNAL_ERR
+			return err
+		}
+
+		if reservation.Status == ReservationCommitted {
+			return nil
+		} else if !reservation.active(now) {
+			result = errReservationInactive.With("reservation_id", reservationID)
+			return errwrap.New("reservation was released or expired")
+		}
+
+		update := tx.Model(&User{}).
+			Where("id = ?", reservation.UserID).
+			Update("credit", gorm.Expr("credit - ?", reservation.Amount))
+		if update.Error != nil {
+			result = util.INTERNAL_ERR
+			return errwrap.Wrap(update.Error, "unable to update credit")
+		} else if update.RowsAffected == 0 {
+			result = errUserNotFound.With("user_id", reservation.UserID)
+			return errwrap.New("user of reservation not found")
+		}
+
+		err = recordEntry(tx, reservation.ledgerEntry(now))
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return err
+		}
+
+		err = setReservationStatus(tx, reservationID, ReservationCommitted)
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit reservation")
+		return result
+	}
+
+	return nil
+}
+
+func (s *postgresUserStore) Release(_ context.Context, reservationID string) error {
+	var result error
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		reservation, err := lockReservation(tx, reservationID)
+		if err == gorm.ErrRecordNotFound {
+			result = errReservationNotFound.With("reservation_id", reservationID)
+			return errwrap.Wrap(err, "reservation not found")
+		} else if err != nil {
+			result = util.INTERNAL_ERR
+			return err
+		}
+
+		if reservation.Status == ReservationCommitted {
+			result = errReservationDone.With("reservation_id", reservationID)
+			return errwrap.New("reservation was committed")
+		}
+
+		err = setReservationStatus(tx, reservationID, ReservationReleased)
+		if err != nil {
+			result = util.INTERNAL_ERR
+			return err
 		}
 
 		return nil
 	})
 	if err != nil {
-		logrus.WithError(err).Error("unable to subtract credit")
-		return
+		logrus.WithError(err).Error("unable to release reservation")
+		return result
 	}
 
-	util.Ok(ctx)
+	return nil
 }
 
-func (s *postgresUserStore) AddCredit(ctx *fasthttp.RequestCtx, userID string, amount int) {
+// Returns the user and locks it until the end of the transaction, so changes of
+// the credit and reservations of a user happen one at a time
+func lockUser(tx *gorm.DB, userID string) (*User, error) {
+	user := &User{}
+	err := util.ForUpdate(tx).
+		Model(&User{}).
+		Where("id = ?", userID).
+		First(user).
+		Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errwrap.Wrap(err, "unable to get user")
+	}
+
+	return user, err
+}
+
+func lockReservation(tx *gorm.DB, reservationID string) (*Reservation, error) {
+	reservation := &Reservation{}
+	err := util.ForUpdate(tx).
+		Model(&Reservation{}).
+		Where("id = ?", reservationID).
+		First(reservation).
+		Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errwrap.Wrap(err, "unable to get reservation")
+	}
+
+	return reservation, err
+}
+
+func setReservationStatus(tx *gorm.DB, reservationID string, status string) error {
+	err := tx.Model(&Reservation{}).
+		Where("id = ?", reservationID).
+		Update("status", status).
+		Error
+	if err != nil {
+		return errwrap.Wrap(err, "unable to update reservation")
+	}
+
+	return nil
+}
+
+// Returns the credit of the user held by reservations that did not expire
+func heldCredit(tx *gorm.DB, userID string, now time.Time) (int, error) {
+	held := 0
+	err := tx.Model(&Reservation{}).
+		Where("user_id = ? AND status = ? AND expires_at > ?", userID, ReservationHeld, now).
+		Select("COALESCE(SUM(amount), 0)").
+		Row().
+		Scan(&held)
+	if err != nil {
+		return 0, errwrap.Wrap(err, "unable to get held credit")
+	}
+
+	return held, nil
+}
+
+func (s *postgresUserStore) Ledger(_ context.Context, userID string, offset int, limit int) ([]*LedgerEntry, int, error) {
 	err := s.db.Model(&User{}).
 		Where("id = ?", userID).
-		Update("credit", gorm.Expr("credit + ?", amount)).
+		First(&User{}).
 		Error
 	if err == gorm.ErrRecordNotFound {
-		util.NotFound(ctx)
-		return
+		return nil, 0, errUserNotFound.With("user_id", userID)
 	} else if err != nil {
-		logrus.WithError(err).Error("unable to add credit")
-		util.InternalServerError(ctx)
-		return
+		logrus.WithError(err).Error("unable to find user")
+		return nil, 0, util.INTERNAL_ERR
+	}
+
+	total := 0
+	err = s.db.Model(&LedgerEntry{}).
+		Where("user_id = ?", userID).
+		Count(&total).
+		Error
+	if err != nil {
+		logrus.WithError(err).Error("unable to count ledger entries")
+		return nil, 0, util.INTERNAL_ERR
+	}
+
+	entries := []*LedgerEntry{}
+	err = s.db.Model(&LedgerEntry{}).
+		Where("user_id = ?", userID).
+		Order("created_at, id").
+		Offset(offset).
+		Limit(limit).
+		Find(&entries).
+		Error
+	if err != nil {
+		logrus.WithError(err).Error("unable to get ledger entries")
+		return nil, 0, util.INTERNAL_ERR
+	}
+
+	return entries, total, nil
+}
+
+// CheckPostgresLedger returns the users whose credit is not the total of their
+// ledger entries.
+func CheckPostgresLedger(db *gorm.DB) ([]*Mismatch, error) {
+	mismatches := []*Mismatch{}
+	err := db.Raw(`SELECT users.id AS user_id, users.credit AS credit, COALESCE(SUM(ledger_entries.amount), 0) AS ledger
+		FROM users LEFT JOIN ledger_entries ON ledger_entries.user_id = users.id
+		GROUP BY users.id, users.credit
+		HAVING users.credit <> COALESCE(SUM(ledger_entries.amount), 0)`).
+		Scan(&mismatches).
+		Error
+	if err != nil {
+		return nil, errwrap.Wrap(err, "unable to compare credit to ledger")
 	}
 
-	util.Ok(ctx)
+	return mismatches, nil
 }
@@ -1,98 +1,599 @@
 package user
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gofrs/uuid"
 	"github.com/martijnjanssen/redi-shop/util"
+	errwrap "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 )
 
-// Script with condition checking
-var decrByXX = redis.NewScript(`
-		if tonumber(redis.call("GET", KEYS[1])) - ARGV[1] > -1 then
-      return redis.call("DECRBY", KEYS[1], ARGV[1])
-    end
-    return false
+// Results of the credit scripts
+const (
+	creditOk           = 0
+	creditNotFound     = 1
+	creditInsufficient = 2
+	creditConflict     = 3
+	creditReserved     = 4
+)
+
+// Lua function returning the credit held by the reservations in the holds hash,
+// reservations that expired at time now are removed first
+const heldCreditLua = `
+		local function held(holds, expiry, now)
+			for _, id in ipairs(redis.call("ZRANGEBYSCORE", expiry, "-inf", now)) do
+				redis.call("HDEL", holds, id)
+			end
+			redis.call("ZREMRANGEBYSCORE", expiry, "-inf", now)
+			local total = 0
+			for _, amount in ipairs(redis.call("HVALS", holds)) do
+				total = total + tonumber(amount)
+			end
+			return total
+		end
+	`
+
+// Changes the credit of user KEYS[1] by ARGV[1] and appends entry ARGV[2] to its
+// ledger in KEYS[2] and counter entry ARGV[4] to the counter account KEYS[5]. The
+// credit cannot go below the credit held at time ARGV[3] by the reservations in
+// KEYS[3] and KEYS[4]. An entry given an ID ARGV[5] is recorded in KEYS[6] and
+// not applied again.
+var changeCredit = redis.NewScript(heldCreditLua + `
+		local credit = redis.call("GET", KEYS[1])
+		if not credit then
+			return 1
+		end
+		if ARGV[5] ~= "" then
+			local recorded = redis.call("HGET", KEYS[6], ARGV[5])
+			if recorded == ARGV[1] then
+				return 0
+			elseif recorded then
+				return 3
+			end
+		end
+		local available = tonumber(credit)
+		if tonumber(ARGV[1]) < 0 then
+			available = available - held(KEYS[3], KEYS[4], ARGV[3])
+		end
+		if available + tonumber(ARGV[1]) < 0 then
+			return 2
+		end
+		if ARGV[5] ~= "" then
+			redis.call("HSET", KEYS[6], ARGV[5], ARGV[1])
+		end
+		redis.call("INCRBY", KEYS[1], ARGV[1])
+		redis.call("RPUSH", KEYS[2], ARGV[2])
+		redis.call("RPUSH", KEYS[5], ARGV[4])
+		return 0
+	`)
+
+// Creates reservation KEYS[2] with ID ARGV[1] holding ARGV[3] of the credit of
+// user KEYS[1] (ARGV[2]) until ARGV[6], when the credit that is not held at time
+// ARGV[7] by the reservations in KEYS[3] and KEYS[4] allows it.
+var reserveCredit = redis.NewScript(heldCreditLua + `
+		local credit = redis.call("GET", KEYS[1])
+		if not credit then
+			return 1
+		end
+		if redis.call("EXISTS", KEYS[2]) == 1 then
+			local r = redis.call("HMGET", KEYS[2], "user_id", "amount", "status", "expires_at")
+			if r[1] == ARGV[2] and r[2] == ARGV[3] and r[3] == "held" and tonumber(r[4]) > tonumber(ARGV[7]) then
+				return 4
+			end
+			return 3
+		end
+		if tonumber(credit) - held(KEYS[3], KEYS[4], ARGV[7]) < tonumber(ARGV[3]) then
+			return 2
+		end
+		redis.call("HSET", KEYS[2], "user_id", ARGV[2], "amount", ARGV[3], "reason", ARGV[4], "reference", ARGV[5], "status", "held", "expires_at", ARGV[6])
+		redis.call("HSET", KEYS[3], ARGV[1], ARGV[3])
+		redis.call("ZADD", KEYS[4], ARGV[6], ARGV[1])
+		return 0
+	`)
+
+// Subtracts the credit held by reservation KEYS[1] with ID ARGV[1] from user
+// KEYS[2] and appends entry ARGV[3] to its ledger in KEYS[5] and counter entry
+// ARGV[4] to the counter account KEYS[6], when the reservation is still held at
+// time ARGV[2]. The reservation expires after ARGV[5] milliseconds.
+var commitCredit = redis.NewScript(`
+		local r = redis.call("HMGET", KEYS[1], "status", "expires_at", "amount")
+		if not r[1] then
+			return 1
+		end
+		if r[1] == "committed" then
+			return 0
+		end
+		if r[1] ~= "held" or tonumber(r[2]) <= tonumber(ARGV[2]) then
+			return 3
+		end
+		if redis.call("EXISTS", KEYS[2]) == 0 then
+			return 1
+		end
+		redis.call("HSET", KEYS[1], "status", "committed")
+		redis.call("PEXPIRE", KEYS[1], ARGV[5])
+		redis.call("HDEL", KEYS[3], ARGV[1])
+		redis.call("ZREM", KEYS[4], ARGV[1])
+		redis.call("DECRBY", KEYS[2], r[3])
+		redis.call("RPUSH", KEYS[5], ARGV[3])
+		redis.call("RPUSH", KEYS[6], ARGV[4])
+		return 0
 	`)
 
+// Releases reservation KEYS[1] with ID ARGV[1] unless it was committed, the
+// reservation expires after ARGV[2] milliseconds
+var releaseCredit = redis.NewScript(`
+		local status = redis.call("HGET", KEYS[1], "status")
+		if not status then
+			return 1
+		end
+		if status == "committed" then
+			return 3
+		end
+		redis.call("HSET", KEYS[1], "status", "released")
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		redis.call("HDEL", KEYS[2], ARGV[1])
+		redis.call("ZREM", KEYS[3], ARGV[1])
+		return 0
+	`)
+
+// Records the credit ARGV[1] of user KEYS[1] as its opening balance, appending
+// entry ARGV[2] to its ledger in KEYS[2] and counter entry ARGV[3] to the counter
+// account KEYS[3], unless the credit changed or the user has a ledger
+var openLedger = redis.NewScript(`
+		if redis.call("GET", KEYS[1]) ~= ARGV[1] or redis.call("EXISTS", KEYS[2]) == 1 then
+			return 0
+		end
+		redis.call("RPUSH", KEYS[2], ARGV[2])
+		redis.call("RPUSH", KEYS[3], ARGV[3])
+		return 1
+	`)
+
+// List of the ledger entries of a user, oldest first
+func ledgerKey(userID string) string {
+	return "ledger:" + userID
+}
+
+// Hash with the amounts of the ledger entries of a user that were given an ID
+func entriesKey(userID string) string {
+	return "ledger:" + userID + ":entries"
+}
+
+// List of the entries of a counter account, oldest first
+func counterKey(account string) string {
+	return "ledger:account:" + account
+}
+
+// Hash with the amount, status and expiry of a reservation
+func reservationKey(reservationID string) string {
+	return "reservation:" + reservationID
+}
+
+// Hash with the amounts of the held reservations of a user
+func holdsKey(userID string) string {
+	return "holds:" + userID
+}
+
+// Sorted set with the held reservations of a user by expiry
+func holdExpiryKey(userID string) string {
+	return "holds:" + userID + ":expiry"
+}
+
+// Keys of the credit scripts, the credit and ledger of the user are followed by
+// its held reservations, the counter account of the entry and the entries of the
+// user that were given an ID
+func creditKeys(entry *LedgerEntry) []string {
+	userID := entry.UserID
+	return []string{userID, ledgerKey(userID), holdsKey(userID), holdExpiryKey(userID), counterKey(counterAccount(entry.Reason)), entriesKey(userID)}
+}
+
 type redisUserStore struct {
 	store *redis.Client
+	// Time a committed or released reservation is kept, so a late reserve of a
+	// released reservation is still refused. Held reservations are kept until
+	// they are committed or released.
+	reservationTTL time.Duration
 }
 
-func newRedisUserStore(c *redis.Client) *redisUserStore {
-	// AutoMigrate structs to create or update database tables
+func newRedisUserStore(c *redis.Client, reservationTTL time.Duration) *redisUserStore {
 	return &redisUserStore{
-		store: c,
+		store:          c,
+		reservationTTL: reservationTTL,
 	}
 }
 
-func (s *redisUserStore) Create(ctx *fasthttp.RequestCtx) {
+func (s *redisUserStore) Create(ctx context.Context) (*User, error) {
 	var userID string
 	created := false
 	for !created {
 		userID = uuid.Must(uuid.NewV4()).String()
 		set := s.store.SetNX(ctx, userID, 0, 0)
 		if set.Err() != nil {
-			logrus.WithError(set.Err()).Error("unable to create new order")
-			util.InternalServerError(ctx)
-			return
+			logrus.WithError(set.Err()).Error("unable to create new user")
+			return nil, util.INTERNAL_ERR
 		}
 
 		created = set.Val()
 	}
 
-	util.JSONResponse(ctx, fasthttp.StatusCreated, fmt.Sprintf("{\"user_id\": \"%s\"}", userID))
+	return &User{ID: userID}, nil
 }
 
-func (s *redisUserStore) Remove(ctx *fasthttp.RequestCtx, userID string) {
-	del := s.store.Del(ctx, userID)
-	if del.Err() != nil {
-		logrus.WithError(del.Err()).Error("unable to remove user")
-		util.InternalServerError(ctx)
-		return
+func (s *redisUserStore) Remove(ctx context.Context, userID string) error {
+	var del *redis.IntCmd
+	_, err := s.store.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, userID)
+		pipe.Del(ctx, ledgerKey(userID), entriesKey(userID), holdsKey(userID), holdExpiryKey(userID))
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to remove user")
+		return util.INTERNAL_ERR
+	} else if del.Val() == 0 {
+		return errUserNotFound.With("user_id", userID)
 	}
 
-	util.Ok(ctx)
+	return nil
 }
 
-func (s *redisUserStore) Find(ctx *fasthttp.RequestCtx, userID string) {
+func (s *redisUserStore) Find(ctx context.Context, userID string) (*User, error) {
 	get := s.store.Get(ctx, userID)
 	if get.Err() == redis.Nil {
-		util.NotFound(ctx)
-		return
+		return nil, errUserNotFound.With("user_id", userID)
 	} else if get.Err() != nil {
 		logrus.WithError(get.Err()).Error("unable to find user")
-		util.InternalServerError(ctx)
-		return
+		return nil, util.INTERNAL_ERR
+	}
+
+	credit, err := strconv.Atoi(get.Val())
+	if err != nil {
+		logrus.WithError(err).WithField("credit", get.Val()).Error("malformed user credit")
+		return nil, util.INTERNAL_ERR
+	}
+
+	return &User{ID: userID, Credit: credit}, nil
+}
+
+func (s *redisUserStore) SubtractCredit(ctx context.Context, entry *LedgerEntry) error {
+	return s.changeCredit(ctx, entry, "unable to subtract credit")
+}
+
+func (s *redisUserStore) AddCredit(ctx context.Context, entry *LedgerEntry) error {
+	return s.changeCredit(ctx, entry, "unable to add credit")
+}
+
+func (s *redisUserStore) changeCredit(ctx context.Context, entry *LedgerEntry, errMsg string) error {
+	entryID := entry.ID
+	b, counter, err := encodeEntry(entry)
+	if err != nil {
+		logrus.WithError(err).Error("unable to encode ledger entry")
+		return util.INTERNAL_ERR
+	}
+
+	res := changeCredit.Run(ctx, s.store, creditKeys(entry), entry.Amount, b, unixMilli(entry.CreatedAt), counter, entryID)
+	return creditResult(res, errUserNotFound.With("user_id", entry.UserID), errEntryExists.With("entry_id", entryID), errMsg)
+}
+
+func (s *redisUserStore) Reserve(ctx context.Context, reservation *Reservation) (*Reservation, bool, error) {
+	keys := []string{reservation.UserID, reservationKey(reservation.ID), holdsKey(reservation.UserID), holdExpiryKey(reservation.UserID)}
+	res := reserveCredit.Run(ctx, s.store, keys,
+		reservation.ID,
+		reservation.UserID,
+		reservation.Amount,
+		reservation.Reason,
+		reservation.Reference,
+		unixMilli(reservation.ExpiresAt),
+		unixMilli(time.Now()),
+	)
+	code, err := res.Int()
+	if err != nil {
+		logrus.WithError(err).Error("unable to reserve credit")
+		return nil, false, util.INTERNAL_ERR
+	}
+
+	switch code {
+	case creditOk:
+		return reservation, true, nil
+	case creditReserved:
+		existing, err := s.getReservation(ctx, reservation.ID)
+		if err != nil {
+			logrus.WithError(err).Error("unable to get reservation")
+			return nil, false, util.INTERNAL_ERR
+		}
+		return existing, false, nil
+	default:
+		return nil, false, creditResult(res, errUserNotFound.With("user_id", reservation.UserID), errReservationExists.With("reservation_id", reservation.ID), "unable to reserve credit")
+	}
+}
+
+func (s *redisUserStore) Commit(ctx context.Context, reservationID string) error {
+	reservation, err := s.getReservation(ctx, reservationID)
+	if err == redis.Nil {
+		return errReservationNotFound.With("reservation_id", reservationID)
+	} else if err != nil {
+		logrus.WithError(err).Error("unable to get reservation")
+		return util.INTERNAL_ERR
+	}
+
+	now := time.Now()
+	entry := reservation.ledgerEntry(now)
+	b, counter, err := encodeEntry(entry)
+	if err != nil {
+		logrus.WithError(err).Error("unable to encode ledger entry")
+		return util.INTERNAL_ERR
+	}
+
+	keys := []string{reservationKey(reservationID), reservation.UserID, holdsKey(reservation.UserID), holdExpiryKey(reservation.UserID), ledgerKey(reservation.UserID), counterKey(counterAccount(entry.Reason))}
+	res := commitCredit.Run(ctx, s.store, keys, reservationID, unixMilli(now), b, counter, s.expiry())
+	return creditResult(res, errReservationNotFound.With("reservation_id", reservationID), errReservationInactive.With("reservation_id", reservationID), "unable to commit reservation")
+}
+
+func (s *redisUserStore) Release(ctx context.Context, reservationID string) error {
+	userID, err := s.store.HGet(ctx, reservationKey(reservationID), "user_id").Result()
+	if err == redis.Nil {
+		return errReservationNotFound.With("reservation_id", reservationID)
+	} else if err != nil {
+		logrus.WithError(err).Error("unable to get reservation")
+		return util.INTERNAL_ERR
+	}
+
+	keys := []string{reservationKey(reservationID), holdsKey(userID), holdExpiryKey(userID)}
+	res := releaseCredit.Run(ctx, s.store, keys, reservationID, s.expiry())
+	return creditResult(res, errReservationNotFound.With("reservation_id", reservationID), errReservationDone.With("reservation_id", reservationID), "unable to release reservation")
+}
+
+// Returns redis.Nil when the reservation does not exist
+func (s *redisUserStore) getReservation(ctx context.Context, reservationID string) (*Reservation, error) {
+	fields, err := s.store.HGetAll(ctx, reservationKey(reservationID)).Result()
+	if err != nil {
+		return nil, err
+	} else if len(fields) == 0 {
+		return nil, redis.Nil
+	}
+
+	amount, err := strconv.Atoi(fields["amount"])
+	if err != nil {
+		return nil, errwrap.Wrap(err, "malformed reservation amount")
+	}
+	expiresAt, err := strconv.ParseInt(fields["expires_at"], 10, 64)
+	if err != nil {
+		return nil, errwrap.Wrap(err, "malformed reservation expiry")
+	}
+
+	return &Reservation{
+		ID:        reservationID,
+		UserID:    fields["user_id"],
+		Amount:    amount,
+		Reason:    fields["reason"],
+		Reference: fields["reference"],
+		Status:    fields["status"],
+		ExpiresAt: time.Unix(0, expiresAt*int64(time.Millisecond)),
+	}, nil
+}
+
+// Returns the error of the result of a credit script, with the errors for a
+// missing user or reservation and a conflicting reservation
+func creditResult(res *redis.Cmd, notFound error, conflict error, errMsg string) error {
+	code, err := res.Int()
+	if err != nil {
+		logrus.WithError(err).Error(errMsg)
+		return util.INTERNAL_ERR
+	}
+
+	switch code {
+	case creditOk:
+		return nil
+	case creditNotFound:
+		return notFound
+	case creditInsufficient:
+		return errInsufficientCredit
+	case creditConflict:
+		return conflict
+	default:
+		logrus.WithField("code", code).Error(errMsg)
+		return util.INTERNAL_ERR
+	}
+}
+
+// Returns the milliseconds after which a finished reservation expires
+func (s *redisUserStore) expiry() int64 {
+	ms := s.reservationTTL.Milliseconds()
+	if ms < 1 {
+		// PEXPIRE refuses a zero ttl
+		return 1
+	}
+	return ms
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (s *redisUserStore) Ledger(ctx context.Context, userID string, offset int, limit int) ([]*LedgerEntry, int, error) {
+	var exists *redis.IntCmd
+	var total *redis.IntCmd
+	var values *redis.StringSliceCmd
+	_, err := s.store.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Exists(ctx, userID)
+		total = pipe.LLen(ctx, ledgerKey(userID))
+		values = pipe.LRange(ctx, ledgerKey(userID), int64(offset), int64(offset+limit-1))
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("unable to get ledger entries")
+		return nil, 0, util.INTERNAL_ERR
+	}
+
+	if exists.Val() == 0 {
+		return nil, 0, errUserNotFound.With("user_id", userID)
+	}
+
+	entries, err := decodeLedger(values.Val())
+	if err != nil {
+		logrus.WithError(err).Error("malformed ledger entry")
+		return nil, 0, util.INTERNAL_ERR
+	}
+
+	return entries, int(total.Val()), nil
+}
+
+// Gives the entry an ID when it has none and encodes it and its counter entry
+func encodeEntry(entry *LedgerEntry) (string, string, error) {
+	if entry.ID == "" {
+		entry.ID = uuid.Must(uuid.NewV4()).String()
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return "", "", errwrap.Wrap(err, "unable to encode ledger entry")
 	}
+	counter, err := json.Marshal(entry.counterEntry())
+	if err != nil {
+		return "", "", errwrap.Wrap(err, "unable to encode counter entry")
+	}
+
+	return string(b), string(counter), nil
+}
+
+func decodeLedger(values []string) ([]*LedgerEntry, error) {
+	entries := make([]*LedgerEntry, 0, len(values))
+	for _, v := range values {
+		entry := &LedgerEntry{}
+		err := json.Unmarshal([]byte(v), entry)
+		if err != nil {
+			return nil, errwrap.Wrap(err, "unable to decode ledger entry")
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// CheckRedisLedger returns the users whose credit is not the total of their
+// ledger entries. Users are the unprefixed keys holding an integer.
+func CheckRedisLedger(ctx context.Context, c *redis.Client) ([]*Mismatch, error) {
+	mismatches := []*Mismatch{}
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(ctx, cursor, "*", 1000).Result()
+		if err != nil {
+			return nil, errwrap.Wrap(err, "unable to scan keys")
+		}
+
+		for _, key := range keys {
+			mismatch, err := checkRedisUser(ctx, c, key)
+			if err != nil {
+				return nil, err
+			} else if mismatch != nil {
+				mismatches = append(mismatches, mismatch)
+			}
+		}
 
-	util.JSONResponse(ctx, fasthttp.StatusOK, fmt.Sprintf("{\"user_id\": \"%s\", \"credit\": %s}", userID, get.Val()))
+		cursor = next
+		if cursor == 0 {
+			return mismatches, nil
+		}
+	}
 }
 
-func (s *redisUserStore) SubtractCredit(ctx *fasthttp.RequestCtx, userID string, amount int) {
-	res := decrByXX.Run(ctx, s.store, []string{userID}, amount)
-	if res.Err() == redis.Nil {
-		util.NotFound(ctx)
-		return
-	} else if res.Err() != nil {
-		logrus.WithError(res.Err()).Error("unable to subtract credit")
-		util.InternalServerError(ctx)
-		return
+func checkRedisUser(ctx context.Context, c *redis.Client, key string) (*Mismatch, error) {
+	if strings.Contains(key, ":") {
+		return nil, nil
+	}
+	if _, err := uuid.FromString(key); err != nil {
+		return nil, nil
+	}
+
+	var credit *redis.StringCmd
+	var values *redis.StringSliceCmd
+	_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		credit = pipe.Get(ctx, key)
+		values = pipe.LRange(ctx, ledgerKey(key), 0, -1)
+		return nil
+	})
+	if err != nil && credit.Err() == nil {
+		return nil, errwrap.Wrapf(err, "unable to get ledger of user %s", key)
+	}
+
+	// Not a user, e.g. an order or a removed user
+	balance, err := credit.Int()
+	if err != nil {
+		return nil, nil
+	}
+
+	entries, err := decodeLedger(values.Val())
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "malformed ledger of user %s", key)
+	}
+
+	total := 0
+	for _, entry := range entries {
+		total += entry.Amount
+	}
+	if total == balance {
+		return nil, nil
 	}
 
-	util.Ok(ctx)
+	return &Mismatch{UserID: key, Credit: balance, Ledger: total}, nil
 }
 
-func (s *redisUserStore) AddCredit(ctx *fasthttp.RequestCtx, userID string, amount int) {
-	incr := s.store.IncrBy(ctx, userID, int64(amount))
-	if incr.Err() != nil {
-		logrus.WithError(incr.Err()).Error("unable to add credit")
-		util.InternalServerError(ctx)
-		return
+// OpenRedisLedgers records the credit of users that have credit but no ledger, as
+// they existed before the ledger, as their opening balance. Returns the number
+// of users.
+func OpenRedisLedgers(ctx context.Context, c *redis.Client) (int, error) {
+	opened := 0
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(ctx, cursor, "*", 1000).Result()
+		if err != nil {
+			return 0, errwrap.Wrap(err, "unable to scan keys")
+		}
+
+		for _, key := range keys {
+			ok, err := openRedisLedger(ctx, c, key)
+			if err != nil {
+				return 0, err
+			} else if ok {
+				opened++
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return opened, nil
+		}
+	}
+}
+
+func openRedisLedger(ctx context.Context, c *redis.Client, key string) (bool, error) {
+	if strings.Contains(key, ":") {
+		return false, nil
+	}
+	if _, err := uuid.FromString(key); err != nil {
+		return false, nil
+	}
+
+	// Not a user, e.g. an order or a removed user
+	credit, err := c.Get(ctx, key).Int()
+	if err != nil || credit == 0 {
+		return false, nil
+	}
+
+	entry := openingBalance(key, credit, time.Now())
+	b, counter, err := encodeEntry(entry)
+	if err != nil {
+		return false, err
+	}
+
+	keys := []string{key, ledgerKey(key), counterKey(counterAccount(entry.Reason))}
+	opened, err := openLedger.Run(ctx, c, keys, credit, b, counter).Int()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "unable to record opening balance of user %s", key)
 	}
 
-	util.Ok(ctx)
+	return opened == 1, nil
 }
@@ -1,22 +1,50 @@
 package user
 
 import (
+	"context"
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	"github.com/valyala/fasthttp"
 )
 
+// Page size of the ledger when no limit is given, and the largest allowed limit
+const (
+	defaultLedgerLimit = 100
+	maxLedgerLimit     = 1000
+)
+
+// Stores return a not found error when the user or reservation does not exist
 type userStore interface {
-	Create(*fasthttp.RequestCtx)
-	Remove(*fasthttp.RequestCtx, string)
-	Find(*fasthttp.RequestCtx, string)
-	AddCredit(*fasthttp.RequestCtx, string, int)
-	SubtractCredit(*fasthttp.RequestCtx, string, int)
+	Create(context.Context) (*User, error)
+	Remove(context.Context, string) error
+	Find(context.Context, string) (*User, error)
+	// AddCredit and SubtractCredit change the credit of the user of the entry by
+	// its amount and record the entry in the ledger, they return an insufficient
+	// credit error when the credit would go below the held credit
+	AddCredit(context.Context, *LedgerEntry) error
+	SubtractCredit(context.Context, *LedgerEntry) error
+	// Ledger returns a page of the ledger of the user and its number of entries
+	Ledger(context.Context, string, int, int) ([]*LedgerEntry, int, error)
+	// Reserve holds credit of the user, reserving an ID that is already held for
+	// the same user and amount returns the existing reservation. Returns whether
+	// the reservation was created, or a conflict when the ID is used otherwise.
+	Reserve(context.Context, *Reservation) (*Reservation, bool, error)
+	// Commit returns an invalid state error when the reservation was released or
+	// expired, and Release when it was committed
+	Commit(context.Context, string) error
+	Release(context.Context, string) error
 }
 
 type userRouteHandler struct {
-	userStore userStore
+	userStore      userStore
+	twoPhase       *util.TwoPhaseParticipant
+	reservationTTL time.Duration
 }
 
 // NewRouteHandler creates a route handler with a store depending on the active connection
@@ -24,34 +52,56 @@ func NewRouteHandler(conn *util.Connection) *userRouteHandler {
 	var store userStore
 
 	switch conn.Backend {
-	case util.POSTGRES:
+	case util.POSTGRES, util.SQLITE:
 		store = newPostgresUserStore(conn.Postgres, &conn.URL)
 	case util.REDIS:
-		store = newRedisUserStore(conn.Redis)
+		store = newRedisUserStore(conn.Redis, conn.Checkout.ReservationTTL)
+	case util.MEMORY:
+		store = newMemoryUserStore()
 	}
 
 	return &userRouteHandler{
-		userStore: store,
+		userStore:      store,
+		twoPhase:       util.NewTwoPhaseParticipant("user", conn, prepareCheckout),
+		reservationTTL: conn.Checkout.ReservationTTL,
 	}
 }
 
 // Returns an ID for the created user
 func (h *userRouteHandler) CreateUser(ctx *fasthttp.RequestCtx) {
-	h.userStore.Create(ctx)
+	user, err := h.userStore.Create(ctx)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.JSONResponse(ctx, fasthttp.StatusCreated, &createResponse{UserID: user.ID})
 }
 
 // Returns success/failure
 func (h *userRouteHandler) RemoveUser(ctx *fasthttp.RequestCtx) {
 	userID := ctx.UserValue("user_id").(string)
 
-	h.userStore.Remove(ctx, userID)
+	err := h.userStore.Remove(ctx, userID)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
 }
 
 // Returns a user with their details (id, credit)
 func (h *userRouteHandler) FindUser(ctx *fasthttp.RequestCtx) {
 	userID := ctx.UserValue("user_id").(string)
 
-	h.userStore.Find(ctx, userID)
+	user, err := h.userStore.Find(ctx, userID)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.JSONResponse(ctx, fasthttp.StatusOK, user)
 }
 
 // Returns success/failure, depending on the credit status.
@@ -59,13 +109,24 @@ func (h *userRouteHandler) FindUser(ctx *fasthttp.RequestCtx) {
 func (h *userRouteHandler) SubtractUserCredit(ctx *fasthttp.RequestCtx) {
 	userID := ctx.UserValue("user_id").(string)
 	amount, err := strconv.Atoi(ctx.UserValue("amount").(string))
+	if err != nil || amount <= 0 {
+		util.ErrorResponse(ctx, errs.New(errs.BadRequest, "amount should be a positive integer"))
+		return
+	}
+
+	entry, err := ledgerEntry(ctx, userID, -amount, subtractReasons)
 	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString("amount should be an integer")
+		util.ErrorResponse(ctx, err)
 		return
 	}
 
-	h.userStore.SubtractCredit(ctx, userID, amount)
+	err = h.userStore.SubtractCredit(ctx, entry)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
 }
 
 // Returns success/failure, depending on the credit status.
@@ -73,11 +134,192 @@ func (h *userRouteHandler) SubtractUserCredit(ctx *fasthttp.RequestCtx) {
 func (h *userRouteHandler) AddUserCredit(ctx *fasthttp.RequestCtx) {
 	userID := ctx.UserValue("user_id").(string)
 	amount, err := strconv.Atoi(ctx.UserValue("amount").(string))
+	if err != nil || amount <= 0 {
+		util.ErrorResponse(ctx, errs.New(errs.BadRequest, "amount should be a positive integer"))
+		return
+	}
+
+	entry, err := ledgerEntry(ctx, userID, amount, addReasons)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	err = h.userStore.AddCredit(ctx, entry)
 	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString("amount should be an integer")
+		util.ErrorResponse(ctx, err)
 		return
 	}
 
-	h.userStore.AddCredit(ctx, userID, amount)
+	util.Ok(ctx)
+}
+
+// Creates the ledger entry of a credit change, the reason, reference and entry ID
+// are taken from the query arguments. The reason must be one of the reasons, the
+// first is used when none is given, and the reference the ID of an order. A
+// change with the ID of an entry that was already recorded is not applied again.
+func ledgerEntry(ctx *fasthttp.RequestCtx, userID string, amount int, reasons []string) (*LedgerEntry, error) {
+	reason := string(ctx.QueryArgs().Peek("reason"))
+	if reason == "" {
+		reason = reasons[0]
+	} else if !contains(reasons, reason) {
+		return nil, errs.New(errs.BadRequest, fmt.Sprintf("reason should be one of %s", strings.Join(reasons, ", ")))
+	}
+
+	reference := string(ctx.QueryArgs().Peek("reference"))
+	if _, err := uuid.FromString(reference); reference != "" && err != nil {
+		return nil, errs.New(errs.BadRequest, "reference should be the ID of an order")
+	}
+
+	entryID := string(ctx.QueryArgs().Peek("entry_id"))
+	if _, err := uuid.FromString(entryID); entryID != "" && err != nil {
+		return nil, errs.New(errs.BadRequest, "entry_id should be a UUID")
+	}
+
+	return &LedgerEntry{
+		ID:        entryID,
+		UserID:    userID,
+		Amount:    amount,
+		Reason:    reason,
+		Reference: reference,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a page of the credit ledger of a user, oldest entries first
+func (h *userRouteHandler) GetLedger(ctx *fasthttp.RequestCtx) {
+	userID := ctx.UserValue("user_id").(string)
+
+	offset, limit := 0, defaultLedgerLimit
+	var err error
+	if ctx.QueryArgs().Has("offset") {
+		offset, err = ctx.QueryArgs().GetUint("offset")
+		if err != nil {
+			util.ErrorResponse(ctx, errs.New(errs.BadRequest, "offset should be a positive integer"))
+			return
+		}
+	}
+	if ctx.QueryArgs().Has("limit") {
+		limit, err = ctx.QueryArgs().GetUint("limit")
+		if err != nil || limit == 0 || limit > maxLedgerLimit {
+			util.ErrorResponse(ctx, errs.New(errs.BadRequest, fmt.Sprintf("limit should be between 1 and %d", maxLedgerLimit)))
+			return
+		}
+	}
+
+	entries, total, err := h.userStore.Ledger(ctx, userID, offset, limit)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.JSONResponse(ctx, fasthttp.StatusOK, &ledgerResponse{
+		UserID:  userID,
+		Offset:  offset,
+		Limit:   limit,
+		Total:   total,
+		Entries: entries,
+	})
+}
+
+// Holds the amount of the credit of the user under the given reservation ID, the
+// hold expires after the reservation TTL or the duration in expires_in.
+func (h *userRouteHandler) ReserveCredit(ctx *fasthttp.RequestCtx) {
+	userID := ctx.UserValue("user_id").(string)
+	reservationID := ctx.UserValue("reservation_id").(string)
+	if _, err := uuid.FromString(reservationID); err != nil {
+		util.ErrorResponse(ctx, errs.New(errs.BadRequest, "reservation ID should be a UUID"))
+		return
+	}
+
+	amount, err := strconv.Atoi(ctx.UserValue("amount").(string))
+	if err != nil || amount <= 0 {
+		util.ErrorResponse(ctx, errs.New(errs.BadRequest, "amount should be a positive integer"))
+		return
+	}
+
+	ttl := h.reservationTTL
+	if ctx.QueryArgs().Has("expires_in") {
+		ttl, err = time.ParseDuration(string(ctx.QueryArgs().Peek("expires_in")))
+		if err != nil || ttl <= 0 {
+			util.ErrorResponse(ctx, errs.New(errs.BadRequest, "expires_in should be a positive duration"))
+			return
+		}
+	}
+
+	entry, err := ledgerEntry(ctx, userID, -amount, subtractReasons)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	reservation, created, err := h.userStore.Reserve(ctx, &Reservation{
+		ID:        reservationID,
+		UserID:    userID,
+		Amount:    amount,
+		Reason:    entry.Reason,
+		Reference: entry.Reference,
+		Status:    ReservationHeld,
+		ExpiresAt: entry.CreatedAt.Add(ttl),
+	})
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	status := fasthttp.StatusOK
+	if created {
+		status = fasthttp.StatusCreated
+	}
+	util.JSONResponse(ctx, status, reservation)
+}
+
+// Subtracts the credit held by the reservation from the user, committing it
+// again succeeds. Returns 409 when the reservation was released or expired.
+func (h *userRouteHandler) CommitCredit(ctx *fasthttp.RequestCtx) {
+	reservationID := ctx.UserValue("reservation_id").(string)
+
+	err := h.userStore.Commit(ctx, reservationID)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
+}
+
+// Releases the credit held by the reservation, releasing it again succeeds.
+// Returns 409 when the reservation was committed.
+func (h *userRouteHandler) ReleaseCredit(ctx *fasthttp.RequestCtx) {
+	reservationID := ctx.UserValue("reservation_id").(string)
+
+	err := h.userStore.Release(ctx, reservationID)
+	if err != nil {
+		util.ErrorResponse(ctx, err)
+		return
+	}
+
+	util.Ok(ctx)
+}
+
+// Prepares the payment of the order in the body for a two-phase commit checkout
+func (h *userRouteHandler) PrepareTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Prepare(ctx)
+}
+
+func (h *userRouteHandler) CommitTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Commit(ctx)
+}
+
+func (h *userRouteHandler) AbortTransaction(ctx *fasthttp.RequestCtx) {
+	h.twoPhase.Abort(ctx)
 }
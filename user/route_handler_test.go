@@ -0,0 +1,177 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// fakeStore records the credit changes and ledger pages it was asked for
+type fakeStore struct {
+	userStore
+
+	entries      []*LedgerEntry
+	reservations []*Reservation
+	offset       int
+	limit        int
+}
+
+func (s *fakeStore) Reserve(_ context.Context, reservation *Reservation) (*Reservation, bool, error) {
+	s.reservations = append(s.reservations, reservation)
+	return reservation, true, nil
+}
+
+func (s *fakeStore) AddCredit(_ context.Context, entry *LedgerEntry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *fakeStore) SubtractCredit(_ context.Context, entry *LedgerEntry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *fakeStore) Ledger(_ context.Context, userID string, offset int, limit int) ([]*LedgerEntry, int, error) {
+	s.offset, s.limit = offset, limit
+	if userID != "user" {
+		return nil, 0, util.NOT_FOUND
+	}
+	return []*LedgerEntry{}, 0, nil
+}
+
+func creditRequest(query string, amount string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/?" + query)
+	ctx.SetUserValue("user_id", "user")
+	ctx.SetUserValue("amount", amount)
+	return ctx
+}
+
+// IDs of the order credit changes refer to and of a ledger entry
+const (
+	orderID = "9b2d8f64-3c1e-4a57-b0f2-6e8d1c4a7f30"
+	entryID = "4e0c7a1b-8d2f-4b6e-9a3c-5f1d2e7b8c90"
+)
+
+func TestCreditLedgerEntry(t *testing.T) {
+	store := &fakeStore{}
+	h := &userRouteHandler{userStore: store}
+
+	h.AddUserCredit(creditRequest("", "10"))
+	h.SubtractUserCredit(creditRequest("reason=payment&reference="+orderID+"&entry_id="+entryID, "4"))
+
+	// Only positive amounts change the credit
+	for _, amount := range []string{"-4", "0"} {
+		ctx := creditRequest("", amount)
+		h.SubtractUserCredit(ctx)
+		assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode(), amount)
+		ctx = creditRequest("", amount)
+		h.AddUserCredit(ctx)
+		assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode(), amount)
+	}
+
+	// Only known reasons for the direction of the change and orders as reference
+	for _, query := range []string{"reason=gift", "reason=payment", "reason=deposit&reference=order", "entry_id=entry"} {
+		ctx := creditRequest(query, "4")
+		h.AddUserCredit(ctx)
+		assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode(), query)
+	}
+	ctx := creditRequest("reason=refund", "4")
+	h.SubtractUserCredit(ctx)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+
+	if assert.Len(t, store.entries, 2) {
+		assert.Equal(t, "user", store.entries[0].UserID)
+		assert.Equal(t, 10, store.entries[0].Amount)
+		assert.Equal(t, ReasonDeposit, store.entries[0].Reason)
+		assert.Empty(t, store.entries[0].Reference)
+		assert.Empty(t, store.entries[0].ID)
+
+		assert.Equal(t, -4, store.entries[1].Amount)
+		assert.Equal(t, ReasonPayment, store.entries[1].Reason)
+		assert.Equal(t, orderID, store.entries[1].Reference)
+		assert.Equal(t, entryID, store.entries[1].ID)
+	}
+}
+
+func TestLedgerPagination(t *testing.T) {
+	store := &fakeStore{}
+	h := &userRouteHandler{userStore: store}
+
+	h.GetLedger(creditRequest("", ""))
+	assert.Equal(t, 0, store.offset)
+	assert.Equal(t, defaultLedgerLimit, store.limit)
+
+	h.GetLedger(creditRequest("offset=20&limit=10", ""))
+	assert.Equal(t, 20, store.offset)
+	assert.Equal(t, 10, store.limit)
+
+	for _, query := range []string{"offset=-1", "limit=0", "limit=1001", "limit=ten"} {
+		ctx := creditRequest(query, "")
+		h.GetLedger(ctx)
+		assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode(), query)
+	}
+
+	ctx := creditRequest("", "")
+	ctx.SetUserValue("user_id", "missing")
+	h.GetLedger(ctx)
+	assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+}
+
+func TestReserveCredit(t *testing.T) {
+	store := &fakeStore{}
+	h := &userRouteHandler{userStore: store, reservationTTL: time.Minute}
+
+	reserve := func(query string, reservationID string, amount string) *fasthttp.RequestCtx {
+		ctx := creditRequest(query, amount)
+		ctx.SetUserValue("reservation_id", reservationID)
+		h.ReserveCredit(ctx)
+		return ctx
+	}
+
+	reservationID := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	ctx := reserve("reason=payment&reference="+orderID, reservationID, "5")
+	assert.Equal(t, fasthttp.StatusCreated, ctx.Response.StatusCode())
+	reserve("expires_in=10s", reservationID, "5")
+
+	for _, ctx := range []*fasthttp.RequestCtx{
+		reserve("", "reservation", "5"),
+		reserve("", reservationID, "0"),
+		reserve("expires_in=soon", reservationID, "5"),
+		reserve("expires_in=-1s", reservationID, "5"),
+		reserve("reason=deposit", reservationID, "5"),
+	} {
+		assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	}
+
+	if assert.Len(t, store.reservations, 2) {
+		r := store.reservations[0]
+		assert.Equal(t, reservationID, r.ID)
+		assert.Equal(t, "user", r.UserID)
+		assert.Equal(t, 5, r.Amount)
+		assert.Equal(t, ReasonPayment, r.Reason)
+		assert.Equal(t, orderID, r.Reference)
+		assert.Equal(t, ReservationHeld, r.Status)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), r.ExpiresAt, time.Second)
+		assert.WithinDuration(t, time.Now().Add(10*time.Second), store.reservations[1].ExpiresAt, time.Second)
+	}
+}
+
+func TestReservationActive(t *testing.T) {
+	now := time.Now()
+	r := &Reservation{UserID: "user", Amount: 5, Reason: "payment", Status: ReservationHeld, ExpiresAt: now.Add(time.Second)}
+
+	assert.True(t, r.active(now))
+	assert.False(t, r.active(now.Add(time.Second)))
+
+	r.Status = ReservationReleased
+	assert.False(t, r.active(now))
+
+	entry := r.ledgerEntry(now)
+	assert.Equal(t, -5, entry.Amount)
+	assert.Equal(t, "payment", entry.Reason)
+}
@@ -0,0 +1,185 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// Sqlite needs no server, the postgres store runs on it in every test run
+func TestSQLiteOpeningBalance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "user.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Users from before the ledger have credit, but no entries
+	require.NoError(t, db.AutoMigrate(&User{}).Error)
+	require.NoError(t, db.Create(&User{Credit: 7}).Error)
+	require.NoError(t, db.Create(&User{Credit: 0}).Error)
+
+	store := newPostgresUserStore(db, nil)
+	mismatches, err := CheckPostgresLedger(db)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	counters := []*CounterEntry{}
+	require.NoError(t, db.Find(&counters).Error)
+	if assert.Len(t, counters, 1) {
+		assert.Equal(t, AccountOpeningBalance, counters[0].Account)
+		assert.Equal(t, -7, counters[0].Amount)
+	}
+
+	// Opening the ledgers again records nothing
+	opened, err := openLedgers(store.db)
+	require.NoError(t, err)
+	assert.Equal(t, 0, opened)
+}
+
+// Adds credit to the user twice with the same entry ID, only the first change is
+// applied and the ID cannot be used for another change
+func assertCreditedOnce(t *testing.T, store userStore, userID string) {
+	ctx := context.Background()
+	entryID := uuid.Must(uuid.NewV4()).String()
+	refund := func(amount int) *LedgerEntry {
+		return &LedgerEntry{ID: entryID, UserID: userID, Amount: amount, Reason: ReasonRefund, CreatedAt: time.Now()}
+	}
+
+	before, err := store.Find(ctx, userID)
+	require.NoError(t, err)
+	require.NoError(t, store.AddCredit(ctx, refund(5)))
+	require.NoError(t, store.AddCredit(ctx, refund(5)))
+	assert.Equal(t, errEntryExists.With("entry_id", entryID), store.AddCredit(ctx, refund(6)))
+
+	after, err := store.Find(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, before.Credit+5, after.Credit)
+}
+
+// Removes the user, removing it again finds no user
+func assertRemovedOnce(t *testing.T, store userStore, userID string) {
+	ctx := context.Background()
+	require.NoError(t, store.Remove(ctx, userID))
+	assert.Equal(t, errUserNotFound.With("user_id", userID), store.Remove(ctx, userID))
+	_, err := store.Find(ctx, userID)
+	assert.Equal(t, errUserNotFound.With("user_id", userID), err)
+}
+
+func TestSQLiteUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "user.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := newPostgresUserStore(db, nil)
+	user, err := store.Create(context.Background())
+	require.NoError(t, err)
+	assertCreditedOnce(t, store, user.ID)
+	assertRemovedOnce(t, store, user.ID)
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	store := newMemoryUserStore()
+	user, err := store.Create(context.Background())
+	require.NoError(t, err)
+	assertCreditedOnce(t, store, user.ID)
+	assertRemovedOnce(t, store, user.ID)
+}
+
+// Runs against a live redis, set REDI_TEST_REDIS to a redis address to run it
+func TestRedisLedger(t *testing.T) {
+	addr := os.Getenv("REDI_TEST_REDIS")
+	if addr == "" {
+		t.Skip("REDI_TEST_REDIS is not set")
+	}
+
+	ctx := context.Background()
+	c := redis.NewClient(&redis.Options{Addr: addr})
+	defer c.Close()
+	require.NoError(t, c.Ping(ctx).Err())
+	store := newRedisUserStore(c, time.Minute)
+
+	user, err := store.Create(ctx)
+	require.NoError(t, err)
+	require.NoError(t, store.AddCredit(ctx, &LedgerEntry{UserID: user.ID, Amount: 10, Reason: ReasonDeposit, CreatedAt: time.Now()}))
+
+	reservationID := uuid.Must(uuid.NewV4()).String()
+	_, _, err = store.Reserve(ctx, &Reservation{ID: reservationID, UserID: user.ID, Amount: 4, Reason: ReasonPayment, Status: ReservationHeld, ExpiresAt: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	require.NoError(t, store.Commit(ctx, reservationID))
+
+	// Finished reservations expire, held ones are kept until they are finished
+	releasedID := uuid.Must(uuid.NewV4()).String()
+	_, _, err = store.Reserve(ctx, &Reservation{ID: releasedID, UserID: user.ID, Amount: 1, Reason: ReasonPayment, Status: ReservationHeld, ExpiresAt: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	ttl, err := c.PTTL(ctx, reservationKey(releasedID)).Result()
+	require.NoError(t, err)
+	assert.True(t, ttl < 0)
+	require.NoError(t, store.Release(ctx, releasedID))
+	for _, id := range []string{reservationID, releasedID} {
+		ttl, err := c.PTTL(ctx, reservationKey(id)).Result()
+		require.NoError(t, err)
+		assert.True(t, ttl > 0 && ttl <= time.Minute, id)
+	}
+
+	// Both entries are balanced on their counter account
+	entries, total, err := store.Ledger(ctx, user.ID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	for i, account := range []string{AccountCash, AccountSales} {
+		last, err := c.LIndex(ctx, counterKey(account), -1).Result()
+		require.NoError(t, err)
+		counter := &CounterEntry{}
+		require.NoError(t, json.Unmarshal([]byte(last), counter))
+		assert.Equal(t, entries[i].ID, counter.EntryID)
+		assert.Equal(t, -entries[i].Amount, counter.Amount)
+	}
+
+	// A user from before the ledger gets its credit as opening balance, once
+	legacyID := uuid.Must(uuid.NewV4()).String()
+	require.NoError(t, c.Set(ctx, legacyID, 7, 0).Err())
+	defer c.Del(ctx, legacyID, ledgerKey(legacyID))
+
+	_, err = OpenRedisLedgers(ctx, c)
+	require.NoError(t, err)
+	_, err = OpenRedisLedgers(ctx, c)
+	require.NoError(t, err)
+
+	entries, total, err = store.Ledger(ctx, legacyID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	assert.Equal(t, 7, entries[0].Amount)
+	assert.Equal(t, ReasonOpeningBalance, entries[0].Reason)
+
+	mismatches, err := CheckRedisLedger(ctx, c)
+	require.NoError(t, err)
+	for _, m := range mismatches {
+		assert.NotContains(t, []string{user.ID, legacyID}, m.UserID)
+	}
+
+	assertCreditedOnce(t, store, user.ID)
+
+	// The ledger and holds are removed with the user
+	assertRemovedOnce(t, store, user.ID)
+	exists, err := c.Exists(ctx, user.ID, ledgerKey(user.ID), entriesKey(user.ID), holdsKey(user.ID), holdExpiryKey(user.ID)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), exists)
+}
@@ -1,6 +1,162 @@
 package user
 
+import (
+	"time"
+
+	"github.com/martijnjanssen/redi-shop/util/errs"
+)
+
+// Errors of the user service, returned with the ID of the user or reservation
+var (
+	errUserNotFound        = errs.New(errs.NotFound, "user not found")
+	errReservationNotFound = errs.New(errs.NotFound, "reservation not found")
+	errInsufficientCredit  = errs.New(errs.InsufficientCredit, "not enough credit")
+	errReservationExists   = errs.New(errs.Conflict, "reservation already exists")
+	errReservationInactive = errs.New(errs.InvalidState, "reservation was released or expired")
+	errReservationDone     = errs.New(errs.InvalidState, "reservation was committed")
+	errEntryExists         = errs.New(errs.Conflict, "ledger entry already exists")
+)
+
+// Reasons of credit changes, deposits and withdrawals are changes that were not
+// given a reason. Opening balances record the credit of users that existed
+// before the ledger.
+const (
+	ReasonDeposit        = "deposit"
+	ReasonWithdrawal     = "withdrawal"
+	ReasonPayment        = "payment"
+	ReasonRefund         = "refund"
+	ReasonOpeningBalance = "opening_balance"
+)
+
+// Reasons clients can give for adding and subtracting credit
+var (
+	addReasons      = []string{ReasonDeposit, ReasonRefund}
+	subtractReasons = []string{ReasonWithdrawal, ReasonPayment}
+)
+
+// Counter accounts the credit of users comes from and goes to: cash is deposited
+// and withdrawn, sales are paid and refunded
+const (
+	AccountCash           = "cash"
+	AccountSales          = "sales"
+	AccountOpeningBalance = "opening_balance"
+)
+
+// Returns the counter account of credit changes for the reason
+func counterAccount(reason string) string {
+	switch reason {
+	case ReasonPayment, ReasonRefund:
+		return AccountSales
+	case ReasonOpeningBalance:
+		return AccountOpeningBalance
+	default:
+		return AccountCash
+	}
+}
+
 type User struct {
-	ID     string `sql:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	ID     string `sql:"type:uuid;primary_key" json:"user_id"`
+	Credit int    `json:"credit"`
+}
+
+// Entry in the credit ledger, every change of the credit of a user is recorded
+// with the reason and the order or payment it belongs to. Subtractions have a
+// negative amount.
+type LedgerEntry struct {
+	ID        string    `sql:"type:uuid;primary_key" json:"entry_id"`
+	UserID    string    `sql:"type:uuid;index" json:"-"`
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Returns whether the entries change the credit of the same user by the same
+// amount
+func (e *LedgerEntry) sameChange(other *LedgerEntry) bool {
+	return e.UserID == other.UserID && e.Amount == other.Amount
+}
+
+// Entry on a counter account balancing a ledger entry of a user, so every credit
+// change is booked twice and the accounts of the shop always add up to zero
+type CounterEntry struct {
+	EntryID   string    `sql:"type:uuid;primary_key" json:"entry_id"`
+	Account   string    `sql:"index" json:"account"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Returns the counter entry of the ledger entry, the entry must have its ID
+func (e *LedgerEntry) counterEntry() *CounterEntry {
+	return &CounterEntry{
+		EntryID:   e.ID,
+		Account:   counterAccount(e.Reason),
+		Amount:    -e.Amount,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// Returns the entry recording the credit of a user that existed before the ledger
+func openingBalance(userID string, credit int, now time.Time) *LedgerEntry {
+	return &LedgerEntry{
+		UserID:    userID,
+		Amount:    credit,
+		Reason:    ReasonOpeningBalance,
+		CreatedAt: now,
+	}
+}
+
+// Status of a credit reservation, a held reservation counts until it expires
+const (
+	ReservationHeld      = "held"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+)
+
+// Reservation holds part of the credit of a user, the held credit cannot be
+// spent until the reservation is committed, released or expires. Committing
+// subtracts the amount and records it in the ledger with the reason and
+// reference of the reservation.
+type Reservation struct {
+	ID        string    `sql:"type:uuid;primary_key" json:"reservation_id"`
+	UserID    string    `sql:"type:uuid;index" json:"user_id"`
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference,omitempty"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (r *Reservation) active(now time.Time) bool {
+	return r.Status == ReservationHeld && r.ExpiresAt.After(now)
+}
+
+// Returns the ledger entry recorded when the reservation is committed
+func (r *Reservation) ledgerEntry(now time.Time) *LedgerEntry {
+	return &LedgerEntry{
+		UserID:    r.UserID,
+		Amount:    -r.Amount,
+		Reason:    r.Reason,
+		Reference: r.Reference,
+		CreatedAt: now,
+	}
+}
+
+// Mismatch is a user whose credit differs from the total of its ledger
+type Mismatch struct {
+	UserID string
 	Credit int
+	Ledger int
+}
+
+type createResponse struct {
+	UserID string `json:"user_id"`
+}
+
+type ledgerResponse struct {
+	UserID  string         `json:"user_id"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Total   int            `json:"total"`
+	Entries []*LedgerEntry `json:"entries"`
 }
@@ -5,7 +5,6 @@ import (
 	"math/rand"
 	"net/http"
 	"strconv"
-	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -46,15 +45,18 @@ func checkUserE2E(t *testing.T) {
 	resp, err := client.Post(server + "/users/create")
 	checkErr(assert, err)
 
-	userIDString, err := resp.ToString()
+	created := struct {
+		UserID string `json:"user_id"`
+	}{}
+	err = resp.ToJSON(&created)
 	checkErr(assert, err)
-	userID := strings.Split(strings.Split(userIDString, ": ")[1], "}")[0]
+	userID := created.UserID
 
 	resp, err = client.Post(server + "/users/credit/add/" + userID + "/43")
 	checkErr(assert, err)
 	checkStatuscode(resp, http.StatusOK, "adding credit failed")
 
-	subtract := r.Intn(20)
+	subtract := r.Intn(20) + 1
 
 	resp, err = client.Post(server + "/users/credit/subtract/" + userID + "/" + strconv.Itoa(subtract))
 	checkErr(assert, err)
@@ -66,7 +68,13 @@ func checkUserE2E(t *testing.T) {
 	total := 43 - subtract
 	respString, err := resp.ToString()
 	checkErr(assert, err)
-	if respString != fmt.Sprintf("{\"user_id\": %s, \"credit\": %d}", userID, total) {
+	found := struct {
+		UserID string `json:"user_id"`
+		Credit int    `json:"credit"`
+	}{}
+	err = resp.ToJSON(&found)
+	checkErr(assert, err)
+	if found.UserID != userID || found.Credit != total {
 		log.Errorf("invalid value for user, should be {\"user_id\": %s, \"credit\": %d}, but was: %s", userID, total, respString)
 	}
 
@@ -2,12 +2,9 @@ package util
 
 import (
 	"context"
-	"errors"
-	"fmt"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/martijnjanssen/redi-shop/util/errs"
 	"github.com/sirupsen/logrus"
-	"github.com/valyala/fasthttp"
 )
 
 var (
@@ -16,52 +13,60 @@ var (
 	// Payment events
 	MESSAGE_PAY        = "MESG_PAY"
 	MESSAGE_PAY_REVERT = "MESG_PAY_REV"
+	MESSAGE_PAY_COMMIT = "MESG_PAY_COMMIT"
+	MESSAGE_REFUND     = "MESG_REFUND"
 
 	// Stock events
-	MESSAGE_STOCK = "MESG_STOCK"
+	MESSAGE_STOCK        = "MESG_STOCK"
+	MESSAGE_STOCK_REVERT = "MESG_STOCK_REV"
+	MESSAGE_STOCK_COMMIT = "MESG_STOCK_COMMIT"
+	MESSAGE_RESTOCK      = "MESG_RESTOCK"
+
+	// Order progress events
+	MESSAGE_ORDER_PAID     = "MESG_ORDER_PAID"
+	MESSAGE_ORDER_REFUNDED = "MESG_ORDER_REFUNDED"
 
 	// Order request response events
 	MESSAGE_ORDER_SUCCESS    = "MESG_ORDER_SUCCESS"
 	MESSAGE_ORDER_BADREQUEST = "MESG_ORDER_BAD"
 	MESSAGE_ORDER_INTERNAL   = "MESG_ORDER_INTERNAL"
+	MESSAGE_ORDER_TIMEOUT    = "MESG_ORDER_TIMEOUT"
 
-	// Error types to determine the response
-	INTERNAL_ERR = errors.New("INTERNAL_ERR")
-	BAD_REQUEST  = errors.New("BAD_REQUEST")
+	// Generic errors of the error kinds without further details
+	INTERNAL_ERR = errs.New(errs.Internal, "internal error")
+	BAD_REQUEST  = errs.New(errs.BadRequest, "bad request")
+	NOT_FOUND    = errs.New(errs.NotFound, "not found")
+	CONFLICT     = errs.New(errs.Conflict, "conflict")
 )
 
-func PubToOrder(r *redis.Client, ctx context.Context, orderChannelID string, trackID string, message string) {
-	err := r.Publish(ctx, fmt.Sprintf("%s.%s", CHANNEL_ORDER, orderChannelID), fmt.Sprintf("%s#%s#%s#", orderChannelID, trackID, message)).Err()
-	if err != nil {
-		logrus.WithField("messsage", message).WithError(err).Error("unable to publish message")
-	}
+// Publishes a response to the order instance waiting for it
+func PubToOrder(t Transport, ctx context.Context, m *Message) {
+	Pub(t, ctx, OrderChannel(m.ChannelID), m)
 }
 
 // Publishes to a running microservice
-func Pub(url string, service string, orderChannelID string, trackID string, message string, payload string) {
-	req := fasthttp.AcquireRequest()
-	req.SetRequestURI(fmt.Sprintf("%s/%s/message", url, service))
-	req.Header.SetMethod("POST")
-	req.SetBodyString(fmt.Sprintf("%s#%s#%s#%s", orderChannelID, trackID, message, payload))
+func Pub(t Transport, ctx context.Context, service string, m *Message) {
+	logger := logrus.WithField("service", service).WithField("messsage", m.Type)
 
-	resp := fasthttp.AcquireResponse()
-	client := &fasthttp.Client{}
-	err := client.Do(req, resp)
+	body, err := EncodeMessage(m)
 	if err != nil {
-		logrus.WithField("service", service).WithField("messsage", message).WithError(err).Error("unable to send message")
+		logger.WithError(err).Error("unable to encode message")
+		return
 	}
 
-	if resp.StatusCode() != fasthttp.StatusOK {
-		logrus.WithField("status", resp.StatusCode).Error("error while making request")
+	err = t.Pub(ctx, service, body)
+	if err != nil {
+		logger.WithError(err).Error("unable to send message")
 	}
 }
 
-func HTTPErrorToSAGAError(status int) error {
-	if status == fasthttp.StatusOK {
-		return nil
-	} else if status == fasthttp.StatusInternalServerError {
-		return INTERNAL_ERR
+// ErrorOutcome returns the outcome of a saga step that failed with the error,
+// internal errors and unavailable services are not the fault of the request
+func ErrorOutcome(err error) string {
+	switch errs.KindOf(err) {
+	case errs.Internal, errs.UpstreamUnavailable, errs.Timeout:
+		return MESSAGE_ORDER_INTERNAL
+	default:
+		return MESSAGE_ORDER_BADREQUEST
 	}
-
-	return BAD_REQUEST
 }
@@ -1,9 +1,14 @@
 package util
 
 import (
+	"net"
+	"time"
+
 	"github.com/go-redis/redis/v8"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
 )
 
 type ConnectionType int
@@ -11,6 +16,12 @@ type ConnectionType int
 const (
 	POSTGRES ConnectionType = 1
 	REDIS    ConnectionType = 2
+	// MEMORY keeps everything in the memory of the process, for tests and local
+	// development
+	MEMORY ConnectionType = 3
+	// SQLITE keeps the data of every service in its own sqlite database file, using
+	// the same stores as postgres
+	SQLITE ConnectionType = 4
 )
 
 func GetConnectionType(name string) ConnectionType {
@@ -19,20 +30,57 @@ func GetConnectionType(name string) ConnectionType {
 		return POSTGRES
 	case "redis":
 		return REDIS
+	case "memory":
+		return MEMORY
+	case "sqlite":
+		return SQLITE
+	default:
+		logrus.WithField("backend", name).Fatal("invalid backend, should be one of: postgres, redis, memory, sqlite")
+		return 0
+	}
+}
+
+type CheckoutMode int
+
+const (
+	// SAGA checks out with the choreographed saga between the services
+	SAGA CheckoutMode = 1
+	// TWO_PHASE checks out with a two-phase commit coordinated by the order
+	// service, using postgres prepared transactions in the other services
+	TWO_PHASE CheckoutMode = 2
+	// ORCHESTRATED checks out with a saga of which every step is issued by the
+	// order service
+	ORCHESTRATED CheckoutMode = 3
+)
+
+func GetCheckoutMode(name string) CheckoutMode {
+	switch name {
+	case "saga":
+		return SAGA
+	case "2pc":
+		return TWO_PHASE
+	case "orchestrated":
+		return ORCHESTRATED
 	default:
-		logrus.WithField("backend", name).Fatal("invalid backend, should be one of: postgres, redis")
+		logrus.WithField("mode", name).Fatal("invalid checkout mode, should be one of: saga, 2pc, orchestrated")
 		return 0
 	}
 }
 
 // Connection struct to pass into the service
 type Connection struct {
-	Backend  ConnectionType
+	Backend ConnectionType
+	// Postgres is the database of the gorm stores, with the postgres and the
+	// sqlite backend
 	Postgres *gorm.DB
 	Redis    *redis.Client
+	// SQLite holds the sqlite database of every service started in the process
+	SQLite map[string]*gorm.DB
 
-	Broker *redis.Client
-	URL    Services
+	Broker    *redis.Client
+	Transport Transport
+	URL       Services
+	Checkout  Checkout
 }
 
 type Services struct {
@@ -40,4 +88,41 @@ type Services struct {
 	Order   string
 	Stock   string
 	Payment string
+
+	// Client sends the requests to the services, when it is not set every
+	// request gets a new client
+	Client *fasthttp.Client
+}
+
+// HTTPClient returns the client to send requests to the services with
+func (s *Services) HTTPClient() *fasthttp.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return &fasthttp.Client{}
+}
+
+// NewLocalClient returns a client that sends every request to the listener, so
+// requests to services served in the same process do not leave it
+func NewLocalClient(ln *fasthttputil.InmemoryListener) *fasthttp.Client {
+	return &fasthttp.Client{
+		Dial: func(string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+}
+
+type Checkout struct {
+	// Protocol used to check out an order
+	Mode CheckoutMode
+	// Time a checkout waits for the other services before it is reverted
+	Timeout time.Duration
+	// Time after which an unfinished checkout saga is considered abandoned
+	RecoverAfter time.Duration
+	// Time the outcome of a handled saga message is remembered
+	DedupTTL time.Duration
+	// Time the credit and stock are held for a checkout before the hold expires
+	ReservationTTL time.Duration
+	// Interval at which expired stock reservations are released
+	SweepInterval time.Duration
 }
@@ -0,0 +1,185 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Outcome recorded for messages that do not send a response
+const OUTCOME_DONE = "DONE"
+
+// Interval at which the postgres store deletes the outcomes older than the ttl
+const dedupExpireInterval = 10 * time.Minute
+
+// DedupStore remembers the outcome of handled saga messages, so a message that is
+// delivered again is not executed twice but answered with the same outcome.
+type DedupStore interface {
+	// Outcome returns the recorded outcome, or an empty string if the message was not handled
+	Outcome(context.Context, string) (string, error)
+	// Record stores the outcome unless one was recorded before, the stored outcome is returned
+	Record(context.Context, string, string) (string, error)
+}
+
+// DedupKey identifies a message of a saga handled by a service
+func DedupKey(service string, trackID string, messageType string) string {
+	return fmt.Sprintf("%s:%s:%s", service, trackID, messageType)
+}
+
+type ProcessedMessage struct {
+	Key       string `gorm:"primary_key"`
+	Outcome   string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+type postgresDedupStore struct {
+	db  *gorm.DB
+	ttl time.Duration
+}
+
+func NewPostgresDedupStore(db *gorm.DB, ttl time.Duration) DedupStore {
+	err := db.AutoMigrate(&ProcessedMessage{}).Error
+	if err != nil {
+		panic(err)
+	}
+
+	s := &postgresDedupStore{
+		db:  db,
+		ttl: ttl,
+	}
+	if ttl > 0 {
+		go s.expireOutcomes(dedupExpireInterval)
+	}
+
+	return s
+}
+
+// Periodically deletes the outcomes that are older than the ttl, like the redis
+// store lets its keys expire
+func (s *postgresDedupStore) expireOutcomes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := s.expire(time.Now().Add(-s.ttl))
+		if err != nil {
+			logrus.WithError(err).Error("unable to delete expired message outcomes")
+			continue
+		}
+		if deleted > 0 {
+			logrus.WithField("deleted", deleted).Info("deleted expired message outcomes")
+		}
+	}
+}
+
+// Deletes the outcomes recorded before the time and returns how many were deleted
+func (s *postgresDedupStore) expire(before time.Time) (int64, error) {
+	del := s.db.Where("created_at < ?", before).Delete(&ProcessedMessage{})
+	if del.Error != nil {
+		return 0, errors.Wrap(del.Error, "unable to delete expired message outcomes")
+	}
+
+	return del.RowsAffected, nil
+}
+
+func (s *postgresDedupStore) Outcome(_ context.Context, key string) (string, error) {
+	message := &ProcessedMessage{}
+	err := s.db.Model(&ProcessedMessage{}).
+		Where("key = ?", key).
+		First(message).
+		Error
+	if err == gorm.ErrRecordNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get message outcome")
+	}
+
+	return message.Outcome, nil
+}
+
+func (s *postgresDedupStore) Record(ctx context.Context, key string, outcome string) (string, error) {
+	err := s.db.Model(&ProcessedMessage{}).
+		Set("gorm:insert_option", "ON CONFLICT DO NOTHING").
+		Create(&ProcessedMessage{Key: key, Outcome: outcome}).
+		Error
+	if err != nil {
+		return "", errors.Wrap(err, "unable to record message outcome")
+	}
+
+	return s.Outcome(ctx, key)
+}
+
+type redisDedupStore struct {
+	store *redis.Client
+	ttl   time.Duration
+}
+
+func NewRedisDedupStore(c *redis.Client, ttl time.Duration) DedupStore {
+	return &redisDedupStore{
+		store: c,
+		ttl:   ttl,
+	}
+}
+
+func dedupKey(key string) string {
+	return fmt.Sprintf("dedup:%s", key)
+}
+
+func (s *redisDedupStore) Outcome(ctx context.Context, key string) (string, error) {
+	get := s.store.Get(ctx, dedupKey(key))
+	if get.Err() == redis.Nil {
+		return "", nil
+	} else if get.Err() != nil {
+		return "", errors.Wrap(get.Err(), "unable to get message outcome")
+	}
+
+	return get.Val(), nil
+}
+
+func (s *redisDedupStore) Record(ctx context.Context, key string, outcome string) (string, error) {
+	set := s.store.SetNX(ctx, dedupKey(key), outcome, s.ttl)
+	if set.Err() != nil {
+		return "", errors.Wrap(set.Err(), "unable to record message outcome")
+	} else if set.Val() {
+		return outcome, nil
+	}
+
+	return s.Outcome(ctx, key)
+}
+
+// memoryDedupStore keeps the outcomes in memory, they are never forgotten
+type memoryDedupStore struct {
+	lock     sync.Mutex
+	outcomes map[string]string
+}
+
+func NewMemoryDedupStore() DedupStore {
+	return &memoryDedupStore{
+		outcomes: map[string]string{},
+	}
+}
+
+func (s *memoryDedupStore) Outcome(_ context.Context, key string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.outcomes[key], nil
+}
+
+func (s *memoryDedupStore) Record(_ context.Context, key string, outcome string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if recorded, ok := s.outcomes[key]; ok {
+		return recorded, nil
+	}
+	s.outcomes[key] = outcome
+
+	return outcome, nil
+}
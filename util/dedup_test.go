@@ -0,0 +1,85 @@
+package util
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDedupStore(t *testing.T, store DedupStore) string {
+	ctx := context.Background()
+	key := DedupKey("test", uuid.Must(uuid.NewV4()).String(), "pay")
+
+	outcome, err := store.Outcome(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, "", outcome)
+
+	recorded, err := store.Record(ctx, key, "SUCCESS")
+	require.NoError(t, err)
+	assert.Equal(t, "SUCCESS", recorded)
+
+	// The first outcome is kept when the message is handled again
+	recorded, err = store.Record(ctx, key, "FAILURE")
+	require.NoError(t, err)
+	assert.Equal(t, "SUCCESS", recorded)
+
+	outcome, err = store.Outcome(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, "SUCCESS", outcome)
+
+	return key
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	testDedupStore(t, NewMemoryDedupStore())
+}
+
+// Runs against a live database, set REDI_TEST_POSTGRES to a postgres connection
+// string to run it
+func TestPostgresDedupStore(t *testing.T) {
+	dsn := os.Getenv("REDI_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("REDI_TEST_POSTGRES is not set")
+	}
+
+	db, err := gorm.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewPostgresDedupStore(db, time.Hour).(*postgresDedupStore)
+	key := testDedupStore(t, store)
+	defer db.Where("key = ?", key).Delete(&ProcessedMessage{})
+
+	// Outcomes are only deleted once they are older than the ttl
+	_, err = store.expire(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	outcome, err := store.Outcome(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, "SUCCESS", outcome)
+
+	deleted, err := store.expire(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.True(t, deleted > 0)
+	outcome, err = store.Outcome(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, "", outcome)
+}
+
+func TestRedisDedupStore(t *testing.T) {
+	ctx := context.Background()
+	c := testBroker(t)
+	defer c.Close()
+
+	key := testDedupStore(t, NewRedisDedupStore(c, time.Hour))
+	defer c.Del(ctx, dedupKey(key))
+
+	ttl, err := c.TTL(ctx, dedupKey(key)).Result()
+	require.NoError(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Hour)
+}
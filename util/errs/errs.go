@@ -0,0 +1,164 @@
+// Package errs defines the domain errors of the services. Every error has a kind
+// that determines its HTTP status, and details that tell the client why a request
+// failed. Errors are sent as JSON in responses and saga messages.
+package errs
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Kind of a domain error
+type Kind string
+
+const (
+	NotFound            Kind = "not_found"
+	BadRequest          Kind = "bad_request"
+	InsufficientCredit  Kind = "insufficient_credit"
+	InsufficientStock   Kind = "insufficient_stock"
+	Conflict            Kind = "conflict"
+	AlreadyPaid         Kind = "already_paid"
+	InvalidState        Kind = "invalid_state"
+	UpstreamUnavailable Kind = "upstream_unavailable"
+	Timeout             Kind = "timeout"
+	Internal            Kind = "internal"
+)
+
+// Status returns the HTTP status of errors of the kind
+func (k Kind) Status() int {
+	switch k {
+	case NotFound:
+		return fasthttp.StatusNotFound
+	case BadRequest, InsufficientCredit, InsufficientStock:
+		return fasthttp.StatusBadRequest
+	case Conflict, AlreadyPaid, InvalidState:
+		return fasthttp.StatusConflict
+	case UpstreamUnavailable:
+		return fasthttp.StatusServiceUnavailable
+	case Timeout:
+		return fasthttp.StatusGatewayTimeout
+	default:
+		return fasthttp.StatusInternalServerError
+	}
+}
+
+// Error is a domain error, errors of the same kind are the same error for Is
+type Error struct {
+	Kind    Kind                   `json:"kind"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func New(kind Kind, message string) *Error {
+	return &Error{Kind: kind, Message: message}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+// Is reports whether the target is an error of the same kind
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind == e.Kind
+}
+
+// With returns a copy of the error with the detail added
+func (e *Error) With(key string, value interface{}) *Error {
+	c := *e
+	c.Details = map[string]interface{}{key: value}
+	for k, v := range e.Details {
+		c.Details[k] = v
+	}
+	return &c
+}
+
+// As returns the domain error in the chain of wrapped errors
+func As(err error) (*Error, bool) {
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			return e, true
+		}
+
+		switch w := err.(type) {
+		case interface{ Cause() error }:
+			err = w.Cause()
+		case interface{ Unwrap() error }:
+			err = w.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+// KindOf returns the kind of the error, errors that are not domain errors are
+// internal errors
+func KindOf(err error) Kind {
+	if err == nil {
+		return ""
+	}
+	if e, ok := As(err); ok {
+		return e.Kind
+	}
+	return Internal
+}
+
+// Is reports whether the error is a domain error of the kind
+func Is(err error, kind Kind) bool {
+	return err != nil && KindOf(err) == kind
+}
+
+// From returns the domain error to send to a client, the cause of other errors is
+// not exposed
+func From(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := As(err); ok {
+		return e
+	}
+	return New(Internal, "internal error")
+}
+
+// Unavailable is the error for a service that could not be reached
+func Unavailable(service string) *Error {
+	return New(UpstreamUnavailable, "service unavailable").With("service", service)
+}
+
+// Body of an error response
+type Response struct {
+	Error *Error `json:"error"`
+}
+
+// FromResponse returns the error of a response from a service, or nil for a
+// successful response. A response without an error body gets the kind of its
+// status.
+func FromResponse(status int, body []byte) error {
+	if status >= 200 && status < 300 {
+		return nil
+	}
+
+	resp := &Response{}
+	if json.Unmarshal(body, resp) == nil && resp.Error != nil && resp.Error.Kind != "" {
+		return resp.Error
+	}
+
+	switch status {
+	case fasthttp.StatusNotFound:
+		return New(NotFound, "not found")
+	case fasthttp.StatusBadRequest:
+		return New(BadRequest, "bad request")
+	case fasthttp.StatusConflict:
+		return New(Conflict, "conflict")
+	case fasthttp.StatusServiceUnavailable:
+		return New(UpstreamUnavailable, "service unavailable")
+	case fasthttp.StatusGatewayTimeout:
+		return New(Timeout, "timeout")
+	default:
+		return New(Internal, fmt.Sprintf("unexpected status %d", status))
+	}
+}
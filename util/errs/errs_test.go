@@ -0,0 +1,48 @@
+package errs
+
+import (
+	"testing"
+
+	errwrap "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestWithCopiesDetails(t *testing.T) {
+	base := New(NotFound, "item not found")
+	e := base.With("item_id", "a").With("count", 2)
+
+	assert.Nil(t, base.Details)
+	assert.Equal(t, map[string]interface{}{"item_id": "a", "count": 2}, e.Details)
+	assert.True(t, e.Is(base))
+	assert.False(t, e.Is(New(BadRequest, "item not found")))
+}
+
+func TestKindOfWrapped(t *testing.T) {
+	err := errwrap.Wrap(New(InsufficientStock, "insufficient stock"), "unable to reserve")
+
+	assert.True(t, Is(err, InsufficientStock))
+	assert.Equal(t, Internal, KindOf(errwrap.New("connection reset")))
+	assert.Equal(t, Kind(""), KindOf(nil))
+	assert.Equal(t, "internal error", From(errwrap.New("connection reset")).Message)
+}
+
+func TestStatus(t *testing.T) {
+	assert.Equal(t, fasthttp.StatusNotFound, NotFound.Status())
+	assert.Equal(t, fasthttp.StatusBadRequest, InsufficientCredit.Status())
+	assert.Equal(t, fasthttp.StatusConflict, AlreadyPaid.Status())
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, UpstreamUnavailable.Status())
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, Timeout.Status())
+	assert.Equal(t, fasthttp.StatusInternalServerError, Kind("unknown").Status())
+}
+
+func TestFromResponse(t *testing.T) {
+	assert.NoError(t, FromResponse(fasthttp.StatusOK, nil))
+
+	err := FromResponse(fasthttp.StatusBadRequest, []byte(`{"error":{"kind":"insufficient_credit","message":"insufficient credit","details":{"user_id":"u"}}}`))
+	assert.Equal(t, New(InsufficientCredit, "insufficient credit").With("user_id", "u"), err)
+
+	// Responses of services without an error body get the kind of the status
+	assert.True(t, Is(FromResponse(fasthttp.StatusNotFound, []byte("not found")), NotFound))
+	assert.True(t, Is(FromResponse(fasthttp.StatusTeapot, nil), Internal))
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// IsSQLite returns whether the database is a sqlite database
+func IsSQLite(db *gorm.DB) bool {
+	return db.Dialect().GetName() == "sqlite3"
+}
+
+// ForUpdate locks the rows selected by the query until the end of the
+// transaction. Sqlite has no row locks, a sqlite transaction holds the write lock
+// of the database from its start.
+func ForUpdate(tx *gorm.DB) *gorm.DB {
+	if IsSQLite(tx) {
+		return tx
+	}
+	return tx.Set("gorm:query_option", "FOR UPDATE")
+}
+
+// ForUpdateSkipLocked locks the rows selected by the query until the end of the
+// transaction, rows locked by other transactions are skipped
+func ForUpdateSkipLocked(tx *gorm.DB) *gorm.DB {
+	if IsSQLite(tx) {
+		return tx
+	}
+	return tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED")
+}
+
+// GenerateID sets the primary key of the created record to a new uuid when it is
+// blank, as not every database can generate them
+func GenerateID(scope *gorm.Scope) error {
+	field := scope.PrimaryField()
+	if field == nil || !field.IsBlank {
+		return nil
+	}
+
+	return field.Set(uuid.Must(uuid.NewV4()).String())
+}
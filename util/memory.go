@@ -0,0 +1,8 @@
+package util
+
+// Clone returns a copy of the string. Route parameters of fasthttp point into the
+// buffer of the request, which is reused for the next request, so strings that
+// are kept in memory after a request have to be copied.
+func Clone(s string) string {
+	return string([]byte(s))
+}
@@ -0,0 +1,184 @@
+package util
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/pkg/errors"
+)
+
+// Version of the message envelope, increased on incompatible changes
+const MessageVersion = 2
+
+// Message is the envelope of every saga message exchanged between the services
+type Message struct {
+	Version   int           `json:"version"`
+	ID        string        `json:"id"`
+	Type      string        `json:"type"`
+	ChannelID string        `json:"channel_id"`
+	TrackID   string        `json:"track_id"`
+	Timestamp time.Time     `json:"timestamp"`
+	Order     *OrderPayload `json:"order,omitempty"`
+	// Step of an orchestrated saga the message belongs to, the services only
+	// reply to the order service with the outcome of such a message
+	Step string `json:"step,omitempty"`
+	// Error a step failed with, which tells the client why the saga failed
+	Error *errs.Error `json:"error,omitempty"`
+}
+
+// Orchestrated returns whether the message is part of a saga orchestrated by the
+// order service
+func (m *Message) Orchestrated() bool {
+	return m.Step != ""
+}
+
+// OrderPayload is the order a saga message is about
+type OrderPayload struct {
+	OrderID string     `json:"order_id"`
+	UserID  string     `json:"user_id"`
+	Items   OrderItems `json:"items"`
+	Cost    int        `json:"cost"`
+}
+
+// OrderItems maps the item IDs in an order to the quantity ordered
+type OrderItems map[string]int
+
+// UnmarshalJSON also accepts the list of item IDs used before version 2, where
+// every item was ordered once.
+func (i *OrderItems) UnmarshalJSON(b []byte) error {
+	ids := []string{}
+	if json.Unmarshal(b, &ids) == nil {
+		*i = OrderItems{}
+		for _, id := range ids {
+			(*i)[id]++
+		}
+		return nil
+	}
+
+	m := map[string]int{}
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return err
+	}
+	*i = m
+
+	return nil
+}
+
+// IDs returns the sorted item IDs, transactions that lock the items in this order
+// cannot deadlock each other
+func (i OrderItems) IDs() []string {
+	ids := make([]string, 0, len(i))
+	for id := range i {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// NewMessage creates a message for the saga identified by the order channel and track ID
+func NewMessage(messageType string, orderChannelID string, trackID string, order *OrderPayload) *Message {
+	return &Message{
+		Version:   MessageVersion,
+		ID:        uuid.Must(uuid.NewV4()).String(),
+		Type:      messageType,
+		ChannelID: orderChannelID,
+		TrackID:   trackID,
+		Timestamp: time.Now(),
+		Order:     order,
+	}
+}
+
+// Next creates the following message in the same saga
+func (m *Message) Next(messageType string) *Message {
+	next := NewMessage(messageType, m.ChannelID, m.TrackID, m.Order)
+	next.Step = m.Step
+	return next
+}
+
+// NextError creates the following message in the same saga with the error that
+// caused it, a nil error is left out
+func (m *Message) NextError(messageType string, err error) *Message {
+	next := m.Next(messageType)
+	next.Error = errs.From(err)
+	return next
+}
+
+func EncodeMessage(m *Message) (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode message")
+	}
+
+	return string(b), nil
+}
+
+// DecodeMessage decodes a message envelope, messages in the legacy
+// "channelID#trackID#message#payload" format are still accepted.
+func DecodeMessage(body string) (*Message, error) {
+	if !strings.HasPrefix(body, "{") {
+		return decodeLegacyMessage(body)
+	}
+
+	m := &Message{}
+	err := json.Unmarshal([]byte(body), m)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed message")
+	}
+
+	if m.Version > MessageVersion {
+		return nil, errors.Errorf("unsupported message version %d", m.Version)
+	} else if m.Type == "" || m.TrackID == "" {
+		return nil, errors.New("message is missing type or track ID")
+	}
+
+	return m, nil
+}
+
+func decodeLegacyMessage(body string) (*Message, error) {
+	s := strings.SplitN(body, "#", 4)
+	if len(s) < 3 || s[1] == "" || s[2] == "" {
+		return nil, errors.New("malformed legacy message")
+	}
+
+	m := &Message{
+		Version:   0,
+		Type:      s[2],
+		ChannelID: s[0],
+		TrackID:   s[1],
+	}
+
+	if len(s) == 4 && s[3] != "" {
+		order, err := DecodeOrderPayload(s[3])
+		if err != nil {
+			return nil, err
+		}
+		m.Order = order
+	}
+
+	return m, nil
+}
+
+func EncodeOrderPayload(order *OrderPayload) (string, error) {
+	b, err := json.Marshal(order)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode order payload")
+	}
+
+	return string(b), nil
+}
+
+func DecodeOrderPayload(payload string) (*OrderPayload, error) {
+	order := &OrderPayload{}
+	err := json.Unmarshal([]byte(payload), order)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed order payload")
+	}
+
+	return order, nil
+}
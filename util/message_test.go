@@ -0,0 +1,71 @@
+package util
+
+import (
+	"testing"
+
+	errwrap "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	order := &OrderPayload{OrderID: "order", UserID: "user#1", Items: OrderItems{"a": 1, "b": 2}, Cost: 3}
+	m := NewMessage(MESSAGE_PAY, "channel", "track", order)
+
+	body, err := EncodeMessage(m)
+	assert.NoError(t, err)
+
+	decoded, err := DecodeMessage(body)
+	assert.NoError(t, err)
+	assert.Equal(t, MessageVersion, decoded.Version)
+	assert.Equal(t, MESSAGE_PAY, decoded.Type)
+	assert.Equal(t, "channel", decoded.ChannelID)
+	assert.Equal(t, "track", decoded.TrackID)
+	assert.Equal(t, order, decoded.Order)
+}
+
+func TestDecodeLegacyMessage(t *testing.T) {
+	m, err := DecodeMessage("channel#track#MESG_PAY#{\"order_id\": \"o#1\", \"user_id\": \"u\", \"items\": [\"a\", \"b\"], \"cost\": 2}")
+	assert.NoError(t, err)
+	assert.Equal(t, MESSAGE_PAY, m.Type)
+	assert.Equal(t, "track", m.TrackID)
+	assert.Equal(t, &OrderPayload{OrderID: "o#1", UserID: "u", Items: OrderItems{"a": 1, "b": 1}, Cost: 2}, m.Order)
+
+	m, err = DecodeMessage("channel#track#MESG_ORDER_SUCCESS#")
+	assert.NoError(t, err)
+	assert.Nil(t, m.Order)
+}
+
+func TestDecodeMalformedMessage(t *testing.T) {
+	for _, body := range []string{"", "channel#track", "{\"version\": 1}", "{\"version\": 99, \"type\": \"t\", \"track_id\": \"t\"}", "{"} {
+		_, err := DecodeMessage(body)
+		assert.Error(t, err, body)
+	}
+}
+
+func TestNextKeepsStep(t *testing.T) {
+	m := NewMessage(MESSAGE_STOCK, "channel", "track", nil)
+	m.Step = "reserve_stock"
+
+	next := m.Next(MESSAGE_ORDER_SUCCESS)
+	assert.Equal(t, "reserve_stock", next.Step)
+	assert.True(t, next.Orchestrated())
+	assert.False(t, NewMessage(MESSAGE_STOCK, "channel", "track", nil).Orchestrated())
+}
+
+func TestNextErrorRoundTrip(t *testing.T) {
+	m := NewMessage(MESSAGE_PAY, "channel", "track", nil)
+
+	body, err := EncodeMessage(m.NextError(MESSAGE_ORDER_BADREQUEST, errwrap.Wrap(BAD_REQUEST, "unable to pay")))
+	assert.NoError(t, err)
+
+	decoded, err := DecodeMessage(body)
+	assert.NoError(t, err)
+	assert.Equal(t, MESSAGE_ORDER_BADREQUEST, decoded.Type)
+	assert.Equal(t, BAD_REQUEST, decoded.Error)
+	assert.Nil(t, m.Next(MESSAGE_ORDER_SUCCESS).Error)
+}
+
+func TestOrderItemsIDs(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, OrderItems{"c": 1, "a": 2, "b": 3}.IDs())
+	assert.Empty(t, OrderItems{}.IDs())
+}
@@ -0,0 +1,4 @@
+package util
+
+// RedisHashes maps the keys of redis hashes to their fields
+type RedisHashes map[string]map[string]interface{}
@@ -1,6 +1,10 @@
 package util
 
 import (
+	"encoding/json"
+
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 )
 
@@ -8,20 +12,46 @@ func Ok(ctx *fasthttp.RequestCtx) {
 	ctx.SetStatusCode(fasthttp.StatusOK)
 }
 
+func Accepted(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+}
+
 func NotFound(ctx *fasthttp.RequestCtx) {
-	ctx.SetStatusCode(fasthttp.StatusNotFound)
+	ErrorResponse(ctx, NOT_FOUND)
 }
 
 func BadRequest(ctx *fasthttp.RequestCtx) {
-	ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	ErrorResponse(ctx, BAD_REQUEST)
+}
+
+func Conflict(ctx *fasthttp.RequestCtx) {
+	ErrorResponse(ctx, CONFLICT)
 }
 
 func InternalServerError(ctx *fasthttp.RequestCtx) {
-	ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	ErrorResponse(ctx, INTERNAL_ERR)
 }
 
-func JSONResponse(ctx *fasthttp.RequestCtx, status int, response string) {
+func GatewayTimeout(ctx *fasthttp.RequestCtx) {
+	ErrorResponse(ctx, errs.New(errs.Timeout, "timeout"))
+}
+
+func JSONResponse(ctx *fasthttp.RequestCtx, status int, response interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		logrus.WithError(err).Error("unable to encode response")
+		InternalServerError(ctx)
+		return
+	}
+
 	ctx.SetStatusCode(status)
-	ctx.SetBodyString(response)
+	ctx.SetBody(body)
 	ctx.SetContentType("application/json")
 }
+
+// ErrorResponse sets the status of the kind of the error and the error as body,
+// errors that are not domain errors are internal errors
+func ErrorResponse(ctx *fasthttp.RequestCtx, err error) {
+	e := errs.From(err)
+	JSONResponse(ctx, e.Kind.Status(), &errs.Response{Error: e})
+}
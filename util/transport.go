@@ -0,0 +1,463 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+type TransportType int
+
+const (
+	PUBSUB  TransportType = 1
+	STREAMS TransportType = 2
+	// MEMORY_BROKER passes messages between services in the same process
+	MEMORY_BROKER TransportType = 3
+)
+
+func GetTransportType(name string) TransportType {
+	switch name {
+	case "pubsub":
+		return PUBSUB
+	case "streams":
+		return STREAMS
+	case "memory":
+		return MEMORY_BROKER
+	default:
+		logrus.WithField("transport", name).Fatal("invalid transport, should be one of: pubsub, streams, memory")
+		return 0
+	}
+}
+
+// MessageHandler handles a message of a queue, it returns an error when the
+// message was not handled and has to be delivered again
+type MessageHandler func(ctx context.Context, body string) error
+
+// Transport exchanges saga messages between the services. A queue is either the
+// name of a service ("payment", "stock") or the channel of an order instance.
+type Transport interface {
+	// Pub sends a message to the given queue
+	Pub(ctx context.Context, queue string, body string) error
+	// Sub sets up a subscription on the queue and calls handle for every message
+	// in the background, it returns once the subscription is active.
+	Sub(ctx context.Context, queue string, handle MessageHandler) error
+	// Close stops the subscriptions and removes the queues of this instance
+	Close(ctx context.Context) error
+}
+
+// OrderChannel returns the queue an order instance receives its responses on
+func OrderChannel(orderChannelID string) string {
+	return fmt.Sprintf("%s.%s", CHANNEL_ORDER, orderChannelID)
+}
+
+// pubSubTransport sends messages to services over HTTP and to order instances
+// with Redis PUBLISH. Messages are lost when the receiver is not listening.
+type pubSubTransport struct {
+	broker *redis.Client
+	urls   *Services
+
+	lock sync.Mutex
+	subs []*redis.PubSub
+}
+
+func NewPubSubTransport(broker *redis.Client, urls *Services) Transport {
+	return &pubSubTransport{
+		broker: broker,
+		urls:   urls,
+	}
+}
+
+func (t *pubSubTransport) Pub(ctx context.Context, queue string, body string) error {
+	if strings.HasPrefix(queue, CHANNEL_ORDER) {
+		return t.broker.Publish(ctx, queue, body).Err()
+	}
+
+	url := t.urls.Payment
+	if queue == "stock" {
+		url = t.urls.Stock
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(fmt.Sprintf("%s/%s/message", url, queue))
+	req.Header.SetMethod("POST")
+	req.SetBodyString(body)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	err := t.urls.HTTPClient().Do(req, resp)
+	if err != nil {
+		return err
+	} else if resp.StatusCode() != fasthttp.StatusOK {
+		return errors.Errorf("error while sending message, status %d", resp.StatusCode())
+	}
+
+	return nil
+}
+
+func (t *pubSubTransport) Sub(ctx context.Context, queue string, handle MessageHandler) error {
+	// Services receive their messages on the HTTP message endpoint
+	if !strings.HasPrefix(queue, CHANNEL_ORDER) {
+		return nil
+	}
+
+	pubsub := t.broker.PSubscribe(ctx, queue)
+
+	// Wait for confirmation that subscription is created before publishing anything.
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error listening to channel")
+	}
+
+	t.lock.Lock()
+	t.subs = append(t.subs, pubsub)
+	t.lock.Unlock()
+
+	go func() {
+		for rm := range pubsub.Channel() {
+			// A published message cannot be delivered again
+			err := handle(ctx, rm.Payload)
+			if err != nil {
+				logrus.WithError(err).WithField("channel", queue).Error("unable to handle message")
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *pubSubTransport) Close(_ context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, pubsub := range t.subs {
+		err := pubsub.Close()
+		if err != nil {
+			return errors.Wrap(err, "unable to close subscription")
+		}
+	}
+	t.subs = nil
+
+	return nil
+}
+
+// Number of deliveries after which a message that fails every time is dropped
+const maxDeliveries = 10
+
+// Number of pending messages inspected at once by the reclaim
+const pendingPage = 100
+
+// streamsTransport stores messages in a Redis stream per queue, which is read by
+// a consumer group. A message is acknowledged once it was handled, messages that
+// were not acknowledged in time are reclaimed and handled again. Streams are
+// trimmed to about maxLen messages.
+type streamsTransport struct {
+	broker       *redis.Client
+	consumer     string
+	reclaimAfter time.Duration
+	maxLen       int64
+
+	// ctx is cancelled when the transport is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock   sync.Mutex
+	queues []string
+}
+
+func NewStreamsTransport(broker *redis.Client, reclaimAfter time.Duration, maxLen int64) Transport {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &streamsTransport{
+		broker:       broker,
+		consumer:     uuid.Must(uuid.NewV4()).String(),
+		reclaimAfter: reclaimAfter,
+		maxLen:       maxLen,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func streamKey(queue string) string {
+	return fmt.Sprintf("stream:%s", queue)
+}
+
+func (t *streamsTransport) Pub(ctx context.Context, queue string, body string) error {
+	return t.broker.XAdd(ctx, &redis.XAddArgs{
+		Stream:       streamKey(queue),
+		MaxLenApprox: t.maxLen,
+		Values:       map[string]interface{}{"body": body},
+	}).Err()
+}
+
+func (t *streamsTransport) Sub(ctx context.Context, queue string, handle MessageHandler) error {
+	stream := streamKey(queue)
+
+	err := t.broker.XGroupCreateMkStream(ctx, stream, queue, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.Wrap(err, "unable to create consumer group")
+	}
+
+	t.lock.Lock()
+	t.queues = append(t.queues, queue)
+	t.lock.Unlock()
+
+	go t.consume(stream, queue, handle)
+	go t.reclaim(stream, queue, handle)
+
+	return nil
+}
+
+// Stops reading and removes the streams of the order channel of this instance
+// with their consumer groups, the streams of the services are shared. The
+// consumer of this instance is removed from the groups of the services, unless
+// messages are still pending for it, those are reclaimed by the other instances.
+func (t *streamsTransport) Close(ctx context.Context) error {
+	t.cancel()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, queue := range t.queues {
+		if strings.HasPrefix(queue, CHANNEL_ORDER) {
+			err := t.broker.Del(ctx, streamKey(queue)).Err()
+			if err != nil {
+				return errors.Wrapf(err, "unable to remove stream of %s", queue)
+			}
+			continue
+		}
+
+		err := t.removeConsumer(ctx, streamKey(queue), queue)
+		if err != nil {
+			return err
+		}
+	}
+	t.queues = nil
+
+	return nil
+}
+
+// Removes the consumer of this instance from the group when no messages are
+// pending for it, deleting a consumer drops its pending messages
+func (t *streamsTransport) removeConsumer(ctx context.Context, stream string, group string) error {
+	pending := t.broker.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   stream,
+		Group:    group,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+		Consumer: t.consumer,
+	})
+	if pending.Err() != nil {
+		return errors.Wrapf(pending.Err(), "unable to get pending messages of %s", group)
+	} else if len(pending.Val()) > 0 {
+		logrus.WithField("stream", stream).Warn("messages are pending for consumer, leaving them to be reclaimed")
+		return nil
+	}
+
+	err := t.broker.XGroupDelConsumer(ctx, stream, group, t.consumer).Err()
+	if err != nil {
+		return errors.Wrapf(err, "unable to remove consumer from %s", group)
+	}
+
+	return nil
+}
+
+func (t *streamsTransport) consume(stream string, group string, handle MessageHandler) {
+	for t.ctx.Err() == nil {
+		read := t.broker.XReadGroup(t.ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: t.consumer,
+			Streams:  []string{stream, ">"},
+			Count:    100,
+			Block:    time.Second,
+		})
+		if read.Err() == redis.Nil || t.ctx.Err() != nil {
+			continue
+		} else if read.Err() != nil {
+			logrus.WithError(read.Err()).WithField("stream", stream).Error("unable to read from stream")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, s := range read.Val() {
+			t.handle(stream, group, s.Messages, handle)
+		}
+	}
+}
+
+// Periodically takes over messages that were delivered to a consumer, but not
+// acknowledged within the reclaim time, e.g. because the consumer crashed or
+// failed to handle them.
+func (t *streamsTransport) reclaim(stream string, group string, handle MessageHandler) {
+	ticker := time.NewTicker(t.reclaimAfter)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Pages through all pending messages, so the old messages are not starved
+		// by many messages that are not idle long enough yet
+		start := "-"
+		for start != "" && t.ctx.Err() == nil {
+			start = t.reclaimPage(stream, group, start, handle)
+		}
+	}
+}
+
+// Reclaims the idle messages of the page of pending messages from the start ID,
+// returns the start of the next page or an empty string after the last page
+func (t *streamsTransport) reclaimPage(stream string, group string, start string, handle MessageHandler) string {
+	pending := t.broker.XPendingExt(t.ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  group,
+		Start:  start,
+		End:    "+",
+		Count:  pendingPage,
+	})
+	if pending.Err() != nil {
+		logrus.WithError(pending.Err()).WithField("stream", stream).Error("unable to get pending messages")
+		return ""
+	}
+
+	ids := []string{}
+	for _, p := range pending.Val() {
+		if p.Idle < t.reclaimAfter {
+			continue
+		} else if p.RetryCount >= maxDeliveries {
+			logrus.WithField("stream", stream).WithField("id", p.ID).Error("DROPPING MESSAGE THAT FAILED TOO OFTEN")
+			t.ack(stream, group, p.ID)
+			continue
+		}
+		ids = append(ids, p.ID)
+	}
+
+	if len(ids) > 0 {
+		claim := t.broker.XClaim(t.ctx, &redis.XClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: t.consumer,
+			MinIdle:  t.reclaimAfter,
+			Messages: ids,
+		})
+		if claim.Err() != nil {
+			logrus.WithError(claim.Err()).WithField("stream", stream).Error("unable to claim pending messages")
+			return ""
+		}
+
+		t.handle(stream, group, claim.Val(), handle)
+	}
+
+	if len(pending.Val()) < pendingPage {
+		return ""
+	}
+	return nextStreamID(pending.Val()[len(pending.Val())-1].ID)
+}
+
+// Returns the smallest stream ID after the ID, stream IDs consist of a time and a
+// sequence number
+func nextStreamID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s-%d", parts[0], seq+1)
+}
+
+// Handles the messages and acknowledges the ones that were handled, the others
+// stay pending until they are reclaimed
+func (t *streamsTransport) handle(stream string, group string, messages []redis.XMessage, handle MessageHandler) {
+	for _, m := range messages {
+		body, ok := m.Values["body"].(string)
+		if !ok {
+			logrus.WithField("stream", stream).WithField("id", m.ID).Error("message without body")
+			t.ack(stream, group, m.ID)
+			continue
+		}
+
+		err := handle(t.ctx, body)
+		if err != nil {
+			logrus.WithError(err).WithField("stream", stream).WithField("id", m.ID).Warn("unable to handle message, it is delivered again")
+			continue
+		}
+		t.ack(stream, group, m.ID)
+	}
+}
+
+func (t *streamsTransport) ack(stream string, group string, id string) {
+	err := t.broker.XAck(t.ctx, stream, group, id).Err()
+	if err != nil {
+		logrus.WithError(err).WithField("stream", stream).WithField("id", id).Error("unable to acknowledge message")
+	}
+}
+
+// memoryTransport passes messages to the handlers subscribed in the same process.
+// Every message is handled in its own goroutine, messages to a queue without
+// subscribers are dropped.
+type memoryTransport struct {
+	lock     sync.RWMutex
+	handlers map[string][]MessageHandler
+}
+
+func NewMemoryTransport() Transport {
+	return &memoryTransport{
+		handlers: map[string][]MessageHandler{},
+	}
+}
+
+func (t *memoryTransport) Pub(_ context.Context, queue string, body string) error {
+	t.lock.RLock()
+	handlers := t.handlers[queue]
+	t.lock.RUnlock()
+
+	if len(handlers) == 0 {
+		logrus.WithField("queue", queue).Warn("no subscribers for message")
+		return nil
+	}
+
+	// Like a consumer group, only one subscriber receives the message
+	handle := handlers[rand.Intn(len(handlers))]
+	go func() {
+		err := handle(context.Background(), body)
+		if err != nil {
+			logrus.WithError(err).WithField("queue", queue).Error("unable to handle message")
+		}
+	}()
+
+	return nil
+}
+
+func (t *memoryTransport) Sub(_ context.Context, queue string, handle MessageHandler) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.handlers[queue] = append(t.handlers[queue], handle)
+	return nil
+}
+
+func (t *memoryTransport) Close(_ context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.handlers = map[string][]MessageHandler{}
+	return nil
+}
@@ -0,0 +1,216 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Collects the received messages, handling the first failures messages fails
+type receiver struct {
+	lock     sync.Mutex
+	failures int
+	bodies   []string
+	handled  chan string
+}
+
+func newReceiver(failures int) *receiver {
+	return &receiver{failures: failures, handled: make(chan string, 1000)}
+}
+
+func (r *receiver) handle(_ context.Context, body string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.bodies = append(r.bodies, body)
+	if len(r.bodies) <= r.failures {
+		return errors.New("failed to handle message")
+	}
+	r.handled <- body
+	return nil
+}
+
+func (r *receiver) received() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.bodies...)
+}
+
+func (r *receiver) wait(t *testing.T) string {
+	select {
+	case body := <-r.handled:
+		return body
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "message was not handled")
+		return ""
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	ctx := context.Background()
+	transport := NewMemoryTransport()
+	r := newReceiver(0)
+
+	require.NoError(t, transport.Sub(ctx, "stock", r.handle))
+	require.NoError(t, transport.Pub(ctx, "stock", "message"))
+	assert.Equal(t, "message", r.wait(t))
+
+	// Messages are dropped once the transport is closed
+	require.NoError(t, transport.Close(ctx))
+	require.NoError(t, transport.Pub(ctx, "stock", "dropped"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"message"}, r.received())
+}
+
+// The streams tests run against a live redis, set REDI_TEST_REDIS to a redis
+// address to run them
+func testBroker(t *testing.T) *redis.Client {
+	addr := os.Getenv("REDI_TEST_REDIS")
+	if addr == "" {
+		t.Skip("REDI_TEST_REDIS is not set")
+	}
+
+	c := redis.NewClient(&redis.Options{Addr: addr})
+	require.NoError(t, c.Ping(context.Background()).Err())
+	return c
+}
+
+func testQueue() string {
+	return fmt.Sprintf("test-%s", uuid.Must(uuid.NewV4()))
+}
+
+func TestStreamsTransport(t *testing.T) {
+	ctx := context.Background()
+	broker := testBroker(t)
+	defer broker.Close()
+
+	queue := testQueue()
+	defer broker.Del(ctx, streamKey(queue))
+
+	transport := NewStreamsTransport(broker, time.Minute, 1000)
+	defer transport.Close(ctx)
+
+	r := newReceiver(0)
+	require.NoError(t, transport.Sub(ctx, queue, r.handle))
+	require.NoError(t, transport.Pub(ctx, queue, "message"))
+	assert.Equal(t, "message", r.wait(t))
+
+	// Handled messages are acknowledged
+	assert.Eventually(t, func() bool {
+		pending, err := broker.XPending(ctx, streamKey(queue), queue).Result()
+		return err == nil && pending.Count == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStreamsTransportReclaimsFailed(t *testing.T) {
+	ctx := context.Background()
+	broker := testBroker(t)
+	defer broker.Close()
+
+	queue := testQueue()
+	defer broker.Del(ctx, streamKey(queue))
+
+	transport := NewStreamsTransport(broker, 100*time.Millisecond, 1000)
+	defer transport.Close(ctx)
+
+	// The failed message stays pending until it is reclaimed
+	r := newReceiver(1)
+	require.NoError(t, transport.Sub(ctx, queue, r.handle))
+	require.NoError(t, transport.Pub(ctx, queue, "message"))
+	assert.Equal(t, "message", r.wait(t))
+	assert.Equal(t, []string{"message", "message"}, r.received())
+
+	assert.Eventually(t, func() bool {
+		pending, err := broker.XPending(ctx, streamKey(queue), queue).Result()
+		return err == nil && pending.Count == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStreamsTransportReclaimsAllPages(t *testing.T) {
+	ctx := context.Background()
+	broker := testBroker(t)
+	defer broker.Close()
+
+	queue := testQueue()
+	defer broker.Del(ctx, streamKey(queue))
+
+	// A consumer that crashed left more than a page of messages pending
+	require.NoError(t, broker.XGroupCreateMkStream(ctx, streamKey(queue), queue, "0").Err())
+	n := pendingPage + 50
+	for i := 0; i < n; i++ {
+		require.NoError(t, broker.XAdd(ctx, &redis.XAddArgs{Stream: streamKey(queue), Values: map[string]interface{}{"body": "message"}}).Err())
+	}
+	require.NoError(t, broker.XReadGroup(ctx, &redis.XReadGroupArgs{Group: queue, Consumer: "crashed", Streams: []string{streamKey(queue), ">"}, Count: int64(n)}).Err())
+
+	transport := NewStreamsTransport(broker, 500*time.Millisecond, 1000)
+	defer transport.Close(ctx)
+
+	// All of them are reclaimed in the first round
+	r := newReceiver(0)
+	require.NoError(t, transport.Sub(ctx, queue, r.handle))
+	assert.Eventually(t, func() bool {
+		return len(r.received()) == n
+	}, 900*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestNextStreamID(t *testing.T) {
+	assert.Equal(t, "1526985054069-1", nextStreamID("1526985054069-0"))
+	assert.Equal(t, "", nextStreamID("invalid"))
+}
+
+func TestStreamsTransportTrims(t *testing.T) {
+	ctx := context.Background()
+	broker := testBroker(t)
+	defer broker.Close()
+
+	queue := testQueue()
+	defer broker.Del(ctx, streamKey(queue))
+
+	transport := NewStreamsTransport(broker, time.Minute, 10)
+	defer transport.Close(ctx)
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, transport.Pub(ctx, queue, "message"))
+	}
+
+	length, err := broker.XLen(ctx, streamKey(queue)).Result()
+	require.NoError(t, err)
+	assert.Less(t, length, int64(1000))
+}
+
+func TestStreamsTransportCloseRemovesOrderChannel(t *testing.T) {
+	ctx := context.Background()
+	broker := testBroker(t)
+	defer broker.Close()
+
+	channel := OrderChannel(uuid.Must(uuid.NewV4()).String())
+	queue := testQueue()
+	defer broker.Del(ctx, streamKey(queue), streamKey(channel))
+
+	transport := NewStreamsTransport(broker, time.Minute, 1000)
+	require.NoError(t, transport.Sub(ctx, channel, newReceiver(0).handle))
+	require.NoError(t, transport.Sub(ctx, queue, newReceiver(0).handle))
+	require.NoError(t, transport.Close(ctx))
+
+	exists, err := broker.Exists(ctx, streamKey(channel)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), exists)
+
+	// The queues of the services are shared with the other instances, only the
+	// consumer of the instance is removed
+	exists, err = broker.Exists(ctx, streamKey(queue)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), exists)
+	consumers, err := broker.Do(ctx, "XINFO", "CONSUMERS", streamKey(queue), queue).Result()
+	require.NoError(t, err)
+	assert.Empty(t, consumers)
+}
@@ -0,0 +1,361 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/martijnjanssen/redi-shop/util/errs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Error codes of postgres when a prepared transaction does not exist or its
+// identifier is already in use
+const (
+	pgUndefinedObject = "42704"
+	pgDuplicateObject = "42710"
+)
+
+// Error of a prepare request that arrives after the transaction was aborted
+var errTransactionAborted = errs.New(errs.Conflict, "transaction was aborted")
+
+// AbortedTransaction records that the coordinator aborted a transaction, so a
+// prepare request for it that arrives later is refused instead of prepared. The
+// records expire like the outcomes of saga messages.
+type AbortedTransaction struct {
+	GID       string    `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// PrepareFunc does the work of a service for the order in the transaction that
+// is prepared, it returns BAD_REQUEST when the service votes to abort
+type PrepareFunc func(tx *gorm.DB, order *OrderPayload) error
+
+// TwoPhaseParticipant handles the prepare, commit and abort requests of the order
+// service when a service takes part in a two-phase commit checkout. Only the
+// postgres backend supports prepared transactions.
+type TwoPhaseParticipant struct {
+	service string
+	db      *gorm.DB
+	prepare PrepareFunc
+}
+
+func NewTwoPhaseParticipant(service string, conn *Connection, prepare PrepareFunc) *TwoPhaseParticipant {
+	p := &TwoPhaseParticipant{
+		service: service,
+		prepare: prepare,
+	}
+	if conn.Backend != POSTGRES {
+		return p
+	}
+
+	err := conn.Postgres.AutoMigrate(&AbortedTransaction{}).Error
+	if err != nil {
+		panic(err)
+	}
+	p.db = conn.Postgres
+	if conn.Checkout.DedupTTL > 0 {
+		go p.expireAborts(dedupExpireInterval, conn.Checkout.DedupTTL)
+	}
+
+	return p
+}
+
+// Periodically deletes the aborts that are older than the ttl, a prepare that
+// arrives later is aborted by the recovery of the coordinator
+func (p *TwoPhaseParticipant) expireAborts(interval time.Duration, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := p.expire(time.Now().Add(-ttl))
+		if err != nil {
+			logrus.WithError(err).Error("unable to delete expired aborted transactions")
+			continue
+		}
+		if deleted > 0 {
+			logrus.WithField("deleted", deleted).Info("deleted expired aborted transactions")
+		}
+	}
+}
+
+// Deletes the aborts recorded before the time and returns how many were deleted
+func (p *TwoPhaseParticipant) expire(before time.Time) (int64, error) {
+	del := p.db.Where("created_at < ?", before).Delete(&AbortedTransaction{})
+	if del.Error != nil {
+		return 0, errors.Wrap(del.Error, "unable to delete expired aborted transactions")
+	}
+
+	return del.RowsAffected, nil
+}
+
+// Prepare does the work for the order in the request body and prepares it,
+// responds with 200 to vote to commit
+func (p *TwoPhaseParticipant) Prepare(ctx *fasthttp.RequestCtx) {
+	gid, ok := p.transactionID(ctx)
+	if !ok {
+		return
+	}
+
+	order := &OrderPayload{}
+	err := json.Unmarshal(ctx.Request.Body(), order)
+	if err != nil {
+		BadRequest(ctx)
+		return
+	}
+
+	var result error
+	err = PrepareTransaction(ctx, p.db, gid, func(tx *gorm.DB) error {
+		result = checkNotAborted(tx, gid)
+		if result != nil {
+			return result
+		}
+
+		result = p.prepare(tx, order)
+		return result
+	})
+	if result != nil && !errs.Is(result, errs.Internal) {
+		// The participant votes to abort for the reason in the error
+		ErrorResponse(ctx, result)
+		return
+	} else if err != nil {
+		logrus.WithError(err).WithField("gid", gid).Error("unable to prepare transaction")
+		InternalServerError(ctx)
+		return
+	}
+
+	// The abort may have been recorded while the transaction was prepared, it then
+	// did not find the transaction to roll back
+	err = checkNotAborted(p.db, gid)
+	if errs.Is(err, errs.Conflict) {
+		err = RollbackPrepared(p.db, gid)
+		if err != nil {
+			logrus.WithError(err).WithField("gid", gid).Error("unable to roll back aborted transaction")
+			InternalServerError(ctx)
+			return
+		}
+		ErrorResponse(ctx, errTransactionAborted.With("gid", gid))
+		return
+	} else if err != nil {
+		logrus.WithError(err).WithField("gid", gid).Error("unable to check transaction")
+		InternalServerError(ctx)
+		return
+	}
+
+	Ok(ctx)
+}
+
+// Returns errTransactionAborted when the transaction was aborted
+func checkNotAborted(db *gorm.DB, gid string) error {
+	err := db.Model(&AbortedTransaction{}).
+		Where(&AbortedTransaction{GID: gid}).
+		First(&AbortedTransaction{}).
+		Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to get aborted transaction")
+	}
+
+	return errTransactionAborted.With("gid", gid)
+}
+
+func (p *TwoPhaseParticipant) Commit(ctx *fasthttp.RequestCtx) {
+	gid, ok := p.transactionID(ctx)
+	if !ok {
+		return
+	}
+
+	err := CommitPrepared(p.db, gid)
+	if err != nil {
+		logrus.WithError(err).WithField("gid", gid).Error("unable to commit transaction")
+		InternalServerError(ctx)
+		return
+	}
+
+	Ok(ctx)
+}
+
+func (p *TwoPhaseParticipant) Abort(ctx *fasthttp.RequestCtx) {
+	gid, ok := p.transactionID(ctx)
+	if !ok {
+		return
+	}
+
+	// Record the abort before rolling back, a prepare that is still running then
+	// either refuses or finds the abort once it prepared
+	err := p.db.Set("gorm:insert_option", "ON CONFLICT DO NOTHING").
+		Create(&AbortedTransaction{GID: gid}).
+		Error
+	if err != nil {
+		logrus.WithError(err).WithField("gid", gid).Error("unable to record aborted transaction")
+		InternalServerError(ctx)
+		return
+	}
+
+	err = RollbackPrepared(p.db, gid)
+	if err != nil {
+		logrus.WithError(err).WithField("gid", gid).Error("unable to abort transaction")
+		InternalServerError(ctx)
+		return
+	}
+
+	Ok(ctx)
+}
+
+// Returns the global identifier of the prepared transaction of the service for
+// the transaction ID in the path, responds with 400 when there is none
+func (p *TwoPhaseParticipant) transactionID(ctx *fasthttp.RequestCtx) (string, bool) {
+	if p.db == nil {
+		logrus.WithField("service", p.service).Error("two-phase commit requires the postgres backend")
+		BadRequest(ctx)
+		return "", false
+	}
+
+	txID, err := uuid.FromString(ctx.UserValue("tx_id").(string))
+	if err != nil {
+		BadRequest(ctx)
+		return "", false
+	}
+
+	return TransactionGID(p.service, txID.String()), true
+}
+
+// TransactionGID returns the global identifier of the prepared transaction of the
+// service in the two-phase commit transaction
+func TransactionGID(service string, txID string) string {
+	return fmt.Sprintf("%s-%s", service, txID)
+}
+
+// ParseTransactionGID returns the service and two-phase commit transaction of the
+// global identifier, or false when it is not one of a participant
+func ParseTransactionGID(gid string) (string, string, bool) {
+	parts := strings.SplitN(gid, "-", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	txID, err := uuid.FromString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+
+	return parts[0], txID.String(), true
+}
+
+// PrepareTransaction runs fn in a transaction that is prepared under the global
+// identifier instead of committed, it keeps its locks until it is committed or
+// rolled back with CommitPrepared or RollbackPrepared. Preparing an identifier
+// that was already prepared succeeds without running fn again.
+func PrepareTransaction(ctx context.Context, db *gorm.DB, gid string, fn func(tx *gorm.DB) error) error {
+	// Prepared transactions are started and prepared with plain statements, the
+	// driver would consider a prepared sql.Tx to still be running
+	prepared := 0
+	err := db.Raw("SELECT COUNT(*) FROM pg_prepared_xacts WHERE gid = ?", gid).Row().Scan(&prepared)
+	if err != nil {
+		return errors.Wrap(err, "unable to get prepared transactions")
+	} else if prepared > 0 {
+		// Running fn again would wait for the locks of the prepared transaction
+		return nil
+	}
+
+	conn, err := db.DB().Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to get connection")
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logrus.WithError(err).Error("unable to release connection")
+		}
+	}()
+
+	tx, err := gorm.Open(db.Dialect().GetName(), &connCommon{ctx: ctx, conn: conn})
+	if err != nil {
+		return errors.Wrap(err, "unable to use connection")
+	}
+
+	err = tx.Exec("BEGIN").Error
+	if err != nil {
+		return errors.Wrap(err, "unable to begin transaction")
+	}
+
+	err = fn(tx)
+	if err != nil {
+		if rbErr := tx.Exec("ROLLBACK").Error; rbErr != nil {
+			logrus.WithError(rbErr).Error("unable to roll back transaction")
+		}
+		return err
+	}
+
+	// A failing prepare rolls the transaction back
+	err = tx.Exec(fmt.Sprintf("PREPARE TRANSACTION %s", quoteLiteral(gid))).Error
+	if isPostgresError(err, pgDuplicateObject) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to prepare transaction")
+	}
+
+	return nil
+}
+
+// CommitPrepared commits the prepared transaction, a transaction that does not
+// exist was already committed
+func CommitPrepared(db *gorm.DB, gid string) error {
+	err := db.Exec(fmt.Sprintf("COMMIT PREPARED %s", quoteLiteral(gid))).Error
+	if err != nil && !isPostgresError(err, pgUndefinedObject) {
+		return errors.Wrap(err, "unable to commit prepared transaction")
+	}
+
+	return nil
+}
+
+// RollbackPrepared rolls the prepared transaction back, a transaction that does
+// not exist was never prepared or already rolled back
+func RollbackPrepared(db *gorm.DB, gid string) error {
+	err := db.Exec(fmt.Sprintf("ROLLBACK PREPARED %s", quoteLiteral(gid))).Error
+	if err != nil && !isPostgresError(err, pgUndefinedObject) {
+		return errors.Wrap(err, "unable to roll back prepared transaction")
+	}
+
+	return nil
+}
+
+func isPostgresError(err error, code string) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && string(pqErr.Code) == code
+}
+
+// connCommon lets gorm run statements on a single connection, so they all run in
+// the transaction that was started on it
+type connCommon struct {
+	ctx  context.Context
+	conn *sql.Conn
+}
+
+func (c *connCommon) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.conn.ExecContext(c.ctx, query, args...)
+}
+
+func (c *connCommon) Prepare(query string) (*sql.Stmt, error) {
+	return c.conn.PrepareContext(c.ctx, query)
+}
+
+func (c *connCommon) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.conn.QueryContext(c.ctx, query, args...)
+}
+
+func (c *connCommon) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.conn.QueryRowContext(c.ctx, query, args...)
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+func TestParseTransactionGID(t *testing.T) {
+	txID := uuid.Must(uuid.NewV4()).String()
+
+	service, parsed, ok := ParseTransactionGID(TransactionGID("stock", txID))
+	assert.True(t, ok)
+	assert.Equal(t, "stock", service)
+	assert.Equal(t, txID, parsed)
+
+	_, _, ok = ParseTransactionGID("stock-order")
+	assert.False(t, ok)
+	_, _, ok = ParseTransactionGID("backup")
+	assert.False(t, ok)
+}
+
+func TestExpireAborts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "twophase.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.AutoMigrate(&AbortedTransaction{}).Error)
+	p := &TwoPhaseParticipant{service: "test", db: db}
+
+	gid := TransactionGID("test", uuid.Must(uuid.NewV4()).String())
+	require.NoError(t, db.Create(&AbortedTransaction{GID: gid}).Error)
+
+	// Aborts are only deleted once they are older than the ttl
+	deleted, err := p.expire(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+	assert.Error(t, checkNotAborted(db, gid))
+
+	deleted, err = p.expire(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.NoError(t, checkNotAborted(db, gid))
+}
+
+// Runs against a live database, set REDI_TEST_POSTGRES to a postgres connection
+// string with max_prepared_transactions above 0 to run it
+func TestPostgresPrepareAfterAbort(t *testing.T) {
+	dsn := os.Getenv("REDI_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("REDI_TEST_POSTGRES is not set")
+	}
+
+	db, err := gorm.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	prepared := false
+	p := NewTwoPhaseParticipant("test", &Connection{Backend: POSTGRES, Postgres: db}, func(_ *gorm.DB, _ *OrderPayload) error {
+		prepared = true
+		return nil
+	})
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go func() {
+		_ = fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetUserValue("tx_id", string(ctx.QueryArgs().Peek("tx_id")))
+			switch string(ctx.Path()) {
+			case "/prepare":
+				p.Prepare(ctx)
+			case "/abort":
+				p.Abort(ctx)
+			}
+		})
+	}()
+	client := NewLocalClient(ln)
+	post := func(action string, txID string) int {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(resp)
+
+		req.Header.SetMethod(fasthttp.MethodPost)
+		req.SetRequestURI(fmt.Sprintf("http://localhost/%s?tx_id=%s", action, txID))
+		req.SetBodyString(`{"order_id":"order","user_id":"user","items":{},"cost":0}`)
+		require.NoError(t, client.Do(req, resp))
+		return resp.StatusCode()
+	}
+
+	// The coordinator aborted before the prepare arrived
+	txID := uuid.Must(uuid.NewV4()).String()
+	assert.Equal(t, fasthttp.StatusOK, post("abort", txID))
+	assert.Equal(t, fasthttp.StatusConflict, post("prepare", txID))
+	assert.False(t, prepared)
+
+	count := 0
+	require.NoError(t, db.Raw("SELECT COUNT(*) FROM pg_prepared_xacts WHERE gid = ?", TransactionGID("test", txID)).Row().Scan(&count))
+	assert.Equal(t, 0, count)
+}